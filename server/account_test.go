@@ -0,0 +1,958 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/pquerna/otp/totp"
+	"mz.attahri.com/code/srp/v3"
+)
+
+func TestChangePassword(t *testing.T) {
+	ts := newTestServer(t)
+	c, other := ts.newClient(), ts.newClient()
+
+	if status, _ := c.register("erin@example.com", "old password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	for _, client := range []*testClient{c, other} {
+		if status := client.login("erin@example.com", "old password"); status != http.StatusOK {
+			t.Fatalf("login: got %d", status)
+		}
+	}
+
+	id := utils.NewUUID()
+	created := time.Now().Add(-time.Hour).UnixMilli()
+	if status, _ := c.post("/calendar/events/save", []map[string]any{
+		{"type": "added", "event": types.EncryptedEvent{ID: id, Data: base64.StdEncoding.EncodeToString([]byte("old")), UpdatedAt: created}},
+	}, nil); status != http.StatusOK {
+		t.Fatalf("save: got %d", status)
+	}
+
+	srpSalt := randomBytes(t, 16)
+	triplet, err := srp.ComputeVerifier(utils.SRPParams, "erin@example.com", "new password", srpSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changePassword proves the password and sends the new credentials with the given events
+	changePassword := func(password string, events []types.EncryptedEvent) (int, *srp.Client, []byte) {
+		t.Helper()
+
+		client, sessionID, status := c.startSRP("erin@example.com", password)
+		if status != http.StatusOK {
+			t.Fatalf("login start: got %d", status)
+		}
+		M1, err := client.ComputeM1()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var resp types.LoginVerifyResponse
+		status, _ = c.post("/user/password", types.ChangePasswordRequest{
+			SessionID: sessionID,
+			M1:        M1,
+			Challenge: "new-challenge",
+			Triplet:   triplet,
+			Salt:      randomBytes(t, 16),
+			Events:    events,
+		}, &resp)
+		return status, client, resp.M2
+	}
+
+	reencrypted := []types.EncryptedEvent{{ID: id, Data: base64.StdEncoding.EncodeToString([]byte("new"))}}
+
+	// The current password must be proven
+	if status, _, _ := changePassword("wrong password", reencrypted); status != http.StatusUnauthorized {
+		t.Fatalf("change with wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Every stored event must be re-encrypted
+	if status, _, _ := changePassword("old password", nil); status != http.StatusConflict {
+		t.Fatalf("change without events: got %d, want %d", status, http.StatusConflict)
+	}
+
+	// A handshake with the old password started before the change
+	staleID, staleM1 := proveSRP(t, other, "erin@example.com", "old password")
+
+	status, client, M2 := changePassword("old password", reencrypted)
+	if status != http.StatusOK {
+		t.Fatalf("change password: got %d", status)
+	}
+	if ok, err := client.CheckM2(M2); err != nil || !ok {
+		t.Fatalf("server proof M2 did not verify: %v", err)
+	}
+
+	// It can't be finished afterwards
+	if status, _ := other.post("/auth/login/verify", map[string]any{
+		"email":      "erin@example.com",
+		"M1":         staleM1,
+		"session_id": staleID,
+	}, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with a handshake from before the change: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The other session is revoked
+	if status, _ := other.get("/user", nil); status != http.StatusUnauthorized {
+		t.Errorf("user info on the other client: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The current session survives, and devices download the re-encrypted event again
+	var sync types.EventSyncResponse
+	if status, _ := c.post("/calendar/events/sync", []types.CachedEvent{
+		{ID: uuidToBase64(t, id), Timestamp: created},
+	}, &sync); status != http.StatusOK {
+		t.Fatalf("sync: got %d", status)
+	}
+	if len(sync.Updated) != 1 {
+		t.Fatalf("updated: got %+v", sync.Updated)
+	} else if data, _ := base64.StdEncoding.DecodeString(sync.Updated[0].Data); string(data) != "new" {
+		t.Errorf("updated data: got %q", data)
+	}
+
+	// Only the new password works from now on
+	if status := other.login("erin@example.com", "old password"); status != http.StatusUnauthorized {
+		t.Errorf("login with old password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := other.login("erin@example.com", "new password"); status != http.StatusOK {
+		t.Errorf("login with new password: got %d", status)
+	}
+}
+
+// proveSRP runs the first SRP step and returns the handshake ID with the client proof.
+func proveSRP(t *testing.T, c *testClient, email, password string) (string, []byte) {
+	t.Helper()
+
+	client, sessionID, status := c.startSRP(email, password)
+	if status != http.StatusOK {
+		t.Fatalf("login start: got %d", status)
+	}
+	M1, err := client.ComputeM1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionID, M1
+}
+
+func TestRecoveryKey(t *testing.T) {
+	ts := newTestServer(t)
+	c, other, lost := ts.newClient(), ts.newClient(), ts.newClient()
+
+	if status, _ := c.register("rita@example.com", "old password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	for _, client := range []*testClient{c, other} {
+		if status := client.login("rita@example.com", "old password"); status != http.StatusOK {
+			t.Fatalf("login: got %d", status)
+		}
+	}
+
+	id := utils.NewUUID()
+	if status, _ := c.post("/calendar/events/save", []map[string]any{
+		{"type": "added", "event": types.EncryptedEvent{ID: id, Data: base64.StdEncoding.EncodeToString([]byte("old")), UpdatedAt: time.Now().UnixMilli()}},
+	}, nil); status != http.StatusOK {
+		t.Fatalf("save: got %d", status)
+	}
+
+	// Without a recovery key there is nothing to recover with
+	if _, _, status := lost.startSRPAt("/auth/recovery/start", "rita@example.com", "recovery code"); status != http.StatusUnauthorized {
+		t.Fatalf("recovery start without key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Set up the recovery key, proving the password
+	recoveryTriplet, err := srp.ComputeVerifier(utils.SRPParams, "rita@example.com", "recovery code", randomBytes(t, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := randomBytes(t, 48)
+
+	sessionID, M1 := proveSRP(t, c, "rita@example.com", "old password")
+	if status, _ := c.post("/user/recovery", types.RecoveryKeySetupRequest{
+		SessionID:  sessionID,
+		M1:         M1,
+		Triplet:    recoveryTriplet,
+		WrappedKey: wrapped,
+	}, nil); status != http.StatusOK {
+		t.Fatalf("set recovery key: got %d", status)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	var info types.PublicUser
+	if status, _ := c.get("/user", &info); status != http.StatusOK || !info.RecoveryKeyEnabled {
+		t.Fatalf("user info: got %d, recovery key enabled %v", status, info.RecoveryKeyEnabled)
+	}
+
+	// A password handshake can't prove the recovery code
+	sessionID, M1 = proveSRP(t, lost, "rita@example.com", "old password")
+	if status, _ := lost.post("/auth/recovery/verify", types.RecoveryVerifyRequest{
+		Email:     "rita@example.com",
+		M1:        M1,
+		SessionID: sessionID,
+	}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("verify with password handshake: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// verifyRecovery proves a recovery code
+	verifyRecovery := func(code string) (int, *srp.Client, types.RecoveryVerifyResponse) {
+		t.Helper()
+
+		client, sessionID, status := lost.startSRPAt("/auth/recovery/start", "rita@example.com", code)
+		if status != http.StatusOK {
+			t.Fatalf("recovery start: got %d", status)
+		}
+		M1, err := client.ComputeM1()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var resp types.RecoveryVerifyResponse
+		status, _ = lost.post("/auth/recovery/verify", types.RecoveryVerifyRequest{
+			Email:     "rita@example.com",
+			M1:        M1,
+			SessionID: sessionID,
+		}, &resp)
+		return status, client, resp
+	}
+
+	if status, _, _ := verifyRecovery("wrong code"); status != http.StatusUnauthorized {
+		t.Fatalf("verify with wrong code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, client, recovery := verifyRecovery("recovery code")
+	if status != http.StatusOK {
+		t.Fatalf("verify recovery: got %d", status)
+	}
+	if ok, err := client.CheckM2(recovery.M2); err != nil || !ok {
+		t.Fatalf("server proof M2 did not verify: %v", err)
+	}
+	if !slices.Equal(recovery.WrappedKey, wrapped) {
+		t.Errorf("wrapped key: got %x, want %x", recovery.WrappedKey, wrapped)
+	}
+	if len(recovery.Events) != 1 || recovery.Events[0].ID != id {
+		t.Fatalf("events: got %+v", recovery.Events)
+	}
+
+	// Set the new password with the events re-encrypted under it
+	triplet, err := srp.ComputeVerifier(utils.SRPParams, "rita@example.com", "new password", randomBytes(t, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := types.RecoveryFinishRequest{
+		Token:     recovery.Token,
+		Challenge: "new-challenge",
+		Triplet:   triplet,
+		Salt:      randomBytes(t, 16),
+		Events:    []types.EncryptedEvent{{ID: id, Data: base64.StdEncoding.EncodeToString([]byte("new"))}},
+	}
+	staleID, staleM1 := proveSRP(t, other, "rita@example.com", "old password") // started before the reset
+	if status, _ := lost.post("/auth/recovery/finish", finish, nil); status != http.StatusOK {
+		t.Fatalf("finish recovery: got %d", status)
+	}
+
+	// A handshake with the old password can't be finished afterwards
+	if status, _ := other.post("/auth/login/verify", map[string]any{
+		"email":      "rita@example.com",
+		"M1":         staleM1,
+		"session_id": staleID,
+	}, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with a handshake from before the reset: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The token is used up
+	if status, _ := lost.post("/auth/recovery/finish", finish, nil); status != http.StatusUnauthorized {
+		t.Errorf("finish again: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Every session is revoked and the owner is told
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	for _, client := range []*testClient{c, other} {
+		if status, _ := client.get("/user", nil); status != http.StatusUnauthorized {
+			t.Errorf("user info after recovery: got %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+	if mails := withoutLoginAlerts(ts.mails()); len(mails) != 1 || !strings.Contains(mails[0], "reset with your recovery key") {
+		t.Errorf("mails: got %q", mails)
+	}
+
+	// Only the new password works, and the recovery key is gone since it wraps the old master key
+	if status := lost.login("rita@example.com", "old password"); status != http.StatusUnauthorized {
+		t.Errorf("login with old password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := lost.login("rita@example.com", "new password"); status != http.StatusOK {
+		t.Fatalf("login with new password: got %d", status)
+	}
+
+	var sync types.EventSyncResponse
+	if status, _ := lost.post("/calendar/events/sync", []types.CachedEvent{}, &sync); status != http.StatusOK {
+		t.Fatalf("sync: got %d", status)
+	}
+	if len(sync.Added) != 1 {
+		t.Fatalf("added: got %+v", sync.Added)
+	} else if data, _ := base64.StdEncoding.DecodeString(sync.Added[0].Data); string(data) != "new" {
+		t.Errorf("added data: got %q", data)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	if status, _ := lost.get("/user", &info); status != http.StatusOK || info.RecoveryKeyEnabled {
+		t.Errorf("user info after recovery: got %d, recovery key enabled %v", status, info.RecoveryKeyEnabled)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	ts := newTestServer(t)
+	c, other := ts.newClient(), ts.newClient()
+
+	for _, email := range []string{"uma@example.com", "taken@example.com"} {
+		if status, _ := c.register(email, "password"); status != http.StatusOK {
+			t.Fatalf("register %s: got %d", email, status)
+		}
+	}
+	if status := c.login("uma@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	recoveryTriplet, err := srp.ComputeVerifier(utils.SRPParams, "uma@example.com", "recovery code", randomBytes(t, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, M1 := proveSRP(t, c, "uma@example.com", "password")
+	if status, _ := c.post("/user/recovery", types.RecoveryKeySetupRequest{
+		SessionID:  sessionID,
+		M1:         M1,
+		Triplet:    recoveryTriplet,
+		WrappedKey: randomBytes(t, 48),
+	}, nil); status != http.StatusOK {
+		t.Fatalf("set recovery key: got %d", status)
+	}
+
+	// changeEmail proves the password and sends a triplet of it for the new address
+	changeEmail := func(email string) int {
+		t.Helper()
+
+		triplet, err := srp.ComputeVerifier(utils.SRPParams, email, "password", randomBytes(t, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionID, M1 := proveSRP(t, c, "uma@example.com", "password")
+		status, _ := c.post("/user/email", types.ChangeEmailRequest{
+			SessionID: sessionID,
+			M1:        M1,
+			Triplet:   triplet,
+		}, nil)
+		return status
+	}
+
+	if status := changeEmail("uma@example.com"); status != http.StatusBadRequest {
+		t.Errorf("change to the same address: got %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := changeEmail("taken@example.com"); status != http.StatusConflict {
+		t.Errorf("change to a taken address: got %d, want %d", status, http.StatusConflict)
+	}
+	if status := changeEmail("uma.new@example.com"); status != http.StatusOK {
+		t.Fatalf("change: got %d", status)
+	}
+
+	// Nothing changes until the link sent to the new address is opened
+	if status := other.login("uma@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login with old address before confirming: got %d", status)
+	}
+	mails := withoutLoginAlerts(ts.mails())
+	if len(mails) != 1 {
+		t.Fatalf("got %d emails after the change, want 1", len(mails))
+	}
+	match := regexp.MustCompile(`https://\S+/auth/email/change\?token=\S+`).FindString(mails[0])
+	u, err := url.Parse(match)
+	if err != nil || match == "" {
+		t.Fatalf("no confirmation link in email:\n%s", mails[0])
+	}
+	link := u.RequestURI()
+
+	if status, _ := other.get(link+"x", nil); status != http.StatusBadRequest {
+		t.Errorf("altered link: got %d, want %d", status, http.StatusBadRequest)
+	}
+	for range 2 { // opening it again is fine
+		if status, reply := other.get(link, nil); status != http.StatusOK {
+			t.Fatalf("confirm: got %d %q", status, reply.Message)
+		}
+	}
+
+	// The old address is told
+	if mails = withoutLoginAlerts(ts.mails()); len(mails) != 2 || !strings.Contains(mails[1], "changed to uma.new@example.com") {
+		t.Errorf("mails: got %q", mails)
+	}
+
+	// Only the new address logs in, and the recovery key is gone since it was bound to the old one
+	if status := other.login("uma@example.com", "password"); status != http.StatusUnauthorized {
+		t.Errorf("login with old address: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := other.login("uma.new@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login with new address: got %d", status)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	var info types.PublicUser
+	if status, _ := c.get("/user", &info); status != http.StatusOK || info.Email != "uma.new@example.com" || info.RecoveryKeyEnabled {
+		t.Errorf("user info after the change: got %d %+v", status, info)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ts := newTestServer(t)
+	c, other := ts.newClient(), ts.newClient()
+
+	if status, _ := c.register("frank@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	for _, client := range []*testClient{c, other} {
+		if status := client.login("frank@example.com", "password"); status != http.StatusOK {
+			t.Fatalf("login: got %d", status)
+		}
+	}
+
+	// The password must be proven
+	sessionID, M1 := proveSRP(t, c, "frank@example.com", "wrong")
+	if status, _ := c.post("/user/delete", types.DeleteAccountRequest{SessionID: sessionID, M1: M1}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("delete with wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	var resp types.DeleteAccountResponse
+	sessionID, M1 = proveSRP(t, c, "frank@example.com", "password")
+	if status, _ := c.post("/user/delete", types.DeleteAccountRequest{SessionID: sessionID, M1: M1}, &resp); status != http.StatusOK {
+		t.Fatalf("delete: got %d", status)
+	}
+	if resp.ScheduledAt != 0 {
+		t.Errorf("scheduled at: got %d, want an immediate deletion", resp.ScheduledAt)
+	}
+
+	// Every session ends with the account
+	for _, client := range []*testClient{c, other} {
+		if status, _ := client.get("/user", nil); status != http.StatusUnauthorized {
+			t.Errorf("user info after deletion: got %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+
+	if status := c.login("frank@example.com", "password"); status != http.StatusUnauthorized {
+		t.Errorf("login after deletion: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The email can be used again
+	if status, _ := c.register("frank@example.com", "password"); status != http.StatusOK {
+		t.Errorf("register after deletion: got %d", status)
+	}
+}
+
+func TestDeleteAccountCoolingOff(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"ACCOUNT_DELETION_DELAY": "72h"})
+	c := ts.newClient()
+
+	if status, _ := c.register("grace@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	if status := c.login("grace@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	var resp types.DeleteAccountResponse
+	sessionID, M1 := proveSRP(t, c, "grace@example.com", "password")
+	if status, _ := c.post("/user/delete", types.DeleteAccountRequest{SessionID: sessionID, M1: M1}, &resp); status != http.StatusOK {
+		t.Fatalf("delete: got %d", status)
+	}
+
+	want := time.Now().Add(72 * time.Hour)
+	if at := time.UnixMilli(resp.ScheduledAt); at.Before(want.Add(-time.Minute)) || at.After(want) {
+		t.Fatalf("scheduled at: got %v, want about %v", at, want)
+	}
+
+	// The account stays usable and reports the pending deletion
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	var user types.PublicUser
+	if status, _ := c.get("/user", &user); status != http.StatusOK {
+		t.Fatalf("user info: got %d", status)
+	}
+	if user.DeletionScheduledAt == nil || *user.DeletionScheduledAt != resp.ScheduledAt {
+		t.Errorf("deletion scheduled at: got %v, want %d", user.DeletionScheduledAt, resp.ScheduledAt)
+	}
+
+	if status, _ := c.post("/user/delete/cancel", nil, nil); status != http.StatusOK {
+		t.Fatalf("cancel deletion: got %d", status)
+	}
+
+	user = types.PublicUser{}
+	if status, _ := c.get("/user", &user); status != http.StatusOK {
+		t.Fatalf("user info: got %d", status)
+	}
+	if user.DeletionScheduledAt != nil {
+		t.Errorf("deletion scheduled at after cancelling: got %d", *user.DeletionScheduledAt)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ts := newTestServer(t)
+	laptop, phone, tablet := ts.newClient(), ts.newClient(), ts.newClient()
+	laptop.deviceName, phone.deviceName = "Laptop", "Phone"
+	laptop.header.Set("User-Agent", "laptop-browser/1.0")
+
+	if status, _ := laptop.register("heidi@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	for _, c := range []*testClient{laptop, phone, tablet} {
+		if status := c.login("heidi@example.com", "password"); status != http.StatusOK {
+			t.Fatalf("login: got %d", status)
+		}
+	}
+
+	// The phone registers for push notifications, tied to its session
+	if status, reply := phone.post("/user/push/subscribe", types.PushSubscribeRequest{
+		Endpoint: "https://push.example/phone",
+		Auth:     base64.RawURLEncoding.EncodeToString(randomBytes(t, 16)),
+		P256DH:   base64.RawURLEncoding.EncodeToString(randomBytes(t, 65)),
+	}, nil); status != http.StatusOK {
+		t.Fatalf("push subscribe: got %d %q", status, reply.Message)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	var sessions []types.SessionInfo
+	if status, _ := laptop.get("/user/sessions", &sessions); status != http.StatusOK {
+		t.Fatalf("list sessions: got %d", status)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("sessions: got %d, want 3", len(sessions))
+	}
+
+	byName := make(map[string]types.SessionInfo)
+	for _, s := range sessions {
+		byName[s.DeviceName] = s
+	}
+	if s := byName["Laptop"]; !s.Current || s.UserAgent != "laptop-browser/1.0" || s.IP != laptop.header.Get("X-Real-IP") {
+		t.Errorf("laptop session: got %+v", s)
+	}
+	if s := byName["Phone"]; s.Current || s.IP != phone.header.Get("X-Real-IP") || s.LastSeenAt < s.CreatedAt {
+		t.Errorf("phone session: got %+v", s)
+	}
+
+	// Revoke the phone, which loses its push subscription too
+	phoneID := strconv.Itoa(byName["Phone"].ID)
+	if status, _ := laptop.post("/user/sessions/"+phoneID+"/revoke", nil, nil); status != http.StatusOK {
+		t.Fatalf("revoke phone: got %d", status)
+	}
+	if status, _ := phone.get("/user", nil); status != http.StatusUnauthorized {
+		t.Errorf("user info on the revoked phone: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	user, err := database.DB.GetUserByEmail(context.Background(), "heidi@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs, err := database.DB.GetPushSubscriptions(context.Background(), user.UUID); err != nil || len(subs) != 0 {
+		t.Errorf("push subscriptions after revoking: got %v, %v", subs, err)
+	}
+
+	if status, _ := laptop.post("/user/sessions/"+phoneID+"/revoke", nil, nil); status != http.StatusNotFound {
+		t.Errorf("revoke twice: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	// Revoke everything but the laptop
+	if status, _ := laptop.post("/user/sessions/revoke-others", nil, nil); status != http.StatusOK {
+		t.Fatalf("revoke others: got %d", status)
+	}
+	if status, _ := tablet.get("/user", nil); status != http.StatusUnauthorized {
+		t.Errorf("user info on the tablet: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	time.Sleep(time.Second)
+
+	sessions = nil
+	if status, _ := laptop.get("/user/sessions", &sessions); status != http.StatusOK {
+		t.Fatalf("list sessions: got %d", status)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("sessions after revoking others: got %+v", sessions)
+	}
+}
+
+func TestNewDeviceLoginAlert(t *testing.T) {
+	ts := newTestServer(t)
+	laptop, phone, stranger := ts.newClient(), ts.newClient(), ts.newClient()
+	laptop.header.Set("X-Real-IP", "10.1.2.3")
+
+	if status, _ := laptop.register("ivan@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	// The first device of an account and the known ones aren't reported
+	for range 2 {
+		if status := laptop.login("ivan@example.com", "password"); status != http.StatusOK {
+			t.Fatalf("login: got %d", status)
+		}
+	}
+
+	// Neither is another address of the same network
+	sameNetwork := ts.newClient()
+	sameNetwork.header.Set("X-Real-IP", "10.1.2.200")
+	if status := sameNetwork.login("ivan@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login from the same network: got %d", status)
+	}
+	if mails := ts.mails(); len(mails) != 0 {
+		t.Fatalf("mails after logins from known devices: got %q", mails)
+	}
+
+	if status := phone.login("ivan@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login from the phone: got %d", status)
+	}
+	mails := ts.mails()
+	if len(mails) != 1 || !strings.Contains(mails[0], "IP address: "+phone.header.Get("X-Real-IP")) {
+		t.Fatalf("mails after a login from a new device: got %q", mails)
+	}
+	match := regexp.MustCompile(`https://\S+/auth/sessions/revoke\?token=\S+`).FindString(mails[0])
+	u, err := url.Parse(match)
+	if err != nil || match == "" {
+		t.Fatalf("no revocation link in email:\n%s", mails[0])
+	}
+	link := u.RequestURI()
+
+	if status, _ := stranger.page(http.MethodGet, link+"x", nil); status != http.StatusBadRequest {
+		t.Errorf("tampered link: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Opening the link, as mail scanners do, only asks to confirm
+	status, page := stranger.page(http.MethodGet, link, nil)
+	if status != http.StatusOK || !strings.Contains(page, `<form method="post">`) {
+		t.Fatalf("open revocation link: got %d %q", status, page)
+	}
+	if status, _ := phone.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info on the phone after opening the link: got %d", status)
+	}
+
+	if status, _ := stranger.page(http.MethodPost, "/auth/sessions/revoke", url.Values{"token": {u.Query().Get("token") + "x"}}); status != http.StatusBadRequest {
+		t.Errorf("tampered token: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Anyone with the link logs the phone out by confirming, only once but confirming again is fine
+	for range 2 {
+		if status, page := stranger.page(http.MethodPost, "/auth/sessions/revoke", url.Values{"token": {u.Query().Get("token")}}); status != http.StatusOK {
+			t.Fatalf("confirm revocation: got %d %q", status, page)
+		}
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	if status, _ := phone.get("/user", nil); status != http.StatusUnauthorized {
+		t.Errorf("user info on the revoked phone: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := laptop.get("/user", nil); status != http.StatusOK {
+		t.Errorf("user info on the laptop: got %d", status)
+	}
+}
+
+func TestNewDeviceLoginAlertAfterRegistration(t *testing.T) {
+	ts := newTestServer(t)
+	desktop, phone := ts.newClient(), ts.newClient()
+
+	if status, _ := desktop.register("judy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	// The device the account registered from is known, even if it didn't log in first
+	if status := phone.login("judy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login from the phone: got %d", status)
+	}
+	if status := desktop.login("judy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login from the desktop: got %d", status)
+	}
+
+	mails := ts.mails()
+	if len(mails) != 1 || !strings.Contains(mails[0], "IP address: "+phone.header.Get("X-Real-IP")) {
+		t.Fatalf("mails: got %q, want an alert about the phone", mails)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("ivan@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	if status := c.login("ivan@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	// Enroll and confirm with a code from the secret
+	var enroll types.TOTPEnrollResponse
+	if status, _ := c.post("/user/2fa/totp/enroll", nil, &enroll); status != http.StatusOK || enroll.Secret == "" {
+		t.Fatalf("enroll: got %d %+v", status, enroll)
+	}
+
+	if status, _ := c.post("/user/2fa/totp/confirm", types.TOTPConfirmRequest{Code: "000000"}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("confirm with a wrong code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	now := time.Now()
+	var confirm types.TOTPConfirmResponse
+	if status, reply := c.post("/user/2fa/totp/confirm", types.TOTPConfirmRequest{Code: totpCode(t, enroll.Secret, now)}, &confirm); status != http.StatusOK {
+		t.Fatalf("confirm: got %d %q", status, reply.Message)
+	}
+	if len(confirm.BackupCodes) != 10 {
+		t.Fatalf("backup codes: got %d, want 10", len(confirm.BackupCodes))
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	var user types.PublicUser
+	if status, _ := c.get("/user", &user); status != http.StatusOK || !user.TwoFactorEnabled {
+		t.Fatalf("user info: got %d %+v", status, user)
+	}
+
+	// The password alone only gives a pending login
+	phone := ts.newClient()
+	verify, status := phone.loginVerify("ivan@example.com", "password")
+	if status != http.StatusOK || verify.SecondFactor == nil {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+	if status, _ := phone.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info before the second factor: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// The code used to confirm can't be replayed, the next one works
+	secondFactor := func(c *testClient, method, code string) (int, string) {
+		status, reply := c.post("/auth/login/2fa", types.LoginSecondFactorRequest{
+			Token:  verify.SecondFactor.Token,
+			Method: method,
+			Code:   code,
+		}, nil)
+		return status, reply.Message
+	}
+	if status, _ := secondFactor(phone, "totp", totpCode(t, enroll.Secret, now)); status != http.StatusUnauthorized {
+		t.Fatalf("replayed code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, msg := secondFactor(phone, "totp", totpCode(t, enroll.Secret, now.Add(30*time.Second))); status != http.StatusOK {
+		t.Fatalf("second factor: got %d %q", status, msg)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	if status, _ := phone.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info after the second factor: got %d", status)
+	}
+
+	// Backup codes work once
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		tablet := ts.newClient()
+		verify, _ = tablet.loginVerify("ivan@example.com", "password")
+		if status, _ := secondFactor(tablet, "backup_code", confirm.BackupCodes[0]); status != want {
+			t.Fatalf("backup code, use %d: got %d, want %d", i+1, status, want)
+		}
+	}
+
+	// Clients without cookies get the access token once the second factor is given
+	native := ts.newBearerClient()
+	verify, _ = native.loginVerify("ivan@example.com", "password")
+	if verify.Session != nil {
+		t.Fatalf("token before the second factor: got %+v", verify.Session)
+	}
+	var token types.SessionToken
+	if status, _ := native.post("/auth/login/2fa", types.LoginSecondFactorRequest{
+		Token:  verify.SecondFactor.Token,
+		Method: "backup_code",
+		Code:   confirm.BackupCodes[2],
+	}, &token); status != http.StatusOK || token.AccessToken == "" {
+		t.Fatalf("second factor with a token: got %d %+v", status, token)
+	}
+
+	// Wrong codes count against the account like wrong passwords, even the right code has to wait then.
+	// Logging in again with the password doesn't start the count over.
+	guesser := ts.newClient()
+	for i := range constants.LoginFailuresBeforeBackoff {
+		if i < 2 {
+			verify, _ = guesser.loginVerify("ivan@example.com", "password")
+		}
+		if status, _ := secondFactor(guesser, "totp", "000000"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: got %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+	if status, msg := secondFactor(guesser, "backup_code", confirm.BackupCodes[1]); status != http.StatusTooManyRequests {
+		t.Fatalf("after too many wrong codes: got %d %q, want %d", status, msg, http.StatusTooManyRequests)
+	}
+
+	// Disabling needs a code too
+	if status, _ := c.post("/user/2fa/totp/disable", types.TOTPDisableRequest{Method: "backup_code", Code: "nope"}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("disable with a wrong code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := c.post("/user/2fa/totp/disable", types.TOTPDisableRequest{Method: "backup_code", Code: confirm.BackupCodes[1]}, nil); status != http.StatusOK {
+		t.Fatalf("disable: got %d", status)
+	}
+
+	time.Sleep(constants.LoginBackoffBase) // the wrong codes above delay the account's next login
+
+	laptop := ts.newClient()
+	if verify, status := laptop.loginVerify("ivan@example.com", "password"); status != http.StatusOK || verify.SecondFactor != nil {
+		t.Fatalf("login after disabling: got %d %+v", status, verify)
+	}
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestWebAuthn(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("judy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	if status := c.login("judy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	cfg := ts.api.Config().WebAuthn
+	key := newSoftAuthenticator(t, cfg.RPID, cfg.Origins[0])
+
+	// Registering a security key needs the password, finishing needs a registration started with it
+	sessionID, _ := proveSRP(t, c, "judy@example.com", "password")
+	if status, _ := c.post("/user/2fa/webauthn/register/start", types.WebAuthnRegisterStartRequest{SessionID: sessionID, M1: []byte("wrong")}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("register start with a wrong proof: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := c.post("/user/2fa/webauthn/register/finish", map[string]any{
+		"name":       "YubiKey",
+		"credential": map[string]any{"id": "forged"},
+	}, nil); status != http.StatusBadRequest {
+		t.Fatalf("register finish without a start: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	sessionID, M1 := proveSRP(t, c, "judy@example.com", "password")
+	var creation json.RawMessage
+	if status, _ := c.post("/user/2fa/webauthn/register/start", types.WebAuthnRegisterStartRequest{SessionID: sessionID, M1: M1}, &creation); status != http.StatusOK {
+		t.Fatalf("register start: got %d", status)
+	}
+
+	var info types.WebAuthnCredentialInfo
+	if status, reply := c.post("/user/2fa/webauthn/register/finish", map[string]any{
+		"name":       "YubiKey",
+		"credential": key.create(creation),
+	}, &info); status != http.StatusOK {
+		t.Fatalf("register finish: got %d %q", status, reply.Message)
+	}
+	if info.Name != "YubiKey" || info.ID == 0 {
+		t.Fatalf("registered key: got %+v", info)
+	}
+
+	// Logging in now needs the key
+	login := func(c *testClient) types.LoginVerifyResponse {
+		t.Helper()
+
+		verify, status := c.loginVerify("judy@example.com", "password")
+		if status != http.StatusOK || verify.SecondFactor == nil {
+			t.Fatalf("login: got %d %+v", status, verify)
+		}
+		return verify
+	}
+	assert := func(c *testClient, verify types.LoginVerifyResponse, key *softAuthenticator) (int, string) {
+		t.Helper()
+
+		options, err := json.Marshal(verify.SecondFactor.WebAuthn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, reply := c.post("/auth/login/2fa", map[string]any{
+			"token":      verify.SecondFactor.Token,
+			"method":     "webauthn",
+			"credential": key.get(options),
+		}, nil)
+		return status, reply.Message
+	}
+
+	phone := ts.newClient()
+	verify := login(phone)
+	if !slices.Equal(verify.SecondFactor.Methods, []string{"webauthn"}) {
+		t.Fatalf("methods: got %v", verify.SecondFactor.Methods)
+	}
+
+	// A different key is rejected, the registered one works
+	if status, _ := assert(phone, verify, newSoftAuthenticator(t, cfg.RPID, cfg.Origins[0])); status != http.StatusUnauthorized {
+		t.Fatalf("unknown key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, msg := assert(phone, verify, key); status != http.StatusOK {
+		t.Fatalf("assertion: got %d %q", status, msg)
+	}
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	if status, _ := phone.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info after the assertion: got %d", status)
+	}
+
+	// A clone of the key reuses the old counter
+	clone := *key
+	clone.counter = 0
+
+	tablet := ts.newClient()
+	if status, _ := assert(tablet, login(tablet), &clone); status != http.StatusUnauthorized {
+		t.Fatalf("cloned key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// A TOTP secret that was enrolled but never confirmed doesn't stand in for the key
+	var enroll types.TOTPEnrollResponse
+	if status, _ := c.post("/user/2fa/totp/enroll", nil, &enroll); status != http.StatusOK {
+		t.Fatalf("enroll: got %d", status)
+	}
+
+	desktop := ts.newClient()
+	verify = login(desktop)
+	if status, _ := desktop.post("/auth/login/2fa", types.LoginSecondFactorRequest{
+		Token:  verify.SecondFactor.Token,
+		Method: "totp",
+		Code:   totpCode(t, enroll.Secret, time.Now()),
+	}, nil); status != http.StatusBadRequest {
+		t.Fatalf("unconfirmed TOTP secret: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var keys []types.WebAuthnCredentialInfo
+	if status, _ := c.get("/user/2fa/webauthn", &keys); status != http.StatusOK {
+		t.Fatalf("list keys: got %d", status)
+	}
+	if len(keys) != 1 || keys[0].Name != "YubiKey" || keys[0].LastUsedAt == 0 {
+		t.Fatalf("keys: got %+v", keys)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	// Removing the key needs the password, and turns the second factor off
+	path := "/user/2fa/webauthn/" + strconv.Itoa(info.ID) + "/remove"
+	sessionID, _ = proveSRP(t, c, "judy@example.com", "password")
+	if status, _ := c.post(path, types.WebAuthnRemoveRequest{SessionID: sessionID, M1: []byte("wrong")}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("remove with a wrong proof: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	sessionID, M1 = proveSRP(t, c, "judy@example.com", "password")
+	if status, _ := c.post(path, types.WebAuthnRemoveRequest{SessionID: sessionID, M1: M1}, nil); status != http.StatusOK {
+		t.Fatalf("remove: got %d", status)
+	}
+	sessionID, M1 = proveSRP(t, c, "judy@example.com", "password")
+	if status, _ := c.post(path, types.WebAuthnRemoveRequest{SessionID: sessionID, M1: M1}, nil); status != http.StatusNotFound {
+		t.Fatalf("remove again: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	laptop := ts.newClient()
+	if verify, status := laptop.loginVerify("judy@example.com", "password"); status != http.StatusOK || verify.SecondFactor != nil {
+		t.Fatalf("login after removing the key: got %d %+v", status, verify)
+	}
+}
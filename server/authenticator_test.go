@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+// softAuthenticator is a security key implemented in software, answering WebAuthn ceremonies
+// the way a browser and a hardware key would. It uses "none" attestation and a P-256 key.
+type softAuthenticator struct {
+	t      *testing.T
+	rpID   string
+	origin string
+
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+// ceremonyOptions is the part of the options sent by the server that the authenticator needs.
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+	} `json:"publicKey"`
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{t: t, rpID: rpID, origin: origin, key: key, id: randomBytes(t, 32)}
+}
+
+// create answers navigator.credentials.create with the given options.
+func (a *softAuthenticator) create(options json.RawMessage) map[string]any {
+	a.t.Helper()
+
+	clientData := a.clientData("webauthn.create", options)
+
+	// COSE EC2 key with the ES256 algorithm
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	point := pub.Bytes() // uncompressed: 0x04 || x || y
+	coseKey, err := webauthncbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	// Attested credential data: AAGUID, credential ID length and ID, public key
+	attested := make([]byte, 16, 16+2+len(a.id)+len(coseKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": append(a.authData(0x01|0x40), attested...), // user present, attested data included
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    b64url(a.id),
+		"rawId": b64url(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url(clientData),
+			"attestationObject": b64url(attestation),
+		},
+	}
+}
+
+// get answers navigator.credentials.get with the given options, incrementing the signature counter.
+func (a *softAuthenticator) get(options json.RawMessage) map[string]any {
+	a.t.Helper()
+
+	a.counter++
+	clientData := a.clientData("webauthn.get", options)
+	authData := a.authData(0x01) // user present
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    b64url(a.id),
+		"rawId": b64url(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url(clientData),
+			"authenticatorData": b64url(authData),
+			"signature":         b64url(signature),
+		},
+	}
+}
+
+func (a *softAuthenticator) clientData(typ string, options json.RawMessage) []byte {
+	a.t.Helper()
+
+	var opts ceremonyOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatal(err)
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": opts.PublicKey.Challenge,
+		"origin":    a.origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return b
+}
+
+// authData returns the RP ID hash, flags and signature counter.
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
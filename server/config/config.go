@@ -0,0 +1,636 @@
+// Package config loads and validates the server configuration.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"acLife/types"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds all settings of the server. It is loaded once at startup.
+type Config struct {
+	Env                string
+	Port               int
+	ServerURL          *url.URL
+	ClientURL          string
+	BehindProxy        bool
+	CORSAllowedOrigins []string
+	SessionKey         string
+	StorageDir         string
+	DiagnosticsToken   string // empty disables the diagnostics endpoint
+	MetricsToken       string // empty leaves the metrics endpoint open
+	AdminToken         string // empty disables the admin endpoints
+	LogLevel           slog.Level
+	StateStore         string // "memory" or "database", see package state
+
+	Registration Registration
+	Account      Account
+	Sessions     Sessions
+	Database     Database
+	Stripe       Stripe
+	Push         Push
+	WebAuthn     WebAuthn
+	Mail         Mail
+}
+
+type Registration struct {
+	Disabled                bool
+	EmailValidationDisabled bool
+	InviteOnly              bool     // registering needs an invite code
+	InviteQuota             int      // accounts each user's invites may admit, zero leaves inviting to admins
+	BlockedDomains          []string // lowercased, see EmailDomainAllowed
+	AllowedDomains          []string // empty allows every domain that isn't blocked
+}
+
+type Account struct {
+	DeletionDelay time.Duration // cooling-off period before a deletion is carried out, zero deletes immediately
+}
+
+type Sessions struct {
+	IdleTimeout time.Duration // sessions not used for this long are logged out
+	MaxLifetime time.Duration // sessions are logged out this long after the login, however active
+}
+
+type Database struct {
+	Driver   string // "mysql", "postgres" or "sqlite"
+	User     string
+	Password string
+	Host     string
+	Port     int
+	Name     string
+	SSLMode  string // postgres only
+	Path     string // sqlite only
+}
+
+type Stripe struct {
+	APIKey         string
+	ProductID      string
+	WebhookSecret  string
+	DeleteCustomer bool // delete the customer along with the account, not only cancel the subscription
+}
+
+type WebAuthn struct {
+	RPID    string   // domain security keys are registered for
+	Origins []string // origins allowed to use them
+}
+
+type Mail struct {
+	Driver   string // "file" writes emails to Dir for development, "smtp" sends them
+	From     string // sender address, optionally with a name
+	Dir      string // file only
+	Host     string // smtp only
+	Port     int
+	User     string // empty sends without authentication
+	Password string
+}
+
+type Push struct {
+	VAPIDPublicKey   string
+	VAPIDPrivateKey  string
+	AllowedEndpoints []*regexp.Regexp // matched against the endpoint host, empty allows all
+}
+
+// Load reads the configuration from a .env file in the working directory,
+// the file named by CONFIG_FILE and the process environment, in increasing order of priority.
+// Any KEY may instead be given as KEY_FILE, the path of a file containing the value.
+func Load() (*Config, error) {
+	values := make(map[string]string)
+
+	if err := readFile(".env", values); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+
+	environ := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			environ[k] = v
+		}
+	}
+
+	configFile := environ["CONFIG_FILE"]
+	if configFile == "" {
+		configFile = values["CONFIG_FILE"]
+	}
+
+	if configFile != "" {
+		if err := readFile(configFile, values); err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+		}
+	}
+
+	for k, v := range environ {
+		values[k] = v
+	}
+
+	return Parse(values)
+}
+
+// Parse builds a Config from raw key/value pairs and validates it.
+// All problems are reported together.
+func Parse(values map[string]string) (*Config, error) {
+	p := &parser{values: values}
+
+	cfg := &Config{
+		Env:                p.oneOf("ENV", "development", "development", "production"),
+		Port:               p.port("PORT", 0),
+		ServerURL:          p.url("SERVER_URL", true),
+		ClientURL:          p.urlString("CLIENT_URL"),
+		BehindProxy:        p.get("IS_BEHIND_PROXY") != "",
+		CORSAllowedOrigins: p.list("CORS_ALLOWED_ORIGINS"),
+		SessionKey:         p.get("SESSION_KEY"),
+		StorageDir:         p.get("STORAGE_DIR"),
+		DiagnosticsToken:   p.get("DIAGNOSTICS_TOKEN"),
+		MetricsToken:       p.get("METRICS_TOKEN"),
+		AdminToken:         p.get("ADMIN_TOKEN"),
+		LogLevel:           p.level("LOG_LEVEL", slog.LevelInfo),
+		StateStore:         p.oneOf("STATE_STORE", "memory", "memory", "database"),
+
+		Registration: Registration{
+			Disabled:                p.bool("DISABLE_REGISTRATION"),
+			EmailValidationDisabled: p.bool("DISABLE_EMAIL_VALIDATION"),
+			InviteOnly:              p.bool("INVITE_ONLY"),
+			InviteQuota:             p.count("INVITE_QUOTA", 0),
+			BlockedDomains:          p.domains("EMAIL_DOMAIN_BLOCKLIST"),
+			AllowedDomains:          p.domains("EMAIL_DOMAIN_ALLOWLIST"),
+		},
+
+		Account: Account{
+			DeletionDelay: p.duration("ACCOUNT_DELETION_DELAY", 0),
+		},
+
+		Sessions: Sessions{
+			IdleTimeout: p.duration("SESSION_IDLE_TIMEOUT", 7*24*time.Hour),
+			MaxLifetime: p.duration("SESSION_MAX_LIFETIME", 30*24*time.Hour),
+		},
+
+		Database: Database{
+			Driver:   p.oneOf("DB_DRIVER", "mysql", "mysql", "postgres", "sqlite"),
+			User:     p.get("DB_USER"),
+			Password: p.get("DB_PASSWORD"),
+			Host:     p.get("DB_HOST"),
+			Name:     p.get("DB_NAME"),
+			Path:     p.get("DB_PATH"),
+		},
+
+		Stripe: Stripe{
+			APIKey:         p.get("STRIPE_API_KEY"),
+			ProductID:      p.get("STRIPE_PRODUCT_ID"),
+			WebhookSecret:  p.get("STRIPE_WEBHOOK_SECRET"),
+			DeleteCustomer: p.bool("STRIPE_DELETE_CUSTOMER"),
+		},
+
+		Push: Push{
+			VAPIDPublicKey:   p.get("VAPID_PUBLIC_KEY"),
+			VAPIDPrivateKey:  p.get("VAPID_PRIVATE_KEY"),
+			AllowedEndpoints: p.hostPatterns("PUSH_ALLOWED_ENDPOINTS"),
+		},
+
+		WebAuthn: WebAuthn{
+			RPID:    p.get("WEBAUTHN_RP_ID"),
+			Origins: p.list("WEBAUTHN_ORIGINS"),
+		},
+
+		Mail: Mail{
+			Driver:   p.oneOf("MAIL_DRIVER", "file", "file", "smtp"),
+			From:     p.get("MAIL_FROM"),
+			Dir:      p.get("MAIL_DIR"),
+			Host:     p.get("SMTP_HOST"),
+			Port:     p.port("SMTP_PORT", 587),
+			User:     p.get("SMTP_USER"),
+			Password: p.get("SMTP_PASSWORD"),
+		},
+	}
+
+	if cfg.Port == 0 {
+		p.fail("PORT", "is required")
+	}
+
+	// Session
+	if cfg.SessionKey == "" {
+		p.fail("SESSION_KEY", "is required")
+	} else if len(cfg.SessionKey) < 32 {
+		p.fail("SESSION_KEY", "is too short, must be at least 32 characters")
+	}
+
+	if cfg.Sessions.IdleTimeout == 0 {
+		p.fail("SESSION_IDLE_TIMEOUT", "must be positive")
+	}
+	if cfg.Sessions.MaxLifetime == 0 {
+		p.fail("SESSION_MAX_LIFETIME", "must be positive")
+	}
+
+	// Tokens for operational endpoints
+	if cfg.DiagnosticsToken != "" && len(cfg.DiagnosticsToken) < 32 {
+		p.fail("DIAGNOSTICS_TOKEN", "is too short, must be at least 32 characters")
+	}
+	if cfg.MetricsToken != "" && len(cfg.MetricsToken) < 32 {
+		p.fail("METRICS_TOKEN", "is too short, must be at least 32 characters")
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 32 {
+		p.fail("ADMIN_TOKEN", "is too short, must be at least 32 characters")
+	}
+
+	// Database
+	switch cfg.Database.Driver {
+	case "mysql", "postgres":
+		defaultPort := 3306
+		if cfg.Database.Driver == "postgres" {
+			defaultPort = 5432
+			cfg.Database.SSLMode = p.oneOf("DB_SSLMODE", "require", "disable", "require", "verify-ca", "verify-full")
+		}
+
+		cfg.Database.Port = p.port("DB_PORT", defaultPort)
+
+		required := map[string]string{
+			"DB_USER": cfg.Database.User,
+			"DB_HOST": cfg.Database.Host,
+			"DB_NAME": cfg.Database.Name,
+		}
+		for _, key := range slices.Sorted(maps.Keys(required)) {
+			if required[key] == "" {
+				p.fail(key, "is required for DB_DRIVER=%s", cfg.Database.Driver)
+			}
+		}
+	case "sqlite":
+		if cfg.Database.Path == "" {
+			cfg.Database.Path = filepath.Join(cfg.StorageDir, "aclife.db")
+		}
+	}
+
+	// Stripe is either fully configured or disabled
+	if cfg.Stripe.Enabled() {
+		required := map[string]string{
+			"STRIPE_PRODUCT_ID":     cfg.Stripe.ProductID,
+			"STRIPE_WEBHOOK_SECRET": cfg.Stripe.WebhookSecret,
+			"CLIENT_URL":            cfg.ClientURL,
+		}
+		for _, key := range slices.Sorted(maps.Keys(required)) {
+			if required[key] == "" {
+				p.fail(key, "is required when STRIPE_API_KEY is set")
+			}
+		}
+	}
+
+	// VAPID keys come in pairs
+	if (cfg.Push.VAPIDPublicKey == "") != (cfg.Push.VAPIDPrivateKey == "") {
+		p.fail("VAPID_PRIVATE_KEY", "VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY must be set together")
+	}
+
+	// Security keys are used from the web client by default
+	if len(cfg.WebAuthn.Origins) == 0 {
+		origin := cfg.ServerURL
+		if cfg.ClientURL != "" {
+			origin, _ = url.Parse(cfg.ClientURL) // validated above
+		}
+		cfg.WebAuthn.Origins = []string{origin.Scheme + "://" + origin.Host}
+	}
+	if cfg.WebAuthn.RPID == "" {
+		if origin, err := url.Parse(cfg.WebAuthn.Origins[0]); err == nil {
+			cfg.WebAuthn.RPID = origin.Hostname()
+		}
+		if cfg.WebAuthn.RPID == "" {
+			p.fail("WEBAUTHN_RP_ID", "is required when the first of WEBAUTHN_ORIGINS has no host")
+		}
+	}
+
+	// Mail
+	if cfg.Mail.From == "" {
+		cfg.Mail.From = "acLife <noreply@" + cfg.ServerURL.Hostname() + ">"
+	}
+	if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+		p.fail("MAIL_FROM", "must be an email address such as \"acLife <noreply@aclife.example>\", got %q", cfg.Mail.From)
+	}
+
+	switch cfg.Mail.Driver {
+	case "file":
+		if cfg.Mail.Dir == "" {
+			cfg.Mail.Dir = filepath.Join(cfg.StorageDir, "mail")
+		}
+		// Nobody would receive the verification links
+		if cfg.IsProduction() && cfg.Registration.EmailVerificationRequired() {
+			p.fail("MAIL_DRIVER", "must be smtp in production unless DISABLE_EMAIL_VALIDATION is set")
+		}
+	case "smtp":
+		if cfg.Mail.Host == "" {
+			p.fail("SMTP_HOST", "is required for MAIL_DRIVER=smtp")
+		}
+		if (cfg.Mail.User == "") != (cfg.Mail.Password == "") {
+			p.fail("SMTP_PASSWORD", "SMTP_USER and SMTP_PASSWORD must be set together")
+		}
+	}
+
+	if len(p.errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(p.errs...))
+	}
+
+	return cfg, nil
+}
+
+// IsProduction reports whether the server runs in production mode.
+func (c *Config) IsProduction() bool {
+	return c.Env == "production"
+}
+
+// CookieDomain returns the session cookie domain derived from the server URL.
+// It is empty for localhost and IP addresses.
+func (c *Config) CookieDomain() string {
+	domain := c.ServerURL.Hostname()
+	if domain == "localhost" || net.ParseIP(domain) != nil {
+		return "" // omit localhost or IPs
+	}
+	return domain
+}
+
+// Metadata returns the public server metadata published to clients.
+func (c *Config) Metadata() types.ServerMetadata {
+	return types.ServerMetadata{
+		URL:      c.ServerURL.String(),
+		Policies: &types.Policies{},
+		Registration: types.Registration{
+			Enabled:              !c.Registration.Disabled,
+			InviteOnly:           c.Registration.InviteOnly,
+			SubscriptionRequired: c.Stripe.Enabled(),
+			Email: &types.EmailSettings{
+				VerificationRequired: c.Registration.EmailVerificationRequired(),
+				DomainBlacklist:      nonNil(c.Registration.BlockedDomains),
+				DomainWhitelist:      nonNil(c.Registration.AllowedDomains),
+			},
+			RetentionPeriod: 0,
+		},
+		VapidPublicKey: c.Push.VAPIDPublicKey, // for push service
+	}
+}
+
+// nonNil returns an empty slice instead of nil, so that lists are published as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// EmailVerificationRequired reports whether accounts must verify their email address before logging in.
+func (r Registration) EmailVerificationRequired() bool {
+	return !r.EmailValidationDisabled
+}
+
+// EmailDomainAllowed reports whether accounts may use the given address. Its domain, or a parent domain of it,
+// must be in AllowedDomains unless that is empty, and must not be in BlockedDomains.
+func (r Registration) EmailDomainAllowed(email string) bool {
+	_, domain, _ := strings.Cut(email, "@")
+	domain = strings.ToLower(domain)
+
+	return (len(r.AllowedDomains) == 0 || matchDomain(r.AllowedDomains, domain)) &&
+		!matchDomain(r.BlockedDomains, domain)
+}
+
+// matchDomain reports whether domain or one of its parent domains is in the list.
+func matchDomain(list []string, domain string) bool {
+	for {
+		if slices.Contains(list, domain) {
+			return true
+		}
+
+		var ok bool
+		if _, domain, ok = strings.Cut(domain, "."); !ok {
+			return false
+		}
+	}
+}
+
+// Enabled reports whether billing through Stripe is configured.
+func (s Stripe) Enabled() bool {
+	return s.APIKey != ""
+}
+
+// Enabled reports whether VAPID keys for sending push notifications are configured.
+func (p Push) Enabled() bool {
+	return p.VAPIDPublicKey != "" && p.VAPIDPrivateKey != ""
+}
+
+// EndpointAllowed reports whether push notifications may be sent to the given endpoint host.
+func (p Push) EndpointAllowed(host string) bool {
+	if len(p.AllowedEndpoints) == 0 {
+		return true
+	}
+
+	for _, re := range p.AllowedEndpoints {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+/* -------------------- Parsing -------------------- */
+
+func readFile(path string, values map[string]string) error {
+	file, err := godotenv.Read(path)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range file {
+		values[k] = v
+	}
+	return nil
+}
+
+type parser struct {
+	values map[string]string
+	errs   []error
+}
+
+func (p *parser) fail(key, format string, args ...any) {
+	p.errs = append(p.errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+}
+
+// get returns the value of key, reading it from the file named by KEY_FILE if that is set instead.
+func (p *parser) get(key string) string {
+	value := strings.TrimSpace(p.values[key])
+	path := strings.TrimSpace(p.values[key+"_FILE"])
+
+	if path == "" {
+		return value
+	}
+
+	if value != "" {
+		p.fail(key, "set either %s or %s_FILE, not both", key, key)
+		return value
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		p.fail(key+"_FILE", "%v", err)
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+func (p *parser) bool(key string) bool {
+	switch strings.ToLower(p.get(key)) {
+	case "", "false", "0", "no":
+		return false
+	case "true", "1", "yes":
+		return true
+	default:
+		p.fail(key, "must be true or false")
+		return false
+	}
+}
+
+func (p *parser) oneOf(key, def string, allowed ...string) string {
+	value := p.get(key)
+	if value == "" {
+		return def
+	}
+
+	if !slices.Contains(allowed, value) {
+		p.fail(key, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+		return def
+	}
+	return value
+}
+
+func (p *parser) level(key string, def slog.Level) slog.Level {
+	value := p.get(key)
+	if value == "" {
+		return def
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		p.fail(key, "must be one of debug, info, warn, error, got %q", value)
+		return def
+	}
+	return level
+}
+
+func (p *parser) duration(key string, def time.Duration) time.Duration {
+	value := p.get(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		p.fail(key, "must be a non-negative duration such as 72h, got %q", value)
+		return def
+	}
+	return d
+}
+
+func (p *parser) port(key string, def int) int {
+	value := p.get(key)
+	if value == "" {
+		return def
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		p.fail(key, "must be a number between 1 and 65535, got %q", value)
+		return def
+	}
+	return port
+}
+
+func (p *parser) count(key string, def int) int {
+	value := p.get(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		p.fail(key, "must be a number of at least 0, got %q", value)
+		return def
+	}
+	return n
+}
+
+func (p *parser) url(key string, required bool) *url.URL {
+	value := p.get(key)
+	if value == "" {
+		if required {
+			p.fail(key, "is required")
+		}
+		return &url.URL{}
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.fail(key, "must be an absolute http(s) URL, got %q", value)
+		return &url.URL{}
+	}
+	return u
+}
+
+func (p *parser) urlString(key string) string {
+	u := p.url(key, false)
+	if u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+func (p *parser) list(key string) []string {
+	var items []string
+	for item := range strings.SplitSeq(p.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// domains reads a list of email domains separated by commas or newlines, so that a list file can be given as KEY_FILE.
+// Lines starting with # are comments, and a leading @ is dropped.
+func (p *parser) domains(key string) []string {
+	var domains []string
+	for line := range strings.Lines(p.get(key)) {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		for domain := range strings.SplitSeq(line, ",") {
+			domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+			if domain == "" {
+				continue
+			}
+			if strings.ContainsAny(domain, "@ \t") || !strings.Contains(domain, ".") {
+				p.fail(key, "%q is not a domain such as example.com", domain)
+				continue
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// hostPatterns compiles a list of host names where * matches any characters.
+func (p *parser) hostPatterns(key string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, pattern := range p.list(key) {
+		re := "^" + regexp.QuoteMeta(pattern) + "$"
+		re = strings.ReplaceAll(re, `\*`, ".*")
+		patterns = append(patterns, regexp.MustCompile(re))
+	}
+	return patterns
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validValues() map[string]string {
+	return map[string]string{
+		"PORT":        "8000",
+		"SERVER_URL":  "https://aclife.example/",
+		"SESSION_KEY": strings.Repeat("k", 32),
+		"DB_DRIVER":   "postgres",
+		"DB_USER":     "aclife",
+		"DB_HOST":     "db",
+		"DB_NAME":     "aclife",
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	cfg, err := Parse(validValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Database.Port != 5432 || cfg.Database.SSLMode != "require" {
+		t.Errorf("postgres defaults not applied: port %d, sslmode %q", cfg.Database.Port, cfg.Database.SSLMode)
+	}
+	if cfg.IsProduction() || cfg.Stripe.Enabled() || cfg.Push.Enabled() {
+		t.Error("expected development mode with Stripe and push disabled")
+	}
+	if cfg.Account.DeletionDelay != 0 {
+		t.Errorf("deletion delay = %v, want immediate deletion", cfg.Account.DeletionDelay)
+	}
+	if cfg.Sessions.IdleTimeout != 7*24*time.Hour || cfg.Sessions.MaxLifetime != 30*24*time.Hour {
+		t.Errorf("sessions = %+v, want a week idle and a month at most", cfg.Sessions)
+	}
+	if cfg.CookieDomain() != "aclife.example" {
+		t.Errorf("cookie domain = %q", cfg.CookieDomain())
+	}
+	if cfg.WebAuthn.RPID != "aclife.example" || len(cfg.WebAuthn.Origins) != 1 || cfg.WebAuthn.Origins[0] != "https://aclife.example" {
+		t.Errorf("webauthn = %+v, want the server origin", cfg.WebAuthn)
+	}
+	if cfg.Mail.Driver != "file" || cfg.Mail.Dir != "mail" || cfg.Mail.From != "acLife <noreply@aclife.example>" {
+		t.Errorf("mail = %+v, want files in the storage directory", cfg.Mail)
+	}
+	if cfg.StateStore != "memory" {
+		t.Errorf("state store = %q, want memory", cfg.StateStore)
+	}
+	if !cfg.Metadata().Registration.Email.VerificationRequired {
+		t.Error("email verification is not required by default")
+	}
+}
+
+func TestMailInProduction(t *testing.T) {
+	values := validValues()
+	values["ENV"] = "production"
+
+	_, err := Parse(values)
+	if err == nil || !strings.Contains(err.Error(), "MAIL_DRIVER:") {
+		t.Fatalf("expected MAIL_DRIVER to be rejected, got %v", err)
+	}
+
+	// Without verification nothing has to be mailed
+	values["DISABLE_EMAIL_VALIDATION"] = "true"
+	if _, err := Parse(values); err != nil {
+		t.Fatal(err)
+	}
+
+	values["DISABLE_EMAIL_VALIDATION"] = "false"
+	values["MAIL_DRIVER"] = "smtp"
+	values["SMTP_HOST"] = "smtp.aclife.example"
+	cfg, err := Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mail.Port != 587 {
+		t.Errorf("smtp port = %d, want 587", cfg.Mail.Port)
+	}
+}
+
+func TestWebAuthnDefaultsToClient(t *testing.T) {
+	values := validValues()
+	values["CLIENT_URL"] = "https://app.aclife.example:8443/calendar"
+
+	cfg, err := Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.WebAuthn.RPID != "app.aclife.example" || len(cfg.WebAuthn.Origins) != 1 || cfg.WebAuthn.Origins[0] != "https://app.aclife.example:8443" {
+		t.Errorf("webauthn = %+v, want the client origin", cfg.WebAuthn)
+	}
+}
+
+func TestParseReportsAllErrors(t *testing.T) {
+	values := validValues()
+	values["PORT"] = "http"
+	values["SESSION_KEY"] = "short"
+	values["STRIPE_API_KEY"] = "sk_test"
+	values["ACCOUNT_DELETION_DELAY"] = "7d"
+	values["SESSION_IDLE_TIMEOUT"] = "0"
+	delete(values, "DB_HOST")
+
+	_, err := Parse(values)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, key := range []string{"PORT", "SESSION_KEY", "ACCOUNT_DELETION_DELAY", "SESSION_IDLE_TIMEOUT", "DB_HOST", "STRIPE_PRODUCT_ID", "STRIPE_WEBHOOK_SECRET", "CLIENT_URL"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("error does not mention %s:\n%v", key, err)
+		}
+	}
+}
+
+func TestParseSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_password")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	values := validValues()
+	values["DB_PASSWORD_FILE"] = path
+
+	cfg, err := Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Password != "s3cret" {
+		t.Errorf("password = %q", cfg.Database.Password)
+	}
+
+	values["DB_PASSWORD"] = "other"
+	if _, err := Parse(values); err == nil {
+		t.Error("expected an error when both DB_PASSWORD and DB_PASSWORD_FILE are set")
+	}
+}
+
+func TestPushEndpointAllowed(t *testing.T) {
+	values := validValues()
+	values["PUSH_ALLOWED_ENDPOINTS"] = "*.push.apple.com, fcm.googleapis.com"
+
+	cfg, err := Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]bool{
+		"web.push.apple.com":  true,
+		"fcm.googleapis.com":  true,
+		"evil.example":        false,
+		"push.apple.com.evil": false,
+	} {
+		if got := cfg.Push.EndpointAllowed(host); got != want {
+			t.Errorf("EndpointAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestEmailDomainAllowed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("# disposable\nmailinator.com\n@Trash.example, spam.example\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	values := validValues()
+	values["EMAIL_DOMAIN_BLOCKLIST_FILE"] = path
+
+	cfg, err := Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Metadata().Registration.Email.DomainBlacklist; !slices.Equal(got, []string{"mailinator.com", "trash.example", "spam.example"}) {
+		t.Errorf("published blocklist = %q", got)
+	}
+
+	for email, want := range map[string]bool{
+		"ann@example.com":        true,
+		"ann@mailinator.com":     false,
+		"ann@MAILINATOR.com":     false,
+		"ann@eu.mailinator.com":  false,
+		"ann@notmailinator.com":  true,
+		"ann@trash.example":      false,
+		"ann@spam.example.other": true,
+	} {
+		if got := cfg.Registration.EmailDomainAllowed(email); got != want {
+			t.Errorf("with blocklist, EmailDomainAllowed(%q) = %v, want %v", email, got, want)
+		}
+	}
+
+	values["EMAIL_DOMAIN_ALLOWLIST"] = "ourcompany.com"
+	values["EMAIL_DOMAIN_BLOCKLIST_FILE"] = ""
+	values["EMAIL_DOMAIN_BLOCKLIST"] = "contractors.ourcompany.com"
+
+	if cfg, err = Parse(values); err != nil {
+		t.Fatal(err)
+	}
+	for email, want := range map[string]bool{
+		"ann@ourcompany.com":             true,
+		"ann@eu.ourcompany.com":          true,
+		"ann@contractors.ourcompany.com": false,
+		"ann@example.com":                false,
+	} {
+		if got := cfg.Registration.EmailDomainAllowed(email); got != want {
+			t.Errorf("with allowlist, EmailDomainAllowed(%q) = %v, want %v", email, got, want)
+		}
+	}
+
+	values["EMAIL_DOMAIN_ALLOWLIST"] = "ann@ourcompany.com"
+	if _, err := Parse(values); err == nil || !strings.Contains(err.Error(), "EMAIL_DOMAIN_ALLOWLIST:") {
+		t.Errorf("expected an EMAIL_DOMAIN_ALLOWLIST error, got %v", err)
+	}
+}
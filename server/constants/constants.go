@@ -1,15 +1,7 @@
 // Package constants defines fixed values used across the application.
 package constants
 
-import (
-	"log"
-	"os"
-	"time"
-
-	"acLife/types"
-
-	"github.com/joho/godotenv"
-)
+import "time"
 
 const Day = 24 * time.Hour
 
@@ -18,45 +10,60 @@ const (
 
 	SessionName = "acl_session"
 
-	HTTPTimeout = 10 * time.Second
+	HTTPTimeout     = 10 * time.Second
+	MailTimeout     = 30 * time.Second
+	ShutdownTimeout = 30 * time.Second
 
 	SRPSessionTTL     = 5 * time.Minute
+	PendingLoginTTL   = 5 * time.Minute
+	WebAuthnSetupTTL  = 5 * time.Minute
+	RecoveryTTL       = 15 * time.Minute // to re-encrypt the events after proving the recovery code
 	SubCacheTTL       = 5 * time.Minute
 	RateLimitCacheTTL = 2 * time.Minute
 
-	AccessTokenExpiry = 7 * Day
+	AccessTokenExpiry    = 15 * time.Minute // renewed with the refresh token, see config.Sessions for the session lifetime
+	SessionTouchInterval = 1 * time.Minute
+	// RefreshReuseGrace lets concurrent browser requests present a refresh token that one of them just rotated
+	RefreshReuseGrace = 30 * time.Second
 
 	DBMaxOpenConns    = 50
 	DBMaxIdleConns    = 10
 	DBConnMaxLifetime = 1 * time.Hour
 	DBTimeout         = 5 * time.Second
 
-	MaxEmailLen     = 260
-	MaxSaltLen      = 16
-	MaxVerifierLen  = 520
-	MaxChallengeLen = 64
-	MaxEventLen     = 10000
-)
+	DBMigrationTimeout  = 5 * time.Minute
+	DBMigrationLockWait = 1 * time.Minute
+
+	MaxEmailLen      = 260
+	MaxSaltLen       = 16
+	MaxVerifierLen   = 520
+	MaxChallengeLen  = 64
+	MaxWrappedKeyLen = 256
+	MaxEventLen      = 10000
+
+	MaxDeviceNameLen = 100
+	MaxUserAgentLen  = 512
 
-var Metadata types.ServerMetadata
-
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Failed to load .env: %v", err)
-	}
-
-	Metadata = types.ServerMetadata{
-		URL:      os.Getenv("SERVER_URL"),
-		Policies: &types.Policies{},
-		Registration: types.Registration{
-			Enabled:              os.Getenv("DISABLE_REGISTRATION") != "true",
-			SubscriptionRequired: os.Getenv("STRIPE_API_KEY") != "",
-			Email: &types.EmailSettings{
-				VerificationRequired: os.Getenv("DISABLE_EMAIL_VALIDATION") == "true",
-				DomainBlacklist:      []string{},
-			},
-			RetentionPeriod: 0,
-		},
-		VapidPublicKey: os.Getenv("VAPID_PUBLIC_KEY"), // for push service
-	}
-}
+	MaxSRPProofAttempts     = 3 // per SRP handshake
+	MaxSecondFactorAttempts = 5 // per pending login
+	MaxKeyNameLen           = 100
+	BackupCodeCount         = 10
+
+	// Failed proofs per account, from any address, see handlers/lockout.go
+	LoginFailuresBeforeBackoff = 3
+	LoginFailuresBeforeLockout = 10
+	LoginBackoffBase           = 1 * time.Second // doubled with each further failure
+	LoginBackoffMax            = 1 * time.Minute
+	LoginLockoutDuration       = 15 * time.Minute
+	LoginFailureTTL            = 24 * time.Hour // since the last failure
+
+	InviteTTL      = 7 * 24 * time.Hour  // of invite codes created without an expiry
+	MaxInviteTTL   = 90 * 24 * time.Hour // from their creation
+	MaxInviteUses  = 1000
+	InviteCodeSize = 16 // random bytes, hex encoded
+
+	KnownDeviceTTL = 180 * Day // since the last login from a device, after which it counts as new again
+
+	EmailVerificationTTL     = 24 * time.Hour  // of the emailed link
+	VerificationMailInterval = 1 * time.Minute // between resent verification emails per account
+)
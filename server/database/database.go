@@ -6,146 +6,248 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
-	"strings"
+	"time"
 
+	"acLife/config"
 	"acLife/constants"
-	"acLife/utils"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
+	"acLife/types"
 )
 
-var DB *sqlx.DB
-
-func Connect() error {
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	name := os.Getenv("DB_NAME")
-
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
-		user,
-		password,
-		host,
-		port,
-		name,
-	)
+// DB is the active storage backend, set by Connect.
+var DB Store
 
-	db, err := sqlx.Open("mysql", dsn)
-	if err != nil {
-		return err
-	}
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("record not found")
 
-	if err := db.Ping(); err != nil {
-		return err
-	}
+// ErrDuplicate is returned by stores that detect unique constraint violations themselves.
+var ErrDuplicate = errors.New("duplicate entry")
 
-	DB = db
+// ErrInviteUnavailable is returned by CreateInvitedUser when the invite code is used up or expired.
+var ErrInviteUnavailable = errors.New("invite code used up or expired")
 
-	DB.SetMaxOpenConns(constants.DBMaxOpenConns)
-	DB.SetMaxIdleConns(constants.DBMaxIdleConns)
-	DB.SetConnMaxLifetime(constants.DBConnMaxLifetime)
+// ErrInviteQuotaExceeded is returned by CreateInvite when the creator's invites would admit too many accounts.
+var ErrInviteQuotaExceeded = errors.New("invite quota exceeded")
 
-	return nil
-}
+// ErrStaleEvents is returned by ChangeCredentials when the re-encrypted events don't match the stored ones.
+var ErrStaleEvents = errors.New("calendar events changed")
 
-func Setup() error {
-	ctx, cancel := context.WithTimeout(context.Background(), constants.DBTimeout)
-	defer cancel()
+// Store is the persistence layer used by the rest of the application.
+type Store interface {
+	// Users
+	CreateUser(ctx context.Context, user *types.User) error
+	// CreateInvitedUser creates the user and counts a use of the invite in a single transaction.
+	// It returns ErrInviteUnavailable if the invite has no uses left or expired before now.
+	CreateInvitedUser(ctx context.Context, user *types.User, inviteID int, now time.Time) error
+	GetUserByEmail(ctx context.Context, email string) (*types.User, error)
+	GetUserByUUID(ctx context.Context, uuid string) (*types.User, error)
+	// VerifyEmail marks the user's email address as verified if it is still email.
+	// It returns ErrNotFound if the user doesn't exist, has another address, or may have been verified already.
+	VerifyEmail(ctx context.Context, uuid, email string) error
+	SetStripeCustomer(ctx context.Context, uuid, customerID, subscriptionID string) error
+	SetSubscriptionStatus(ctx context.Context, subscriptionID, status string) error
 
-	// Create users table
-	userTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		uuid CHAR(36) NOT NULL DEFAULT UUID() UNIQUE,
-		email VARCHAR(255) NOT NULL UNIQUE,
-		salt BINARY(16) NOT NULL,
-		srp_salt BINARY(16) NOT NULL,
-		verifier VARBINARY(512) NOT NULL,
-		challenge VARBINARY(64) NOT NULL,
-		stripe_customer_id VARCHAR(255),
-		stripe_subscription_id VARCHAR(255) UNIQUE,
-		subscription_status VARCHAR(50)
-	);`
-
-	if _, err := Exec(ctx, userTable); err != nil {
-		utils.LogError("Setup", "Exec(users)", err)
-		return err
-	}
+	// ScheduleUserDeletion sets the time at which the user will be deleted, nil cancels a scheduled deletion.
+	ScheduleUserDeletion(ctx context.Context, uuid string, at *time.Time) error
+	// GetUsersDueForDeletion returns the users whose scheduled deletion time is before now.
+	GetUsersDueForDeletion(ctx context.Context, now time.Time) ([]types.User, error)
+	// DeleteUser deletes the user along with their sessions, push subscriptions, second factors and calendar events.
+	DeleteUser(ctx context.Context, uuid string) error
 
-	// Create account_sessions table
-	sessionsTable := `
-	CREATE TABLE IF NOT EXISTS account_sessions (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		owner CHAR(36) NOT NULL,
-		access_token VARCHAR(64) NOT NULL UNIQUE,
-		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME NOT NULL,
-		FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
-		INDEX idx_access_token (access_token)
-	);`
-
-	if _, err := Exec(ctx, sessionsTable); err != nil {
-		utils.LogError("Setup", "Exec(account_sessions)", err)
-		return err
-	}
+	// ChangeCredentials replaces the user's credentials and all of their calendar events, removes the recovery key,
+	// which wraps the old master key, and any pending email change, whose verifier is bound to the old password,
+	// and revokes every account session except keepAccessToken, in a single transaction.
+	// events must contain exactly the stored event IDs, otherwise ErrStaleEvents is returned.
+	ChangeCredentials(ctx context.Context, uuid string, creds types.Credentials, events []types.CalendarEvent, keepAccessToken string) error
+	// SetRecoveryKey stores the user's recovery key, replacing any previous one. Nil removes it.
+	SetRecoveryKey(ctx context.Context, uuid string, key *types.RecoveryKey) error
 
-	// Create push_subscriptions table
-	pushTable := `
-	CREATE TABLE IF NOT EXISTS push_subscriptions (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		owner CHAR(36) NOT NULL,
-		endpoint VARCHAR(1024) NOT NULL UNIQUE,
-		p256dh VARCHAR(255) NOT NULL,
-		auth VARCHAR(255) NOT NULL,
-		FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE
-	);`
-
-	if _, err := Exec(ctx, pushTable); err != nil {
-		utils.LogError("Setup", "Exec(push_subscriptions)", err)
-		return err
+	// Email changes
+	// RequestEmailChange stores an address change, replacing any pending one of the owner.
+	RequestEmailChange(ctx context.Context, change *types.EmailChange) error
+	// ApplyEmailChange sets the address and the credentials of the owner's pending change to email, marks the address
+	// as verified and removes the recovery key, whose verifier is bound to the old address, in a single transaction.
+	// It returns ErrNotFound if no change to email is pending, and a duplicate entry error if the address is taken.
+	ApplyEmailChange(ctx context.Context, owner, email string) error
+	DeleteEmailChangesCreatedBefore(ctx context.Context, before time.Time) error
+
+	// Invites
+	// CreateInvite stores a new invite and sets its ID. An invite with a creator is only stored if the creator's
+	// invites, counting the accounts each one admitted or may still admit at its CreatedAt, stay within quota,
+	// otherwise ErrInviteQuotaExceeded is returned. Invites of the same creator are counted one after the other.
+	CreateInvite(ctx context.Context, invite *types.Invite, quota int) error
+	GetInviteByCode(ctx context.Context, codeHash []byte) (*types.Invite, error)
+	// GetInvites returns the invites created by creator, or every invite if creator is nil, newest first.
+	GetInvites(ctx context.Context, creator *string) ([]types.Invite, error)
+	// RevokeInvite expires an invite at now. It returns ErrNotFound if there is no such invite that is still valid,
+	// or if creator isn't nil and didn't create it.
+	RevokeInvite(ctx context.Context, id int, creator *string, now time.Time) error
+
+	// Two-factor authentication
+	// SetTOTPSecret stores a new, not yet enabled TOTP secret.
+	SetTOTPSecret(ctx context.Context, uuid, secret string) error
+	// EnableTOTP enables the stored secret and replaces the user's backup codes.
+	EnableTOTP(ctx context.Context, uuid string, backupCodeHashes [][]byte) error
+	// DisableTOTP removes the secret and the backup codes.
+	DisableTOTP(ctx context.Context, uuid string) error
+	// UseTOTPStep records that a code of the given time step was accepted.
+	// It reports false if a code of that step or a later one was already used.
+	UseTOTPStep(ctx context.Context, uuid string, step int64) (bool, error)
+	// UseBackupCode deletes the backup code with the given hash, reporting false if the user has none.
+	UseBackupCode(ctx context.Context, uuid string, hash []byte) (bool, error)
+
+	// Security keys
+	// AddWebAuthnCredential stores a new credential and sets its ID.
+	// It returns a duplicate entry error if the credential ID is already registered.
+	AddWebAuthnCredential(ctx context.Context, cred *types.WebAuthnCredential) error
+	GetWebAuthnCredentials(ctx context.Context, owner string) ([]types.WebAuthnCredential, error)
+	// UseWebAuthnCredential stores the signature counter and backup state of a successful assertion.
+	UseWebAuthnCredential(ctx context.Context, owner string, credentialID []byte, signCount uint32, backupState bool, now time.Time) error
+	// DeleteWebAuthnCredential returns ErrNotFound if the owner has no credential with that ID.
+	DeleteWebAuthnCredential(ctx context.Context, owner string, id int) error
+
+	// Account sessions
+	// CreateAccountSession stores a new session along with its first refresh token, and sets its ID.
+	CreateAccountSession(ctx context.Context, session *types.AccountSession, refreshTokenHash []byte) error
+	GetAccountSession(ctx context.Context, accessToken string) (*types.AccountSession, error)
+	GetAccountSessionByID(ctx context.Context, id int) (*types.AccountSession, error)
+	ListAccountSessions(ctx context.Context, owner string) ([]types.AccountSession, error)
+	TouchAccountSession(ctx context.Context, accessToken, ip string, now time.Time) error
+	DeleteAccountSession(ctx context.Context, accessToken string) error
+	// DeleteAccountSessionByID returns ErrNotFound if the owner has no session with that ID.
+	DeleteAccountSessionByID(ctx context.Context, owner string, id int) error
+	DeleteOtherAccountSessions(ctx context.Context, owner, keepAccessToken string) error
+	// DeleteExpiredAccountSessions deletes the sessions last seen before lastSeenBefore or created before createdBefore.
+	DeleteExpiredAccountSessions(ctx context.Context, lastSeenBefore, createdBefore time.Time) error
+
+	// Known devices
+	// RememberDevice records a login of the owner from the device with the given fingerprint at now.
+	// It reports whether the device is new to an account that already had other known devices.
+	RememberDevice(ctx context.Context, owner string, fingerprint []byte, now time.Time) (bool, error)
+	DeleteDevicesSeenBefore(ctx context.Context, before time.Time) error
+
+	// Refresh tokens
+	GetRefreshToken(ctx context.Context, hash []byte) (*types.RefreshToken, error)
+	// RotateRefreshToken marks the refresh token as used, adds its successor to the same session and
+	// gives the session a new access token. It reports false if the token was already used.
+	RotateRefreshToken(ctx context.Context, token *types.RefreshToken, newHash []byte, accessToken string, expiresAt, now time.Time) (bool, error)
+
+	// Push subscriptions
+	SavePushSubscription(ctx context.Context, sub *types.PushSubscription) error
+	GetPushSubscriptions(ctx context.Context, owner string) ([]types.PushSubscription, error)
+	DeletePushSubscription(ctx context.Context, endpoint string) error
+
+	// Calendar events
+	SaveCalendarEvents(ctx context.Context, owner string, upserts []types.CalendarEvent, deletedIDs []string) error
+	GetCalendarEvents(ctx context.Context, owner string) ([]types.CalendarEvent, error)
+
+	// Short-lived state shared by the server instances, see package state
+	CreateSRPSession(ctx context.Context, sess *types.SavedSRPSession) error
+	GetSRPSession(ctx context.Context, id string) (*types.SavedSRPSession, error)
+	// CountSRPAttempt records a proof attempt, reporting false if the session is gone or already had maxAttempts.
+	CountSRPAttempt(ctx context.Context, id string, maxAttempts int) (bool, error)
+	DeleteSRPSession(ctx context.Context, id string) error
+	DeleteSRPSessionsByEmail(ctx context.Context, email string) error
+	DeleteSRPSessionsCreatedBefore(ctx context.Context, before time.Time) error
+	CountSRPSessions(ctx context.Context) (int, error)
+
+	// AddRateLimitHit records a request of client at now, unless it made limit requests since then already.
+	// It reports whether the request was recorded.
+	AddRateLimitHit(ctx context.Context, client string, limit int, since, now time.Time) (bool, error)
+	DeleteRateLimitHits(ctx context.Context, before time.Time) error
+	CountRateLimitClients(ctx context.Context) (int, error)
+
+	CreatePendingLogin(ctx context.Context, login *types.SavedPendingLogin) error
+	GetPendingLogin(ctx context.Context, token string) (*types.SavedPendingLogin, error)
+	// CountPendingLoginAttempt records a second factor attempt, reporting false if the login is gone or already had maxAttempts.
+	CountPendingLoginAttempt(ctx context.Context, token string, maxAttempts int) (bool, error)
+	DeletePendingLogin(ctx context.Context, token string) error
+	DeletePendingLoginsCreatedBefore(ctx context.Context, before time.Time) error
+	CountPendingLogins(ctx context.Context) (int, error)
+
+	CreatePendingRecovery(ctx context.Context, recovery *types.PendingRecovery) error
+	GetPendingRecovery(ctx context.Context, token string) (*types.PendingRecovery, error)
+	DeletePendingRecovery(ctx context.Context, token string) error
+	DeletePendingRecoveriesCreatedBefore(ctx context.Context, before time.Time) error
+
+	// SaveWebAuthnSetup stores a security key registration, replacing the owner's previous one.
+	SaveWebAuthnSetup(ctx context.Context, setup *types.SavedWebAuthnSetup) error
+	// TakeWebAuthnSetup returns and deletes the owner's registration. Of concurrent calls, only one gets it.
+	TakeWebAuthnSetup(ctx context.Context, owner string) (*types.SavedWebAuthnSetup, error)
+	DeleteWebAuthnSetupsCreatedBefore(ctx context.Context, before time.Time) error
+
+	GetLoginFailures(ctx context.Context, email string) (*types.LoginFailures, error)
+	// AddLoginFailure records a failure at now and returns the number of consecutive failures, including it.
+	AddLoginFailure(ctx context.Context, email string, now time.Time) (int, error)
+	// DelayLogins moves the next attempt to at, unless it is later already, and with reset starts the count over.
+	DelayLogins(ctx context.Context, email string, at time.Time, reset bool) error
+	DeleteLoginFailures(ctx context.Context, email string) error
+	// DeleteExpiredLoginFailures deletes the failures last recorded before lastFailureBefore that don't delay attempts at now.
+	DeleteExpiredLoginFailures(ctx context.Context, lastFailureBefore, now time.Time) error
+	CountLoginFailures(ctx context.Context) (int, error)
+
+	// ClaimVerificationMail records a verification email to owner at now, unless one was sent after since.
+	// It reports whether the email was recorded.
+	ClaimVerificationMail(ctx context.Context, owner string, since, now time.Time) (bool, error)
+	DeleteVerificationMailsSentBefore(ctx context.Context, before time.Time) error
+
+	// GetCachedSubscriptionStatus returns ErrNotFound if the status isn't cached or expired before now.
+	GetCachedSubscriptionStatus(ctx context.Context, subscriptionID string, now time.Time) (string, error)
+	CacheSubscriptionStatus(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error
+	DeleteCachedSubscriptionStatus(ctx context.Context, subscriptionID string) error
+	DeleteExpiredSubscriptionStatuses(ctx context.Context, now time.Time) error
+	CountCachedSubscriptionStatuses(ctx context.Context) (int, error)
+
+	// Schema management
+	Migrate(ctx context.Context) error
+	Rollback(ctx context.Context, target int) error
+	SchemaVersion(ctx context.Context) (int, error)
+	LatestSchemaVersion() (int, error)
+
+	Ping(ctx context.Context) error
+	Stats() sql.DBStats
+	Close() error
+}
+
+// Connect opens the configured storage backend.
+func Connect(cfg config.Database) error {
+	var (
+		store Store
+		err   error
+	)
+
+	switch cfg.Driver {
+	case "mysql":
+		store, err = openMySQL(cfg)
+	case "postgres":
+		store, err = openPostgres(cfg)
+	case "sqlite":
+		store, err = openSQLite(cfg)
+	default:
+		return fmt.Errorf("unknown database driver %q", cfg.Driver)
 	}
 
-	// Create calendar_events table
-	calendarTable := `
-	CREATE TABLE IF NOT EXISTS calendar_events (
-		id CHAR(36) NOT NULL PRIMARY KEY,
-		owner CHAR(36) NOT NULL,
-		data BLOB NOT NULL,
-		updated_at TIMESTAMP(3) NOT NULL,
-		FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
-		INDEX idx_owner (owner)
-	);`
-
-	if _, err := Exec(ctx, calendarTable); err != nil {
-		utils.LogError("Setup", "Exec(calendar_events)", err)
+	if err != nil {
 		return err
 	}
 
+	DB = store
 	return nil
 }
 
-func Exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
-	return DB.ExecContext(ctx, query, args...)
-}
-
-func QueryRow(ctx context.Context, query string, args ...any) *sql.Row {
-	return DB.QueryRowContext(ctx, query, args...)
-}
+// Migrate applies all pending migrations to the active backend.
+func Migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.DBMigrationTimeout)
+	defer cancel()
 
-func Query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
-	return DB.QueryContext(ctx, query, args...)
+	return DB.Migrate(ctx)
 }
 
-func Rebind(query string) string {
-	return DB.Rebind(query)
-}
+// Rollback reverts the active backend's schema to the target version.
+func Rollback(target int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.DBMigrationTimeout)
+	defer cancel()
 
-func In(query string, args ...any) (string, []any, error) {
-	return sqlx.In(query, args...)
+	return DB.Rollback(ctx, target)
 }
 
 // IsDuplicateEntry checks if the error is a SQL unique constraint violation.
@@ -154,10 +256,25 @@ func IsDuplicateEntry(err error) bool {
 		return false
 	}
 
-	if errors.Is(err, sql.ErrNoRows) {
+	return errors.Is(err, ErrDuplicate) ||
+		isMySQLDuplicate(err) || isPostgresDuplicate(err) || isSQLiteDuplicate(err)
+}
+
+// sameEventIDs reports whether events contains exactly the stored event IDs.
+func sameEventIDs(stored []string, events []types.CalendarEvent) bool {
+	if len(stored) != len(events) {
 		return false
 	}
 
-	msg := err.Error()
-	return strings.Contains(msg, "Duplicate entry")
+	ids := make(map[string]struct{}, len(events))
+	for _, ev := range events {
+		ids[ev.ID] = struct{}{}
+	}
+
+	for _, id := range stored {
+		if _, ok := ids[id]; !ok {
+			return false
+		}
+	}
+	return len(ids) == len(stored)
 }
@@ -0,0 +1,1376 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"acLife/types"
+	"acLife/utils"
+)
+
+// memoryStore implements Store in process memory.
+// It is intended for tests and keeps nothing across restarts.
+type memoryStore struct {
+	mu sync.Mutex
+
+	nextID   int
+	users    map[string]*types.User             // by uuid
+	sessions map[string]*types.AccountSession   // by access token
+	refresh  map[string]*types.RefreshToken     // by token hash
+	pushSubs map[string]*types.PushSubscription // by endpoint
+	events   map[string]ownedEvent              // by event id, unique across owners like the primary key
+	backup   map[string][][]byte                // backup code hashes by owner
+	keys     map[int]*types.WebAuthnCredential  // by id
+	changes  map[string]*types.EmailChange      // by owner
+	invites  map[int]*types.Invite              // by id
+	devices  map[string]map[string]*knownDevice // by owner, then fingerprint
+
+	srpSessions       map[string]*types.SavedSRPSession    // by id
+	rateHits          map[string][]time.Time               // by client
+	pendingLogins     map[string]*types.SavedPendingLogin  // by token
+	recoveries        map[string]*types.PendingRecovery    // by token
+	keySetups         map[string]*types.SavedWebAuthnSetup // by owner
+	loginFailures     map[string]*types.LoginFailures      // by email
+	verificationMails map[string]time.Time                 // when one was last sent, by owner
+	subStatuses       map[string]cachedSubStatus           // by subscription id
+}
+
+type ownedEvent struct {
+	owner string
+	event types.CalendarEvent
+}
+
+type knownDevice struct {
+	firstSeenAt time.Time
+	lastSeenAt  time.Time
+}
+
+type cachedSubStatus struct {
+	status    string
+	expiresAt time.Time
+}
+
+// NewMemoryStore returns an empty in-memory Store.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		users:    make(map[string]*types.User),
+		sessions: make(map[string]*types.AccountSession),
+		refresh:  make(map[string]*types.RefreshToken),
+		pushSubs: make(map[string]*types.PushSubscription),
+		events:   make(map[string]ownedEvent),
+		backup:   make(map[string][][]byte),
+		keys:     make(map[int]*types.WebAuthnCredential),
+		changes:  make(map[string]*types.EmailChange),
+		invites:  make(map[int]*types.Invite),
+		devices:  make(map[string]map[string]*knownDevice),
+
+		srpSessions:       make(map[string]*types.SavedSRPSession),
+		rateHits:          make(map[string][]time.Time),
+		pendingLogins:     make(map[string]*types.SavedPendingLogin),
+		recoveries:        make(map[string]*types.PendingRecovery),
+		keySetups:         make(map[string]*types.SavedWebAuthnSetup),
+		loginFailures:     make(map[string]*types.LoginFailures),
+		verificationMails: make(map[string]time.Time),
+		subStatuses:       make(map[string]cachedSubStatus),
+	}
+}
+
+func (m *memoryStore) id() int {
+	m.nextID++
+	return m.nextID
+}
+
+// clone copies a byte slice so callers can't modify stored data.
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func copyUser(u *types.User) *types.User {
+	c := *u
+	c.Salt = clone(u.Salt)
+	c.SrpSalt = clone(u.SrpSalt)
+	c.Verifier = clone(u.Verifier)
+	c.Challenge = clone(u.Challenge)
+	c.RecoverySrpSalt = clone(u.RecoverySrpSalt)
+	c.RecoveryVerifier = clone(u.RecoveryVerifier)
+	c.RecoveryKey = clone(u.RecoveryKey)
+	if u.DeletionScheduledAt != nil {
+		at := *u.DeletionScheduledAt
+		c.DeletionScheduledAt = &at
+	}
+	if u.TOTPSecret != nil {
+		secret := *u.TOTPSecret
+		c.TOTPSecret = &secret
+	}
+	if u.TOTPLastStep != nil {
+		step := *u.TOTPLastStep
+		c.TOTPLastStep = &step
+	}
+	return &c
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryStore) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+/* -------------------- Users -------------------- */
+
+func (m *memoryStore) CreateUser(ctx context.Context, user *types.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.createUser(user)
+}
+
+func (m *memoryStore) CreateInvitedUser(ctx context.Context, user *types.User, inviteID int, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[inviteID]
+	if !ok || invite.Uses >= invite.MaxUses || !invite.ExpiresAt.After(now) {
+		return ErrInviteUnavailable
+	}
+
+	if err := m.createUser(user); err != nil {
+		return err
+	}
+	invite.Uses++
+	return nil
+}
+
+func (m *memoryStore) createUser(user *types.User) error {
+	if user.UUID == "" {
+		user.UUID = utils.NewUUID()
+	}
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, user.Email) || u.UUID == user.UUID {
+			return ErrDuplicate
+		}
+	}
+
+	user.ID = m.id()
+	m.users[user.UUID] = copyUser(user)
+	return nil
+}
+
+func (m *memoryStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryStore) GetUserByUUID(ctx context.Context, uuid string) (*types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (m *memoryStore) VerifyEmail(ctx context.Context, uuid, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[uuid]
+	if !ok || u.Email != email || u.EmailVerified {
+		return ErrNotFound
+	}
+	u.EmailVerified = true
+	return nil
+}
+
+func (m *memoryStore) SetStripeCustomer(ctx context.Context, uuid, customerID, subscriptionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[uuid]; ok {
+		u.StripeCustomerID = &customerID
+		u.StripeSubscriptionID = &subscriptionID
+	}
+	return nil
+}
+
+func (m *memoryStore) SetSubscriptionStatus(ctx context.Context, subscriptionID, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.StripeSubscriptionID != nil && *u.StripeSubscriptionID == subscriptionID {
+			u.SubscriptionStatus = &status
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ScheduleUserDeletion(ctx context.Context, uuid string, at *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[uuid]; ok {
+		if at != nil {
+			c := *at
+			at = &c
+		}
+		u.DeletionScheduledAt = at
+	}
+	return nil
+}
+
+func (m *memoryStore) GetUsersDueForDeletion(ctx context.Context, now time.Time) ([]types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []types.User
+	for _, u := range m.users {
+		if u.DeletionScheduledAt != nil && u.DeletionScheduledAt.Before(now) {
+			users = append(users, *copyUser(u))
+		}
+	}
+	return users, nil
+}
+
+// DeleteUser removes everything the user owns, like the cascading foreign keys of the SQL schema.
+func (m *memoryStore) DeleteUser(ctx context.Context, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, uuid)
+	delete(m.backup, uuid)
+	delete(m.changes, uuid)
+	delete(m.devices, uuid)
+
+	for id, ev := range m.events {
+		if ev.owner == uuid {
+			delete(m.events, id)
+		}
+	}
+	for id, key := range m.keys {
+		if key.Owner == uuid {
+			delete(m.keys, id)
+		}
+	}
+	for id, invite := range m.invites {
+		if invite.Creator != nil && *invite.Creator == uuid {
+			delete(m.invites, id)
+		}
+	}
+	for token, s := range m.sessions {
+		if s.Owner == uuid {
+			m.deleteSession(token)
+		}
+	}
+	for endpoint, sub := range m.pushSubs {
+		if sub.Owner == uuid {
+			delete(m.pushSubs, endpoint)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ChangeCredentials(ctx context.Context, uuid string, creds types.Credentials, events []types.CalendarEvent, keepAccessToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	var stored []string
+	for id, ev := range m.events {
+		if ev.owner == uuid {
+			stored = append(stored, id)
+		}
+	}
+	if !sameEventIDs(stored, events) {
+		return ErrStaleEvents
+	}
+
+	for _, ev := range events {
+		ev.Data = clone(ev.Data)
+		m.events[ev.ID] = ownedEvent{owner: uuid, event: ev}
+	}
+
+	u.Salt = clone(creds.Salt)
+	u.SrpSalt = clone(creds.SrpSalt)
+	u.Verifier = clone(creds.Verifier)
+	u.Challenge = clone(creds.Challenge)
+	u.RecoverySrpSalt, u.RecoveryVerifier, u.RecoveryKey = nil, nil, nil
+	delete(m.changes, uuid)
+
+	for token, s := range m.sessions {
+		if s.Owner == uuid && token != keepAccessToken {
+			m.deleteSession(token)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) SetRecoveryKey(ctx context.Context, uuid string, key *types.RecoveryKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[uuid]
+	if !ok {
+		return nil
+	}
+
+	if key == nil {
+		key = &types.RecoveryKey{}
+	}
+	u.RecoverySrpSalt = clone(key.SrpSalt)
+	u.RecoveryVerifier = clone(key.Verifier)
+	u.RecoveryKey = clone(key.WrappedKey)
+	return nil
+}
+
+/* -------------------- Email Changes -------------------- */
+
+func (m *memoryStore) RequestEmailChange(ctx context.Context, change *types.EmailChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *change
+	c.SrpSalt = clone(change.SrpSalt)
+	c.Verifier = clone(change.Verifier)
+	m.changes[change.Owner] = &c
+	return nil
+}
+
+func (m *memoryStore) ApplyEmailChange(ctx context.Context, owner, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	change, ok := m.changes[owner]
+	u, exists := m.users[owner]
+	if !ok || !exists || change.Email != email {
+		return ErrNotFound
+	}
+
+	for _, other := range m.users {
+		if other.UUID != owner && strings.EqualFold(other.Email, email) {
+			return ErrDuplicate
+		}
+	}
+
+	u.Email = change.Email
+	u.SrpSalt = clone(change.SrpSalt)
+	u.Verifier = clone(change.Verifier)
+	u.EmailVerified = true
+	u.RecoverySrpSalt, u.RecoveryVerifier, u.RecoveryKey = nil, nil, nil
+	delete(m.changes, owner)
+	return nil
+}
+
+func (m *memoryStore) DeleteEmailChangesCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for owner, change := range m.changes {
+		if change.CreatedAt.Before(before) {
+			delete(m.changes, owner)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Invites -------------------- */
+
+func copyInvite(invite *types.Invite) types.Invite {
+	c := *invite
+	c.CodeHash = clone(invite.CodeHash)
+	if invite.Creator != nil {
+		creator := *invite.Creator
+		c.Creator = &creator
+	}
+	if invite.Email != nil {
+		email := *invite.Email
+		c.Email = &email
+	}
+	return c
+}
+
+func (m *memoryStore) CreateInvite(ctx context.Context, invite *types.Invite, quota int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seats := 0
+	for _, other := range m.invites {
+		if bytes.Equal(other.CodeHash, invite.CodeHash) {
+			return ErrDuplicate
+		}
+
+		switch {
+		case invite.Creator == nil || other.Creator == nil || *other.Creator != *invite.Creator:
+		case other.ExpiresAt.After(invite.CreatedAt):
+			seats += other.MaxUses
+		default:
+			seats += other.Uses
+		}
+	}
+	if invite.Creator != nil && seats+invite.MaxUses > quota {
+		return ErrInviteQuotaExceeded
+	}
+
+	invite.ID = m.id()
+	c := copyInvite(invite)
+	m.invites[invite.ID] = &c
+	return nil
+}
+
+func (m *memoryStore) GetInviteByCode(ctx context.Context, codeHash []byte) (*types.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, invite := range m.invites {
+		if bytes.Equal(invite.CodeHash, codeHash) {
+			c := copyInvite(invite)
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryStore) GetInvites(ctx context.Context, creator *string) ([]types.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var invites []types.Invite
+	for _, invite := range m.invites {
+		if creator == nil || (invite.Creator != nil && *invite.Creator == *creator) {
+			invites = append(invites, copyInvite(invite))
+		}
+	}
+	slices.SortFunc(invites, func(a, b types.Invite) int { return b.ID - a.ID })
+	return invites, nil
+}
+
+func (m *memoryStore) RevokeInvite(ctx context.Context, id int, creator *string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[id]
+	if !ok || !invite.ExpiresAt.After(now) ||
+		(creator != nil && (invite.Creator == nil || *invite.Creator != *creator)) {
+		return ErrNotFound
+	}
+	invite.ExpiresAt = now
+	return nil
+}
+
+/* -------------------- Two-Factor Authentication -------------------- */
+
+func (m *memoryStore) SetTOTPSecret(ctx context.Context, uuid, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[uuid]; ok && !u.TOTPEnabled {
+		u.TOTPSecret = &secret
+	}
+	return nil
+}
+
+func (m *memoryStore) EnableTOTP(ctx context.Context, uuid string, backupCodeHashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[uuid]; ok {
+		u.TOTPEnabled = true
+
+		hashes := make([][]byte, 0, len(backupCodeHashes))
+		for _, h := range backupCodeHashes {
+			hashes = append(hashes, clone(h))
+		}
+		m.backup[uuid] = hashes
+	}
+	return nil
+}
+
+func (m *memoryStore) DisableTOTP(ctx context.Context, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[uuid]; ok {
+		u.TOTPSecret = nil
+		u.TOTPEnabled = false
+		u.TOTPLastStep = nil
+	}
+	delete(m.backup, uuid)
+	return nil
+}
+
+func (m *memoryStore) UseTOTPStep(ctx context.Context, uuid string, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[uuid]
+	if !ok || (u.TOTPLastStep != nil && *u.TOTPLastStep >= step) {
+		return false, nil
+	}
+	u.TOTPLastStep = &step
+	return true, nil
+}
+
+func (m *memoryStore) UseBackupCode(ctx context.Context, uuid string, hash []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, h := range m.backup[uuid] {
+		if bytes.Equal(h, hash) {
+			m.backup[uuid] = slices.Delete(m.backup[uuid], i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/* -------------------- Security Keys -------------------- */
+
+func copyWebAuthnCredential(c *types.WebAuthnCredential) *types.WebAuthnCredential {
+	k := *c
+	k.CredentialID = clone(c.CredentialID)
+	k.PublicKey = clone(c.PublicKey)
+	k.AAGUID = clone(c.AAGUID)
+	if c.LastUsedAt != nil {
+		at := *c.LastUsedAt
+		k.LastUsedAt = &at
+	}
+	return &k
+}
+
+func (m *memoryStore) AddWebAuthnCredential(ctx context.Context, cred *types.WebAuthnCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[cred.Owner]; !ok {
+		return errors.New("webauthn credential owner does not exist")
+	}
+
+	for _, key := range m.keys {
+		if bytes.Equal(key.CredentialID, cred.CredentialID) {
+			return ErrDuplicate
+		}
+	}
+
+	cred.ID = m.id()
+	m.keys[cred.ID] = copyWebAuthnCredential(cred)
+	return nil
+}
+
+func (m *memoryStore) GetWebAuthnCredentials(ctx context.Context, owner string) ([]types.WebAuthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var creds []types.WebAuthnCredential
+	for _, key := range m.keys {
+		if key.Owner == owner {
+			creds = append(creds, *copyWebAuthnCredential(key))
+		}
+	}
+
+	slices.SortFunc(creds, func(a, b types.WebAuthnCredential) int {
+		return a.ID - b.ID
+	})
+	return creds, nil
+}
+
+func (m *memoryStore) UseWebAuthnCredential(ctx context.Context, owner string, credentialID []byte, signCount uint32, backupState bool, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.keys {
+		if key.Owner == owner && bytes.Equal(key.CredentialID, credentialID) {
+			key.SignCount = signCount
+			key.BackupState = backupState
+			key.LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteWebAuthnCredential(ctx context.Context, owner string, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key, ok := m.keys[id]; !ok || key.Owner != owner {
+		return ErrNotFound
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+/* -------------------- Account Sessions -------------------- */
+
+func (m *memoryStore) CreateAccountSession(ctx context.Context, session *types.AccountSession, refreshTokenHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[session.Owner]; !ok {
+		return errors.New("account session owner does not exist")
+	}
+
+	if _, ok := m.sessions[session.AccessToken]; ok {
+		return ErrDuplicate
+	}
+
+	if _, ok := m.refresh[string(refreshTokenHash)]; ok {
+		return ErrDuplicate
+	}
+
+	session.ID = m.id()
+	c := *session
+	m.sessions[session.AccessToken] = &c
+	m.refresh[string(refreshTokenHash)] = &types.RefreshToken{
+		ID:        m.id(),
+		SessionID: session.ID,
+		TokenHash: clone(refreshTokenHash),
+		CreatedAt: session.CreatedAt,
+	}
+	return nil
+}
+
+func (m *memoryStore) GetAccountSession(ctx context.Context, accessToken string) (*types.AccountSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[accessToken]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *memoryStore) GetAccountSessionByID(ctx context.Context, id int) (*types.AccountSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.ID == id {
+			c := *s
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryStore) ListAccountSessions(ctx context.Context, owner string) ([]types.AccountSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []types.AccountSession
+	for _, s := range m.sessions {
+		if s.Owner == owner {
+			sessions = append(sessions, *s)
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b types.AccountSession) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *memoryStore) TouchAccountSession(ctx context.Context, accessToken, ip string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[accessToken]; ok {
+		s.IP = ip
+		s.LastSeenAt = now
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteAccountSession(ctx context.Context, accessToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteSession(accessToken)
+	return nil
+}
+
+func (m *memoryStore) DeleteAccountSessionByID(ctx context.Context, owner string, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.Owner == owner && s.ID == id {
+			m.deleteSession(token)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memoryStore) DeleteOtherAccountSessions(ctx context.Context, owner, keepAccessToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.Owner == owner && token != keepAccessToken {
+			m.deleteSession(token)
+		}
+	}
+	return nil
+}
+
+// deleteSession removes a session along with its refresh tokens and the push subscriptions it registered.
+func (m *memoryStore) deleteSession(accessToken string) {
+	s, ok := m.sessions[accessToken]
+	if !ok {
+		return
+	}
+
+	delete(m.sessions, accessToken)
+	for hash, token := range m.refresh {
+		if token.SessionID == s.ID {
+			delete(m.refresh, hash)
+		}
+	}
+	for endpoint, sub := range m.pushSubs {
+		if sub.SessionID != nil && *sub.SessionID == s.ID {
+			delete(m.pushSubs, endpoint)
+		}
+	}
+}
+
+func (m *memoryStore) DeleteExpiredAccountSessions(ctx context.Context, lastSeenBefore, createdBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, s := range m.sessions {
+		if s.LastSeenAt.Before(lastSeenBefore) || s.CreatedAt.Before(createdBefore) {
+			m.deleteSession(token)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Known Devices -------------------- */
+
+func (m *memoryStore) RememberDevice(ctx context.Context, owner string, fingerprint []byte, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices, ok := m.devices[owner]
+	if !ok {
+		devices = make(map[string]*knownDevice)
+		m.devices[owner] = devices
+	}
+
+	if device, ok := devices[string(fingerprint)]; ok {
+		device.lastSeenAt = now
+		return false, nil
+	}
+
+	devices[string(fingerprint)] = &knownDevice{firstSeenAt: now, lastSeenAt: now}
+	return len(devices) > 1, nil
+}
+
+func (m *memoryStore) DeleteDevicesSeenBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for owner, devices := range m.devices {
+		for fingerprint, device := range devices {
+			if device.lastSeenAt.Before(before) {
+				delete(devices, fingerprint)
+			}
+		}
+		if len(devices) == 0 {
+			delete(m.devices, owner)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Refresh Tokens -------------------- */
+
+func (m *memoryStore) GetRefreshToken(ctx context.Context, hash []byte) (*types.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refresh[string(hash)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	c := *token
+	c.TokenHash = clone(token.TokenHash)
+	if token.UsedAt != nil {
+		at := *token.UsedAt
+		c.UsedAt = &at
+	}
+	return &c, nil
+}
+
+func (m *memoryStore) RotateRefreshToken(ctx context.Context, token *types.RefreshToken, newHash []byte, accessToken string, expiresAt, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.refresh[string(token.TokenHash)]
+	if !ok || stored.UsedAt != nil {
+		return false, nil
+	}
+
+	var session *types.AccountSession
+	for _, s := range m.sessions {
+		if s.ID == stored.SessionID {
+			session = s
+		}
+	}
+	if session == nil {
+		return false, nil
+	}
+
+	if _, ok := m.refresh[string(newHash)]; ok {
+		return false, ErrDuplicate
+	}
+	if _, ok := m.sessions[accessToken]; ok {
+		return false, ErrDuplicate
+	}
+
+	stored.UsedAt = &now
+	m.refresh[string(newHash)] = &types.RefreshToken{
+		ID:        m.id(),
+		SessionID: stored.SessionID,
+		TokenHash: clone(newHash),
+		CreatedAt: now,
+	}
+
+	delete(m.sessions, session.AccessToken)
+	session.AccessToken = accessToken
+	session.ExpiresAt = expiresAt
+	session.LastSeenAt = now
+	m.sessions[accessToken] = session
+	return true, nil
+}
+
+/* -------------------- Push Subscriptions -------------------- */
+
+func (m *memoryStore) SavePushSubscription(ctx context.Context, sub *types.PushSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.pushSubs[sub.Endpoint]; ok {
+		sub.ID = existing.ID
+	} else {
+		sub.ID = m.id()
+	}
+
+	c := *sub
+	if sub.SessionID != nil {
+		id := *sub.SessionID
+		c.SessionID = &id
+	}
+	m.pushSubs[sub.Endpoint] = &c
+	return nil
+}
+
+func (m *memoryStore) GetPushSubscriptions(ctx context.Context, owner string) ([]types.PushSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []types.PushSubscription
+	for _, sub := range m.pushSubs {
+		if sub.Owner == owner {
+			subs = append(subs, *sub)
+		}
+	}
+	return subs, nil
+}
+
+func (m *memoryStore) DeletePushSubscription(ctx context.Context, endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.pushSubs, endpoint)
+	return nil
+}
+
+/* -------------------- Calendar Events -------------------- */
+
+func (m *memoryStore) SaveCalendarEvents(ctx context.Context, owner string, upserts []types.CalendarEvent, deletedIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range deletedIDs {
+		if m.events[id].owner == owner {
+			delete(m.events, id)
+		}
+	}
+
+	// Like the SQL upsert, an event of another account with the same ID is left alone
+	for _, ev := range upserts {
+		if stored, ok := m.events[ev.ID]; ok && stored.owner != owner {
+			continue
+		}
+		ev.Data = clone(ev.Data)
+		m.events[ev.ID] = ownedEvent{owner: owner, event: ev}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) GetCalendarEvents(ctx context.Context, owner string) ([]types.CalendarEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make([]types.CalendarEvent, 0)
+	for _, stored := range m.events {
+		if stored.owner != owner {
+			continue
+		}
+		ev := stored.event
+		ev.Data = clone(ev.Data)
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+/* -------------------- Shared State -------------------- */
+
+func (m *memoryStore) CreateSRPSession(ctx context.Context, sess *types.SavedSRPSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.srpSessions[sess.ID]; ok {
+		return ErrDuplicate
+	}
+	c := *sess
+	c.State = clone(sess.State)
+	m.srpSessions[sess.ID] = &c
+	return nil
+}
+
+func (m *memoryStore) GetSRPSession(ctx context.Context, id string) (*types.SavedSRPSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.srpSessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *sess
+	c.State = clone(sess.State)
+	return &c, nil
+}
+
+func (m *memoryStore) CountSRPAttempt(ctx context.Context, id string, maxAttempts int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.srpSessions[id]
+	if !ok || sess.Attempts >= maxAttempts {
+		return false, nil
+	}
+	sess.Attempts++
+	return true, nil
+}
+
+func (m *memoryStore) DeleteSRPSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.srpSessions, id)
+	return nil
+}
+
+func (m *memoryStore) DeleteSRPSessionsByEmail(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, sess := range m.srpSessions {
+		if strings.EqualFold(sess.Email, email) {
+			delete(m.srpSessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteSRPSessionsCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, sess := range m.srpSessions {
+		if sess.CreatedAt.Before(before) {
+			delete(m.srpSessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountSRPSessions(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.srpSessions), nil
+}
+
+func (m *memoryStore) AddRateLimitHit(ctx context.Context, client string, limit int, since, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, at := range m.rateHits[client] {
+		if !at.Before(since) {
+			count++
+		}
+	}
+	if count >= limit {
+		return false, nil
+	}
+
+	m.rateHits[client] = append(m.rateHits[client], now)
+	return true, nil
+}
+
+func (m *memoryStore) DeleteRateLimitHits(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for client, hits := range m.rateHits {
+		hits = slices.DeleteFunc(hits, func(at time.Time) bool { return at.Before(before) })
+		if len(hits) == 0 {
+			delete(m.rateHits, client)
+		} else {
+			m.rateHits[client] = hits
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountRateLimitClients(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.rateHits), nil
+}
+
+func (m *memoryStore) CreatePendingLogin(ctx context.Context, login *types.SavedPendingLogin) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pendingLogins[login.Token]; ok {
+		return ErrDuplicate
+	}
+	c := *login
+	c.WebAuthn = clone(login.WebAuthn)
+	m.pendingLogins[login.Token] = &c
+	return nil
+}
+
+func (m *memoryStore) GetPendingLogin(ctx context.Context, token string) (*types.SavedPendingLogin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.pendingLogins[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *login
+	c.WebAuthn = clone(login.WebAuthn)
+	return &c, nil
+}
+
+func (m *memoryStore) CountPendingLoginAttempt(ctx context.Context, token string, maxAttempts int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.pendingLogins[token]
+	if !ok || login.Attempts >= maxAttempts {
+		return false, nil
+	}
+	login.Attempts++
+	return true, nil
+}
+
+func (m *memoryStore) DeletePendingLogin(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.pendingLogins, token)
+	return nil
+}
+
+func (m *memoryStore) DeletePendingLoginsCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, login := range m.pendingLogins {
+		if login.CreatedAt.Before(before) {
+			delete(m.pendingLogins, token)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountPendingLogins(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.pendingLogins), nil
+}
+
+func (m *memoryStore) CreatePendingRecovery(ctx context.Context, recovery *types.PendingRecovery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.recoveries[recovery.Token]; ok {
+		return ErrDuplicate
+	}
+	c := *recovery
+	m.recoveries[recovery.Token] = &c
+	return nil
+}
+
+func (m *memoryStore) GetPendingRecovery(ctx context.Context, token string) (*types.PendingRecovery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recovery, ok := m.recoveries[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *recovery
+	return &c, nil
+}
+
+func (m *memoryStore) DeletePendingRecovery(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.recoveries, token)
+	return nil
+}
+
+func (m *memoryStore) DeletePendingRecoveriesCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, recovery := range m.recoveries {
+		if recovery.CreatedAt.Before(before) {
+			delete(m.recoveries, token)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) SaveWebAuthnSetup(ctx context.Context, setup *types.SavedWebAuthnSetup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *setup
+	c.Session = clone(setup.Session)
+	m.keySetups[setup.Owner] = &c
+	return nil
+}
+
+func (m *memoryStore) TakeWebAuthnSetup(ctx context.Context, owner string) (*types.SavedWebAuthnSetup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	setup, ok := m.keySetups[owner]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.keySetups, owner)
+	return setup, nil
+}
+
+func (m *memoryStore) DeleteWebAuthnSetupsCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for owner, setup := range m.keySetups {
+		if setup.CreatedAt.Before(before) {
+			delete(m.keySetups, owner)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetLoginFailures(ctx context.Context, email string) (*types.LoginFailures, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.loginFailures[email]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *failures
+	return &c, nil
+}
+
+func (m *memoryStore) AddLoginFailure(ctx context.Context, email string, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.loginFailures[email]
+	if !ok {
+		failures = &types.LoginFailures{Email: email, NextAttemptAt: now}
+		m.loginFailures[email] = failures
+	}
+	failures.Failures++
+	failures.LastFailureAt = now
+	return failures.Failures, nil
+}
+
+func (m *memoryStore) DelayLogins(ctx context.Context, email string, at time.Time, reset bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.loginFailures[email]
+	if !ok || !failures.NextAttemptAt.Before(at) {
+		return nil
+	}
+	failures.NextAttemptAt = at
+	if reset {
+		failures.Failures = 0
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteLoginFailures(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, email)
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredLoginFailures(ctx context.Context, lastFailureBefore, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for email, failures := range m.loginFailures {
+		if failures.LastFailureAt.Before(lastFailureBefore) && !failures.NextAttemptAt.After(now) {
+			delete(m.loginFailures, email)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountLoginFailures(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.loginFailures), nil
+}
+
+func (m *memoryStore) ClaimVerificationMail(ctx context.Context, owner string, since, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sentAt, ok := m.verificationMails[owner]; ok && sentAt.After(since) {
+		return false, nil
+	}
+	m.verificationMails[owner] = now
+	return true, nil
+}
+
+func (m *memoryStore) DeleteVerificationMailsSentBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for owner, sentAt := range m.verificationMails {
+		if sentAt.Before(before) {
+			delete(m.verificationMails, owner)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetCachedSubscriptionStatus(ctx context.Context, subscriptionID string, now time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cached, ok := m.subStatuses[subscriptionID]
+	if !ok || !now.Before(cached.expiresAt) {
+		return "", ErrNotFound
+	}
+	return cached.status, nil
+}
+
+func (m *memoryStore) CacheSubscriptionStatus(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subStatuses[subscriptionID] = cachedSubStatus{status: status, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *memoryStore) DeleteCachedSubscriptionStatus(ctx context.Context, subscriptionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subStatuses, subscriptionID)
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredSubscriptionStatuses(ctx context.Context, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, cached := range m.subStatuses {
+		if !now.Before(cached.expiresAt) {
+			delete(m.subStatuses, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountCachedSubscriptionStatuses(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.subStatuses), nil
+}
+
+/* -------------------- Schema Management -------------------- */
+
+// The in-memory store has no schema, so migrations are no-ops.
+
+func (m *memoryStore) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryStore) Rollback(ctx context.Context, target int) error {
+	return nil
+}
+
+func (m *memoryStore) SchemaVersion(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (m *memoryStore) LatestSchemaVersion() (int, error) {
+	return 0, nil
+}
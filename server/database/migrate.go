@@ -0,0 +1,282 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"acLife/utils"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrSchemaTooNew is returned when the database has migrations applied that this binary doesn't know about.
+var ErrSchemaTooNew = errors.New("database schema is newer than this server supports")
+
+// Migration is a single numbered schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations returns all embedded migrations for a dialect ordered by version.
+func Migrations(dialect string) ([]Migration, error) {
+	dir := "migrations/" + dialect
+
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", e.Name())
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", mig.Version)
+		}
+		migrations = append(migrations, *mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential, expected %d but found %d", i+1, mig.Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies all pending migrations.
+// It refuses to run against a schema newer than the latest embedded migration.
+func (s *sqlStore) Migrate(ctx context.Context) error {
+	migrations, err := Migrations(s.dialect.Name())
+	if err != nil {
+		return err
+	}
+
+	return s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		current, err := appliedVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if current > len(migrations) {
+			return fmt.Errorf("%w (database is at version %d, server supports up to %d)", ErrSchemaTooNew, current, len(migrations))
+		}
+
+		for _, mig := range migrations[current:] {
+			if err := execScript(ctx, conn, mig.Up); err != nil {
+				utils.LogError(ctx, "Migrate", fmt.Sprintf("up(%d_%s)", mig.Version, mig.Name), err)
+				return err
+			}
+
+			if _, err := conn.ExecContext(ctx,
+				s.db.Rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"),
+				mig.Version, mig.Name,
+			); err != nil {
+				utils.LogError(ctx, "Migrate", "Exec(schema_migrations)", err)
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Rollback reverts applied migrations until the schema is at the target version.
+func (s *sqlStore) Rollback(ctx context.Context, target int) error {
+	if target < 0 {
+		return fmt.Errorf("invalid target version %d", target)
+	}
+
+	migrations, err := Migrations(s.dialect.Name())
+	if err != nil {
+		return err
+	}
+
+	return s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		current, err := appliedVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if current > len(migrations) {
+			return fmt.Errorf("%w (database is at version %d, server supports up to %d)", ErrSchemaTooNew, current, len(migrations))
+		}
+
+		for v := current; v > target; v-- {
+			mig := migrations[v-1]
+
+			if err := execScript(ctx, conn, mig.Down); err != nil {
+				utils.LogError(ctx, "Rollback", fmt.Sprintf("down(%d_%s)", mig.Version, mig.Name), err)
+				return err
+			}
+
+			if _, err := conn.ExecContext(ctx,
+				s.db.Rebind("DELETE FROM schema_migrations WHERE version = ?"),
+				mig.Version,
+			); err != nil {
+				utils.LogError(ctx, "Rollback", "Exec(schema_migrations)", err)
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// SchemaVersion returns the highest migration version applied to the database.
+func (s *sqlStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// LatestSchemaVersion returns the version of the newest migration embedded in the binary.
+func (s *sqlStore) LatestSchemaVersion() (int, error) {
+	migrations, err := Migrations(s.dialect.Name())
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+/* -------------------- Helpers -------------------- */
+
+// withMigrationLock runs fn on a dedicated connection holding the dialect's migration lock,
+// so that only one instance migrates the schema at a time.
+func (s *sqlStore) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	unlock, err := s.dialect.Lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(err == nil); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`); err != nil {
+		utils.LogError(ctx, "withMigrationLock", "Exec(schema_migrations)", err)
+		return err
+	}
+
+	return fn(conn)
+}
+
+func appliedVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// execScript runs each statement of a migration file in order.
+// The driver doesn't allow multiple statements per Exec, so the script is split into statements first.
+func execScript(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, stmt := range splitStatements(script) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script on the semicolons outside of string literals, dropping "--" comments.
+// Each statement keeps its semicolon.
+func splitStatements(script string) []string {
+	var stmts []string
+	var current strings.Builder
+	inString := false
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+
+		switch {
+		case inString:
+			// A doubled quote closes and reopens the literal, so it needs no special case
+			inString = c != '\''
+		case c == '\'':
+			inString = true
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end - 1 // the newline itself is kept
+			continue
+		case c == ';':
+			current.WriteByte(c)
+			if stmt := strings.TrimSpace(current.String()); stmt != ";" {
+				stmts = append(stmts, stmt)
+			}
+			current.Reset()
+			continue
+		}
+
+		current.WriteByte(c)
+	}
+
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+
+	return stmts
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, dialect := range []string{"sqlite", "mysql", "postgres"} {
+		if _, err := Migrations(dialect); err != nil {
+			t.Errorf("%s: %v", dialect, err)
+		}
+	}
+}
+
+func TestMigrateAndRollback(t *testing.T) {
+	s, err := newSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	ctx := context.Background()
+
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expectVersion checks the applied version, and whether the users table exists along with it
+	expectVersion := func(step string, want int) {
+		t.Helper()
+
+		if version, err := s.SchemaVersion(ctx); err != nil || version != want {
+			t.Fatalf("%s: got version %d, %v, want %d", step, version, err, want)
+		}
+
+		_, err := s.db.ExecContext(ctx, "SELECT COUNT(*) FROM users")
+		if exists := err == nil; exists != (want > 0) {
+			t.Fatalf("%s: users table exists: %v (%v)", step, exists, err)
+		}
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion("migrate", latest)
+
+	// Nothing is pending anymore
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion("migrate again", latest)
+
+	if err := s.Rollback(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion("rollback", 0)
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion("migrate after rollback", latest)
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer server applied a migration this one doesn't know about
+	if _, err := s.exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", latest+1, "from_the_future"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Migrate(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("migrate: got %v, want %v", err, ErrSchemaTooNew)
+	}
+	if err := s.Rollback(ctx, 0); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("rollback: got %v, want %v", err, ErrSchemaTooNew)
+	}
+
+	if version, err := s.SchemaVersion(ctx); err != nil || version != latest+1 {
+		t.Errorf("version: got %d, %v, want %d", version, err, latest+1)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "one per line",
+			script: "CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);\n",
+			want:   []string{"CREATE TABLE a (id INT);", "CREATE TABLE b (id INT);"},
+		},
+		{
+			name:   "spanning lines",
+			script: "CREATE TABLE a (\n\tid INT\n);",
+			want:   []string{"CREATE TABLE a (\n\tid INT\n);"},
+		},
+		{
+			name:   "several on a line",
+			script: "DROP TABLE a; DROP TABLE b;",
+			want:   []string{"DROP TABLE a;", "DROP TABLE b;"},
+		},
+		{
+			name:   "semicolons in string literals",
+			script: "INSERT INTO a VALUES ('x;y');\nINSERT INTO a VALUES ('ends with;\n');\n",
+			want:   []string{"INSERT INTO a VALUES ('x;y');", "INSERT INTO a VALUES ('ends with;\n');"},
+		},
+		{
+			name:   "escaped quotes",
+			script: "INSERT INTO a VALUES ('it''s; fine');",
+			want:   []string{"INSERT INTO a VALUES ('it''s; fine');"},
+		},
+		{
+			name:   "comments",
+			script: "-- the user's table; with a note\nCREATE TABLE a (\n\tid INT -- primary; key\n);\n-- trailing",
+			want:   []string{"CREATE TABLE a (\n\tid INT \n);"},
+		},
+		{
+			name:   "dashes in string literals",
+			script: "INSERT INTO a VALUES ('--not a comment');",
+			want:   []string{"INSERT INTO a VALUES ('--not a comment');"},
+		},
+		{
+			name:   "missing final semicolon",
+			script: "DROP TABLE a;\nDROP TABLE b\n",
+			want:   []string{"DROP TABLE a;", "DROP TABLE b"},
+		},
+		{
+			name:   "empty statements",
+			script: ";\n;DROP TABLE a;;",
+			want:   []string{"DROP TABLE a;"},
+		},
+	} {
+		if got := splitStatements(tc.script); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
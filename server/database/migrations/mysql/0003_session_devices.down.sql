@@ -0,0 +1,9 @@
+ALTER TABLE push_subscriptions
+	DROP FOREIGN KEY fk_push_subscriptions_session,
+	DROP COLUMN session_id;
+
+ALTER TABLE account_sessions
+	DROP COLUMN last_seen_at,
+	DROP COLUMN ip,
+	DROP COLUMN user_agent,
+	DROP COLUMN device_name;
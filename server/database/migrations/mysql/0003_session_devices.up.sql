@@ -0,0 +1,12 @@
+ALTER TABLE account_sessions
+	ADD COLUMN device_name VARCHAR(100) NOT NULL DEFAULT '',
+	ADD COLUMN user_agent VARCHAR(512) NOT NULL DEFAULT '',
+	ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+	ADD COLUMN last_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE account_sessions SET last_seen_at = created_at;
+
+-- Subscriptions registered by a session are removed with it
+ALTER TABLE push_subscriptions
+	ADD COLUMN session_id INT NULL,
+	ADD CONSTRAINT fk_push_subscriptions_session FOREIGN KEY (session_id) REFERENCES account_sessions(id) ON DELETE CASCADE;
@@ -0,0 +1,13 @@
+ALTER TABLE users
+	ADD COLUMN totp_secret VARCHAR(64) NULL,
+	ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD COLUMN totp_last_step BIGINT NULL;
+
+-- Hashes of the unused backup codes, each one is deleted when used
+CREATE TABLE backup_codes (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	owner CHAR(36) NOT NULL,
+	code_hash BINARY(32) NOT NULL,
+	FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
+	INDEX idx_backup_codes_owner (owner)
+);
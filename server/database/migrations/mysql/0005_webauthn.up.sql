@@ -0,0 +1,17 @@
+CREATE TABLE webauthn_credentials (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	owner CHAR(36) NOT NULL,
+	name VARCHAR(100) NOT NULL,
+	credential_id VARBINARY(1023) NOT NULL UNIQUE,
+	public_key BLOB NOT NULL,
+	attestation_type VARCHAR(32) NOT NULL,
+	transports VARCHAR(255) NOT NULL,
+	aaguid VARBINARY(16) NOT NULL,
+	sign_count BIGINT NOT NULL,
+	backup_eligible BOOLEAN NOT NULL,
+	backup_state BOOLEAN NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME NULL,
+	FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
+	INDEX idx_webauthn_credentials_owner (owner)
+);
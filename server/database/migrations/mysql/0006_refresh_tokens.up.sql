@@ -0,0 +1,10 @@
+-- Refresh tokens of a session are one family: replaying a used one revokes the session
+CREATE TABLE refresh_tokens (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	session_id INT NOT NULL,
+	token_hash VARBINARY(32) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_at DATETIME NULL,
+	FOREIGN KEY (session_id) REFERENCES account_sessions(id) ON DELETE CASCADE,
+	INDEX idx_refresh_tokens_session (session_id)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE users
+	DROP COLUMN recovery_key,
+	DROP COLUMN recovery_verifier,
+	DROP COLUMN recovery_srp_salt;
@@ -0,0 +1,5 @@
+-- SRP verifier of the recovery code, and the master key wrapped under it
+ALTER TABLE users
+	ADD COLUMN recovery_srp_salt VARBINARY(16) NULL,
+	ADD COLUMN recovery_verifier VARBINARY(512) NULL,
+	ADD COLUMN recovery_key VARBINARY(256) NULL;
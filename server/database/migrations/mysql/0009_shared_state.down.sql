@@ -0,0 +1,3 @@
+DROP TABLE subscription_cache;
+DROP TABLE rate_limit_hits;
+DROP TABLE srp_sessions;
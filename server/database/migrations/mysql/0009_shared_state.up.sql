@@ -0,0 +1,29 @@
+-- Short-lived state, stored here with STATE_STORE=database so that several server instances share it
+
+-- SRP handshakes between their start and the client's proof, with the serialized server state
+CREATE TABLE srp_sessions (
+	id VARCHAR(64) PRIMARY KEY,
+	email VARCHAR(255) NOT NULL,
+	recovery BOOLEAN NOT NULL,
+	state BLOB NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	INDEX idx_srp_sessions_email (email),
+	INDEX idx_srp_sessions_created (created_at)
+);
+
+-- One row per rate limited request, in unix milliseconds since windows can be shorter than a second
+CREATE TABLE rate_limit_hits (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	client VARCHAR(64) NOT NULL,
+	hit_at BIGINT NOT NULL,
+	INDEX idx_rate_limit_hits_client (client, hit_at),
+	INDEX idx_rate_limit_hits_time (hit_at)
+);
+
+-- Subscription statuses recently fetched from Stripe
+CREATE TABLE subscription_cache (
+	subscription_id VARCHAR(255) PRIMARY KEY,
+	status VARCHAR(50) NOT NULL,
+	expires_at DATETIME NOT NULL
+);
@@ -0,0 +1,10 @@
+-- Address changes waiting for the emailed link, with the verifier bound to the new address
+CREATE TABLE email_changes (
+	owner CHAR(36) PRIMARY KEY,
+	email VARCHAR(255) NOT NULL,
+	srp_salt BINARY(16) NOT NULL,
+	verifier VARBINARY(512) NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
+	INDEX idx_email_changes_created_at (created_at)
+);
@@ -0,0 +1,13 @@
+-- Invite codes for invite-only registration, stored hashed. Admins create them without a creator
+CREATE TABLE invites (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	code_hash VARBINARY(32) NOT NULL UNIQUE,
+	creator CHAR(36) NULL,
+	email VARCHAR(255) NULL,
+	max_uses INT NOT NULL,
+	uses INT NOT NULL DEFAULT 0,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (creator) REFERENCES users(uuid) ON DELETE CASCADE,
+	INDEX idx_invites_creator (creator)
+);
@@ -0,0 +1 @@
+DROP TABLE known_devices;
@@ -0,0 +1,10 @@
+-- Devices each account logged in from, by a hash of the user agent and the address's network
+CREATE TABLE known_devices (
+	owner CHAR(36) NOT NULL,
+	fingerprint BINARY(32) NOT NULL,
+	first_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (owner, fingerprint),
+	FOREIGN KEY (owner) REFERENCES users(uuid) ON DELETE CASCADE,
+	INDEX idx_known_devices_last_seen_at (last_seen_at)
+);
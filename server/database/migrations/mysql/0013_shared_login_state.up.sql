@@ -0,0 +1,45 @@
+-- More short-lived state, stored here with STATE_STORE=database so that logins can span several server instances
+
+-- Logins that passed the SRP proof and still need a second factor, with the WebAuthn assertion as JSON
+CREATE TABLE pending_logins (
+	token VARCHAR(64) PRIMARY KEY,
+	owner CHAR(36) NOT NULL,
+	device_name VARCHAR(100) NOT NULL,
+	return_token BOOLEAN NOT NULL,
+	webauthn BLOB NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	INDEX idx_pending_logins_created (created_at)
+);
+
+-- Recoveries that proved the recovery code and wait for the new password
+CREATE TABLE pending_recoveries (
+	token VARCHAR(64) PRIMARY KEY,
+	owner CHAR(36) NOT NULL,
+	created_at DATETIME NOT NULL,
+	INDEX idx_pending_recoveries_created (created_at)
+);
+
+-- Security key registrations waiting for the authenticator, with the WebAuthn session as JSON
+CREATE TABLE webauthn_setups (
+	owner CHAR(36) PRIMARY KEY,
+	session BLOB NOT NULL,
+	created_at DATETIME NOT NULL,
+	INDEX idx_webauthn_setups_created (created_at)
+);
+
+-- Failed proofs per account, by lowercased email
+CREATE TABLE login_failures (
+	email VARCHAR(255) PRIMARY KEY,
+	failures INT NOT NULL,
+	last_failure_at DATETIME NOT NULL,
+	next_attempt_at DATETIME NOT NULL,
+	INDEX idx_login_failures_last (last_failure_at)
+);
+
+-- When a verification email was last resent to each account
+CREATE TABLE verification_mails (
+	owner CHAR(36) PRIMARY KEY,
+	sent_at DATETIME NOT NULL,
+	INDEX idx_verification_mails_sent (sent_at)
+);
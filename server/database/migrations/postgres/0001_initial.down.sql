@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS calendar_events;
+DROP TABLE IF EXISTS push_subscriptions;
+DROP TABLE IF EXISTS account_sessions;
+DROP TABLE IF EXISTS users;
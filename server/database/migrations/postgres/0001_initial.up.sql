@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	uuid UUID NOT NULL DEFAULT gen_random_uuid() UNIQUE,
+	email VARCHAR(255) NOT NULL,
+	salt BYTEA NOT NULL,
+	srp_salt BYTEA NOT NULL,
+	verifier BYTEA NOT NULL,
+	challenge BYTEA NOT NULL,
+	stripe_customer_id VARCHAR(255),
+	stripe_subscription_id VARCHAR(255) UNIQUE,
+	subscription_status VARCHAR(50)
+);
+
+-- emails are unique regardless of case, matching the MySQL collation
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (LOWER(email));
+
+CREATE TABLE IF NOT EXISTS account_sessions (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	access_token VARCHAR(64) NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	endpoint VARCHAR(1024) NOT NULL UNIQUE,
+	p256dh VARCHAR(255) NOT NULL,
+	auth VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS calendar_events (
+	id UUID NOT NULL PRIMARY KEY,
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	data BYTEA NOT NULL,
+	updated_at TIMESTAMPTZ(3) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_events_owner ON calendar_events (owner);
@@ -0,0 +1,11 @@
+ALTER TABLE account_sessions
+	ADD COLUMN device_name VARCHAR(100) NOT NULL DEFAULT '',
+	ADD COLUMN user_agent VARCHAR(512) NOT NULL DEFAULT '',
+	ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+	ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE account_sessions SET last_seen_at = created_at;
+
+-- Subscriptions registered by a session are removed with it
+ALTER TABLE push_subscriptions
+	ADD COLUMN session_id INTEGER REFERENCES account_sessions(id) ON DELETE CASCADE;
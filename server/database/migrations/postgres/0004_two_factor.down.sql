@@ -0,0 +1,6 @@
+DROP TABLE backup_codes;
+
+ALTER TABLE users
+	DROP COLUMN totp_last_step,
+	DROP COLUMN totp_enabled,
+	DROP COLUMN totp_secret;
@@ -0,0 +1,13 @@
+ALTER TABLE users
+	ADD COLUMN totp_secret VARCHAR(64),
+	ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD COLUMN totp_last_step BIGINT;
+
+-- Hashes of the unused backup codes, each one is deleted when used
+CREATE TABLE backup_codes (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	code_hash BYTEA NOT NULL
+);
+
+CREATE INDEX idx_backup_codes_owner ON backup_codes (owner);
@@ -0,0 +1,17 @@
+CREATE TABLE webauthn_credentials (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	name VARCHAR(100) NOT NULL,
+	credential_id BYTEA NOT NULL UNIQUE,
+	public_key BYTEA NOT NULL,
+	attestation_type VARCHAR(32) NOT NULL,
+	transports VARCHAR(255) NOT NULL,
+	aaguid BYTEA NOT NULL,
+	sign_count BIGINT NOT NULL,
+	backup_eligible BOOLEAN NOT NULL,
+	backup_state BOOLEAN NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_webauthn_credentials_owner ON webauthn_credentials (owner);
@@ -0,0 +1,5 @@
+-- SRP verifier of the recovery code, and the master key wrapped under it
+ALTER TABLE users
+	ADD COLUMN recovery_srp_salt BYTEA,
+	ADD COLUMN recovery_verifier BYTEA,
+	ADD COLUMN recovery_key BYTEA;
@@ -0,0 +1,31 @@
+-- Short-lived state, stored here with STATE_STORE=database so that several server instances share it
+
+-- SRP handshakes between their start and the client's proof, with the serialized server state
+CREATE TABLE srp_sessions (
+	id VARCHAR(64) PRIMARY KEY,
+	email VARCHAR(255) NOT NULL,
+	recovery BOOLEAN NOT NULL,
+	state BYTEA NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_srp_sessions_email ON srp_sessions (email);
+CREATE INDEX idx_srp_sessions_created ON srp_sessions (created_at);
+
+-- One row per rate limited request, in unix milliseconds since windows can be shorter than a second
+CREATE TABLE rate_limit_hits (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	client VARCHAR(64) NOT NULL,
+	hit_at BIGINT NOT NULL
+);
+
+CREATE INDEX idx_rate_limit_hits_client ON rate_limit_hits (client, hit_at);
+CREATE INDEX idx_rate_limit_hits_time ON rate_limit_hits (hit_at);
+
+-- Subscription statuses recently fetched from Stripe
+CREATE TABLE subscription_cache (
+	subscription_id VARCHAR(255) PRIMARY KEY,
+	status VARCHAR(50) NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
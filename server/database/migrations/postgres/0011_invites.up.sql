@@ -0,0 +1,13 @@
+-- Invite codes for invite-only registration, stored hashed. Admins create them without a creator
+CREATE TABLE invites (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	code_hash BYTEA NOT NULL UNIQUE,
+	creator UUID REFERENCES users(uuid) ON DELETE CASCADE,
+	email VARCHAR(255),
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_invites_creator ON invites (creator);
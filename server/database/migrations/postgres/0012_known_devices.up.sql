@@ -0,0 +1,10 @@
+-- Devices each account logged in from, by a hash of the user agent and the address's network
+CREATE TABLE known_devices (
+	owner UUID NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	fingerprint BYTEA NOT NULL,
+	first_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (owner, fingerprint)
+);
+
+CREATE INDEX idx_known_devices_last_seen_at ON known_devices (last_seen_at);
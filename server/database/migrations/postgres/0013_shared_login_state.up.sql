@@ -0,0 +1,50 @@
+-- More short-lived state, stored here with STATE_STORE=database so that logins can span several server instances
+
+-- Logins that passed the SRP proof and still need a second factor, with the WebAuthn assertion as JSON
+CREATE TABLE pending_logins (
+	token VARCHAR(64) PRIMARY KEY,
+	owner UUID NOT NULL,
+	device_name VARCHAR(100) NOT NULL,
+	return_token BOOLEAN NOT NULL,
+	webauthn BYTEA,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_pending_logins_created ON pending_logins (created_at);
+
+-- Recoveries that proved the recovery code and wait for the new password
+CREATE TABLE pending_recoveries (
+	token VARCHAR(64) PRIMARY KEY,
+	owner UUID NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_pending_recoveries_created ON pending_recoveries (created_at);
+
+-- Security key registrations waiting for the authenticator, with the WebAuthn session as JSON
+CREATE TABLE webauthn_setups (
+	owner UUID PRIMARY KEY,
+	session BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_webauthn_setups_created ON webauthn_setups (created_at);
+
+-- Failed proofs per account, by lowercased email
+CREATE TABLE login_failures (
+	email VARCHAR(255) PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure_at TIMESTAMPTZ NOT NULL,
+	next_attempt_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_login_failures_last ON login_failures (last_failure_at);
+
+-- When a verification email was last resent to each account
+CREATE TABLE verification_mails (
+	owner UUID PRIMARY KEY,
+	sent_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_verification_mails_sent ON verification_mails (sent_at);
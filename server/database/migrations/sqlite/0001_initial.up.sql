@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uuid TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	salt BLOB NOT NULL,
+	srp_salt BLOB NOT NULL,
+	verifier BLOB NOT NULL,
+	challenge BLOB NOT NULL,
+	stripe_customer_id TEXT,
+	stripe_subscription_id TEXT UNIQUE,
+	subscription_status TEXT
+);
+
+CREATE TABLE IF NOT EXISTS account_sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	access_token TEXT NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS calendar_events (
+	id TEXT NOT NULL PRIMARY KEY,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	data BLOB NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_events_owner ON calendar_events (owner);
@@ -0,0 +1,19 @@
+-- SQLite can't drop a column used by a foreign key, so the table is rebuilt
+CREATE TABLE push_subscriptions_old (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL
+);
+
+INSERT INTO push_subscriptions_old (id, owner, endpoint, p256dh, auth)
+SELECT id, owner, endpoint, p256dh, auth FROM push_subscriptions;
+
+DROP TABLE push_subscriptions;
+ALTER TABLE push_subscriptions_old RENAME TO push_subscriptions;
+
+ALTER TABLE account_sessions DROP COLUMN last_seen_at;
+ALTER TABLE account_sessions DROP COLUMN ip;
+ALTER TABLE account_sessions DROP COLUMN user_agent;
+ALTER TABLE account_sessions DROP COLUMN device_name;
@@ -0,0 +1,9 @@
+ALTER TABLE account_sessions ADD COLUMN device_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE account_sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE account_sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE account_sessions ADD COLUMN last_seen_at DATETIME;
+
+UPDATE account_sessions SET last_seen_at = created_at;
+
+-- Subscriptions registered by a session are removed with it
+ALTER TABLE push_subscriptions ADD COLUMN session_id INTEGER REFERENCES account_sessions(id) ON DELETE CASCADE;
@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER;
+
+-- Hashes of the unused backup codes, each one is deleted when used
+CREATE TABLE backup_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	code_hash BLOB NOT NULL
+);
+
+CREATE INDEX idx_backup_codes_owner ON backup_codes (owner);
@@ -0,0 +1,17 @@
+CREATE TABLE webauthn_credentials (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL REFERENCES users(uuid) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	credential_id BLOB NOT NULL UNIQUE,
+	public_key BLOB NOT NULL,
+	attestation_type TEXT NOT NULL,
+	transports TEXT NOT NULL,
+	aaguid BLOB NOT NULL,
+	sign_count INTEGER NOT NULL,
+	backup_eligible BOOLEAN NOT NULL,
+	backup_state BOOLEAN NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME
+);
+
+CREATE INDEX idx_webauthn_credentials_owner ON webauthn_credentials (owner);
@@ -0,0 +1,10 @@
+-- Refresh tokens of a session are one family: replaying a used one revokes the session
+CREATE TABLE refresh_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id INTEGER NOT NULL REFERENCES account_sessions(id) ON DELETE CASCADE,
+	token_hash BLOB NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_at DATETIME
+);
+
+CREATE INDEX idx_refresh_tokens_session ON refresh_tokens (session_id);
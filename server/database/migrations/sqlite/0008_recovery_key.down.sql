@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN recovery_key;
+ALTER TABLE users DROP COLUMN recovery_verifier;
+ALTER TABLE users DROP COLUMN recovery_srp_salt;
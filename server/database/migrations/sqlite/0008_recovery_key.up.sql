@@ -0,0 +1,4 @@
+-- SRP verifier of the recovery code, and the master key wrapped under it
+ALTER TABLE users ADD COLUMN recovery_srp_salt BLOB;
+ALTER TABLE users ADD COLUMN recovery_verifier BLOB;
+ALTER TABLE users ADD COLUMN recovery_key BLOB;
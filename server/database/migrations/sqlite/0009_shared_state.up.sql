@@ -0,0 +1,31 @@
+-- Short-lived state, stored here with STATE_STORE=database so that several server instances share it
+
+-- SRP handshakes between their start and the client's proof, with the serialized server state
+CREATE TABLE srp_sessions (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	recovery BOOLEAN NOT NULL,
+	state BLOB NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL
+);
+
+CREATE INDEX idx_srp_sessions_email ON srp_sessions (email);
+CREATE INDEX idx_srp_sessions_created ON srp_sessions (created_at);
+
+-- One row per rate limited request, in unix milliseconds since windows can be shorter than a second
+CREATE TABLE rate_limit_hits (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client TEXT NOT NULL,
+	hit_at BIGINT NOT NULL
+);
+
+CREATE INDEX idx_rate_limit_hits_client ON rate_limit_hits (client, hit_at);
+CREATE INDEX idx_rate_limit_hits_time ON rate_limit_hits (hit_at);
+
+-- Subscription statuses recently fetched from Stripe
+CREATE TABLE subscription_cache (
+	subscription_id TEXT PRIMARY KEY,
+	status TEXT NOT NULL,
+	expires_at DATETIME NOT NULL
+);
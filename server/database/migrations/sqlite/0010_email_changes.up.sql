@@ -0,0 +1,10 @@
+-- Address changes waiting for the emailed link, with the verifier bound to the new address
+CREATE TABLE email_changes (
+	owner TEXT PRIMARY KEY REFERENCES users(uuid) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	srp_salt BLOB NOT NULL,
+	verifier BLOB NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_changes_created_at ON email_changes (created_at);
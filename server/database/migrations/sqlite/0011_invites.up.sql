@@ -0,0 +1,13 @@
+-- Invite codes for invite-only registration, stored hashed. Admins create them without a creator
+CREATE TABLE invites (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_hash BLOB NOT NULL UNIQUE,
+	creator TEXT REFERENCES users(uuid) ON DELETE CASCADE,
+	email TEXT COLLATE NOCASE,
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_invites_creator ON invites (creator);
@@ -0,0 +1,5 @@
+DROP TABLE verification_mails;
+DROP TABLE login_failures;
+DROP TABLE webauthn_setups;
+DROP TABLE pending_recoveries;
+DROP TABLE pending_logins;
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"acLife/config"
+	"acLife/constants"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const mysqlMigrationLock = "aclife_schema_migrations"
+
+type mysqlDialect struct{}
+
+func openMySQL(cfg config.Database) (*sqlStore, error) {
+	dsn := fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?parseTime=true&charset=utf8mb4",
+		cfg.User,
+		cfg.Password,
+		cfg.Host,
+		cfg.Port,
+		cfg.Name,
+	)
+
+	db, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(constants.DBMaxOpenConns)
+	db.SetMaxIdleConns(constants.DBMaxIdleConns)
+	db.SetConnMaxLifetime(constants.DBConnMaxLifetime)
+
+	return &sqlStore{db: db, dialect: mysqlDialect{}}, nil
+}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Upsert(key string, cols ...string) string {
+	sets := make([]string, len(cols))
+	for i, col := range cols {
+		sets[i] = col + " = VALUES(" + col + ")"
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// UpsertIf keeps the current value of each column unless the guard matches, as MySQL has no WHERE on upserts.
+// The guard itself is never assigned, so every column compares against the row as it was.
+func (mysqlDialect) UpsertIf(table, key, guard string, cols ...string) string {
+	sets := make([]string, len(cols))
+	for i, col := range cols {
+		sets[i] = col + " = IF(" + guard + " = VALUES(" + guard + "), VALUES(" + col + "), " + col + ")"
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// EqualFold relies on the default collation, which ignores case.
+func (mysqlDialect) EqualFold(col string) string {
+	return col + " = ?"
+}
+
+func (mysqlDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+// Lock takes a named lock, which is held for the lifetime of the connection.
+// MySQL commits DDL implicitly, so ok has no effect.
+func (mysqlDialect) Lock(ctx context.Context, conn *sql.Conn) (func(ok bool) error, error) {
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx,
+		"SELECT GET_LOCK(?, ?)",
+		mysqlMigrationLock, int(constants.DBMigrationLockWait.Seconds()),
+	).Scan(&acquired); err != nil {
+		return nil, err
+	}
+
+	if acquired.Int64 != 1 {
+		return nil, errors.New("timed out waiting for the migration lock")
+	}
+
+	return func(bool) error {
+		// use a fresh context so the lock is released even if ctx expired
+		_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", mysqlMigrationLock)
+		return err
+	}, nil
+}
+
+func isMySQLDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	}
+	return strings.Contains(err.Error(), "Duplicate entry")
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"acLife/config"
+	"acLife/constants"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// postgresMigrationLock is the advisory lock key held while migrating.
+const postgresMigrationLock = 0x61634c696665 // "acLife"
+
+type postgresDialect struct{}
+
+func openPostgres(cfg config.Database) (*sqlStore, error) {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.User, cfg.Password),
+		Host:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Path:     "/" + cfg.Name,
+		RawQuery: url.Values{"sslmode": {cfg.SSLMode}}.Encode(),
+	}
+
+	db, err := sqlx.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(constants.DBMaxOpenConns)
+	db.SetMaxIdleConns(constants.DBMaxIdleConns)
+	db.SetConnMaxLifetime(constants.DBConnMaxLifetime)
+
+	return &sqlStore{db: db, dialect: postgresDialect{}}, nil
+}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Upsert(key string, cols ...string) string {
+	return upsertOnConflict(key, cols...)
+}
+
+func (postgresDialect) UpsertIf(table, key, guard string, cols ...string) string {
+	return upsertOnConflictIf(table, key, guard, cols...)
+}
+
+// EqualFold lowers both sides, which the unique index on LOWER(email) covers.
+func (postgresDialect) EqualFold(col string) string {
+	return "LOWER(" + col + ") = LOWER(?)"
+}
+
+func (postgresDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+// Lock takes a transaction-scoped advisory lock.
+// DDL is transactional in PostgreSQL, so the whole migration is committed or rolled back together.
+func (postgresDialect) Lock(ctx context.Context, conn *sql.Conn) (func(ok bool) error, error) {
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return nil, err
+	}
+
+	rollback := func() { _, _ = conn.ExecContext(context.Background(), "ROLLBACK") }
+
+	if _, err := conn.ExecContext(ctx,
+		fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", constants.DBMigrationLockWait.Milliseconds()),
+	); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	return func(ok bool) error {
+		stmt := "ROLLBACK"
+		if ok {
+			stmt = "COMMIT"
+		}
+		_, err := conn.ExecContext(context.Background(), stmt)
+		return err
+	}, nil
+}
+
+func isPostgresDuplicate(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
@@ -0,0 +1,1276 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dialect contains the parts of a SQL backend that differ between database engines.
+type dialect interface {
+	// Name identifies the dialect and the directory its migrations are stored in.
+	Name() string
+
+	// Upsert returns the clause appended to an INSERT so that rows conflicting on key get cols overwritten.
+	Upsert(key string, cols ...string) string
+
+	// UpsertIf is Upsert, but leaves the conflicting row of table alone unless its guard column equals the new one.
+	UpsertIf(table, key, guard string, cols ...string) string
+
+	// EqualFold returns a condition matching col against the next parameter regardless of case.
+	EqualFold(col string) string
+
+	// ForUpdate returns the clause appended to a SELECT in a transaction to lock the selected rows until it ends.
+	ForUpdate() string
+
+	// Lock acquires an exclusive schema migration lock on conn.
+	// The returned function releases it, keeping the changes only if ok is true where the engine allows it.
+	Lock(ctx context.Context, conn *sql.Conn) (unlock func(ok bool) error, err error)
+}
+
+// upsertOnConflict builds the standard SQL upsert clause shared by SQLite and PostgreSQL.
+func upsertOnConflict(key string, cols ...string) string {
+	sets := make([]string, len(cols))
+	for i, col := range cols {
+		sets[i] = col + " = excluded." + col
+	}
+	return " ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// upsertOnConflictIf is upsertOnConflict restricted to rows whose guard column matches, shared by SQLite and PostgreSQL.
+func upsertOnConflictIf(table, key, guard string, cols ...string) string {
+	return upsertOnConflict(key, cols...) + " WHERE " + table + "." + guard + " = excluded." + guard
+}
+
+// sqlStore implements Store on top of a SQL database.
+// Queries are written with ? placeholders and rebound for the driver.
+type sqlStore struct {
+	db      *sqlx.DB
+	dialect dialect
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.db.Rebind(query), args...)
+}
+
+func (s *sqlStore) get(ctx context.Context, dest any, query string, args ...any) error {
+	err := s.db.GetContext(ctx, dest, s.db.Rebind(query), args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// insertReturningID runs insert with db, the store's database or a transaction, and returns the ID of the new row.
+// The row is looked up by its unique key column rather than relying on driver support for LastInsertId,
+// which PostgreSQL lacks.
+func insertReturningID(ctx context.Context, db sqlx.ExtContext, table, key string, value any, insert string, args ...any) (int, error) {
+	if _, err := db.ExecContext(ctx, db.Rebind(insert), args...); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err := sqlx.GetContext(ctx, db, &id, db.Rebind("SELECT id FROM "+table+" WHERE "+key+" = ?"), value)
+	return id, err
+}
+
+/* -------------------- Shared State -------------------- */
+
+func (s *sqlStore) CreateSRPSession(ctx context.Context, sess *types.SavedSRPSession) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO srp_sessions (id, email, recovery, state, attempts, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		sess.ID, sess.Email, sess.Recovery, sess.State, sess.Attempts, sess.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) GetSRPSession(ctx context.Context, id string) (*types.SavedSRPSession, error) {
+	sess := &types.SavedSRPSession{}
+	if err := s.get(ctx, sess, `
+		SELECT id, email, recovery, state, attempts, created_at
+		FROM srp_sessions
+		WHERE id = ?`,
+		id,
+	); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *sqlStore) CountSRPAttempt(ctx context.Context, id string, maxAttempts int) (bool, error) {
+	res, err := s.exec(ctx,
+		"UPDATE srp_sessions SET attempts = attempts + 1 WHERE id = ? AND attempts < ?",
+		id, maxAttempts,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) DeleteSRPSession(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, "DELETE FROM srp_sessions WHERE id = ?", id)
+	return err
+}
+
+func (s *sqlStore) DeleteSRPSessionsByEmail(ctx context.Context, email string) error {
+	_, err := s.exec(ctx, "DELETE FROM srp_sessions WHERE LOWER(email) = LOWER(?)", email)
+	return err
+}
+
+func (s *sqlStore) DeleteSRPSessionsCreatedBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM srp_sessions WHERE created_at < ?", before.UTC())
+	return err
+}
+
+func (s *sqlStore) CountSRPSessions(ctx context.Context) (int, error) {
+	var n int
+	err := s.get(ctx, &n, "SELECT COUNT(*) FROM srp_sessions")
+	return n, err
+}
+
+func (s *sqlStore) AddRateLimitHit(ctx context.Context, client string, limit int, since, now time.Time) (bool, error) {
+	// Record the hit before counting, so that concurrent requests always see each other's hits.
+	// Counting first would let every request that counted before the others inserted through.
+	if _, err := s.exec(ctx,
+		"INSERT INTO rate_limit_hits (client, hit_at) VALUES (?, ?)",
+		client, now.UnixMilli(),
+	); err != nil {
+		return false, err
+	}
+
+	var count int
+	if err := s.get(ctx, &count,
+		"SELECT COUNT(*) FROM rate_limit_hits WHERE client = ? AND hit_at >= ?",
+		client, since.UnixMilli(),
+	); err != nil {
+		return false, err
+	}
+	if count <= limit {
+		return true, nil
+	}
+
+	// Over the limit, take the hit back so rejected requests don't count.
+	// Hits of the client at the same time are alike, any of them will do.
+	// The derived table lets MySQL select from the table it deletes from.
+	if _, err := s.exec(ctx, `
+		DELETE FROM rate_limit_hits
+		WHERE id = (SELECT id FROM (SELECT MAX(id) AS id FROM rate_limit_hits WHERE client = ? AND hit_at = ?) AS newest)`,
+		client, now.UnixMilli(),
+	); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *sqlStore) DeleteRateLimitHits(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM rate_limit_hits WHERE hit_at < ?", before.UnixMilli())
+	return err
+}
+
+func (s *sqlStore) CountRateLimitClients(ctx context.Context) (int, error) {
+	var n int
+	err := s.get(ctx, &n, "SELECT COUNT(DISTINCT client) FROM rate_limit_hits")
+	return n, err
+}
+
+func (s *sqlStore) CreatePendingLogin(ctx context.Context, login *types.SavedPendingLogin) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO pending_logins (token, owner, device_name, return_token, webauthn, attempts, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		login.Token, login.Owner, login.DeviceName, login.ReturnToken, login.WebAuthn, login.Attempts, login.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) GetPendingLogin(ctx context.Context, token string) (*types.SavedPendingLogin, error) {
+	login := &types.SavedPendingLogin{}
+	if err := s.get(ctx, login, `
+		SELECT token, owner, device_name, return_token, webauthn, attempts, created_at
+		FROM pending_logins
+		WHERE token = ?`,
+		token,
+	); err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+func (s *sqlStore) CountPendingLoginAttempt(ctx context.Context, token string, maxAttempts int) (bool, error) {
+	res, err := s.exec(ctx,
+		"UPDATE pending_logins SET attempts = attempts + 1 WHERE token = ? AND attempts < ?",
+		token, maxAttempts,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) DeletePendingLogin(ctx context.Context, token string) error {
+	_, err := s.exec(ctx, "DELETE FROM pending_logins WHERE token = ?", token)
+	return err
+}
+
+func (s *sqlStore) DeletePendingLoginsCreatedBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM pending_logins WHERE created_at < ?", before.UTC())
+	return err
+}
+
+func (s *sqlStore) CountPendingLogins(ctx context.Context) (int, error) {
+	var n int
+	err := s.get(ctx, &n, "SELECT COUNT(*) FROM pending_logins")
+	return n, err
+}
+
+func (s *sqlStore) CreatePendingRecovery(ctx context.Context, recovery *types.PendingRecovery) error {
+	_, err := s.exec(ctx,
+		"INSERT INTO pending_recoveries (token, owner, created_at) VALUES (?, ?, ?)",
+		recovery.Token, recovery.Owner, recovery.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) GetPendingRecovery(ctx context.Context, token string) (*types.PendingRecovery, error) {
+	recovery := &types.PendingRecovery{}
+	if err := s.get(ctx, recovery, "SELECT token, owner, created_at FROM pending_recoveries WHERE token = ?", token); err != nil {
+		return nil, err
+	}
+	return recovery, nil
+}
+
+func (s *sqlStore) DeletePendingRecovery(ctx context.Context, token string) error {
+	_, err := s.exec(ctx, "DELETE FROM pending_recoveries WHERE token = ?", token)
+	return err
+}
+
+func (s *sqlStore) DeletePendingRecoveriesCreatedBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM pending_recoveries WHERE created_at < ?", before.UTC())
+	return err
+}
+
+func (s *sqlStore) SaveWebAuthnSetup(ctx context.Context, setup *types.SavedWebAuthnSetup) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO webauthn_setups (owner, session, created_at)
+		VALUES (?, ?, ?)`+
+		s.dialect.Upsert("owner", "session", "created_at"),
+		setup.Owner, setup.Session, setup.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) TakeWebAuthnSetup(ctx context.Context, owner string) (*types.SavedWebAuthnSetup, error) {
+	setup := &types.SavedWebAuthnSetup{}
+	if err := s.get(ctx, setup, "SELECT owner, session, created_at FROM webauthn_setups WHERE owner = ?", owner); err != nil {
+		return nil, err
+	}
+
+	// Only the call that deletes the row gets it, a new registration started in between is kept
+	res, err := s.exec(ctx, "DELETE FROM webauthn_setups WHERE owner = ? AND session = ?", owner, setup.Session)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	return setup, nil
+}
+
+func (s *sqlStore) DeleteWebAuthnSetupsCreatedBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM webauthn_setups WHERE created_at < ?", before.UTC())
+	return err
+}
+
+func (s *sqlStore) GetLoginFailures(ctx context.Context, email string) (*types.LoginFailures, error) {
+	failures := &types.LoginFailures{}
+	if err := s.get(ctx, failures, `
+		SELECT email, failures, last_failure_at, next_attempt_at
+		FROM login_failures
+		WHERE email = ?`,
+		email,
+	); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+func (s *sqlStore) AddLoginFailure(ctx context.Context, email string, now time.Time) (int, error) {
+	failures, err := s.addLoginFailure(ctx, email, now)
+	if IsDuplicateEntry(err) {
+		// The account's first failure was recorded concurrently, count this one on top
+		return s.addLoginFailure(ctx, email, now)
+	}
+	return failures, err
+}
+
+func (s *sqlStore) addLoginFailure(ctx context.Context, email string, now time.Time) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	// The update locks the row, so concurrent failures are counted one after the other
+	res, err := tx.ExecContext(ctx, tx.Rebind(
+		"UPDATE login_failures SET failures = failures + 1, last_failure_at = ? WHERE email = ?"),
+		now.UTC(), email,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		if _, err := tx.ExecContext(ctx, tx.Rebind(`
+			INSERT INTO login_failures (email, failures, last_failure_at, next_attempt_at)
+			VALUES (?, 1, ?, ?)`),
+			email, now.UTC(), now.UTC(),
+		); err != nil {
+			return 0, err
+		}
+	}
+
+	var failures int
+	if err := tx.GetContext(ctx, &failures, tx.Rebind("SELECT failures FROM login_failures WHERE email = ?"), email); err != nil {
+		return 0, err
+	}
+
+	return failures, tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) DelayLogins(ctx context.Context, email string, at time.Time, reset bool) error {
+	query := "UPDATE login_failures SET next_attempt_at = ?"
+	if reset {
+		query += ", failures = 0"
+	}
+	_, err := s.exec(ctx, query+" WHERE email = ? AND next_attempt_at < ?", at.UTC(), email, at.UTC())
+	return err
+}
+
+func (s *sqlStore) DeleteLoginFailures(ctx context.Context, email string) error {
+	_, err := s.exec(ctx, "DELETE FROM login_failures WHERE email = ?", email)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredLoginFailures(ctx context.Context, lastFailureBefore, now time.Time) error {
+	_, err := s.exec(ctx,
+		"DELETE FROM login_failures WHERE last_failure_at < ? AND next_attempt_at <= ?",
+		lastFailureBefore.UTC(), now.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) CountLoginFailures(ctx context.Context) (int, error) {
+	var n int
+	err := s.get(ctx, &n, "SELECT COUNT(*) FROM login_failures")
+	return n, err
+}
+
+func (s *sqlStore) ClaimVerificationMail(ctx context.Context, owner string, since, now time.Time) (bool, error) {
+	res, err := s.exec(ctx,
+		"UPDATE verification_mails SET sent_at = ? WHERE owner = ? AND sent_at <= ?",
+		now.UTC(), owner, since.UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+
+	// No email was sent yet, or one was sent recently and the insert fails
+	_, err = s.exec(ctx, "INSERT INTO verification_mails (owner, sent_at) VALUES (?, ?)", owner, now.UTC())
+	if IsDuplicateEntry(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) DeleteVerificationMailsSentBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM verification_mails WHERE sent_at < ?", before.UTC())
+	return err
+}
+
+func (s *sqlStore) GetCachedSubscriptionStatus(ctx context.Context, subscriptionID string, now time.Time) (string, error) {
+	var status string
+	err := s.get(ctx, &status,
+		"SELECT status FROM subscription_cache WHERE subscription_id = ? AND expires_at > ?",
+		subscriptionID, now.UTC(),
+	)
+	return status, err
+}
+
+func (s *sqlStore) CacheSubscriptionStatus(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO subscription_cache (subscription_id, status, expires_at)
+		VALUES (?, ?, ?)`+
+		s.dialect.Upsert("subscription_id", "status", "expires_at"),
+		subscriptionID, status, expiresAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteCachedSubscriptionStatus(ctx context.Context, subscriptionID string) error {
+	_, err := s.exec(ctx, "DELETE FROM subscription_cache WHERE subscription_id = ?", subscriptionID)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredSubscriptionStatuses(ctx context.Context, now time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM subscription_cache WHERE expires_at <= ?", now.UTC())
+	return err
+}
+
+func (s *sqlStore) CountCachedSubscriptionStatuses(ctx context.Context) (int, error) {
+	var n int
+	err := s.get(ctx, &n, "SELECT COUNT(*) FROM subscription_cache")
+	return n, err
+}
+
+func (s *sqlStore) selectAll(ctx context.Context, dest any, query string, args ...any) error {
+	return s.db.SelectContext(ctx, dest, s.db.Rebind(query), args...)
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+/* -------------------- Users -------------------- */
+
+const userColumns = `
+	id, uuid, email, salt, srp_salt, verifier, challenge, email_verified,
+	stripe_customer_id, stripe_subscription_id, subscription_status,
+	deletion_scheduled_at, totp_secret, totp_enabled, totp_last_step,
+	recovery_srp_salt, recovery_verifier, recovery_key`
+
+func (s *sqlStore) CreateUser(ctx context.Context, user *types.User) error {
+	return insertUser(ctx, s.db, user)
+}
+
+func (s *sqlStore) CreateInvitedUser(ctx context.Context, user *types.User, inviteID int, now time.Time) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	res, err := tx.ExecContext(ctx, tx.Rebind(`
+		UPDATE invites SET uses = uses + 1
+		WHERE id = ? AND uses < max_uses AND expires_at > ?`),
+		inviteID, now.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInviteUnavailable
+	}
+
+	// A taken address rolls back the use
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+// insertUser creates the user with db, the store's database or a transaction, setting its UUID if empty.
+func insertUser(ctx context.Context, db sqlx.ExtContext, user *types.User) error {
+	if user.UUID == "" {
+		user.UUID = utils.NewUUID()
+	}
+
+	_, err := db.ExecContext(ctx, db.Rebind(`
+		INSERT INTO users (uuid, email, salt, srp_salt, verifier, challenge, email_verified)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		user.UUID, user.Email, user.Salt, user.SrpSalt, user.Verifier, user.Challenge, user.EmailVerified,
+	)
+	return err
+}
+
+func (s *sqlStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	user := &types.User{}
+	if err := s.get(ctx, user, "SELECT "+userColumns+" FROM users WHERE "+s.dialect.EqualFold("email"), email); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) GetUserByUUID(ctx context.Context, uuid string) (*types.User, error) {
+	user := &types.User{}
+	if err := s.get(ctx, user, "SELECT "+userColumns+" FROM users WHERE uuid = ?", uuid); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) VerifyEmail(ctx context.Context, uuid, email string) error {
+	res, err := s.exec(ctx, "UPDATE users SET email_verified = TRUE WHERE uuid = ? AND email = ?", uuid, email)
+	if err != nil {
+		return err
+	}
+
+	// MySQL only counts changed rows, so an address that is already verified is reported as not found too
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) SetStripeCustomer(ctx context.Context, uuid, customerID, subscriptionID string) error {
+	_, err := s.exec(ctx, `
+		UPDATE users SET
+			stripe_customer_id = ?,
+			stripe_subscription_id = ?
+		WHERE uuid = ?`,
+		customerID, subscriptionID, uuid,
+	)
+	return err
+}
+
+func (s *sqlStore) SetSubscriptionStatus(ctx context.Context, subscriptionID, status string) error {
+	_, err := s.exec(ctx,
+		"UPDATE users SET subscription_status = ? WHERE stripe_subscription_id = ?",
+		status, subscriptionID,
+	)
+	return err
+}
+
+func (s *sqlStore) ScheduleUserDeletion(ctx context.Context, uuid string, at *time.Time) error {
+	if at != nil {
+		utc := at.UTC()
+		at = &utc
+	}
+
+	_, err := s.exec(ctx, "UPDATE users SET deletion_scheduled_at = ? WHERE uuid = ?", at, uuid)
+	return err
+}
+
+func (s *sqlStore) GetUsersDueForDeletion(ctx context.Context, now time.Time) ([]types.User, error) {
+	var users []types.User
+	if err := s.selectAll(ctx, &users,
+		"SELECT "+userColumns+" FROM users WHERE deletion_scheduled_at < ?",
+		now.UTC(),
+	); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// DeleteUser relies on ON DELETE CASCADE to remove everything the user owns.
+func (s *sqlStore) DeleteUser(ctx context.Context, uuid string) error {
+	_, err := s.exec(ctx, "DELETE FROM users WHERE uuid = ?", uuid)
+	return err
+}
+
+func (s *sqlStore) ChangeCredentials(ctx context.Context, uuid string, creds types.Credentials, events []types.CalendarEvent, keepAccessToken string) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	// Every stored event must be re-encrypted, or it would become unreadable
+	var stored []string
+	if err := tx.SelectContext(ctx, &stored, tx.Rebind("SELECT id FROM calendar_events WHERE owner = ?"), uuid); err != nil {
+		return err
+	}
+	if !sameEventIDs(stored, events) {
+		return ErrStaleEvents
+	}
+
+	for _, ev := range events {
+		if _, err := tx.ExecContext(ctx, tx.Rebind(`
+			UPDATE calendar_events SET data = ?, updated_at = ?
+			WHERE owner = ? AND id = ?`),
+			ev.Data, ev.UpdatedAt.UTC(), uuid, ev.ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(`
+		UPDATE users SET
+			salt = ?, srp_salt = ?, verifier = ?, challenge = ?,
+			recovery_srp_salt = NULL, recovery_verifier = NULL, recovery_key = NULL
+		WHERE uuid = ?`),
+		creds.Salt, creds.SrpSalt, creds.Verifier, creds.Challenge, uuid,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM email_changes WHERE owner = ?"), uuid); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(
+		"DELETE FROM account_sessions WHERE owner = ? AND access_token <> ?"),
+		uuid, keepAccessToken,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) SetRecoveryKey(ctx context.Context, uuid string, key *types.RecoveryKey) error {
+	if key == nil {
+		key = &types.RecoveryKey{}
+	}
+
+	_, err := s.exec(ctx, `
+		UPDATE users SET recovery_srp_salt = ?, recovery_verifier = ?, recovery_key = ?
+		WHERE uuid = ?`,
+		key.SrpSalt, key.Verifier, key.WrappedKey, uuid,
+	)
+	return err
+}
+
+/* -------------------- Email Changes -------------------- */
+
+func (s *sqlStore) RequestEmailChange(ctx context.Context, change *types.EmailChange) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO email_changes (owner, email, srp_salt, verifier, created_at)
+		VALUES (?, ?, ?, ?, ?)`+
+		s.dialect.Upsert("owner", "email", "srp_salt", "verifier", "created_at"),
+		change.Owner, change.Email, change.SrpSalt, change.Verifier, change.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) ApplyEmailChange(ctx context.Context, owner, email string) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	var change types.EmailChange
+	err = tx.GetContext(ctx, &change, tx.Rebind(`
+		SELECT owner, email, srp_salt, verifier, created_at
+		FROM email_changes WHERE owner = ? AND email = ?`),
+		owner, email,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(`
+		UPDATE users SET
+			email = ?, srp_salt = ?, verifier = ?, email_verified = TRUE,
+			recovery_srp_salt = NULL, recovery_verifier = NULL, recovery_key = NULL
+		WHERE uuid = ?`),
+		change.Email, change.SrpSalt, change.Verifier, owner,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM email_changes WHERE owner = ?"), owner); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) DeleteEmailChangesCreatedBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM email_changes WHERE created_at < ?", before.UTC())
+	return err
+}
+
+/* -------------------- Invites -------------------- */
+
+const inviteColumns = "id, code_hash, creator, email, max_uses, uses, expires_at, created_at"
+
+func (s *sqlStore) CreateInvite(ctx context.Context, invite *types.Invite, quota int) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	if invite.Creator != nil {
+		// Lock the creator, so that concurrent invites are counted one after the other
+		var creator string
+		if err := tx.GetContext(ctx, &creator,
+			tx.Rebind("SELECT uuid FROM users WHERE uuid = ?"+s.dialect.ForUpdate()), *invite.Creator,
+		); err != nil {
+			return err
+		}
+
+		var seats int
+		if err := tx.GetContext(ctx, &seats, tx.Rebind(`
+			SELECT COALESCE(SUM(CASE WHEN expires_at > ? THEN max_uses ELSE uses END), 0)
+			FROM invites
+			WHERE creator = ?`),
+			invite.CreatedAt.UTC(), creator,
+		); err != nil {
+			return err
+		}
+		if seats+invite.MaxUses > quota {
+			return ErrInviteQuotaExceeded
+		}
+	}
+
+	if invite.ID, err = insertReturningID(ctx, tx, "invites", "code_hash", invite.CodeHash, `
+		INSERT INTO invites (code_hash, creator, email, max_uses, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		invite.CodeHash, invite.Creator, invite.Email, invite.MaxUses, invite.ExpiresAt.UTC(), invite.CreatedAt.UTC(),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) GetInviteByCode(ctx context.Context, codeHash []byte) (*types.Invite, error) {
+	invite := &types.Invite{}
+	if err := s.get(ctx, invite, "SELECT "+inviteColumns+" FROM invites WHERE code_hash = ?", codeHash); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (s *sqlStore) GetInvites(ctx context.Context, creator *string) ([]types.Invite, error) {
+	query := "SELECT " + inviteColumns + " FROM invites"
+	var args []any
+	if creator != nil {
+		query += " WHERE creator = ?"
+		args = append(args, *creator)
+	}
+
+	var invites []types.Invite
+	if err := s.selectAll(ctx, &invites, query+" ORDER BY id DESC", args...); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (s *sqlStore) RevokeInvite(ctx context.Context, id int, creator *string, now time.Time) error {
+	query := "UPDATE invites SET expires_at = ? WHERE id = ? AND expires_at > ?"
+	args := []any{now.UTC(), id, now.UTC()}
+	if creator != nil {
+		query += " AND creator = ?"
+		args = append(args, *creator)
+	}
+
+	res, err := s.exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/* -------------------- Two-Factor Authentication -------------------- */
+
+func (s *sqlStore) SetTOTPSecret(ctx context.Context, uuid, secret string) error {
+	_, err := s.exec(ctx, "UPDATE users SET totp_secret = ? WHERE uuid = ? AND NOT totp_enabled", secret, uuid)
+	return err
+}
+
+func (s *sqlStore) EnableTOTP(ctx context.Context, uuid string, backupCodeHashes [][]byte) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE users SET totp_enabled = TRUE WHERE uuid = ?"), uuid); err != nil {
+		return err
+	}
+
+	if err := replaceBackupCodes(ctx, tx, uuid, backupCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) DisableTOTP(ctx context.Context, uuid string) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(`
+		UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL
+		WHERE uuid = ?`), uuid,
+	); err != nil {
+		return err
+	}
+
+	if err := replaceBackupCodes(ctx, tx, uuid, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+// UseTOTPStep is a single conditional update, so concurrent requests can't both use the same code.
+func (s *sqlStore) UseTOTPStep(ctx context.Context, uuid string, step int64) (bool, error) {
+	res, err := s.exec(ctx, `
+		UPDATE users SET totp_last_step = ?
+		WHERE uuid = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`,
+		step, uuid, step,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) UseBackupCode(ctx context.Context, uuid string, hash []byte) (bool, error) {
+	res, err := s.exec(ctx, "DELETE FROM backup_codes WHERE owner = ? AND code_hash = ?", uuid, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// replaceBackupCodes deletes the user's backup codes and stores the given ones.
+func replaceBackupCodes(ctx context.Context, tx *sqlx.Tx, uuid string, hashes [][]byte) error {
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM backup_codes WHERE owner = ?"), uuid); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, tx.Rebind(
+			"INSERT INTO backup_codes (owner, code_hash) VALUES (?, ?)"),
+			uuid, hash,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* -------------------- Security Keys -------------------- */
+
+const webAuthnCredentialColumns = `
+	id, owner, name, credential_id, public_key, attestation_type, transports,
+	aaguid, sign_count, backup_eligible, backup_state, created_at, last_used_at`
+
+func (s *sqlStore) AddWebAuthnCredential(ctx context.Context, cred *types.WebAuthnCredential) error {
+	id, err := insertReturningID(ctx, s.db, "webauthn_credentials", "credential_id", cred.CredentialID, `
+		INSERT INTO webauthn_credentials (owner, name, credential_id, public_key, attestation_type, transports,
+			aaguid, sign_count, backup_eligible, backup_state, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cred.Owner, cred.Name, cred.CredentialID, cred.PublicKey, cred.AttestationType, cred.Transports,
+		cred.AAGUID, cred.SignCount, cred.BackupEligible, cred.BackupState, cred.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	cred.ID = id
+	return nil
+}
+
+func (s *sqlStore) GetWebAuthnCredentials(ctx context.Context, owner string) ([]types.WebAuthnCredential, error) {
+	var creds []types.WebAuthnCredential
+	if err := s.selectAll(ctx, &creds,
+		"SELECT "+webAuthnCredentialColumns+" FROM webauthn_credentials WHERE owner = ? ORDER BY id",
+		owner,
+	); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (s *sqlStore) UseWebAuthnCredential(ctx context.Context, owner string, credentialID []byte, signCount uint32, backupState bool, now time.Time) error {
+	_, err := s.exec(ctx, `
+		UPDATE webauthn_credentials SET sign_count = ?, backup_state = ?, last_used_at = ?
+		WHERE owner = ? AND credential_id = ?`,
+		signCount, backupState, now.UTC(), owner, credentialID,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteWebAuthnCredential(ctx context.Context, owner string, id int) error {
+	res, err := s.exec(ctx, "DELETE FROM webauthn_credentials WHERE owner = ? AND id = ?", owner, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/* -------------------- Account Sessions -------------------- */
+
+const accountSessionColumns = `
+	id, owner, access_token, created_at, expires_at,
+	device_name, user_agent, ip, last_seen_at`
+
+func (s *sqlStore) CreateAccountSession(ctx context.Context, session *types.AccountSession, refreshTokenHash []byte) error {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	if session.ID, err = insertReturningID(ctx, tx, "account_sessions", "access_token", session.AccessToken, `
+		INSERT INTO account_sessions (owner, access_token, created_at, expires_at, device_name, user_agent, ip, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.Owner, session.AccessToken, session.CreatedAt.UTC(), session.ExpiresAt.UTC(),
+		session.DeviceName, session.UserAgent, session.IP, session.LastSeenAt.UTC(),
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(
+		"INSERT INTO refresh_tokens (session_id, token_hash, created_at) VALUES (?, ?, ?)"),
+		session.ID, refreshTokenHash, session.CreatedAt.UTC(),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetAccountSession(ctx context.Context, accessToken string) (*types.AccountSession, error) {
+	session := &types.AccountSession{}
+	if err := s.get(ctx, session,
+		"SELECT "+accountSessionColumns+" FROM account_sessions WHERE access_token = ?",
+		accessToken,
+	); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *sqlStore) GetAccountSessionByID(ctx context.Context, id int) (*types.AccountSession, error) {
+	session := &types.AccountSession{}
+	if err := s.get(ctx, session,
+		"SELECT "+accountSessionColumns+" FROM account_sessions WHERE id = ?",
+		id,
+	); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *sqlStore) ListAccountSessions(ctx context.Context, owner string) ([]types.AccountSession, error) {
+	var sessions []types.AccountSession
+	if err := s.selectAll(ctx, &sessions,
+		"SELECT "+accountSessionColumns+" FROM account_sessions WHERE owner = ? ORDER BY last_seen_at DESC",
+		owner,
+	); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *sqlStore) TouchAccountSession(ctx context.Context, accessToken, ip string, now time.Time) error {
+	_, err := s.exec(ctx,
+		"UPDATE account_sessions SET ip = ?, last_seen_at = ? WHERE access_token = ?",
+		ip, now.UTC(), accessToken,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteAccountSession(ctx context.Context, accessToken string) error {
+	_, err := s.exec(ctx, "DELETE FROM account_sessions WHERE access_token = ?", accessToken)
+	return err
+}
+
+func (s *sqlStore) DeleteAccountSessionByID(ctx context.Context, owner string, id int) error {
+	res, err := s.exec(ctx, "DELETE FROM account_sessions WHERE owner = ? AND id = ?", owner, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteOtherAccountSessions(ctx context.Context, owner, keepAccessToken string) error {
+	_, err := s.exec(ctx,
+		"DELETE FROM account_sessions WHERE owner = ? AND access_token <> ?",
+		owner, keepAccessToken,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredAccountSessions(ctx context.Context, lastSeenBefore, createdBefore time.Time) error {
+	_, err := s.exec(ctx,
+		"DELETE FROM account_sessions WHERE last_seen_at < ? OR created_at < ?",
+		lastSeenBefore.UTC(), createdBefore.UTC(),
+	)
+	return err
+}
+
+/* -------------------- Known Devices -------------------- */
+
+func (s *sqlStore) RememberDevice(ctx context.Context, owner string, fingerprint []byte, now time.Time) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	var known, total int
+	if err := tx.GetContext(ctx, &total, tx.Rebind(`
+		SELECT COUNT(*) FROM known_devices WHERE owner = ?`),
+		owner,
+	); err != nil {
+		return false, err
+	}
+	if err := tx.GetContext(ctx, &known, tx.Rebind(`
+		SELECT COUNT(*) FROM known_devices WHERE owner = ? AND fingerprint = ?`),
+		owner, fingerprint,
+	); err != nil {
+		return false, err
+	}
+
+	if known > 0 {
+		if _, err := tx.ExecContext(ctx, tx.Rebind(`
+			UPDATE known_devices SET last_seen_at = ? WHERE owner = ? AND fingerprint = ?`),
+			now.UTC(), owner, fingerprint,
+		); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(`
+		INSERT INTO known_devices (owner, fingerprint, first_seen_at, last_seen_at)
+		VALUES (?, ?, ?, ?)`),
+		owner, fingerprint, now.UTC(), now.UTC(),
+	); err != nil {
+		if IsDuplicateEntry(err) {
+			return false, nil // a concurrent login from the same device recorded it first
+		}
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil { // finalize transaction
+		return false, err
+	}
+	return total > 0, nil
+}
+
+func (s *sqlStore) DeleteDevicesSeenBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM known_devices WHERE last_seen_at < ?", before.UTC())
+	return err
+}
+
+/* -------------------- Refresh Tokens -------------------- */
+
+func (s *sqlStore) GetRefreshToken(ctx context.Context, hash []byte) (*types.RefreshToken, error) {
+	token := &types.RefreshToken{}
+	if err := s.get(ctx, token,
+		"SELECT id, session_id, token_hash, created_at, used_at FROM refresh_tokens WHERE token_hash = ?",
+		hash,
+	); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *sqlStore) RotateRefreshToken(ctx context.Context, token *types.RefreshToken, newHash []byte, accessToken string, expiresAt, now time.Time) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	// Only one request can use the token, a concurrent one sees it as already used
+	res, err := tx.ExecContext(ctx, tx.Rebind(
+		"UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL"),
+		now.UTC(), token.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(
+		"INSERT INTO refresh_tokens (session_id, token_hash, created_at) VALUES (?, ?, ?)"),
+		token.SessionID, newHash, now.UTC(),
+	); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(
+		"UPDATE account_sessions SET access_token = ?, expires_at = ?, last_seen_at = ? WHERE id = ?"),
+		accessToken, expiresAt.UTC(), now.UTC(), token.SessionID,
+	); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+/* -------------------- Push Subscriptions -------------------- */
+
+func (s *sqlStore) SavePushSubscription(ctx context.Context, sub *types.PushSubscription) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO push_subscriptions (owner, endpoint, p256dh, auth, session_id)
+		VALUES (?, ?, ?, ?, ?)`+
+		s.dialect.Upsert("endpoint", "owner", "p256dh", "auth", "session_id"),
+		sub.Owner, sub.Endpoint, sub.P256DH, sub.Auth, sub.SessionID,
+	)
+	return err
+}
+
+func (s *sqlStore) GetPushSubscriptions(ctx context.Context, owner string) ([]types.PushSubscription, error) {
+	var subs []types.PushSubscription
+	if err := s.selectAll(ctx, &subs, `
+		SELECT id, owner, endpoint, p256dh, auth, session_id
+		FROM push_subscriptions
+		WHERE owner = ?`,
+		owner,
+	); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (s *sqlStore) DeletePushSubscription(ctx context.Context, endpoint string) error {
+	_, err := s.exec(ctx, "DELETE FROM push_subscriptions WHERE endpoint = ?", endpoint)
+	return err
+}
+
+/* -------------------- Calendar Events -------------------- */
+
+func (s *sqlStore) SaveCalendarEvents(ctx context.Context, owner string, upserts []types.CalendarEvent, deletedIDs []string) error {
+	if len(upserts) == 0 && len(deletedIDs) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil) // start transaction
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
+
+	// Batch delete
+	if len(deletedIDs) > 0 {
+		query := `DELETE FROM calendar_events WHERE owner = ? AND id IN (?` + strings.Repeat(",?", len(deletedIDs)-1) + `)`
+		args := make([]any, 0, len(deletedIDs)+1)
+		args = append(args, owner)
+		for _, id := range deletedIDs {
+			args = append(args, id)
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+	}
+
+	// Batch upsert
+	if len(upserts) > 0 {
+		// PostgreSQL refuses to update a row twice in one statement, so only the last change to each event is kept
+		last := make(map[string]int, len(upserts))
+		for i, ev := range upserts {
+			last[ev.ID] = i
+		}
+
+		valueStrings := make([]string, 0, len(last))
+		valueArgs := make([]any, 0, len(last)*4)
+
+		for i, ev := range upserts {
+			if last[ev.ID] != i {
+				continue
+			}
+			valueStrings = append(valueStrings, "(?, ?, ?, ?)")
+			valueArgs = append(valueArgs, ev.ID, owner, ev.Data, ev.UpdatedAt.UTC())
+		}
+
+		// IDs are unique across accounts, so an ID taken by another account must not overwrite its event
+		query := `
+		INSERT INTO calendar_events (id, owner, data, updated_at)
+		VALUES ` + strings.Join(valueStrings, ",") +
+			s.dialect.UpsertIf("calendar_events", "id", "owner", "data", "updated_at")
+
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), valueArgs...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit() // finalize transaction
+}
+
+func (s *sqlStore) GetCalendarEvents(ctx context.Context, owner string) ([]types.CalendarEvent, error) {
+	var events []types.CalendarEvent
+	if err := s.selectAll(ctx, &events, `
+		SELECT id, data, updated_at
+		FROM calendar_events
+		WHERE owner = ?`,
+		owner,
+	); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
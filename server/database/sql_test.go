@@ -0,0 +1,396 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"acLife/types"
+	"acLife/utils"
+)
+
+// newTestStore returns a store on a new, migrated SQLite database.
+func newTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+
+	s, err := newSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestUser creates a user with the given address.
+func newTestUser(t *testing.T, s *sqlStore, email string) *types.User {
+	t.Helper()
+
+	user := &types.User{
+		Email:     email,
+		Salt:      []byte("salt"),
+		SrpSalt:   []byte("srp salt"),
+		Verifier:  []byte("verifier"),
+		Challenge: []byte("challenge"),
+	}
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newTestSession creates an account session of owner with the given access token and refresh token hash.
+func newTestSession(t *testing.T, s *sqlStore, owner, accessToken string, refreshHash []byte, now time.Time) *types.AccountSession {
+	t.Helper()
+
+	sess := &types.AccountSession{
+		Owner:       owner,
+		AccessToken: accessToken,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+		LastSeenAt:  now,
+	}
+	if err := s.CreateAccountSession(context.Background(), sess, refreshHash); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestChangeCredentials(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	user := newTestUser(t, s, "alice@example.com")
+	first, second := utils.NewUUID(), utils.NewUUID()
+	if err := s.SaveCalendarEvents(ctx, user.UUID, []types.CalendarEvent{
+		{ID: first, Data: []byte("one"), UpdatedAt: now},
+		{ID: second, Data: []byte("two"), UpdatedAt: now},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetRecoveryKey(ctx, user.UUID, &types.RecoveryKey{
+		SrpSalt: []byte("recovery salt"), Verifier: []byte("recovery verifier"), WrappedKey: []byte("wrapped"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestEmailChange(ctx, &types.EmailChange{
+		Owner: user.UUID, Email: "new@example.com", SrpSalt: []byte("new salt"), Verifier: []byte("new verifier"), CreatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	newTestSession(t, s, user.UUID, "kept", []byte("kept refresh"), now)
+	other := newTestSession(t, s, user.UUID, "other", []byte("other refresh"), now)
+
+	creds := types.Credentials{
+		Salt:      []byte("salt 2"),
+		SrpSalt:   []byte("srp salt 2"),
+		Verifier:  []byte("verifier 2"),
+		Challenge: []byte("challenge 2"),
+	}
+	later := now.Add(time.Minute)
+
+	// Leaving out a stored event changes nothing
+	if err := s.ChangeCredentials(ctx, user.UUID, creds, []types.CalendarEvent{
+		{ID: first, Data: []byte("one v2"), UpdatedAt: later},
+	}, "kept"); !errors.Is(err, ErrStaleEvents) {
+		t.Fatalf("missing event: got %v, want %v", err, ErrStaleEvents)
+	}
+	if got, err := s.GetUserByUUID(ctx, user.UUID); err != nil || !bytes.Equal(got.Verifier, user.Verifier) {
+		t.Fatalf("after stale events: got %+v, %v", got, err)
+	}
+
+	if err := s.ChangeCredentials(ctx, user.UUID, creds, []types.CalendarEvent{
+		{ID: first, Data: []byte("one v2"), UpdatedAt: later},
+		{ID: second, Data: []byte("two v2"), UpdatedAt: later},
+	}, "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetUserByUUID(ctx, user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Salt, creds.Salt) || !bytes.Equal(got.SrpSalt, creds.SrpSalt) ||
+		!bytes.Equal(got.Verifier, creds.Verifier) || !bytes.Equal(got.Challenge, creds.Challenge) {
+		t.Errorf("credentials: got %+v", got)
+	}
+	if got.RecoveryVerifier != nil || got.RecoveryKey != nil {
+		t.Errorf("recovery key kept: got %+v", got)
+	}
+
+	events, err := s.GetCalendarEvents(ctx, user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range events {
+		if string(ev.Data) != map[string]string{first: "one v2", second: "two v2"}[ev.ID] || !ev.UpdatedAt.Equal(later) {
+			t.Errorf("event %s: got %q at %v", ev.ID, ev.Data, ev.UpdatedAt)
+		}
+	}
+
+	// The pending email change was bound to the old password
+	if err := s.ApplyEmailChange(ctx, user.UUID, "new@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("apply email change: got %v, want %v", err, ErrNotFound)
+	}
+
+	if _, err := s.GetAccountSession(ctx, "kept"); err != nil {
+		t.Errorf("kept session: got %v", err)
+	}
+	if _, err := s.GetAccountSessionByID(ctx, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other session: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	user := newTestUser(t, s, "bob@example.com")
+	sess := newTestSession(t, s, user.UUID, "access 1", []byte("refresh 1"), now)
+
+	token, err := s.GetRefreshToken(ctx, []byte("refresh 1"))
+	if err != nil || token.SessionID != sess.ID || token.UsedAt != nil {
+		t.Fatalf("first token: got %+v, %v", token, err)
+	}
+
+	later := now.Add(time.Minute)
+	if ok, err := s.RotateRefreshToken(ctx, token, []byte("refresh 2"), "access 2", later.Add(time.Hour), later); err != nil || !ok {
+		t.Fatalf("rotate: got %v, %v", ok, err)
+	}
+
+	// The session continues with the new access token
+	got, err := s.GetAccountSessionByID(ctx, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access 2" || !got.ExpiresAt.Equal(later.Add(time.Hour)) || !got.LastSeenAt.Equal(later) {
+		t.Errorf("session after rotation: got %+v", got)
+	}
+
+	next, err := s.GetRefreshToken(ctx, []byte("refresh 2"))
+	if err != nil || next.SessionID != sess.ID || next.UsedAt != nil {
+		t.Errorf("successor: got %+v, %v", next, err)
+	}
+	if used, err := s.GetRefreshToken(ctx, []byte("refresh 1")); err != nil || used.UsedAt == nil {
+		t.Errorf("used token: got %+v, %v", used, err)
+	}
+
+	// A used token can't be rotated again, and nothing changes
+	if ok, err := s.RotateRefreshToken(ctx, token, []byte("refresh 3"), "access 3", later.Add(time.Hour), later); err != nil || ok {
+		t.Fatalf("rotate used token: got %v, %v", ok, err)
+	}
+	if _, err := s.GetRefreshToken(ctx, []byte("refresh 3")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("successor of a used token: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.GetAccountSession(ctx, "access 2"); err != nil {
+		t.Errorf("access token after replay: got %v", err)
+	}
+}
+
+func TestCreateInvitedUser(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	newInvite := func(code string, maxUses int, expiresAt time.Time) *types.Invite {
+		t.Helper()
+
+		invite := &types.Invite{
+			CodeHash:  utils.HashToken(code),
+			MaxUses:   maxUses,
+			ExpiresAt: expiresAt,
+			CreatedAt: now,
+		}
+		if err := s.CreateInvite(ctx, invite, 0); err != nil {
+			t.Fatal(err)
+		}
+		return invite
+	}
+	newUser := func(email string) *types.User {
+		return &types.User{Email: email, Salt: []byte("salt"), SrpSalt: []byte("srp salt"), Verifier: []byte("verifier"), Challenge: []byte("challenge")}
+	}
+	uses := func(invite *types.Invite) int {
+		t.Helper()
+
+		got, err := s.GetInviteByCode(ctx, invite.CodeHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Uses
+	}
+
+	single := newInvite("single", 1, now.Add(time.Hour))
+	if err := s.CreateInvitedUser(ctx, newUser("carol@example.com"), single.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := uses(single); n != 1 {
+		t.Errorf("uses: got %d, want 1", n)
+	}
+
+	// A used up invite creates no account
+	if err := s.CreateInvitedUser(ctx, newUser("dave@example.com"), single.ID, now); !errors.Is(err, ErrInviteUnavailable) {
+		t.Fatalf("used up invite: got %v, want %v", err, ErrInviteUnavailable)
+	}
+	if _, err := s.GetUserByEmail(ctx, "dave@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("user of a used up invite: got %v, want %v", err, ErrNotFound)
+	}
+
+	expired := newInvite("expired", 5, now.Add(-time.Minute))
+	if err := s.CreateInvitedUser(ctx, newUser("dave@example.com"), expired.ID, now); !errors.Is(err, ErrInviteUnavailable) {
+		t.Fatalf("expired invite: got %v, want %v", err, ErrInviteUnavailable)
+	}
+
+	// A taken address doesn't use up the invite
+	multi := newInvite("multi", 2, now.Add(time.Hour))
+	if err := s.CreateInvitedUser(ctx, newUser("Carol@example.com"), multi.ID, now); !IsDuplicateEntry(err) {
+		t.Fatalf("taken address: got %v, want a duplicate entry", err)
+	}
+	if n := uses(multi); n != 0 {
+		t.Errorf("uses after a taken address: got %d, want 0", n)
+	}
+}
+
+func TestCreateInvite(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	creator := newTestUser(t, s, "frank@example.com").UUID
+	create := func(maxUses int) error {
+		return s.CreateInvite(ctx, &types.Invite{
+			CodeHash:  utils.HashToken(utils.RandomToken(16)),
+			Creator:   &creator,
+			MaxUses:   maxUses,
+			ExpiresAt: now.Add(time.Hour),
+			CreatedAt: now,
+		}, 5)
+	}
+
+	if err := create(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(3); !errors.Is(err, ErrInviteQuotaExceeded) {
+		t.Fatalf("over the quota: got %v, want %v", err, ErrInviteQuotaExceeded)
+	}
+
+	// Concurrent invites are counted one after the other, the quota fits exactly two more seats
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int32
+	)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := create(1)
+			switch {
+			case err == nil:
+				created.Add(1)
+			case !errors.Is(err, ErrInviteQuotaExceeded):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := created.Load(); n != 2 {
+		t.Errorf("concurrent invites: got %d created, want 2", n)
+	}
+
+	// Admin invites have no quota
+	if err := s.CreateInvite(ctx, &types.Invite{
+		CodeHash: utils.HashToken("admin"), MaxUses: 100, ExpiresAt: now.Add(time.Hour), CreatedAt: now,
+	}, 5); err != nil {
+		t.Errorf("admin invite: got %v", err)
+	}
+}
+
+func TestRememberDevice(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	alice := newTestUser(t, s, "alice@example.com")
+	bob := newTestUser(t, s, "bob@example.com")
+
+	for _, tc := range []struct {
+		name        string
+		owner       string
+		fingerprint string
+		want        bool
+	}{
+		{"first device", alice.UUID, "laptop", false},
+		{"same device", alice.UUID, "laptop", false},
+		{"second device", alice.UUID, "phone", true},
+		{"second device again", alice.UUID, "phone", false},
+		{"device known to another account", bob.UUID, "laptop", false},
+	} {
+		if isNew, err := s.RememberDevice(ctx, tc.owner, []byte(tc.fingerprint), now); err != nil || isNew != tc.want {
+			t.Errorf("%s: got %v, %v, want %v", tc.name, isNew, err, tc.want)
+		}
+	}
+}
+
+func TestSaveCalendarEvents(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	user := newTestUser(t, s, "erin@example.com")
+	first, second := utils.NewUUID(), utils.NewUUID()
+
+	// The last change to an event wins
+	if err := s.SaveCalendarEvents(ctx, user.UUID, []types.CalendarEvent{
+		{ID: first, Data: []byte("one"), UpdatedAt: now},
+		{ID: second, Data: []byte("two"), UpdatedAt: now},
+		{ID: first, Data: []byte("one v2"), UpdatedAt: now.Add(time.Second)},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletions are applied before the upserts of the same save
+	if err := s.SaveCalendarEvents(ctx, user.UUID, []types.CalendarEvent{
+		{ID: second, Data: []byte("two v2"), UpdatedAt: now.Add(time.Second)},
+	}, []string{first, second}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.GetCalendarEvents(ctx, user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != second || string(events[0].Data) != "two v2" {
+		t.Fatalf("events: got %+v", events)
+	}
+
+	// Another account can't overwrite the event by saving one with the same ID
+	other := newTestUser(t, s, "mallory@example.com")
+	if err := s.SaveCalendarEvents(ctx, other.UUID, []types.CalendarEvent{
+		{ID: second, Data: []byte("forged"), UpdatedAt: now.Add(2 * time.Second)},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = s.GetCalendarEvents(ctx, user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].Data) != "two v2" || !events[0].UpdatedAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("events after another account's save: got %+v", events)
+	}
+	if events, err := s.GetCalendarEvents(ctx, other.UUID); err != nil || len(events) != 0 {
+		t.Fatalf("other account's events: got %+v, %v", events, err)
+	}
+}
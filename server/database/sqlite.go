@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"acLife/config"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+type sqliteDialect struct{}
+
+func openSQLite(cfg config.Database) (*sqlStore, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o700); err != nil {
+		return nil, err
+	}
+
+	return newSQLiteStore(cfg.Path)
+}
+
+func newSQLiteStore(path string) (*sqlStore, error) {
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_txlock", "immediate")
+
+	db, err := sqlx.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: sqliteDialect{}}, nil
+}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Upsert(key string, cols ...string) string {
+	return upsertOnConflict(key, cols...)
+}
+
+func (sqliteDialect) UpsertIf(table, key, guard string, cols ...string) string {
+	return upsertOnConflictIf(table, key, guard, cols...)
+}
+
+// EqualFold relies on the column being declared COLLATE NOCASE.
+func (sqliteDialect) EqualFold(col string) string {
+	return col + " = ?"
+}
+
+// ForUpdate is empty, since transactions are immediate and hold the database's write lock from their start.
+func (sqliteDialect) ForUpdate() string {
+	return ""
+}
+
+// Lock opens an immediate transaction, which blocks other writers until it ends.
+// The whole migration runs inside it, so a failure leaves the schema untouched.
+func (sqliteDialect) Lock(ctx context.Context, conn *sql.Conn) (func(ok bool) error, error) {
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+
+	return func(ok bool) error {
+		stmt := "ROLLBACK"
+		if ok {
+			stmt = "COMMIT"
+		}
+		_, err := conn.ExecContext(context.Background(), stmt)
+		return err
+	}, nil
+}
+
+func isSQLiteDuplicate(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
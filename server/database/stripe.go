@@ -2,7 +2,6 @@ package database
 
 import (
 	"context"
-	"os"
 
 	"acLife/utils"
 
@@ -11,7 +10,7 @@ import (
 )
 
 // UpdateSubscriptionStatus fetches a subscription from Stripe and updates subscription_status in the DB.
-func UpdateSubscriptionStatus(subID string, status ...string) (string, error) {
+func UpdateSubscriptionStatus(ctx context.Context, subID string, status ...string) (string, error) {
 	if subID == "" {
 		return "", nil
 	}
@@ -22,25 +21,19 @@ func UpdateSubscriptionStatus(subID string, status ...string) (string, error) {
 		subStatus = status[0]
 	} else {
 		// Fetch subscription from Stripe
-		stripe.Key = os.Getenv("STRIPE_API_KEY")
-		s, err := subscription.Get(subID, nil)
+		s, err := subscription.Get(subID, &stripe.SubscriptionParams{
+			Params: stripe.Params{Context: ctx},
+		})
 		if err != nil {
-			utils.LogError("UpdateSubscriptionStatus", "sub.Get", err)
+			utils.LogError(ctx, "UpdateSubscriptionStatus", "sub.Get", err)
 			return "", err
 		}
 		subStatus = string(s.Status)
 	}
 
 	// Update database
-	ctx := context.Background()
-	_, err := Exec(ctx, `
-        UPDATE users
-        SET subscription_status=?
-        WHERE stripe_subscription_id=?`,
-		subStatus, subID,
-	)
-	if err != nil {
-		utils.LogError("UpdateSubscriptionStatus", "database.Exec", err)
+	if err := DB.SetSubscriptionStatus(ctx, subID, subStatus); err != nil {
+		utils.LogError(ctx, "UpdateSubscriptionStatus", "SetSubscriptionStatus", err)
 		return "", err
 	}
 
@@ -2,73 +2,53 @@ package handlers
 
 import (
 	"context"
-	"crypto"
-	"database/sql"
+	"errors"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 
 	"acLife/constants"
 	"acLife/database"
+	"acLife/metrics"
 	"acLife/session"
+	"acLife/state"
 	"acLife/types"
 	"acLife/utils"
 
 	"mz.attahri.com/code/srp/v3"
 )
 
-var srpSessionStore = sync.Map{} // map[string]types.SRPSession
-
-func init() {
-	go cleanupSRPSessions()
-	go cleanupAccountSessions()
-}
-
 /* -------------------- Cleanup -------------------- */
 
-func cleanupSRPSessions() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+func (h *API) cleanupSRPSessions(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
 
-	for range ticker.C {
-		now := time.Now()
-		srpSessionStore.Range(func(key, value any) bool {
-			s := value.(types.SRPSession)
-			if now.Sub(s.CreatedAt) > constants.SRPSessionTTL {
-				srpSessionStore.Delete(key)
-			}
-			return true
-		})
+	if err := h.state.SRPSessions.DeleteCreatedBefore(ctx, time.Now().Add(-constants.SRPSessionTTL)); err != nil {
+		utils.LogError(ctx, "cleanupSRPSessions", "DeleteCreatedBefore", err)
 	}
 }
 
-func cleanupAccountSessions() {
-	ticker := time.NewTicker(1 * time.Hour)
-	defer ticker.Stop()
+func (h *API) cleanupAccountSessions(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
 
-	for range ticker.C {
-		if _, err := database.Exec(context.Background(),
-			"DELETE FROM account_sessions WHERE expires_at < NOW()",
-		); err != nil {
-			utils.LogError("cleanupAccountSessions", "Exec", err)
-		}
+	now := time.Now()
+	if err := database.DB.DeleteExpiredAccountSessions(ctx, now.Add(-h.cfg.Sessions.IdleTimeout), now.Add(-h.cfg.Sessions.MaxLifetime)); err != nil {
+		utils.LogError(ctx, "cleanupAccountSessions", "DeleteExpiredAccountSessions", err)
 	}
 }
 
 /* -------------------- Handlers -------------------- */
 
 // Register handles creating new accounts.
-func Register(w http.ResponseWriter, r *http.Request) {
-	if !constants.Metadata.Registration.Enabled {
+func (h *API) Register(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Registration.Disabled {
 		utils.SendBadRequest(w)
 		return
 	}
 
-	var req struct {
-		Challenge string `json:"challenge"`
-		Triplet   []byte `json:"triplet"`
-		Salt      []byte `json:"salt"`
-	}
+	var req types.RegisterRequest
 	if err := utils.ParseJSON(r.Body, &req); err != nil {
 		utils.SendBadRequest(w)
 		return
@@ -77,19 +57,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	var triplet srp.Triplet = req.Triplet
 	challenge := req.Challenge
 
-	// Make sure the fields are not empty
-	if len(triplet.Username()) == 0 || len(triplet.Verifier()) == 0 || len(triplet.Salt()) == 0 || len(challenge) == 0 {
-		utils.SendBadRequest(w)
-		return
-	}
-
-	// Enforce max lengths
-	if len(triplet.Username()) > constants.MaxEmailLen ||
-		len(triplet.Salt()) > constants.MaxSaltLen ||
-		len(req.Salt) > constants.MaxSaltLen ||
-		len(triplet.Verifier()) > constants.MaxVerifierLen ||
-		len(challenge) > constants.MaxChallengeLen {
-		utils.SendBadRequest(w)
+	if !validateCredentials(w, triplet, req.Salt, challenge) {
 		return
 	}
 
@@ -101,13 +69,39 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if !h.cfg.Registration.EmailDomainAllowed(triplet.Username()) {
+		sendEmailDomainNotAllowed(w)
+		return
+	}
+
+	// In invite-only mode the account uses up part of an invite
+	var invite *types.Invite
+	if h.cfg.Registration.InviteOnly {
+		var ok bool
+		if invite, ok = checkInvite(w, r, req.InviteCode, triplet.Username()); !ok {
+			return
+		}
+	}
 
 	// Insert into database
-	if _, err := database.Exec(r.Context(), `
-		INSERT INTO users (email, salt, srp_salt, verifier, challenge)
-		VALUES (?, ?, ?, ?, ?)`,
-		triplet.Username(), req.Salt, triplet.Salt(), triplet.Verifier(), challenge,
-	); err != nil {
+	user := &types.User{
+		Email:     triplet.Username(),
+		Salt:      req.Salt,
+		SrpSalt:   triplet.Salt(),
+		Verifier:  triplet.Verifier(),
+		Challenge: []byte(challenge),
+	}
+	var err error
+	if invite != nil {
+		err = database.DB.CreateInvitedUser(r.Context(), user, invite.ID, time.Now())
+	} else {
+		err = database.DB.CreateUser(r.Context(), user)
+	}
+	if errors.Is(err, database.ErrInviteUnavailable) { // used up by a concurrent registration
+		sendInvalidInvite(w)
+		return
+	}
+	if err != nil {
 		if database.IsDuplicateEntry(err) {
 			utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
 				Success: false,
@@ -116,22 +110,36 @@ func Register(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		utils.LogError("RegisterUser", "database.Exec", err)
+		utils.LogError(r.Context(), "RegisterUser", "CreateUser", err)
 		utils.SendInternalError(w)
 		return
 	}
 
+	h.rememberRegistrationDevice(r, user)
+
+	// The account can't log in until the emailed link is opened
+	if h.cfg.Registration.EmailVerificationRequired() {
+		if err := h.sendVerificationEmail(r.Context(), user); err != nil {
+			utils.LogError(r.Context(), "RegisterUser", "sendVerificationEmail", err)
+			utils.SendInternalError(w)
+			return
+		}
+
+		utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+			Success: true,
+			Message: "Check your inbox to verify your email address.",
+		})
+		return
+	}
+
 	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
 		Success: true,
 	})
 }
 
 // LoginStart is the first step of the SRP login procedure.
-func LoginStart(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Email string `json:"email"`
-		A     []byte `json:"A"`
-	}
+func (h *API) LoginStart(w http.ResponseWriter, r *http.Request) {
+	var req types.LoginStartRequest
 	if err := utils.ParseJSON(r.Body, &req); err != nil {
 		utils.SendBadRequest(w)
 		return
@@ -145,15 +153,10 @@ func LoginStart(w http.ResponseWriter, r *http.Request) {
 	// If A is not provided, the client is requesting the salt
 	// TODO: remove this, the client doesn't need the salt to generate A - the library is just silly
 	if len(req.A) == 0 {
-		var salt []byte
-
-		if err := database.QueryRow(
-			r.Context(),
-			"SELECT srp_salt FROM users WHERE email = ?",
-			req.Email,
-		).Scan(&salt); err != nil {
-			if err != sql.ErrNoRows { // no rows is ok
-				utils.LogError("LoginStart", "QueryRow(srp_salt)", err)
+		user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
+		if err != nil {
+			if !errors.Is(err, database.ErrNotFound) { // not found is ok
+				utils.LogError(r.Context(), "LoginStart", "GetUserByEmail(srp_salt)", err)
 			}
 
 			utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
@@ -165,22 +168,16 @@ func LoginStart(w http.ResponseWriter, r *http.Request) {
 
 		utils.SendJSON(w, http.StatusOK, types.Reply[[]byte]{
 			Success: true,
-			Data:    salt,
+			Data:    user.SrpSalt,
 		})
 		return
 	}
 
 	// Start of SRP flow - get salt and verifier
-	var salt, verifier []byte
-
-	user := &types.User{}
-	err := database.QueryRow(r.Context(),
-		"SELECT id, srp_salt, verifier FROM users WHERE email = ?",
-		req.Email,
-	).Scan(&user.ID, &salt, &verifier)
+	user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			utils.LogError("LoginStart", "QueryRow(verifier)", err)
+		if !errors.Is(err, database.ErrNotFound) {
+			utils.LogError(r.Context(), "LoginStart", "GetUserByEmail(verifier)", err)
 		}
 
 		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
@@ -190,22 +187,174 @@ func LoginStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.startSRPHandshake(w, r, "LoginStart", req.Email, req.A, user.SrpSalt, user.Verifier, false)
+}
+
+// LoginVerify is the second step of the SRP login procedure.
+func (h *API) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	var req types.LoginVerifyRequest
+
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.Email) == 0 || len(req.M1) == 0 || len(req.SessionID) == 0 {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.DeviceName) > constants.MaxDeviceNameLen {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Verify client proof and compute server proof M2, the failures are reset once the login is complete
+	M2, ok := h.verifySRPProof(w, r, "LoginVerify", req.SessionID, req.Email, req.M1, false)
+	if !ok {
+		return
+	}
+
+	// Get the user for this email
+	user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
+	if err != nil {
+		utils.LogError(r.Context(), "LoginVerify", "GetUserByEmail", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if h.cfg.Registration.EmailVerificationRequired() && !user.EmailVerified {
+		sendEmailNotVerified(w)
+		return
+	}
+
+	deviceName := strings.TrimSpace(req.DeviceName)
+
+	// With two-factor authentication the session is only created once the second factor is given
+	secondFactor, err := h.startPendingLogin(r.Context(), user, deviceName, req.ReturnToken)
+	if err != nil {
+		utils.LogError(r.Context(), "LoginVerify", "startPendingLogin", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if secondFactor != nil {
+		utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginVerifyResponse]{
+			Success: true,
+			Data: types.LoginVerifyResponse{
+				M2:           M2,
+				SecondFactor: secondFactor,
+			},
+		})
+		return
+	}
+
+	if err := h.forgetLoginFailures(r.Context(), user.Email); err != nil {
+		utils.LogError(r.Context(), "LoginVerify", "forgetLoginFailures", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	token, ok := h.startSession(w, r, "LoginVerify", user, deviceName, req.ReturnToken)
+	if !ok {
+		return
+	}
+
+	metrics.Logins.WithLabelValues("success").Inc()
+
+	// Send M2 back
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginVerifyResponse]{
+		Success: true,
+		Data: types.LoginVerifyResponse{
+			M2:      M2,
+			Session: token,
+		},
+	})
+}
+
+// Logout invalidates the current session and destroys the session cookie.
+func (h *API) Logout(w http.ResponseWriter, r *http.Request) {
+	accessToken := session.GetAccessToken(r)
+	if accessToken != "" {
+		// Delete the session from DB
+		_ = database.DB.DeleteAccountSession(r.Context(), accessToken)
+	}
+
+	// Destroy the session
+	if err := session.DestroySession(w, r); err != nil {
+		utils.LogError(r.Context(), "LogoutUser", "session.DestroySession", err)
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// startSession creates an account session for the user and saves its tokens in the session cookie,
+// or returns them if returnToken is set. On failure the error response has been sent.
+func (h *API) startSession(w http.ResponseWriter, r *http.Request, function string, user *types.User, deviceName string, returnToken bool) (*types.SessionToken, bool) {
+	// Generate tokens
+	now := time.Now()
+	accessToken := utils.RandomToken(32)
+	refreshToken := utils.RandomToken(32)
+	expires := h.accessTokenExpiry(now, now)
+
+	// Insert new session to DB
+	accountSession := &types.AccountSession{
+		Owner:       user.UUID,
+		AccessToken: accessToken,
+		CreatedAt:   now,
+		ExpiresAt:   expires,
+		DeviceName:  deviceName,
+		UserAgent:   clientUserAgent(r),
+		IP:          h.getClientIP(r),
+		LastSeenAt:  now,
+	}
+	if err := database.DB.CreateAccountSession(r.Context(), accountSession, utils.HashToken(refreshToken)); err != nil {
+		utils.LogError(r.Context(), function, "CreateAccountSession", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+
+	h.alertNewDevice(r, user, accountSession)
+
+	// Clients without cookies send the token as a Bearer token
+	if returnToken {
+		return &types.SessionToken{
+			AccessToken:  accessToken,
+			ExpiresAt:    expires.UnixMilli(),
+			RefreshToken: refreshToken,
+		}, true
+	}
+
+	// Save tokens in session
+	if err := session.SetValues(w, r, map[string]any{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+	}); err != nil {
+		utils.LogError(r.Context(), function, "session.Set", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+
+	return nil, true
+}
+
+// startSRPHandshake begins an SRP handshake for email against the given salt and verifier, and replies with B.
+// The handshake is completed by checkSRPProof. On failure the error response has been sent.
+func (h *API) startSRPHandshake(w http.ResponseWriter, r *http.Request, function, email string, A, salt, verifier []byte, recovery bool) {
 	// Create SRP server (parameters must match client)
-	server, err := srp.NewServer(&srp.Params{
-		Name:  "DH16–SHA256–Argon2",
-		Group: srp.RFC5054Group4096,
-		Hash:  crypto.SHA256,
-		KDF:   utils.KDFArgon2,
-	}, req.Email, salt, verifier)
+	server, err := srp.NewServer(utils.SRPParams, email, salt, verifier)
 	if err != nil {
-		utils.LogError("LoginStart", "srp.NewServer", err)
+		utils.LogError(r.Context(), function, "srp.NewServer", err)
 		utils.SendInternalError(w)
 		return
 	}
 
 	// Set client public ephemeral A
-	if err := server.SetA(req.A); err != nil {
-		utils.LogError("LoginStart", "server.SetA", err)
+	if err := server.SetA(A); err != nil {
+		utils.LogError(r.Context(), function, "server.SetA", err)
 		utils.SendBadRequest(w)
 		return
 	}
@@ -213,28 +362,27 @@ func LoginStart(w http.ResponseWriter, r *http.Request) {
 	// Generate a random session ID and store in session cookie
 	sessionID := utils.RandomToken(32)
 	if err := session.Set(w, r, "srp_session_id", sessionID); err != nil {
-		utils.LogError("LoginStart", "session.Set", err)
+		utils.LogError(r.Context(), function, "session.Set", err)
 		utils.SendInternalError(w)
 		return
 	}
 
-	// Store SRP server instance in memory for step 2 verification
-	srpSessionStore.Store(sessionID, types.SRPSession{
+	// Keep the SRP server for step 2 verification
+	if err := h.state.SRPSessions.Save(r.Context(), sessionID, &types.SRPSession{
 		Server:    server,
 		CreatedAt: time.Now(),
-		Email:     req.Email,
-	})
-
-	// Respond with salt and server public ephemeral B
-	type SRPData struct {
-		Salt      []byte `json:"salt"`
-		B         []byte `json:"B"`
-		SessionID string `json:"session_id"`
+		Email:     email,
+		Recovery:  recovery,
+	}); err != nil {
+		utils.LogError(r.Context(), function, "SRPSessions.Save", err)
+		utils.SendInternalError(w)
+		return
 	}
 
-	utils.SendJSON(w, http.StatusOK, types.Reply[SRPData]{
+	// Respond with salt and server public ephemeral B
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginStartResponse]{
 		Success: true,
-		Data: SRPData{
+		Data: types.LoginStartResponse{
 			Salt:      salt,
 			B:         server.B(),
 			SessionID: sessionID,
@@ -242,130 +390,124 @@ func LoginStart(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// LoginVerify is the second step of the SRP login procedure.
-func LoginVerify(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Email     string `json:"email"`
-		M1        []byte `json:"M1"`
-		SessionID string `json:"session_id"`
-	}
-
-	if err := utils.ParseJSON(r.Body, &req); err != nil {
-		utils.SendBadRequest(w)
-		return
+// checkSRPProof verifies the client proof M1 of an SRP handshake that LoginStart began for email,
+// or StartRecovery if recovery is set, and returns the server proof M2. A verified proof resets the account's failures.
+// On failure the error response has been sent.
+func (h *API) checkSRPProof(w http.ResponseWriter, r *http.Request, function, sessionID, email string, M1 []byte, recovery bool) ([]byte, bool) {
+	M2, ok := h.verifySRPProof(w, r, function, sessionID, email, M1, recovery)
+	if !ok {
+		return nil, false
 	}
 
-	if len(req.Email) == 0 || len(req.M1) == 0 || len(req.SessionID) == 0 {
-		utils.SendBadRequest(w)
-		return
+	if err := h.forgetLoginFailures(r.Context(), email); err != nil {
+		utils.LogError(r.Context(), function, "forgetLoginFailures", err)
+		utils.SendInternalError(w)
+		return nil, false
 	}
+	return M2, true
+}
 
+// verifySRPProof is checkSRPProof without resetting the account's failures, for logins that still need a second factor.
+// A verified handshake is removed, so each proof is only accepted once, and failed proofs are limited
+// per handshake and per account, see recordLoginFailure.
+// On failure the error response has been sent.
+func (h *API) verifySRPProof(w http.ResponseWriter, r *http.Request, function, sessionID, email string, M1 []byte, recovery bool) ([]byte, bool) {
 	// Load the previously saved SRP server using the session ID
-	value, ok := srpSessionStore.Load(req.SessionID)
-	if !ok {
+	sess, err := h.state.SRPSessions.Get(r.Context(), sessionID)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		utils.LogError(r.Context(), function, "SRPSessions.Get", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+	if err != nil || time.Since(sess.CreatedAt) > constants.SRPSessionTTL {
 		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
 			Success: false,
 			Message: "Invalid or expired session.",
 		})
-		return
+		return nil, false
 	}
 
-	sess := value.(types.SRPSession) // safe to assert now
-	server := sess.Server            // get SRP server from the session
+	server := sess.Server // get SRP server from the session
 
-	// Make sure the same email is provided
-	if sess.Email != req.Email {
+	// Make sure the same email is provided, and a proof of the recovery code isn't taken for the password
+	if sess.Email != email || sess.Recovery != recovery {
 		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
 			Success: false,
 			Message: "Invalid session.",
 		})
-		return
+		return nil, false
+	}
+
+	// Limit the guesses per account, from all addresses together
+	now := time.Now()
+	if !h.checkLoginThrottle(w, r, function, email, now) {
+		return nil, false
+	}
+
+	// Limit the guesses per handshake, the client has to start a new one after that
+	ok, err := h.state.SRPSessions.CountAttempt(r.Context(), sessionID, constants.MaxSRPProofAttempts)
+	if err != nil {
+		utils.LogError(r.Context(), function, "SRPSessions.CountAttempt", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+	if !ok { // used up, possibly by a concurrent proof
+		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+			Success: false,
+			Message: "Invalid or expired session.",
+		})
+		return nil, false
 	}
 
 	// Verify client proof
-	okVerify, err := server.CheckM1(req.M1)
+	okVerify, err := server.CheckM1(M1)
 	if err != nil || !okVerify {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		if !h.countLoginFailure(w, r, function, email, now) {
+			return nil, false
+		}
+
 		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
 			Success: false,
 			Message: "Invalid credentials.",
 		})
-		return
+		return nil, false
 	}
 
 	// Compute server proof M2
 	M2, err := server.ComputeM2()
 	if err != nil {
-		utils.LogError("LoginVerify", "server.ComputeM2", err)
+		utils.LogError(r.Context(), function, "server.ComputeM2", err)
 		utils.SendInternalError(w)
-		return
+		return nil, false
 	}
 
-	// Login successful, generate access token
-	accessToken := utils.RandomToken(32)
-	expires := time.Now().Add(constants.AccessTokenExpiry)
-
-	// Get the user UUID for this email
-	var userUUID string
-	if err := database.QueryRow(r.Context(),
-		"SELECT uuid FROM users WHERE email=?",
-		sess.Email,
-	).Scan(&userUUID); err != nil {
-		utils.LogError("LoginVerify", "database.QueryRow", err)
-		utils.SendInternalError(w)
-		return
-	}
-
-	// Insert new session to DB
-	_, err = database.Exec(r.Context(), `
-		INSERT INTO account_sessions (owner, access_token, created_at, expires_at)
-		VALUES (?, ?, ?, ?)`,
-		userUUID, accessToken, time.Now(), expires)
-	if err != nil {
-		utils.LogError("LoginVerify", "database.Exec", err)
-		utils.SendInternalError(w)
-		return
-	}
-
-	// Save token in session
-	if err := session.Set(w, r, "access_token", accessToken); err != nil {
-		utils.LogError("LoginVerify", "session.Set", err)
+	if err := h.state.SRPSessions.Delete(r.Context(), sessionID); err != nil {
+		utils.LogError(r.Context(), function, "SRPSessions.Delete", err)
 		utils.SendInternalError(w)
-		return
+		return nil, false
 	}
-
-	// Remove SRP session after successful login
-	srpSessionStore.Delete(req.SessionID)
-
-	// Send M2 back
-	type M2Data struct {
-		M2 []byte `json:"M2"`
-	}
-
-	utils.SendJSON(w, http.StatusOK, types.Reply[M2Data]{
-		Success: true,
-		Data: M2Data{
-			M2: M2,
-		},
-	})
+	return M2, true
 }
 
-// Logout invalidates the current session and destroys the session cookie.
-func Logout(w http.ResponseWriter, r *http.Request) {
-	// Get the access token from the session
-	accessToken := session.Get[string](r, "access_token")
-	if accessToken != "" {
-		// Delete the session from DB
-		_, _ = database.Exec(r.Context(),
-			"DELETE FROM account_sessions WHERE access_token = ?",
-			accessToken)
+// validateCredentials checks the SRP triplet, master salt and challenge sent on registration or password change.
+// On failure the error response has been sent.
+func validateCredentials(w http.ResponseWriter, triplet srp.Triplet, salt []byte, challenge string) bool {
+	// Make sure the fields are not empty
+	if len(triplet.Username()) == 0 || len(triplet.Verifier()) == 0 || len(triplet.Salt()) == 0 || len(challenge) == 0 {
+		utils.SendBadRequest(w)
+		return false
 	}
 
-	// Destroy the session
-	if err := session.DestroySession(w, r); err != nil {
-		utils.LogError("LogoutUser", "session.DestroySession", err)
+	// Enforce max lengths
+	if len(triplet.Username()) > constants.MaxEmailLen ||
+		len(triplet.Salt()) > constants.MaxSaltLen ||
+		len(salt) > constants.MaxSaltLen ||
+		len(triplet.Verifier()) > constants.MaxVerifierLen ||
+		len(challenge) > constants.MaxChallengeLen {
+		utils.SendBadRequest(w)
+		return false
 	}
 
-	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
-		Success: true,
-	})
+	return true
 }
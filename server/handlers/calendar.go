@@ -1,30 +1,25 @@
 package handlers
 
 import (
-	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"acLife/constants"
 	"acLife/database"
+	"acLife/metrics"
 	"acLife/push"
 	"acLife/session"
 	"acLife/types"
 	"acLife/utils"
 )
 
-func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
+func (h *API) SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 	user := session.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
-	var changes []struct {
-		Type  string               `json:"type"`
-		ID    string               `json:"id,omitempty"`
-		Event types.EncryptedEvent `json:"event"`
-	}
+	var changes []types.CalendarChange
 	if err := utils.ParseJSON(r.Body, &changes); err != nil {
 		utils.SendBadRequest(w)
 		return
@@ -37,20 +32,22 @@ func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := r.Context()
-	tx, err := database.DB.BeginTx(ctx, nil) // start transaction
-	if err != nil {
-		utils.LogError("SaveCalendarEvents", "BeginTx", err)
-		utils.SendInternalError(w)
-		return
-	}
-	defer func() { _ = tx.Rollback() }() // rollback if commit never happens
-
 	var deletedIDs []string
 	var upserts []types.CalendarEvent
+	var added, updated int
 
 	// Process each change
 	for _, c := range changes {
+		// Event IDs are stored as UUIDs on PostgreSQL, so anything else is refused everywhere
+		id := c.ID
+		if c.Type != "deleted" {
+			id = c.Event.ID
+		}
+		if !utils.ValidateUUID(id) {
+			utils.SendBadRequest(w)
+			return
+		}
+
 		switch c.Type {
 		case "deleted":
 			deletedIDs = append(deletedIDs, c.ID) // collect IDs to delete
@@ -58,7 +55,7 @@ func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 		case "added", "updated":
 			decoded, err := base64.StdEncoding.DecodeString(c.Event.Data) // decode event payload
 			if err != nil {
-				utils.LogError("SaveCalendarEvents", "InvalidBase64", fmt.Errorf("event %s invalid base64: %v", c.Event.ID, err))
+				utils.LogError(r.Context(), "SaveCalendarEvents", "InvalidBase64", fmt.Errorf("event %s invalid base64: %v", c.Event.ID, err))
 				continue
 			}
 
@@ -67,6 +64,12 @@ func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
+			if c.Type == "added" {
+				added++
+			} else {
+				updated++
+			}
+
 			upserts = append(upserts, types.CalendarEvent{
 				ID:        c.Event.ID,
 				Data:      decoded,
@@ -75,56 +78,21 @@ func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Batch delete
-	if len(deletedIDs) > 0 {
-		query := `DELETE FROM calendar_events WHERE owner = ? AND id IN (?` + strings.Repeat(",?", len(deletedIDs)-1) + `)`
-		args := make([]any, 0, len(deletedIDs)+1)
-		args = append(args, user.UUID)
-		for _, id := range deletedIDs {
-			args = append(args, id)
-		}
-		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
-			utils.LogError("SaveCalendarEvents", "BatchDelete", err)
-			utils.SendInternalError(w)
-			return
-		}
-	}
-
-	// Batch upsert
-	if len(upserts) > 0 {
-		valueStrings := make([]string, 0, len(upserts))
-		valueArgs := make([]any, 0, len(upserts)*4)
-
-		for _, ev := range upserts {
-			valueStrings = append(valueStrings, "(?, ?, ?, ?)")
-			valueArgs = append(valueArgs, ev.ID, user.UUID, ev.Data, ev.UpdatedAt)
-		}
-
-		query := `
-		INSERT INTO calendar_events (id, owner, data, updated_at)
-		VALUES ` + strings.Join(valueStrings, ",") + `
-		ON DUPLICATE KEY UPDATE
-			data = VALUES(data),
-			updated_at = VALUES(updated_at)
-		`
-
-		if _, err := tx.ExecContext(ctx, query, valueArgs...); err != nil {
-			utils.LogError("SaveCalendarEvents", "BatchUpsert", err)
-			utils.SendInternalError(w)
-			return
-		}
-	}
-
-	if err := tx.Commit(); err != nil { // finalize transaction
-		utils.LogError("SaveCalendarEvents", "Commit", err)
+	// Apply deletions and upserts in a single transaction
+	if err := database.DB.SaveCalendarEvents(r.Context(), user.UUID, upserts, deletedIDs); err != nil {
+		utils.LogError(r.Context(), "SaveCalendarEvents", "SaveCalendarEvents", err)
 		utils.SendInternalError(w)
 		return
 	}
 
+	metrics.CalendarEvents.WithLabelValues("added").Add(float64(added))
+	metrics.CalendarEvents.WithLabelValues("updated").Add(float64(updated))
+	metrics.CalendarEvents.WithLabelValues("deleted").Add(float64(len(deletedIDs)))
+
 	// Notify other clients via push event
 	originClientID := r.URL.Query().Get("c")
 	if originClientID != "" && len(originClientID) == 6 {
-		go push.SendToUser(context.Background(), user.UUID, push.SyncEvent(originClientID))
+		h.push.Enqueue(r.Context(), user.UUID, push.SyncEvent(originClientID))
 	}
 
 	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
@@ -132,7 +100,7 @@ func SaveCalendarEvents(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func SyncCalendarEvents(w http.ResponseWriter, r *http.Request) {
+func (h *API) SyncCalendarEvents(w http.ResponseWriter, r *http.Request) {
 	user := session.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
@@ -147,7 +115,7 @@ func SyncCalendarEvents(w http.ResponseWriter, r *http.Request) {
 	for i, c := range cached {
 		uuid, err := utils.Base64ToUUID(c.ID)
 		if err != nil {
-			utils.LogError("SyncCalendarEvents", "InvalidUUID", fmt.Errorf("event %s invalid UUID: %v", c.ID, err))
+			utils.LogError(r.Context(), "SyncCalendarEvents", "InvalidUUID", fmt.Errorf("event %s invalid UUID: %v", c.ID, err))
 			continue
 		}
 
@@ -156,28 +124,12 @@ func SyncCalendarEvents(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch all events for this user from DB
-	rows, err := database.Query(r.Context(), `
-		SELECT id, data, updated_at
-		FROM calendar_events
-		WHERE owner = ?
-	`, user.UUID)
+	dbEvents, err := database.DB.GetCalendarEvents(r.Context(), user.UUID)
 	if err != nil {
-		utils.LogError("SyncCalendarEvents", "QueryAll", err)
+		utils.LogError(r.Context(), "SyncCalendarEvents", "GetCalendarEvents", err)
 		utils.SendInternalError(w)
 		return
 	}
-	defer func() { _ = rows.Close() }()
-
-	var dbEvents []types.CalendarEvent
-	for rows.Next() {
-		var ev types.CalendarEvent
-		if err := rows.Scan(&ev.ID, &ev.Data, &ev.UpdatedAt); err != nil {
-			utils.LogError("SyncCalendarEvents", "Scan", err)
-			utils.SendInternalError(w)
-			return
-		}
-		dbEvents = append(dbEvents, ev)
-	}
 
 	seenIDs := make(map[string]struct{})
 	updatedEvents := make([]types.EncryptedEvent, 0)
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/mail"
+	"acLife/push"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// revokeSessionPurpose is signed into the links of new device alerts, so other signed tokens aren't accepted in their place.
+const revokeSessionPurpose = "revoke-session"
+
+// revokeSessionClaims are carried by the "this wasn't me" link of a new device alert.
+type revokeSessionClaims struct {
+	UUID      string `json:"u"`
+	SessionID int    `json:"s"`
+}
+
+// revokeSessionPage is shown by the "this wasn't me" link. Its form posts the token back to revoke the session.
+var revokeSessionPage = template.Must(template.New("revoke").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>acLife</title>
+</head>
+<body>
+<p>{{.Message}}</p>
+{{if .Token}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Log that device out</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupKnownDevices(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := database.DB.DeleteDevicesSeenBefore(ctx, time.Now().Add(-constants.KnownDeviceTTL)); err != nil {
+		utils.LogError(ctx, "cleanupKnownDevices", "DeleteDevicesSeenBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// ConfirmRevokeSession shows the page of a new device alert's "this wasn't me" link.
+// Mail scanners open links to check them, so opening it only asks to confirm, the form posts to RevokeSessionByLink.
+func (h *API) ConfirmRevokeSession(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, ok := h.parseRevokeSessionToken(w, token); !ok {
+		return
+	}
+
+	sendRevokeSessionPage(w, http.StatusOK,
+		"Someone logged in to your acLife account from a new device. If this wasn't you, log that device out, "+
+			"then change your password.",
+		token,
+	)
+}
+
+// RevokeSessionByLink logs out the session of a new device alert, given the token of its "this wasn't me" link
+// in the form posted by its page. Posting it again is fine.
+func (h *API) RevokeSessionByLink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.parseRevokeSessionToken(w, r.PostFormValue("token"))
+	if !ok {
+		return
+	}
+
+	subs, ok := h.sessionPushSubscriptions(w, r, "RevokeSessionByLink", claims.UUID, func(sessionID int) bool {
+		return sessionID == claims.SessionID
+	})
+	if !ok {
+		return
+	}
+
+	// Already gone if it was revoked, logged out or expired in the meantime
+	err := database.DB.DeleteAccountSessionByID(r.Context(), claims.UUID, claims.SessionID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		utils.LogError(r.Context(), "RevokeSessionByLink", "DeleteAccountSessionByID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	h.push.EnqueueTo(r.Context(), subs, push.RevokedEvent())
+
+	sendRevokeSessionPage(w, http.StatusOK, "The device was logged out. Change your password, since someone else knows it.", "")
+}
+
+/* -------------------- Helpers -------------------- */
+
+// alertNewDevice remembers the device of a new session and, if the account hasn't seen it before,
+// notifies the user's devices and emails them a link to revoke the session.
+// Failures are logged, they don't fail the login.
+func (h *API) alertNewDevice(r *http.Request, user *types.User, accountSession *types.AccountSession) {
+	ctx := r.Context()
+
+	isNew, err := database.DB.RememberDevice(ctx, user.UUID, deviceFingerprint(accountSession.UserAgent, accountSession.IP), accountSession.CreatedAt)
+	if err != nil {
+		utils.LogError(ctx, "alertNewDevice", "RememberDevice", err)
+		return
+	}
+	if !isNew {
+		return
+	}
+
+	// The session can't outlive its maximum lifetime, and neither needs the link
+	token, err := utils.SignToken(h.linkKey, revokeSessionPurpose, revokeSessionClaims{
+		UUID:      user.UUID,
+		SessionID: accountSession.ID,
+	}, accountSession.CreatedAt.Add(h.cfg.Sessions.MaxLifetime))
+	if err != nil {
+		utils.LogError(ctx, "alertNewDevice", "SignToken", err)
+		return
+	}
+
+	link := h.cfg.ServerURL.JoinPath("auth/sessions/revoke")
+	link.RawQuery = url.Values{"token": {token}}.Encode()
+
+	device := accountSession.DeviceName
+	if device == "" {
+		device = accountSession.UserAgent
+	}
+	if device == "" {
+		device = "Unknown device"
+	}
+
+	h.push.Enqueue(ctx, user.UUID, push.NotificationEvent("New login to your account",
+		"From "+device+" at "+accountSession.IP+" around "+accountSession.CreatedAt.UTC().Format("15:04 UTC, January 2")+
+			". If this wasn't you, open "+link.String()))
+	h.mail.Enqueue(ctx, mail.NewDeviceLoginEmail(user.Email, accountSession.CreatedAt, accountSession.IP, device, link.String()))
+}
+
+// rememberRegistrationDevice records the device an account registered from,
+// so that a first login from another device is reported. Failures are logged, they don't fail the registration.
+func (h *API) rememberRegistrationDevice(r *http.Request, user *types.User) {
+	fingerprint := deviceFingerprint(clientUserAgent(r), h.getClientIP(r))
+	if _, err := database.DB.RememberDevice(r.Context(), user.UUID, fingerprint, time.Now()); err != nil {
+		utils.LogError(r.Context(), "rememberRegistrationDevice", "RememberDevice", err)
+	}
+}
+
+// clientUserAgent returns the request's user agent as stored with sessions, cut to constants.MaxUserAgentLen.
+func clientUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > constants.MaxUserAgentLen {
+		userAgent = userAgent[:constants.MaxUserAgentLen]
+	}
+	return strings.ToValidUTF8(userAgent, "")
+}
+
+// parseRevokeSessionToken checks the token of a "this wasn't me" link.
+// On failure the error page has been sent.
+func (h *API) parseRevokeSessionToken(w http.ResponseWriter, token string) (revokeSessionClaims, bool) {
+	var claims revokeSessionClaims
+	if err := utils.ParseSignedToken(h.linkKey, revokeSessionPurpose, token, &claims, time.Now()); err != nil {
+		sendRevokeSessionPage(w, http.StatusBadRequest, "Invalid or expired link.", "")
+		return claims, false
+	}
+	return claims, true
+}
+
+// sendRevokeSessionPage replies with the page of a "this wasn't me" link, with the form if token is set.
+func sendRevokeSessionPage(w http.ResponseWriter, status int, message, token string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+	w.Header().Set("Referrer-Policy", "no-referrer") // the address holds the token
+	w.WriteHeader(status)
+	_ = revokeSessionPage.Execute(w, struct{ Message, Token string }{message, token})
+}
+
+// deviceFingerprint identifies a device by its user agent and the network of its address,
+// so that a device moving between addresses of the same provider stays known.
+func deviceFingerprint(userAgent, ip string) []byte {
+	network := ip
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if v4 := parsed.To4(); v4 != nil {
+			network = v4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = parsed.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	return utils.HashToken(userAgent + "\n" + network)
+}
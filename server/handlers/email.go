@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/mail"
+	"acLife/session"
+	"acLife/types"
+	"acLife/utils"
+
+	"mz.attahri.com/code/srp/v3"
+)
+
+// changeEmailPurpose is signed into email change links, so verification links aren't accepted in their place.
+const changeEmailPurpose = "change-email"
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupEmailChanges(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := database.DB.DeleteEmailChangesCreatedBefore(ctx, time.Now().Add(-constants.EmailVerificationTTL)); err != nil {
+		utils.LogError(ctx, "cleanupEmailChanges", "DeleteEmailChangesCreatedBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// ChangeEmail starts changing the user's email address, given a proof of the password and an SRP triplet
+// for the new address. The change is applied once the link sent to the new address is opened.
+func (h *API) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.ChangeEmailRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// The password and the master key stay the same, only the verifier is bound to the address
+	var triplet srp.Triplet = req.Triplet
+	email := triplet.Username()
+	if len(email) == 0 || len(email) > constants.MaxEmailLen ||
+		len(triplet.Salt()) == 0 || len(triplet.Salt()) > constants.MaxSaltLen ||
+		len(triplet.Verifier()) == 0 || len(triplet.Verifier()) > constants.MaxVerifierLen ||
+		strings.EqualFold(email, user.Email) {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if !utils.ValidateEmail(email) {
+		utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+			Success: false,
+			Message: "Invalid email address.",
+		})
+		return
+	}
+	if !h.cfg.Registration.EmailDomainAllowed(email) {
+		sendEmailDomainNotAllowed(w)
+		return
+	}
+
+	// Prove knowledge of the password
+	M2, ok := h.checkSRPProof(w, r, "ChangeEmail", req.SessionID, user.Email, req.M1, false)
+	if !ok {
+		return
+	}
+
+	// Checked again when the change is applied, in case the address is taken in the meantime
+	_, err := database.DB.GetUserByEmail(r.Context(), email)
+	if err == nil {
+		sendEmailInUse(w)
+		return
+	}
+	if !errors.Is(err, database.ErrNotFound) {
+		utils.LogError(r.Context(), "ChangeEmail", "GetUserByEmail", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if err := database.DB.RequestEmailChange(r.Context(), &types.EmailChange{
+		Owner:     user.UUID,
+		Email:     email,
+		SrpSalt:   triplet.Salt(),
+		Verifier:  triplet.Verifier(),
+		CreatedAt: time.Now(),
+	}); err != nil {
+		utils.LogError(r.Context(), "ChangeEmail", "RequestEmailChange", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	token, err := utils.SignToken(h.linkKey, changeEmailPurpose, emailClaims{
+		UUID:  user.UUID,
+		Email: email,
+	}, time.Now().Add(constants.EmailVerificationTTL))
+	if err != nil {
+		utils.LogError(r.Context(), "ChangeEmail", "SignToken", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	link := h.cfg.ServerURL.JoinPath("auth/email/change")
+	link.RawQuery = url.Values{"token": {token}}.Encode()
+
+	h.mail.Enqueue(r.Context(), mail.EmailChangeEmail(email, link.String(), constants.EmailVerificationTTL))
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginVerifyResponse]{
+		Success: true,
+		Message: "Check the inbox of the new address to confirm the change.",
+		Data:    types.LoginVerifyResponse{M2: M2},
+	})
+}
+
+// ConfirmEmailChange applies a change started with ChangeEmail, given the token of the link sent to the new address.
+// The old address is notified, and the Stripe customer gets the new one.
+func (h *API) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var claims emailClaims
+	if err := utils.ParseSignedToken(h.linkKey, changeEmailPurpose, r.URL.Query().Get("token"), &claims, time.Now()); err != nil {
+		sendInvalidVerificationLink(w)
+		return
+	}
+
+	user, err := database.DB.GetUserByUUID(r.Context(), claims.UUID)
+	if errors.Is(err, database.ErrNotFound) {
+		sendInvalidVerificationLink(w)
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "ConfirmEmailChange", "GetUserByUUID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Opening the link again is fine
+	if user.Email == claims.Email {
+		utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+			Success: true,
+			Message: "Email address changed.",
+		})
+		return
+	}
+
+	// Gone if the password changed or another change was requested since
+	err = database.DB.ApplyEmailChange(r.Context(), user.UUID, claims.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		sendInvalidVerificationLink(w)
+		return
+	}
+	if database.IsDuplicateEntry(err) {
+		sendEmailInUse(w)
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "ConfirmEmailChange", "ApplyEmailChange", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Handshakes started with the old address can't be finished anymore
+	if err := h.state.SRPSessions.DeleteByEmail(r.Context(), user.Email); err != nil {
+		utils.LogError(r.Context(), "ConfirmEmailChange", "DeleteByEmail", err)
+	}
+
+	// The address is changed either way, billing emails just keep going to the old one
+	if err := h.updateBillingEmail(r.Context(), user, claims.Email); err != nil {
+		utils.LogError(r.Context(), "ConfirmEmailChange", "updateBillingEmail", err)
+	}
+
+	h.mail.Enqueue(r.Context(), mail.EmailChangedEmail(user.Email, claims.Email, time.Now()))
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+		Message: "Email address changed.",
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// sendEmailDomainNotAllowed replies to an address outside the domains allowed by EMAIL_DOMAIN_ALLOWLIST and EMAIL_DOMAIN_BLOCKLIST.
+func sendEmailDomainNotAllowed(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+		Success: false,
+		Message: "Email addresses of this domain can't be used on this server.",
+	})
+}
+
+func sendEmailInUse(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+		Success: false,
+		Message: "Email already in use.",
+	})
+}
@@ -2,23 +2,96 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
+	"time"
 
+	"acLife/config"
 	"acLife/constants"
+	"acLife/lifecycle"
+	"acLife/mail"
+	"acLife/push"
+	"acLife/state"
+	"acLife/twofactor"
 	"acLife/types"
 	"acLife/utils"
+
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
-func Root(w http.ResponseWriter, r *http.Request) {
+// API holds the configuration and services shared by the request handlers.
+type API struct {
+	cfg      *config.Config
+	push     *push.Sender
+	mail     *mail.Mailer
+	state    *state.Store
+	tasks    *lifecycle.Manager
+	metadata types.ServerMetadata
+	webAuthn *webauthn.WebAuthn
+	linkKey  []byte // signs the links sent by email
+}
+
+// New creates the request handlers for the given configuration.
+// Background work started by handlers is tracked by tasks.
+func New(cfg *config.Config, tasks *lifecycle.Manager) *API {
+	webAuthn, err := twofactor.NewWebAuthn(cfg.WebAuthn)
+	utils.Assert(err == nil) // only fails without origins, which the config always has
+
+	return &API{
+		cfg:      cfg,
+		push:     push.NewSender(cfg.Push),
+		mail:     mail.New(cfg.Mail),
+		state:    state.New(cfg.StateStore),
+		tasks:    tasks,
+		metadata: cfg.Metadata(),
+		webAuthn: webAuthn,
+		linkKey:  utils.DeriveKey(cfg.SessionKey, "email links"),
+	}
+}
+
+// StartWorkers starts the periodic cleanup of expired sessions and caches, and of accounts due for deletion.
+func (h *API) StartWorkers() {
+	h.tasks.Every("cleanupSRPSessions", 1*time.Minute, h.cleanupSRPSessions)
+	h.tasks.Every("cleanupPendingLogins", 1*time.Minute, h.cleanupPendingLogins)
+	h.tasks.Every("cleanupLoginFailures", 1*time.Hour, h.cleanupLoginFailures)
+	h.tasks.Every("cleanupWebAuthnSetups", 1*time.Minute, h.cleanupWebAuthnSetups)
+	h.tasks.Every("cleanupVerificationMails", 1*time.Minute, h.cleanupVerificationMails)
+	h.tasks.Every("cleanupPendingRecoveries", 1*time.Minute, h.cleanupPendingRecoveries)
+	h.tasks.Every("cleanupEmailChanges", 1*time.Hour, h.cleanupEmailChanges)
+	h.tasks.Every("cleanupAccountSessions", 1*time.Hour, h.cleanupAccountSessions)
+	h.tasks.Every("cleanupKnownDevices", 1*time.Hour, h.cleanupKnownDevices)
+	h.tasks.Every("cleanupRateLimits", 1*time.Minute, h.cleanupRateLimits)
+	h.tasks.Every("cleanupSubCache", constants.SubCacheTTL, h.cleanupSubCache)
+	h.tasks.Every("purgeDeletedAccounts", 1*time.Hour, h.purgeDeletedAccounts)
+}
+
+// DrainPush waits for push notifications queued by handlers to be sent.
+// It must only be called once the HTTP server has stopped accepting requests.
+func (h *API) DrainPush(ctx context.Context) error {
+	return h.push.Drain(ctx)
+}
+
+// DrainMail waits for emails queued by handlers to be sent.
+// It must only be called once the HTTP server has stopped accepting requests.
+func (h *API) DrainMail(ctx context.Context) error {
+	return h.mail.Drain(ctx)
+}
+
+// Config returns the configuration the handlers were created with.
+func (h *API) Config() *config.Config {
+	return h.cfg
+}
+
+func (h *API) Root(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
 		Success: true,
 		Message: "acLife API v" + constants.Version,
 	})
 }
 
-func Metadata(w http.ResponseWriter, r *http.Request) {
+func (h *API) Metadata(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSON(w, http.StatusOK, types.Reply[types.ServerMetadata]{
 		Success: true,
-		Data:    constants.Metadata,
+		Data:    h.metadata,
 	})
 }
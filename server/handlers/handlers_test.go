@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"maps"
+	"testing"
+
+	"acLife/config"
+	"acLife/database"
+	"acLife/lifecycle"
+	"acLife/utils"
+)
+
+// newTestAPI returns the handlers on store, with overrides applied on top of the default test configuration.
+func newTestAPI(t *testing.T, store database.Store, overrides map[string]string) *API {
+	t.Helper()
+
+	values := map[string]string{
+		"PORT":        "8000",
+		"SERVER_URL":  "https://localhost:8000/",
+		"SESSION_KEY": utils.RandomToken(32),
+		"DB_DRIVER":   "sqlite",
+	}
+	maps.Copy(values, overrides)
+
+	cfg, err := config.Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database.DB = store
+	return New(cfg, lifecycle.New())
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// Live reports that the process is up and serving requests.
+func (h *API) Live(w http.ResponseWriter, r *http.Request) {
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+// Ready reports whether the server can handle traffic.
+// It fails with 503 if the database is unreachable or its schema isn't up to date.
+func (h *API) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), constants.DBTimeout)
+	defer cancel()
+
+	report := types.Readiness{
+		Ready: true,
+		Checks: map[string]types.HealthCheck{
+			"database": checkDatabase(ctx),
+			"schema":   checkSchema(ctx),
+			"push":     checkEnabled(h.cfg.Push.Enabled()),
+			"stripe":   checkEnabled(h.cfg.Stripe.Enabled()),
+		},
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == "fail" {
+			report.Ready = false
+		}
+	}
+
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	utils.SendJSON(w, status, types.Reply[types.Readiness]{
+		Success: report.Ready,
+		Data:    report,
+	})
+}
+
+// Diagnostics reports internal state useful for debugging a running server.
+func (h *API) Diagnostics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), constants.DBTimeout)
+	defer cancel()
+
+	version, err := database.DB.SchemaVersion(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "SchemaVersion", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// The shared state may live in the database
+	srpSessions, err := h.state.SRPSessions.Len(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "SRPSessions.Len", err)
+		utils.SendInternalError(w)
+		return
+	}
+	rateLimits, err := h.state.RateLimits.Len(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "RateLimits.Len", err)
+		utils.SendInternalError(w)
+		return
+	}
+	pendingLogins, err := h.state.PendingLogins.Len(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "PendingLogins.Len", err)
+		utils.SendInternalError(w)
+		return
+	}
+	loginFailures, err := h.state.LoginFailures.Len(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "LoginFailures.Len", err)
+		utils.SendInternalError(w)
+		return
+	}
+	subscriptions, err := h.state.Subscriptions.Len(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Diagnostics", "Subscriptions.Len", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	stats := database.DB.Stats()
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.Diagnostics]{
+		Success: true,
+		Data: types.Diagnostics{
+			Version:       constants.Version,
+			SchemaVersion: version,
+			Pool: types.PoolStats{
+				MaxOpen:      stats.MaxOpenConnections,
+				Open:         stats.OpenConnections,
+				InUse:        stats.InUse,
+				Idle:         stats.Idle,
+				WaitCount:    stats.WaitCount,
+				WaitDuration: stats.WaitDuration.Milliseconds(),
+			},
+			Caches: types.CacheSizes{
+				SRPSessions:   srpSessions,
+				PendingLogins: pendingLogins,
+				RateLimits:    rateLimits,
+				LoginFailures: loginFailures,
+				Subscriptions: subscriptions,
+			},
+			PushPending: h.push.Pending(),
+			Workers:     h.tasks.Running(),
+		},
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+func checkDatabase(ctx context.Context) types.HealthCheck {
+	if err := database.DB.Ping(ctx); err != nil {
+		utils.LogError(ctx, "Ready", "Ping", err)
+		return types.HealthCheck{Status: "fail", Detail: "database unreachable"}
+	}
+	return types.HealthCheck{Status: "ok"}
+}
+
+func checkSchema(ctx context.Context) types.HealthCheck {
+	current, err := database.DB.SchemaVersion(ctx)
+	if err != nil {
+		utils.LogError(ctx, "Ready", "SchemaVersion", err)
+		return types.HealthCheck{Status: "fail", Detail: "schema version unavailable"}
+	}
+
+	latest, err := database.DB.LatestSchemaVersion()
+	if err != nil {
+		utils.LogError(ctx, "Ready", "LatestSchemaVersion", err)
+		return types.HealthCheck{Status: "fail", Detail: "schema version unavailable"}
+	}
+
+	detail := fmt.Sprintf("version %d of %d", current, latest)
+	if current != latest {
+		return types.HealthCheck{Status: "fail", Detail: detail}
+	}
+	return types.HealthCheck{Status: "ok", Detail: detail}
+}
+
+func checkEnabled(enabled bool) types.HealthCheck {
+	if !enabled {
+		return types.HealthCheck{Status: "disabled"}
+	}
+	return types.HealthCheck{Status: "ok"}
+}
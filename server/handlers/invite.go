@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/session"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/gorilla/mux"
+)
+
+/* -------------------- Handlers -------------------- */
+
+// ListInvites returns the invite codes the user created, without the codes themselves.
+func (h *API) ListInvites(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	h.sendInvites(w, r, "ListInvites", &user.UUID)
+}
+
+// CreateInvite creates an invite code for the user, as long as their invites admit at most
+// the configured quota of accounts. Uses of expired or revoked invites still count.
+func (h *API) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	if h.cfg.Registration.InviteQuota == 0 {
+		utils.SendJSON(w, http.StatusForbidden, types.Reply[any]{
+			Success: false,
+			Message: "Only admins can create invites on this server.",
+		})
+		return
+	}
+
+	h.createInvite(w, r, "CreateInvite", &user.UUID)
+}
+
+// RevokeInvite ends one of the user's invite codes before it expires.
+func (h *API) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	h.revokeInvite(w, r, "RevokeInvite", &user.UUID)
+}
+
+// ListAllInvites returns every invite code, including those created by users, without the codes themselves.
+func (h *API) ListAllInvites(w http.ResponseWriter, r *http.Request) {
+	h.sendInvites(w, r, "ListAllInvites", nil)
+}
+
+// CreateAdminInvite creates an invite code without a quota.
+func (h *API) CreateAdminInvite(w http.ResponseWriter, r *http.Request) {
+	h.createInvite(w, r, "CreateAdminInvite", nil)
+}
+
+// RevokeAdminInvite ends any invite code before it expires.
+func (h *API) RevokeAdminInvite(w http.ResponseWriter, r *http.Request) {
+	h.revokeInvite(w, r, "RevokeAdminInvite", nil)
+}
+
+/* -------------------- Helpers -------------------- */
+
+// createInvite creates an invite code as described by the request, for creator or for an admin if nil.
+func (h *API) createInvite(w http.ResponseWriter, r *http.Request, function string, creator *string) {
+	var req types.CreateInviteRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	now := time.Now()
+	invite := &types.Invite{
+		Creator:   creator,
+		MaxUses:   max(req.MaxUses, 1),
+		ExpiresAt: now.Add(constants.InviteTTL),
+		CreatedAt: now,
+	}
+	if req.ExpiresAt != 0 {
+		invite.ExpiresAt = time.UnixMilli(req.ExpiresAt)
+	}
+
+	if req.MaxUses < 0 || req.MaxUses > constants.MaxInviteUses ||
+		!invite.ExpiresAt.After(now) || invite.ExpiresAt.After(now.Add(constants.MaxInviteTTL)) {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if req.Email != "" {
+		if !utils.ValidateEmail(req.Email) {
+			utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+				Success: false,
+				Message: "Invalid email address.",
+			})
+			return
+		}
+		if !h.cfg.Registration.EmailDomainAllowed(req.Email) {
+			sendEmailDomainNotAllowed(w)
+			return
+		}
+		invite.Email = &req.Email
+	}
+
+	code := utils.RandomToken(constants.InviteCodeSize)
+	invite.CodeHash = utils.HashToken(code)
+
+	err := database.DB.CreateInvite(r.Context(), invite, h.cfg.Registration.InviteQuota)
+	if errors.Is(err, database.ErrInviteQuotaExceeded) {
+		utils.SendJSON(w, http.StatusForbidden, types.Reply[any]{
+			Success: false,
+			Message: "Your invites would admit more than " + strconv.Itoa(h.cfg.Registration.InviteQuota) + " accounts.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), function, "CreateInvite", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	info := inviteInfo(invite)
+	info.Code = code
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.InviteInfo]{
+		Success: true,
+		Data:    info,
+	})
+}
+
+// sendInvites replies with the invites of creator, or every invite if nil.
+func (h *API) sendInvites(w http.ResponseWriter, r *http.Request, function string, creator *string) {
+	invites, err := database.DB.GetInvites(r.Context(), creator)
+	if err != nil {
+		utils.LogError(r.Context(), function, "GetInvites", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	infos := make([]types.InviteInfo, 0, len(invites))
+	for i := range invites {
+		infos = append(infos, inviteInfo(&invites[i]))
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[[]types.InviteInfo]{
+		Success: true,
+		Data:    infos,
+	})
+}
+
+// revokeInvite revokes the invite with the ID in the path, if creator created it or creator is nil.
+func (h *API) revokeInvite(w http.ResponseWriter, r *http.Request, function string, creator *string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	err = database.DB.RevokeInvite(r.Context(), id, creator, time.Now())
+	if errors.Is(err, database.ErrNotFound) {
+		utils.SendJSON(w, http.StatusNotFound, types.Reply[any]{
+			Success: false,
+			Message: "Invite not found or no longer valid.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), function, "RevokeInvite", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+// checkInvite looks up the invite code a new account registers with. On failure the error response has been sent.
+// The use is only counted when the account is created.
+func checkInvite(w http.ResponseWriter, r *http.Request, code, email string) (*types.Invite, bool) {
+	if code == "" {
+		utils.SendJSON(w, http.StatusForbidden, types.Reply[any]{
+			Success: false,
+			Message: "An invite code is required to register.",
+		})
+		return nil, false
+	}
+
+	invite, err := database.DB.GetInviteByCode(r.Context(), utils.HashToken(code))
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		utils.LogError(r.Context(), "RegisterUser", "GetInviteByCode", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+	if err != nil || invite.Uses >= invite.MaxUses || !invite.ExpiresAt.After(time.Now()) ||
+		(invite.Email != nil && !strings.EqualFold(*invite.Email, email)) {
+		sendInvalidInvite(w)
+		return nil, false
+	}
+
+	return invite, true
+}
+
+func inviteInfo(invite *types.Invite) types.InviteInfo {
+	info := types.InviteInfo{
+		ID:        invite.ID,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		ExpiresAt: invite.ExpiresAt.UnixMilli(),
+		CreatedAt: invite.CreatedAt.UnixMilli(),
+	}
+	if invite.Email != nil {
+		info.Email = *invite.Email
+	}
+	return info
+}
+
+func sendInvalidInvite(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusForbidden, types.Reply[any]{
+		Success: false,
+		Message: "Invalid or expired invite code.",
+	})
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"acLife/constants"
+	"acLife/mail"
+	"acLife/metrics"
+	"acLife/state"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// Failed password, recovery code and second factor proofs are counted per account, from any address,
+// since the rate limiter only counts requests per IP. Addresses differing in case are the same account.
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupLoginFailures(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	now := time.Now()
+	if err := h.state.LoginFailures.DeleteExpired(ctx, now.Add(-constants.LoginFailureTTL), now); err != nil {
+		utils.LogError(ctx, "cleanupLoginFailures", "DeleteExpired", err)
+	}
+}
+
+/* -------------------- Helpers -------------------- */
+
+// checkLoginThrottle replies 429 if the account must wait before its next proof is checked.
+// On failure the error response has been sent.
+func (h *API) checkLoginThrottle(w http.ResponseWriter, r *http.Request, function, email string, now time.Time) bool {
+	retryAfter, err := h.loginRetryAfter(r.Context(), email, now)
+	if err != nil {
+		utils.LogError(r.Context(), function, "loginRetryAfter", err)
+		utils.SendInternalError(w)
+		return false
+	}
+	if retryAfter > 0 {
+		metrics.Logins.WithLabelValues("throttled").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		utils.SendJSON(w, http.StatusTooManyRequests, types.Reply[any]{
+			Success: false,
+			Message: "Too many failed attempts, try again later.",
+		})
+		return false
+	}
+	return true
+}
+
+// countLoginFailure records a failed proof for the account and emails the user if it locked the account.
+// It returns false if the error response has been sent, otherwise the caller replies.
+func (h *API) countLoginFailure(w http.ResponseWriter, r *http.Request, function, email string, now time.Time) bool {
+	until, locked, err := h.recordLoginFailure(r.Context(), email, now)
+	if err != nil {
+		utils.LogError(r.Context(), function, "recordLoginFailure", err)
+		utils.SendInternalError(w)
+		return false
+	}
+	if locked {
+		slog.WarnContext(r.Context(), "account locked after failed proofs", "function", function)
+		h.mail.Enqueue(r.Context(), mail.AccountLockedEmail(email, until))
+	}
+	return true
+}
+
+// loginRetryAfter returns how long the account must wait before its next proof is checked, or 0.
+func (h *API) loginRetryAfter(ctx context.Context, email string, now time.Time) (time.Duration, error) {
+	f, err := h.state.LoginFailures.Get(ctx, strings.ToLower(email))
+	if errors.Is(err, state.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return max(f.NextAttemptAt.Sub(now), 0), nil
+}
+
+// recordLoginFailure counts a failed proof for the account. From constants.LoginFailuresBeforeBackoff failures on,
+// each one doubles the wait before the next attempt, and constants.LoginFailuresBeforeLockout lock the account
+// for constants.LoginLockoutDuration. It returns the end of the lockout if this failure started one.
+func (h *API) recordLoginFailure(ctx context.Context, email string, now time.Time) (lockedUntil time.Time, locked bool, err error) {
+	email = strings.ToLower(email)
+
+	failures, err := h.state.LoginFailures.Add(ctx, email, now)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	switch {
+	case failures >= constants.LoginFailuresBeforeLockout:
+		// The backoff starts over once the lockout ends
+		lockedUntil = now.Add(constants.LoginLockoutDuration)
+		return lockedUntil, true, h.state.LoginFailures.Delay(ctx, email, lockedUntil, true)
+	case failures >= constants.LoginFailuresBeforeBackoff:
+		return time.Time{}, false, h.state.LoginFailures.Delay(ctx, email, now.Add(loginBackoff(failures)), false)
+	}
+	return time.Time{}, false, nil
+}
+
+// forgetLoginFailures resets the account's failures after a successful proof.
+func (h *API) forgetLoginFailures(ctx context.Context, email string) error {
+	return h.state.LoginFailures.Delete(ctx, strings.ToLower(email))
+}
+
+// loginBackoff is the wait after the given number of consecutive failures,
+// constants.LoginBackoffBase doubled for each failure past the first that backs off, up to constants.LoginBackoffMax.
+func loginBackoff(failures int) time.Duration {
+	d := constants.LoginBackoffBase
+	for i := constants.LoginFailuresBeforeBackoff; i < failures && d < constants.LoginBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, constants.LoginBackoffMax)
+}
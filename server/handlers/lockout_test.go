@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+)
+
+func TestLoginFailures(t *testing.T) {
+	h := newTestAPI(t, database.NewMemoryStore(), nil)
+	ctx := context.Background()
+
+	const email = "lockout@example.com"
+	now := time.Now()
+
+	// recordLoginFailure and loginRetryAfter, failing the test on errors
+	recordLoginFailure := func(email string, now time.Time) (time.Time, bool) {
+		until, locked, err := h.recordLoginFailure(ctx, email, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return until, locked
+	}
+	loginRetryAfter := func(email string, now time.Time) time.Duration {
+		wait, err := h.loginRetryAfter(ctx, email, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	// The first failures don't slow down the user
+	for range constants.LoginFailuresBeforeBackoff - 1 {
+		if _, locked := recordLoginFailure(email, now); locked {
+			t.Fatal("locked too early")
+		}
+	}
+	if wait := loginRetryAfter(email, now); wait != 0 {
+		t.Fatalf("wait before the backoff: got %v", wait)
+	}
+
+	// Then each failure doubles the wait, regardless of case
+	recordLoginFailure("Lockout@Example.com", now)
+	if wait := loginRetryAfter(email, now); wait != constants.LoginBackoffBase {
+		t.Fatalf("wait after the first backoff: got %v, want %v", wait, constants.LoginBackoffBase)
+	}
+	if wait := loginRetryAfter(email, now.Add(constants.LoginBackoffBase)); wait != 0 {
+		t.Fatalf("wait once the backoff passed: got %v", wait)
+	}
+
+	recordLoginFailure(email, now)
+	if wait := loginRetryAfter(email, now); wait != 2*constants.LoginBackoffBase {
+		t.Fatalf("wait after the second backoff: got %v, want %v", wait, 2*constants.LoginBackoffBase)
+	}
+
+	// Until the account is locked
+	var until time.Time
+	for i := constants.LoginFailuresBeforeBackoff + 1; i < constants.LoginFailuresBeforeLockout; i++ {
+		var locked bool
+		if until, locked = recordLoginFailure(email, now); locked != (i == constants.LoginFailuresBeforeLockout-1) {
+			t.Fatalf("failure %d: locked %v", i+1, locked)
+		}
+	}
+	if want := now.Add(constants.LoginLockoutDuration); !until.Equal(want) {
+		t.Fatalf("locked until %v, want %v", until, want)
+	}
+	if wait := loginRetryAfter(email, now); wait != constants.LoginLockoutDuration {
+		t.Fatalf("wait while locked: got %v, want %v", wait, constants.LoginLockoutDuration)
+	}
+
+	// A success starts over
+	if err := h.forgetLoginFailures(ctx, email); err != nil {
+		t.Fatal(err)
+	}
+	if wait := loginRetryAfter(email, now); wait != 0 {
+		t.Fatalf("wait after a success: got %v", wait)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	if got := loginBackoff(constants.LoginFailuresBeforeBackoff); got != constants.LoginBackoffBase {
+		t.Errorf("first backoff: got %v, want %v", got, constants.LoginBackoffBase)
+	}
+	if got := loginBackoff(constants.LoginFailuresBeforeBackoff + 100); got != constants.LoginBackoffMax {
+		t.Errorf("backoff after many failures: got %v, want %v", got, constants.LoginBackoffMax)
+	}
+}
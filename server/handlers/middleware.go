@@ -2,88 +2,46 @@ package handlers
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"net"
 	"net/http"
-	"os"
+	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"acLife/constants"
 	"acLife/database"
+	"acLife/logging"
+	"acLife/metrics"
 	"acLife/session"
+	"acLife/state"
 	"acLife/types"
 	"acLife/utils"
 
 	"github.com/gorilla/mux"
 )
 
-var (
-	isBehindProxy = os.Getenv("IS_BEHIND_PROXY") != ""
-
-	rateLimitStore = sync.Map{} // map[string]*rateLimitEntry
-	subCache       = sync.Map{} // map[string]subCacheEntry
-)
-
-type rateLimitEntry struct {
-	timestamps []time.Time
-	mu         sync.Mutex
-}
-
-type subCacheEntry struct {
-	status    string
-	expiresAt time.Time
-}
-
-func init() {
-	go cleanupRateLimits(constants.RateLimitCacheTTL)
-	go cleanupSubCache(constants.SubCacheTTL)
-}
+// requestIDRe limits propagated request IDs to a safe length and character set.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
 
 /* -------------------- Cleanup -------------------- */
 
-func cleanupRateLimits(ttl time.Duration) {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+func (h *API) cleanupRateLimits(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
 
-	for range ticker.C {
-		now := time.Now()
-
-		rateLimitStore.Range(func(key, value any) bool {
-			entry := value.(*rateLimitEntry)
-
-			entry.mu.Lock()
-			filtered := make([]time.Time, 0, len(entry.timestamps))
-			for _, ts := range entry.timestamps {
-				if now.Sub(ts) <= ttl {
-					filtered = append(filtered, ts)
-				}
-			}
-			entry.timestamps = filtered
-			empty := len(filtered) == 0
-			entry.mu.Unlock()
-
-			if empty {
-				rateLimitStore.Delete(key)
-			}
-			return true
-		})
+	if err := h.state.RateLimits.DeleteBefore(ctx, time.Now().Add(-constants.RateLimitCacheTTL)); err != nil {
+		utils.LogError(ctx, "cleanupRateLimits", "DeleteBefore", err)
 	}
 }
 
-func cleanupSubCache(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+func (h *API) cleanupSubCache(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
 
-	for range ticker.C {
-		now := time.Now()
-		subCache.Range(func(key, value any) bool {
-			entry := value.(subCacheEntry)
-			if now.After(entry.expiresAt) {
-				subCache.Delete(key)
-			}
-			return true
-		})
+	if err := h.state.Subscriptions.DeleteExpired(ctx, time.Now()); err != nil {
+		utils.LogError(ctx, "cleanupSubCache", "DeleteExpired", err)
 	}
 }
 
@@ -99,6 +57,24 @@ func MaxBodySizeMiddleware(limit int64) mux.MiddlewareFunc {
 	}
 }
 
+// RequestIDMiddleware assigns an ID to each request, keeping a valid X-Request-ID sent by the client or proxy.
+// The ID is returned in the response and added to all log lines of the request, along with its route.
+func RequestIDMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get("X-Request-ID")
+			if !requestIDRe.MatchString(id) {
+				id = utils.RandomToken(16)
+			}
+
+			w.Header().Set("X-Request-ID", id)
+
+			ctx := logging.WithRequest(r.Context(), id, metrics.Route(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // BodyCloseMiddleware closes the request Body handle at the end of the request.
 func BodyCloseMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
@@ -110,27 +86,18 @@ func BodyCloseMiddleware() mux.MiddlewareFunc {
 }
 
 // RateLimitMiddleware limits the number of requests made by the user in a specified period of time.
-func RateLimitMiddleware(maxRequests int, window time.Duration) mux.MiddlewareFunc {
+func (h *API) RateLimitMiddleware(maxRequests int, window time.Duration) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getClientIP(r)
-			now := time.Now()
-
-			val, _ := rateLimitStore.LoadOrStore(ip, &rateLimitEntry{})
-			entry := val.(*rateLimitEntry)
-
-			entry.mu.Lock()
-			filtered := make([]time.Time, 0, len(entry.timestamps))
-			for _, ts := range entry.timestamps {
-				if now.Sub(ts) <= window {
-					filtered = append(filtered, ts)
-				}
+			allowed, err := h.state.RateLimits.Allow(r.Context(), h.getClientIP(r), maxRequests, window, time.Now())
+			if err != nil {
+				// A broken limiter shouldn't take the whole API down with it
+				utils.LogError(r.Context(), "RateLimitMiddleware", "RateLimits.Allow", err)
+				allowed = true
 			}
 
-			if len(filtered) >= maxRequests {
-				entry.timestamps = filtered
-				entry.mu.Unlock()
-
+			if !allowed {
+				metrics.RateLimitRejections.WithLabelValues(metrics.Route(r)).Inc()
 				utils.SendJSON(w, http.StatusTooManyRequests, types.Reply[any]{
 					Success: false,
 					Message: "Too many requests.",
@@ -138,19 +105,23 @@ func RateLimitMiddleware(maxRequests int, window time.Duration) mux.MiddlewareFu
 				return
 			}
 
-			entry.timestamps = append(filtered, now)
-			entry.mu.Unlock()
-
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// AuthMiddleware requires the user to be logged in at the time of the request.
-func AuthMiddleware() mux.MiddlewareFunc {
+// AuthMiddleware requires the user to be logged in at the time of the request,
+// with the session cookie or an Authorization: Bearer access token.
+// Expired access tokens in the cookie are renewed with the refresh token stored next to them.
+// It also records when and from where the session was last seen.
+func (h *API) AuthMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			user := session.GetLoggedInUser(r)
+			user, accountSession := session.GetLoggedInSession(r)
+			if user == nil {
+				// Browsers don't refresh explicitly, renew expired access tokens from the cookie
+				user, accountSession = h.refreshCookieSession(w, r)
+			}
 			if user == nil {
 				utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
 					Success: false,
@@ -159,17 +130,31 @@ func AuthMiddleware() mux.MiddlewareFunc {
 				return
 			}
 
+			logging.SetUser(r.Context(), user.UUID)
+
+			// Only write to the database once in a while, or when the address changes
+			now := time.Now()
+			ip := h.getClientIP(r)
+			if now.Sub(accountSession.LastSeenAt) > constants.SessionTouchInterval || ip != accountSession.IP {
+				if err := database.DB.TouchAccountSession(r.Context(), accountSession.AccessToken, ip, now); err != nil {
+					utils.LogError(r.Context(), "AuthMiddleware", "TouchAccountSession", err)
+				}
+				accountSession.IP = ip
+				accountSession.LastSeenAt = now
+			}
+
 			ctx := context.WithValue(r.Context(), session.UserContextKey, user)
+			ctx = context.WithValue(ctx, session.AccountSessionContextKey, accountSession)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
 // SubscriptionMiddleware enforces a valid subscription at the time of the request.
-func SubscriptionMiddleware() mux.MiddlewareFunc {
+func (h *API) SubscriptionMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !constants.Metadata.Registration.SubscriptionRequired {
+			if !h.cfg.Stripe.Enabled() {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -184,11 +169,16 @@ func SubscriptionMiddleware() mux.MiddlewareFunc {
 
 			subID := *user.StripeSubscriptionID
 
-			status, ok := getSubStatus(subID)
-			if !ok {
-				newStatus, err := database.UpdateSubscriptionStatus(subID)
+			status, err := h.state.Subscriptions.Get(r.Context(), subID, time.Now())
+			if err != nil && !errors.Is(err, state.ErrNotFound) {
+				utils.LogError(r.Context(), "SubscriptionMiddleware", "Subscriptions.Get", err)
+				utils.SendInternalError(w)
+				return
+			}
+			if err != nil {
+				newStatus, err := database.UpdateSubscriptionStatus(r.Context(), subID)
 				if err != nil {
-					utils.LogError("SubscriptionMiddleware", "UpdateSubscriptionStatus", err)
+					utils.LogError(r.Context(), "SubscriptionMiddleware", "UpdateSubscriptionStatus", err)
 					utils.SendInternalError(w)
 					return
 				}
@@ -201,7 +191,9 @@ func SubscriptionMiddleware() mux.MiddlewareFunc {
 				}
 
 				status = *user.SubscriptionStatus
-				setSubStatus(subID, status)
+				if err := h.state.Subscriptions.Set(r.Context(), subID, status, time.Now().Add(constants.SubCacheTTL)); err != nil {
+					utils.LogError(r.Context(), "SubscriptionMiddleware", "Subscriptions.Set", err)
+				}
 			}
 
 			if status != "active" && status != "trialing" {
@@ -214,6 +206,87 @@ func SubscriptionMiddleware() mux.MiddlewareFunc {
 	}
 }
 
+// VerifiedEmailMiddleware requires a verified email address while verification is enabled.
+func (h *API) VerifiedEmailMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := session.GetLoggedInUser(r)
+			utils.Assert(user != nil) // should be ensured by AuthMiddleware
+
+			if h.cfg.Registration.EmailVerificationRequired() && !user.EmailVerified {
+				sendEmailNotVerified(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DiagnosticsAuthMiddleware requires the configured diagnostics token as a Bearer token.
+// Without a configured token the endpoint doesn't exist.
+func (h *API) DiagnosticsAuthMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.cfg.DiagnosticsToken == "" {
+				NotFound(w, r)
+				return
+			}
+
+			if !hasBearerToken(r, h.cfg.DiagnosticsToken) {
+				utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+					Success: false,
+					Message: "Invalid diagnostics token.",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminAuthMiddleware requires the configured admin token as a Bearer token.
+// Without a configured token the endpoints don't exist.
+func (h *API) AdminAuthMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.cfg.AdminToken == "" {
+				NotFound(w, r)
+				return
+			}
+
+			if !hasBearerToken(r, h.cfg.AdminToken) {
+				utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+					Success: false,
+					Message: "Invalid admin token.",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MetricsAuthMiddleware requires the configured metrics token as a Bearer token.
+// Without a configured token the metrics are public.
+func (h *API) MetricsAuthMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.cfg.MetricsToken != "" && !hasBearerToken(r, h.cfg.MetricsToken) {
+				utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+					Success: false,
+					Message: "Invalid metrics token.",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // TimeoutMiddleware sets a timeout for the request.
 func TimeoutMiddleware(d time.Duration) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
@@ -241,28 +314,6 @@ func TimeoutMiddleware(d time.Duration) mux.MiddlewareFunc {
 
 /* -------------------- Helpers -------------------- */
 
-func getSubStatus(subID string) (string, bool) {
-	val, ok := subCache.Load(subID)
-	if !ok {
-		return "", false
-	}
-
-	entry := val.(subCacheEntry)
-	if time.Now().After(entry.expiresAt) {
-		subCache.Delete(subID)
-		return "", false
-	}
-
-	return entry.status, true
-}
-
-func setSubStatus(subID, status string) {
-	subCache.Store(subID, subCacheEntry{
-		status:    status,
-		expiresAt: time.Now().Add(constants.SubCacheTTL),
-	})
-}
-
 func denySubscription(w http.ResponseWriter) {
 	utils.SendJSON(w, http.StatusPaymentRequired, types.Reply[any]{
 		Success: false,
@@ -270,8 +321,14 @@ func denySubscription(w http.ResponseWriter) {
 	})
 }
 
-func getClientIP(r *http.Request) string {
-	if isBehindProxy {
+// hasBearerToken reports whether the request is authorized with the given token.
+func hasBearerToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func (h *API) getClientIP(r *http.Request) string {
+	if h.cfg.BehindProxy {
 		ip := strings.TrimSpace(r.Header.Get("X-Real-IP"))
 		if ip != "" && net.ParseIP(ip) != nil {
 			return ip
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/mail"
+	"acLife/push"
+	"acLife/session"
+	"acLife/state"
+	"acLife/types"
+	"acLife/utils"
+
+	"mz.attahri.com/code/srp/v3"
+)
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupPendingRecoveries(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := h.state.PendingRecoveries.DeleteCreatedBefore(ctx, time.Now().Add(-constants.RecoveryTTL)); err != nil {
+		utils.LogError(ctx, "cleanupPendingRecoveries", "DeleteCreatedBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// SetRecoveryKey stores the SRP verifier of a recovery code and the master key wrapped under it,
+// given a proof of the password. It replaces any previous recovery key.
+func (h *API) SetRecoveryKey(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.RecoveryKeySetupRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// The recovery code is proven like a password of the same account
+	var triplet srp.Triplet = req.Triplet
+	if triplet.Username() != user.Email ||
+		len(triplet.Salt()) == 0 || len(triplet.Salt()) > constants.MaxSaltLen ||
+		len(triplet.Verifier()) == 0 || len(triplet.Verifier()) > constants.MaxVerifierLen ||
+		len(req.WrappedKey) == 0 || len(req.WrappedKey) > constants.MaxWrappedKeyLen {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Prove knowledge of the password
+	M2, ok := h.checkSRPProof(w, r, "SetRecoveryKey", req.SessionID, user.Email, req.M1, false)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.SetRecoveryKey(r.Context(), user.UUID, &types.RecoveryKey{
+		SrpSalt:    triplet.Salt(),
+		Verifier:   triplet.Verifier(),
+		WrappedKey: req.WrappedKey,
+	}); err != nil {
+		utils.LogError(r.Context(), "SetRecoveryKey", "SetRecoveryKey", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginVerifyResponse]{
+		Success: true,
+		Data:    types.LoginVerifyResponse{M2: M2},
+	})
+}
+
+// RemoveRecoveryKey deletes the user's recovery key.
+func (h *API) RemoveRecoveryKey(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	if err := database.DB.SetRecoveryKey(r.Context(), user.UUID, nil); err != nil {
+		utils.LogError(r.Context(), "RemoveRecoveryKey", "SetRecoveryKey", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+// StartRecovery is the first step of proving the recovery code, the same as LoginStart with the recovery verifier.
+func (h *API) StartRecovery(w http.ResponseWriter, r *http.Request) {
+	var req types.LoginStartRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.Email) == 0 || len(req.Email) > constants.MaxEmailLen {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		utils.LogError(r.Context(), "StartRecovery", "GetUserByEmail", err)
+	}
+	if err != nil || user.RecoveryVerifier == nil {
+		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+			Success: false,
+			Message: "Invalid credentials.",
+		})
+		return
+	}
+
+	// Without A the client is requesting the salt, as with LoginStart
+	if len(req.A) == 0 {
+		utils.SendJSON(w, http.StatusOK, types.Reply[[]byte]{
+			Success: true,
+			Data:    user.RecoverySrpSalt,
+		})
+		return
+	}
+
+	h.startSRPHandshake(w, r, "StartRecovery", req.Email, req.A, user.RecoverySrpSalt, user.RecoveryVerifier, true)
+}
+
+// VerifyRecovery checks the proof of the recovery code. It replies with the wrapped master key and every calendar event,
+// and a token for FinishRecovery that is valid for constants.RecoveryTTL.
+func (h *API) VerifyRecovery(w http.ResponseWriter, r *http.Request) {
+	var req types.RecoveryVerifyRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.Email) == 0 || len(req.M1) == 0 || len(req.SessionID) == 0 {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	M2, ok := h.checkSRPProof(w, r, "VerifyRecovery", req.SessionID, req.Email, req.M1, true)
+	if !ok {
+		return
+	}
+
+	user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
+	if err != nil {
+		utils.LogError(r.Context(), "VerifyRecovery", "GetUserByEmail", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if user.RecoveryKey == nil { // removed in the meantime
+		sendInvalidRecovery(w)
+		return
+	}
+
+	dbEvents, err := database.DB.GetCalendarEvents(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "VerifyRecovery", "GetCalendarEvents", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	events := make([]types.EncryptedEvent, 0, len(dbEvents))
+	for _, ev := range dbEvents {
+		events = append(events, types.EncryptedEvent{
+			ID:        ev.ID,
+			Data:      base64.StdEncoding.EncodeToString(ev.Data),
+			UpdatedAt: ev.UpdatedAt.UnixMilli(),
+		})
+	}
+
+	token := utils.RandomToken(32)
+	if err := h.state.PendingRecoveries.Save(r.Context(), &types.PendingRecovery{
+		Token:     token,
+		Owner:     user.UUID,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		utils.LogError(r.Context(), "VerifyRecovery", "PendingRecoveries.Save", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.RecoveryVerifyResponse]{
+		Success: true,
+		Data: types.RecoveryVerifyResponse{
+			M2:         M2,
+			WrappedKey: user.RecoveryKey,
+			Token:      token,
+			Events:     events,
+		},
+	})
+}
+
+// FinishRecovery sets a new password and the calendar events re-encrypted under it, for a recovery proven with VerifyRecovery.
+// Every session is revoked and the recovery key is removed, since it wraps the old master key.
+func (h *API) FinishRecovery(w http.ResponseWriter, r *http.Request) {
+	var req types.RecoveryFinishRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	pending, err := h.state.PendingRecoveries.Get(r.Context(), req.Token)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		utils.LogError(r.Context(), "FinishRecovery", "PendingRecoveries.Get", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if err != nil || time.Since(pending.CreatedAt) > constants.RecoveryTTL {
+		sendInvalidRecovery(w)
+		return
+	}
+
+	user, err := database.DB.GetUserByUUID(r.Context(), pending.Owner)
+	if errors.Is(err, database.ErrNotFound) { // deleted in the meantime
+		if err := h.state.PendingRecoveries.Delete(r.Context(), req.Token); err != nil {
+			utils.LogError(r.Context(), "FinishRecovery", "PendingRecoveries.Delete", err)
+		}
+		sendInvalidRecovery(w)
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "FinishRecovery", "GetUserByUUID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	var triplet srp.Triplet = req.Triplet
+	if !validateCredentials(w, triplet, req.Salt, req.Challenge) {
+		return
+	}
+	if triplet.Username() != user.Email {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	now := time.Now()
+	events, ok := decodeReencryptedEvents(req.Events, now)
+	if !ok {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Subscriptions of the revoked sessions are deleted with them, so collect them first
+	subs, err := database.DB.GetPushSubscriptions(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "FinishRecovery", "GetPushSubscriptions", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// The token is used up either way, changed events have to be downloaded again with a new proof
+	if err := h.state.PendingRecoveries.Delete(r.Context(), req.Token); err != nil {
+		utils.LogError(r.Context(), "FinishRecovery", "PendingRecoveries.Delete", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	err = database.DB.ChangeCredentials(r.Context(), user.UUID, types.Credentials{
+		Salt:      req.Salt,
+		SrpSalt:   triplet.Salt(),
+		Verifier:  triplet.Verifier(),
+		Challenge: []byte(req.Challenge),
+	}, events, "")
+	if errors.Is(err, database.ErrStaleEvents) {
+		utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+			Success: false,
+			Message: "Calendar events changed, start the recovery again.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "FinishRecovery", "ChangeCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Handshakes started with the old password can't be finished anymore
+	if err := h.state.SRPSessions.DeleteByEmail(r.Context(), user.Email); err != nil {
+		utils.LogError(r.Context(), "FinishRecovery", "DeleteByEmail", err)
+	}
+
+	// Tell every device to log in again, and the owner that it happened
+	h.push.EnqueueTo(r.Context(), subs, push.ReauthEvent(""))
+	h.mail.Enqueue(r.Context(), mail.PasswordRecoveredEmail(user.Email, now))
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+func sendInvalidRecovery(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+		Success: false,
+		Message: "Invalid or expired session.",
+	})
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/push"
+	"acLife/session"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// errInvalidRefreshToken is returned for unknown, expired and replayed refresh tokens.
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+/* -------------------- Handlers -------------------- */
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// Presenting a refresh token that was already exchanged revokes the whole session.
+func (h *API) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req types.RefreshRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.RefreshToken) == 0 {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Without a reuse grace, a successful refresh always returns new tokens
+	token, _, err := h.refreshSession(r, req.RefreshToken, 0)
+	if errors.Is(err, errInvalidRefreshToken) || (err == nil && token == nil) {
+		utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+			Success: false,
+			Message: "Invalid or expired refresh token.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "Refresh", "refreshSession", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.SessionToken]{
+		Success: true,
+		Data:    *token,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// refreshSession rotates a refresh token, giving its session a new access token, and returns the new tokens.
+// Sessions past the idle timeout or the maximum lifetime are deleted instead.
+//
+// A refresh token that was already exchanged revokes its session, unless it was exchanged less than grace ago:
+// then the session is returned without new tokens, as concurrent requests of one client may present the same token.
+func (h *API) refreshSession(r *http.Request, refreshToken string, grace time.Duration) (*types.SessionToken, *types.AccountSession, error) {
+	ctx := r.Context()
+
+	stored, err := database.DB.GetRefreshToken(ctx, utils.HashToken(refreshToken))
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accountSession, err := database.DB.GetAccountSessionByID(ctx, stored.SessionID)
+	if errors.Is(err, database.ErrNotFound) { // revoked in the meantime
+		return nil, nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if now.Sub(accountSession.LastSeenAt) > h.cfg.Sessions.IdleTimeout || now.Sub(accountSession.CreatedAt) > h.cfg.Sessions.MaxLifetime {
+		return nil, nil, h.revokeSession(ctx, accountSession, false)
+	}
+
+	if stored.UsedAt == nil {
+		accessToken := utils.RandomToken(32)
+		newRefreshToken := utils.RandomToken(32)
+		expires := h.accessTokenExpiry(accountSession.CreatedAt, now)
+
+		ok, err := database.DB.RotateRefreshToken(ctx, stored, utils.HashToken(newRefreshToken), accessToken, expires, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			accountSession.AccessToken = accessToken
+			accountSession.ExpiresAt = expires
+			accountSession.LastSeenAt = now
+
+			return &types.SessionToken{
+				AccessToken:  accessToken,
+				ExpiresAt:    expires.UnixMilli(),
+				RefreshToken: newRefreshToken,
+			}, accountSession, nil
+		}
+
+		// A concurrent request rotated it first, only the winner gets new tokens
+		if grace <= 0 {
+			return nil, nil, errInvalidRefreshToken
+		}
+		stored.UsedAt = &now
+	}
+
+	if grace > 0 && now.Sub(*stored.UsedAt) <= grace {
+		// The session has the access token given to the request that rotated the refresh token
+		accountSession, err = database.DB.GetAccountSessionByID(ctx, stored.SessionID)
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, nil, errInvalidRefreshToken
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, accountSession, nil
+	}
+
+	// The token may have been stolen, revoke every token descended from it
+	slog.WarnContext(ctx, "refresh token reused, revoking the session", "session_id", accountSession.ID)
+	return nil, nil, h.revokeSession(ctx, accountSession, true)
+}
+
+// revokeSession deletes a session whose refresh token can't be used, and returns errInvalidRefreshToken.
+// With notify, the device is told to drop its keys like after a manual revocation.
+func (h *API) revokeSession(ctx context.Context, accountSession *types.AccountSession, notify bool) error {
+	var revoked []types.PushSubscription
+	if notify {
+		subs, err := database.DB.GetPushSubscriptions(ctx, accountSession.Owner)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			if sub.SessionID != nil && *sub.SessionID == accountSession.ID {
+				revoked = append(revoked, sub)
+			}
+		}
+	}
+
+	err := database.DB.DeleteAccountSessionByID(ctx, accountSession.Owner, accountSession.ID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+
+	if len(revoked) > 0 {
+		h.push.EnqueueTo(ctx, revoked, push.RevokedEvent())
+	}
+	return errInvalidRefreshToken
+}
+
+// refreshCookieSession renews the access token of a browser session with the refresh token in the session cookie,
+// so that browsers don't have to call /auth/refresh. It returns nil if the cookie has no valid refresh token.
+func (h *API) refreshCookieSession(w http.ResponseWriter, r *http.Request) (*types.User, *types.AccountSession) {
+	if r.Header.Get("Authorization") != "" {
+		return nil, nil // Bearer clients refresh explicitly
+	}
+
+	refreshToken := session.Get[string](r, "refresh_token")
+	if refreshToken == "" {
+		return nil, nil
+	}
+
+	token, accountSession, err := h.refreshSession(r, refreshToken, constants.RefreshReuseGrace)
+	if err != nil {
+		if !errors.Is(err, errInvalidRefreshToken) {
+			utils.LogError(r.Context(), "refreshCookieSession", "refreshSession", err)
+		}
+		return nil, nil
+	}
+
+	if token != nil {
+		if err := session.SetValues(w, r, map[string]any{
+			"access_token":  token.AccessToken,
+			"refresh_token": token.RefreshToken,
+		}); err != nil {
+			utils.LogError(r.Context(), "refreshCookieSession", "session.SetValues", err)
+			return nil, nil
+		}
+	}
+
+	user, err := database.DB.GetUserByUUID(r.Context(), accountSession.Owner)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			utils.LogError(r.Context(), "refreshCookieSession", "GetUserByUUID", err)
+		}
+		return nil, nil
+	}
+
+	return user, accountSession
+}
+
+// accessTokenExpiry returns when an access token issued now expires, never after the session's maximum lifetime.
+func (h *API) accessTokenExpiry(createdAt, now time.Time) time.Time {
+	expires := now.Add(constants.AccessTokenExpiry)
+	if end := createdAt.Add(h.cfg.Sessions.MaxLifetime); end.Before(expires) {
+		return end
+	}
+	return expires
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// lostRotationStore lets a concurrent request rotate every refresh token first, as if it always won the race.
+type lostRotationStore struct {
+	database.Store
+}
+
+func (s lostRotationStore) RotateRefreshToken(ctx context.Context, token *types.RefreshToken, newHash []byte, accessToken string, expiresAt, now time.Time) (bool, error) {
+	if _, err := s.Store.RotateRefreshToken(ctx, token, utils.HashToken(utils.RandomToken(32)), utils.RandomToken(32), expiresAt, now); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func TestRefreshLosingRotationRace(t *testing.T) {
+	h := newTestAPI(t, lostRotationStore{database.NewMemoryStore()}, nil)
+	ctx := context.Background()
+
+	user := &types.User{Email: "race@example.com"}
+	if err := database.DB.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// newRefreshToken logs in and returns the session with its refresh token
+	newRefreshToken := func() (*types.AccountSession, string) {
+		now := time.Now()
+		accountSession := &types.AccountSession{
+			Owner:       user.UUID,
+			AccessToken: utils.RandomToken(32),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(constants.AccessTokenExpiry),
+			LastSeenAt:  now,
+		}
+		refreshToken := utils.RandomToken(32)
+		if err := database.DB.CreateAccountSession(ctx, accountSession, utils.HashToken(refreshToken)); err != nil {
+			t.Fatal(err)
+		}
+		return accountSession, refreshToken
+	}
+
+	// Without a grace the losing request is turned away, and the session stays with the winner
+	accountSession, refreshToken := newRefreshToken()
+	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+	rec := httptest.NewRecorder()
+	h.Refresh(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh losing the race: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, err := database.DB.GetAccountSessionByID(ctx, accountSession.ID); err != nil {
+		t.Errorf("session after losing the race: %v", err)
+	}
+
+	// With a grace it gets the session with the winner's access token
+	accountSession, refreshToken = newRefreshToken()
+	token, got, err := h.refreshSession(httptest.NewRequest(http.MethodGet, "/user", nil), refreshToken, constants.RefreshReuseGrace)
+	if err != nil || token != nil || got == nil || got.ID != accountSession.ID || got.AccessToken == accountSession.AccessToken {
+		t.Errorf("refresh losing the race within the grace: got %+v, %+v, %v", token, got, err)
+	}
+}
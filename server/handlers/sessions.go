@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"acLife/database"
+	"acLife/push"
+	"acLife/session"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// ListSessions returns the user's logged in devices, most recently seen first.
+func (h *API) ListSessions(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+	current := session.GetAccountSession(r)
+
+	sessions, err := database.DB.ListAccountSessions(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "ListSessions", "ListAccountSessions", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	infos := make([]types.SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, types.SessionInfo{
+			ID:         s.ID,
+			DeviceName: s.DeviceName,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt.UnixMilli(),
+			LastSeenAt: s.LastSeenAt.UnixMilli(),
+			Current:    s.ID == current.ID,
+		})
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[[]types.SessionInfo]{
+		Success: true,
+		Data:    infos,
+	})
+}
+
+// RevokeSession ends one of the user's sessions and tells that device to drop its keys.
+// Revoking the current session logs the user out.
+func (h *API) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+	current := session.GetAccountSession(r)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	subs, ok := h.sessionPushSubscriptions(w, r, "RevokeSession", user.UUID, func(sessionID int) bool {
+		return sessionID == id
+	})
+	if !ok {
+		return
+	}
+
+	err = database.DB.DeleteAccountSessionByID(r.Context(), user.UUID, id)
+	if errors.Is(err, database.ErrNotFound) {
+		utils.SendJSON(w, http.StatusNotFound, types.Reply[any]{
+			Success: false,
+			Message: "Session not found.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "RevokeSession", "DeleteAccountSessionByID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	h.push.EnqueueTo(r.Context(), subs, push.RevokedEvent())
+
+	if id == current.ID {
+		if err := session.DestroySession(w, r); err != nil {
+			utils.LogError(r.Context(), "RevokeSession", "DestroySession", err)
+		}
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+// RevokeOtherSessions ends all of the user's sessions except the current one,
+// and tells those devices to drop their keys.
+func (h *API) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+	current := session.GetAccountSession(r)
+
+	subs, ok := h.sessionPushSubscriptions(w, r, "RevokeOtherSessions", user.UUID, func(sessionID int) bool {
+		return sessionID != current.ID
+	})
+	if !ok {
+		return
+	}
+
+	if err := database.DB.DeleteOtherAccountSessions(r.Context(), user.UUID, current.AccessToken); err != nil {
+		utils.LogError(r.Context(), "RevokeOtherSessions", "DeleteOtherAccountSessions", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	h.push.EnqueueTo(r.Context(), subs, push.RevokedEvent())
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// sessionPushSubscriptions returns the user's push subscriptions registered by the sessions matching revoked.
+// They are deleted along with their session, so they must be collected before revoking it.
+// On failure the error response has been sent.
+func (h *API) sessionPushSubscriptions(w http.ResponseWriter, r *http.Request, function, uuid string, revoked func(sessionID int) bool) ([]types.PushSubscription, bool) {
+	subs, err := database.DB.GetPushSubscriptions(r.Context(), uuid)
+	if err != nil {
+		utils.LogError(r.Context(), function, "GetPushSubscriptions", err)
+		utils.SendInternalError(w)
+		return nil, false
+	}
+
+	var matching []types.PushSubscription
+	for _, sub := range subs {
+		if sub.SessionID != nil && revoked(*sub.SessionID) {
+			matching = append(matching, sub)
+		}
+	}
+	return matching, true
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
-	"os"
 	"time"
 
 	"acLife/database"
+	"acLife/metrics"
 	aclSession "acLife/session"
 	"acLife/types"
 	"acLife/utils"
@@ -14,17 +16,16 @@ import (
 	"github.com/stripe/stripe-go/v84"
 	portal "github.com/stripe/stripe-go/v84/billingportal/session"
 	"github.com/stripe/stripe-go/v84/checkout/session"
+	"github.com/stripe/stripe-go/v84/customer"
 	"github.com/stripe/stripe-go/v84/price"
+	"github.com/stripe/stripe-go/v84/subscription"
 	"github.com/stripe/stripe-go/v84/webhook"
 )
 
 // Pricing gets the subscription prices from Stripe.
-func Pricing(w http.ResponseWriter, r *http.Request) {
-	stripe.Key = os.Getenv("STRIPE_API_KEY")
-	productID := os.Getenv("STRIPE_PRODUCT_ID")
-
+func (h *API) Pricing(w http.ResponseWriter, r *http.Request) {
 	params := &stripe.PriceListParams{
-		Product: stripe.String(productID),
+		Product: stripe.String(h.cfg.Stripe.ProductID),
 		Active:  stripe.Bool(true),
 		ListParams: stripe.ListParams{
 			Limit: stripe.Int64(3),
@@ -50,7 +51,7 @@ func Pricing(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := iter.Err(); err != nil {
-		utils.LogError("Pricing", "iter", err)
+		utils.LogError(r.Context(), "Pricing", "iter", err)
 		utils.SendInternalError(w)
 		return
 	}
@@ -62,9 +63,7 @@ func Pricing(w http.ResponseWriter, r *http.Request) {
 }
 
 // CreatePortalSession creates a Stripe Customer Portal session and returns the URL.
-func CreatePortalSession(w http.ResponseWriter, r *http.Request) {
-	stripe.Key = os.Getenv("STRIPE_API_KEY")
-
+func (h *API) CreatePortalSession(w http.ResponseWriter, r *http.Request) {
 	user := aclSession.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
@@ -75,12 +74,12 @@ func CreatePortalSession(w http.ResponseWriter, r *http.Request) {
 
 	params := &stripe.BillingPortalSessionParams{
 		Customer:  stripe.String(*user.StripeCustomerID),
-		ReturnURL: stripe.String(os.Getenv("CLIENT_URL")),
+		ReturnURL: stripe.String(h.cfg.ClientURL),
 	}
 
 	sess, err := portal.New(params)
 	if err != nil {
-		utils.LogError("CreatePortalSession", "portal.New", err)
+		utils.LogError(r.Context(), "CreatePortalSession", "portal.New", err)
 		utils.SendInternalError(w)
 		return
 	}
@@ -92,15 +91,11 @@ func CreatePortalSession(w http.ResponseWriter, r *http.Request) {
 }
 
 // CreateCheckoutSession creates a Stripe Checkout Session and returns the URL.
-func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+func (h *API) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	user := aclSession.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
-	stripe.Key = os.Getenv("STRIPE_API_KEY")
-
-	var req struct {
-		PriceID string `json:"priceId"`
-	}
+	var req types.CheckoutRequest
 	if err := utils.ParseJSON(r.Body, &req); err != nil {
 		utils.SendBadRequest(w)
 		return
@@ -114,15 +109,15 @@ func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 				Quantity: stripe.Int64(1),
 			},
 		},
-		SuccessURL: stripe.String(os.Getenv("CLIENT_URL")),
-		CancelURL:  stripe.String(os.Getenv("CLIENT_URL")),
+		SuccessURL: stripe.String(h.cfg.ClientURL),
+		CancelURL:  stripe.String(h.cfg.ClientURL),
 		// Include the user's UUID in the metadata for later lookup
 		Metadata: map[string]string{
 			"aclUserId": user.UUID,
 		},
 	})
 	if err != nil {
-		utils.LogError("CreateCheckoutSession", "New", err)
+		utils.LogError(r.Context(), "CreateCheckoutSession", "New", err)
 		utils.SendInternalError(w)
 		return
 	}
@@ -134,27 +129,28 @@ func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 }
 
 // StripeWebhook is used by the Stripe webhook to receive events.
-func StripeWebhook(w http.ResponseWriter, r *http.Request) {
+func (h *API) StripeWebhook(w http.ResponseWriter, r *http.Request) {
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
 	sigHeader := r.Header.Get("Stripe-Signature")
 
-	event, err := webhook.ConstructEventWithOptions(payload, sigHeader, endpointSecret,
+	event, err := webhook.ConstructEventWithOptions(payload, sigHeader, h.cfg.Stripe.WebhookSecret,
 		webhook.ConstructEventOptions{
-			IgnoreAPIVersionMismatch: os.Getenv("ENV") != "production",
+			IgnoreAPIVersionMismatch: !h.cfg.IsProduction(),
 		},
 	)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		utils.LogError("StripeWebhook", "ConstructEventWithOptions", err)
+		utils.LogError(r.Context(), "StripeWebhook", "ConstructEventWithOptions", err)
 		return
 	}
 
+	metrics.StripeWebhooks.WithLabelValues(string(event.Type)).Inc()
+
 	obj := event.Data.Object
 
 	switch event.Type {
@@ -173,21 +169,16 @@ func StripeWebhook(w http.ResponseWriter, r *http.Request) {
 
 		// Update database
 		ctx := r.Context()
-		if _, err := database.Exec(ctx, `
-        UPDATE users SET
-            stripe_customer_id=?,
-            stripe_subscription_id=?
-        WHERE uuid=?`,
-			cusID, subID, aclUserID,
-		); err != nil {
-			utils.LogError("StripeWebhook", "database.Exec", err)
+		if err := database.DB.SetStripeCustomer(ctx, aclUserID, cusID, subID); err != nil {
+			utils.LogError(r.Context(), "StripeWebhook", "SetStripeCustomer", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// Schedule a status update
-		time.AfterFunc(5*time.Second, func() {
-			_, _ = database.UpdateSubscriptionStatus(subID)
+		// Schedule a status update, outliving the request
+		ctx = context.WithoutCancel(ctx)
+		h.tasks.After("UpdateSubscriptionStatus", 5*time.Second, func() {
+			_, _ = database.UpdateSubscriptionStatus(ctx, subID)
 		})
 	case "customer.subscription.updated":
 		fallthrough
@@ -195,11 +186,61 @@ func StripeWebhook(w http.ResponseWriter, r *http.Request) {
 		subID, _ := obj["id"].(string)
 		status, _ := obj["status"].(string)
 
-		_, err := database.UpdateSubscriptionStatus(subID, status);
+		_, err := database.UpdateSubscriptionStatus(r.Context(), subID, status);
 		if err != nil {
-			utils.LogError("StripeWebhook", "UpdateSubscriptionStatus", err)
+			utils.LogError(r.Context(), "StripeWebhook", "UpdateSubscriptionStatus", err)
 		}
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+/* -------------------- Helpers -------------------- */
+
+// cancelBilling cancels the user's Stripe subscription and, if configured, deletes their Stripe customer.
+// Objects that no longer exist on Stripe are skipped.
+func (h *API) cancelBilling(ctx context.Context, user *types.User) error {
+	if !h.cfg.Stripe.Enabled() {
+		return nil
+	}
+
+	params := stripe.Params{Context: ctx}
+
+	if user.StripeSubscriptionID != nil && *user.StripeSubscriptionID != "" &&
+		(user.SubscriptionStatus == nil || *user.SubscriptionStatus != string(stripe.SubscriptionStatusCanceled)) {
+		_, err := subscription.Cancel(*user.StripeSubscriptionID, &stripe.SubscriptionCancelParams{Params: params})
+		if err != nil && !isStripeMissing(err) {
+			return err
+		}
+	}
+
+	if h.cfg.Stripe.DeleteCustomer && user.StripeCustomerID != nil && *user.StripeCustomerID != "" {
+		_, err := customer.Del(*user.StripeCustomerID, &stripe.CustomerParams{Params: params})
+		if err != nil && !isStripeMissing(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateBillingEmail sets the email address of the user's Stripe customer, if they have one.
+func (h *API) updateBillingEmail(ctx context.Context, user *types.User, email string) error {
+	if !h.cfg.Stripe.Enabled() || user.StripeCustomerID == nil || *user.StripeCustomerID == "" {
+		return nil
+	}
+
+	_, err := customer.Update(*user.StripeCustomerID, &stripe.CustomerParams{
+		Params: stripe.Params{Context: ctx},
+		Email:  stripe.String(email),
+	})
+	if err != nil && !isStripeMissing(err) {
+		return err
+	}
+	return nil
+}
+
+func isStripeMissing(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/metrics"
+	"acLife/session"
+	"acLife/state"
+	"acLife/twofactor"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// Second factor methods, as sent by the client.
+const (
+	methodTOTP       = "totp"
+	methodBackupCode = "backup_code"
+	methodWebAuthn   = "webauthn"
+)
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupPendingLogins(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := h.state.PendingLogins.DeleteCreatedBefore(ctx, time.Now().Add(-constants.PendingLoginTTL)); err != nil {
+		utils.LogError(ctx, "cleanupPendingLogins", "DeleteCreatedBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// LoginSecondFactor completes a login that LoginVerify left pending, given a valid TOTP or backup code,
+// or a security key's answer to the assertion options sent with the pending login.
+func (h *API) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var req types.LoginSecondFactorRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.Token) == 0 {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	pending, err := h.state.PendingLogins.Get(r.Context(), req.Token)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		utils.LogError(r.Context(), "LoginSecondFactor", "PendingLogins.Get", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if err != nil || time.Since(pending.CreatedAt) > constants.PendingLoginTTL {
+		sendInvalidPendingLogin(w)
+		return
+	}
+
+	user, err := database.DB.GetUserByUUID(r.Context(), pending.UUID)
+	if errors.Is(err, database.ErrNotFound) { // deleted in the meantime
+		if err := h.state.PendingLogins.Delete(r.Context(), req.Token); err != nil {
+			utils.LogError(r.Context(), "LoginSecondFactor", "PendingLogins.Delete", err)
+		}
+		sendInvalidPendingLogin(w)
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "LoginSecondFactor", "GetUserByUUID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if !h.checkSecondFactorMethod(w, r, "LoginSecondFactor", user, req.Method) {
+		return
+	}
+
+	// Limit the guesses per account, together with the failed passwords, from all addresses and logins
+	now := time.Now()
+	if !h.checkLoginThrottle(w, r, "LoginSecondFactor", user.Email, now) {
+		return
+	}
+
+	// Limit the guesses per login, the client has to start over with the password after that
+	ok, err := h.state.PendingLogins.CountAttempt(r.Context(), req.Token, constants.MaxSecondFactorAttempts)
+	if err != nil {
+		utils.LogError(r.Context(), "LoginSecondFactor", "PendingLogins.CountAttempt", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if !ok { // used up, possibly by concurrent attempts
+		if err := h.state.PendingLogins.Delete(r.Context(), req.Token); err != nil {
+			utils.LogError(r.Context(), "LoginSecondFactor", "PendingLogins.Delete", err)
+		}
+		sendInvalidPendingLogin(w)
+		return
+	}
+
+	var valid bool
+	if req.Method == methodWebAuthn {
+		valid, ok = h.verifyWebAuthnAssertion(w, r, "LoginSecondFactor", user, pending.WebAuthn, req.Credential)
+	} else {
+		valid, ok = h.verifySecondFactor(w, r, "LoginSecondFactor", user, req.Method, req.Code)
+	}
+	if !ok {
+		return
+	}
+	if !valid {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		if !h.countLoginFailure(w, r, "LoginSecondFactor", user.Email, now) {
+			return
+		}
+
+		if req.Method == methodWebAuthn {
+			sendInvalidSecurityKey(w, http.StatusUnauthorized)
+		} else {
+			sendInvalidCode(w)
+		}
+		return
+	}
+
+	// Only now is the login complete, the password alone doesn't reset the failures
+	if err := h.forgetLoginFailures(r.Context(), user.Email); err != nil {
+		utils.LogError(r.Context(), "LoginSecondFactor", "forgetLoginFailures", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if err := h.state.PendingLogins.Delete(r.Context(), req.Token); err != nil {
+		utils.LogError(r.Context(), "LoginSecondFactor", "PendingLogins.Delete", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	token, ok := h.startSession(w, r, "LoginSecondFactor", user, pending.DeviceName, pending.ReturnToken)
+	if !ok {
+		return
+	}
+
+	metrics.Logins.WithLabelValues("success").Inc()
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[*types.SessionToken]{
+		Success: true,
+		Data:    token,
+	})
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. It is enabled by ConfirmTOTP.
+func (h *API) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	if user.TOTPEnabled {
+		sendTOTPAlreadyEnabled(w)
+		return
+	}
+
+	secret, url, err := twofactor.NewTOTPKey(user.Email)
+	if err != nil {
+		utils.LogError(r.Context(), "EnrollTOTP", "twofactor.NewTOTPKey", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if err := database.DB.SetTOTPSecret(r.Context(), user.UUID, secret); err != nil {
+		utils.LogError(r.Context(), "EnrollTOTP", "SetTOTPSecret", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.TOTPEnrollResponse]{
+		Success: true,
+		Data: types.TOTPEnrollResponse{
+			Secret: secret,
+			URL:    url,
+		},
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the user shows a code generated from the enrolled secret.
+// It replies with a fresh set of backup codes.
+func (h *API) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.TOTPConfirmRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if user.TOTPEnabled {
+		sendTOTPAlreadyEnabled(w)
+		return
+	}
+
+	if user.TOTPSecret == nil {
+		utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+			Success: false,
+			Message: "Two-factor authentication enrollment was not started.",
+		})
+		return
+	}
+
+	// The secret isn't enabled yet, so it is checked apart from the second factors
+	valid, ok := h.verifyTOTP(w, r, "ConfirmTOTP", user, req.Code)
+	if !ok {
+		return
+	}
+	if !valid {
+		sendInvalidCode(w)
+		return
+	}
+
+	codes, hashes := twofactor.NewBackupCodes(constants.BackupCodeCount)
+	if err := database.DB.EnableTOTP(r.Context(), user.UUID, hashes); err != nil {
+		utils.LogError(r.Context(), "ConfirmTOTP", "EnableTOTP", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.TOTPConfirmResponse]{
+		Success: true,
+		Data: types.TOTPConfirmResponse{
+			BackupCodes: codes,
+		},
+	})
+}
+
+// DisableTOTP turns off two-factor authentication, given a valid TOTP or backup code.
+func (h *API) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.TOTPDisableRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+			Success: false,
+			Message: "Two-factor authentication is not enabled.",
+		})
+		return
+	}
+
+	if !h.checkSecondFactorMethod(w, r, "DisableTOTP", user, req.Method) ||
+		!h.checkSecondFactor(w, r, "DisableTOTP", user, req.Method, req.Code) {
+		return
+	}
+
+	if err := database.DB.DisableTOTP(r.Context(), user.UUID); err != nil {
+		utils.LogError(r.Context(), "DisableTOTP", "DisableTOTP", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// startPendingLogin records a login that passed the SRP proof and returns the challenge for the second factor.
+// It returns nil if the user has no second factor. Security keys are asked to sign a new WebAuthn challenge.
+func (h *API) startPendingLogin(ctx context.Context, user *types.User, deviceName string, returnToken bool) (*types.SecondFactorChallenge, error) {
+	creds, err := database.DB.GetWebAuthnCredentials(ctx, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := secondFactorMethods(user, creds)
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	pending := &types.PendingLogin{
+		UUID:        user.UUID,
+		DeviceName:  deviceName,
+		ReturnToken: returnToken,
+		CreatedAt:   time.Now(),
+	}
+	challenge := &types.SecondFactorChallenge{
+		Token:   utils.RandomToken(32),
+		Methods: methods,
+	}
+
+	if len(creds) > 0 {
+		assertion, setup, err := h.webAuthn.BeginLogin(twofactor.WebAuthnUser{User: user, Credentials: creds})
+		if err != nil {
+			return nil, err
+		}
+		pending.WebAuthn = setup
+		challenge.WebAuthn = assertion
+	}
+
+	if err := h.state.PendingLogins.Save(ctx, challenge.Token, pending); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// secondFactorMethods lists the second factors the user has set up.
+func secondFactorMethods(user *types.User, creds []types.WebAuthnCredential) []string {
+	var methods []string
+	if user.TOTPEnabled {
+		methods = append(methods, methodTOTP, methodBackupCode)
+	}
+	if len(creds) > 0 {
+		methods = append(methods, methodWebAuthn)
+	}
+	return methods
+}
+
+// checkSecondFactorMethod replies 400 unless method is one of the second factors the user has set up.
+// On failure the error response has been sent.
+func (h *API) checkSecondFactorMethod(w http.ResponseWriter, r *http.Request, function string, user *types.User, method string) bool {
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), function, "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return false
+	}
+
+	if !slices.Contains(secondFactorMethods(user, creds), method) {
+		utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+			Success: false,
+			Message: "This second factor is not set up.",
+		})
+		return false
+	}
+	return true
+}
+
+// checkSecondFactor verifies a TOTP or backup code of the user. Each code is only accepted once.
+// On failure the error response has been sent.
+func (h *API) checkSecondFactor(w http.ResponseWriter, r *http.Request, function string, user *types.User, method, code string) bool {
+	valid, ok := h.verifySecondFactor(w, r, function, user, method, code)
+	if ok && !valid {
+		sendInvalidCode(w)
+	}
+	return ok && valid
+}
+
+// verifySecondFactor is checkSecondFactor without replying to an invalid code, so the caller can count it first.
+// It reports whether the code is valid, and returns false for ok if the error response has been sent.
+func (h *API) verifySecondFactor(w http.ResponseWriter, r *http.Request, function string, user *types.User, method, code string) (valid, ok bool) {
+	var err error
+
+	switch method {
+	case methodTOTP:
+		// A secret that was enrolled but never confirmed isn't a second factor
+		if !user.TOTPEnabled {
+			break
+		}
+		return h.verifyTOTP(w, r, function, user, code)
+	case methodBackupCode:
+		if !user.TOTPEnabled {
+			break
+		}
+
+		valid, err = database.DB.UseBackupCode(r.Context(), user.UUID, twofactor.HashBackupCode(code))
+		if err != nil {
+			utils.LogError(r.Context(), function, "UseBackupCode", err)
+			utils.SendInternalError(w)
+			return false, false
+		}
+	default:
+		utils.SendBadRequest(w)
+		return false, false
+	}
+
+	return valid, true
+}
+
+// verifyTOTP checks a code generated from the user's TOTP secret, enabled or not. Each code is only accepted once.
+// It reports whether the code is valid, and returns false for ok if the error response has been sent.
+func (h *API) verifyTOTP(w http.ResponseWriter, r *http.Request, function string, user *types.User, code string) (valid, ok bool) {
+	if user.TOTPSecret == nil {
+		return false, true
+	}
+
+	step, matched := twofactor.ValidateTOTP(*user.TOTPSecret, code, time.Now())
+	if !matched {
+		return false, true
+	}
+
+	// Reject codes that were already used
+	valid, err := database.DB.UseTOTPStep(r.Context(), user.UUID, step)
+	if err != nil {
+		utils.LogError(r.Context(), function, "UseTOTPStep", err)
+		utils.SendInternalError(w)
+		return false, false
+	}
+	return valid, true
+}
+
+func sendInvalidCode(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+		Success: false,
+		Message: "Invalid code.",
+	})
+}
+
+func sendInvalidPendingLogin(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusUnauthorized, types.Reply[any]{
+		Success: false,
+		Message: "Invalid or expired session.",
+	})
+}
+
+func sendTOTPAlreadyEnabled(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+		Success: false,
+		Message: "Two-factor authentication is already enabled.",
+	})
+}
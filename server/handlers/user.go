@@ -1,13 +1,15 @@
 package handlers
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
-	"os"
-	"regexp"
-	"strings"
+	"time"
 
+	"acLife/constants"
 	"acLife/database"
 	"acLife/push"
 	"acLife/session"
@@ -15,37 +17,218 @@ import (
 	"acLife/utils"
 
 	_ "crypto/sha256"
+
+	"mz.attahri.com/code/srp/v3"
 )
 
-func UserInfo(w http.ResponseWriter, r *http.Request) {
+/* -------------------- Cleanup -------------------- */
+
+// purgeDeletedAccounts carries out the deletions whose cooling-off period has ended.
+func (h *API) purgeDeletedAccounts(ctx context.Context) {
+	queryCtx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	users, err := database.DB.GetUsersDueForDeletion(queryCtx, time.Now())
+	cancel()
+	if err != nil {
+		utils.LogError(ctx, "purgeDeletedAccounts", "GetUsersDueForDeletion", err)
+		return
+	}
+
+	for _, user := range users {
+		// Each account gets the time a request deleting it would have, Stripe included
+		deleteCtx, cancel := context.WithTimeout(ctx, constants.HTTPTimeout)
+		err := h.deleteUser(deleteCtx, &user)
+		cancel()
+		if err != nil {
+			utils.LogError(ctx, "purgeDeletedAccounts", "deleteUser", err) // retried on the next pass
+		}
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+func (h *API) UserInfo(w http.ResponseWriter, r *http.Request) {
 	user := session.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "UserInfo", "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	var deletionScheduledAt *int64
+	if user.DeletionScheduledAt != nil {
+		ms := user.DeletionScheduledAt.UnixMilli()
+		deletionScheduledAt = &ms
+	}
+
 	// Respond with JSON (only exposing what needs to be)
 	// TODO: send Salt and Challenge only when requested
 	utils.SendJSON(w, http.StatusOK, types.Reply[types.PublicUser]{
 		Success: true,
 		Data: types.PublicUser{
-			UUID:               user.UUID,
-			Email:              user.Email,
-			SubscriptionStatus: user.SubscriptionStatus,
-			Salt:               user.Salt,
-			Challenge:          user.Challenge,
+			UUID:                user.UUID,
+			Email:               user.Email,
+			SubscriptionStatus:  user.SubscriptionStatus,
+			Salt:                user.Salt,
+			Challenge:           user.Challenge,
+			DeletionScheduledAt: deletionScheduledAt,
+			TwoFactorEnabled:    len(secondFactorMethods(user, creds)) > 0,
+			EmailVerified:       user.EmailVerified,
+			RecoveryKeyEnabled:  user.RecoveryVerifier != nil,
 		},
 	})
 }
 
-// PushSubscribe stores a push service subscription in the DB.
-func PushSubscribe(w http.ResponseWriter, r *http.Request) {
+// DeleteAccount deletes the user's account after a fresh proof of the password.
+// With a cooling-off period configured the deletion is only scheduled, and can be cancelled until then.
+func (h *API) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.DeleteAccountRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Prove knowledge of the password
+	if _, ok := h.checkSRPProof(w, r, "DeleteAccount", req.SessionID, user.Email, req.M1, false); !ok {
+		return
+	}
+
+	if delay := h.cfg.Account.DeletionDelay; delay > 0 {
+		at := time.Now().Add(delay)
+		if err := database.DB.ScheduleUserDeletion(r.Context(), user.UUID, &at); err != nil {
+			utils.LogError(r.Context(), "DeleteAccount", "ScheduleUserDeletion", err)
+			utils.SendInternalError(w)
+			return
+		}
+
+		utils.SendJSON(w, http.StatusOK, types.Reply[types.DeleteAccountResponse]{
+			Success: true,
+			Data:    types.DeleteAccountResponse{ScheduledAt: at.UnixMilli()},
+		})
+		return
+	}
+
+	if err := h.deleteUser(r.Context(), user); err != nil {
+		utils.LogError(r.Context(), "DeleteAccount", "deleteUser", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if err := session.DestroySession(w, r); err != nil {
+		utils.LogError(r.Context(), "DeleteAccount", "DestroySession", err)
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.DeleteAccountResponse]{
+		Success: true,
+	})
+}
+
+// CancelAccountDeletion cancels a deletion scheduled by DeleteAccount.
+func (h *API) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
 	user := session.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
-	var req struct {
-		Endpoint string `json:"endpoint"`
-		Auth     string `json:"auth"`
-		P256DH   string `json:"p256dh"`
+	if err := database.DB.ScheduleUserDeletion(r.Context(), user.UUID, nil); err != nil {
+		utils.LogError(r.Context(), "CancelAccountDeletion", "ScheduleUserDeletion", err)
+		utils.SendInternalError(w)
+		return
 	}
 
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+// ChangePassword replaces the user's credentials after a fresh proof of the current password.
+// The client sends every calendar event re-encrypted under the new key, all other sessions are revoked
+// and the user's other devices are told to log in again.
+func (h *API) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.ChangePasswordRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	var triplet srp.Triplet = req.Triplet
+	if !validateCredentials(w, triplet, req.Salt, req.Challenge) {
+		return
+	}
+
+	// The email doesn't change with the password
+	if triplet.Username() != user.Email {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	events, ok := decodeReencryptedEvents(req.Events, time.Now())
+	if !ok {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Prove knowledge of the current password
+	M2, ok := h.checkSRPProof(w, r, "ChangePassword", req.SessionID, user.Email, req.M1, false)
+	if !ok {
+		return
+	}
+
+	// Subscriptions of the revoked sessions are deleted with them, so collect them first
+	subs, err := database.DB.GetPushSubscriptions(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "ChangePassword", "GetPushSubscriptions", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Replace credentials and events, keeping only the current session
+	err = database.DB.ChangeCredentials(r.Context(), user.UUID, types.Credentials{
+		Salt:      req.Salt,
+		SrpSalt:   triplet.Salt(),
+		Verifier:  triplet.Verifier(),
+		Challenge: []byte(req.Challenge),
+	}, events, session.GetAccountSession(r).AccessToken)
+	if errors.Is(err, database.ErrStaleEvents) {
+		utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+			Success: false,
+			Message: "Calendar events changed, sync and try again.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "ChangePassword", "ChangeCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Handshakes started with the old password can't be finished anymore
+	if err := h.state.SRPSessions.DeleteByEmail(r.Context(), user.Email); err != nil {
+		utils.LogError(r.Context(), "ChangePassword", "DeleteByEmail", err)
+	}
+
+	// Tell other devices to log in again
+	h.push.EnqueueTo(r.Context(), subs, push.ReauthEvent(r.URL.Query().Get("c")))
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.LoginVerifyResponse]{
+		Success: true,
+		Data:    types.LoginVerifyResponse{M2: M2},
+	})
+}
+
+// PushSubscribe stores a push service subscription in the DB.
+func (h *API) PushSubscribe(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.PushSubscribeRequest
+
 	if err := utils.ParseJSON(r.Body, &req); err != nil {
 		utils.SendBadRequest(w)
 		return
@@ -59,32 +242,9 @@ func PushSubscribe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make sure the endpoint is allowed
-	allowed := os.Getenv("PUSH_ALLOWED_ENDPOINTS")
-	if allowed != "" {
-		host := u.Hostname()
-		found := false
-
-		for pattern := range strings.SplitSeq(allowed, ",") {
-			pattern = strings.TrimSpace(pattern)
-			if pattern == "" {
-				continue
-			}
-
-			re := "^" + regexp.QuoteMeta(pattern) + "$"
-			re = strings.ReplaceAll(re, `\*`, ".*")
-
-			matched, _ := regexp.MatchString(re, host)
-
-			if matched {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			utils.SendBadRequest(w)
-			return
-		}
+	if !h.cfg.Push.EndpointAllowed(u.Hostname()) {
+		utils.SendBadRequest(w)
+		return
 	}
 
 	// Validate auth: valid base64 and 16 bytes long
@@ -101,17 +261,16 @@ func PushSubscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Upsert into database
-	if _, err := database.Exec(r.Context(), `
-		INSERT INTO push_subscriptions (owner, endpoint, p256dh, auth)
-		VALUES (?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-			owner = VALUES(owner),
-			p256dh = VALUES(p256dh),
-			auth = VALUES(auth);`,
-		user.UUID, req.Endpoint, req.P256DH, req.Auth,
-	); err != nil {
-		utils.LogError("PushSubscribe", "database.Exec", err)
+	// Upsert into database, tied to the session so it goes away when the session is revoked
+	accountSession := session.GetAccountSession(r)
+	if err := database.DB.SavePushSubscription(r.Context(), &types.PushSubscription{
+		Owner:     user.UUID,
+		Endpoint:  req.Endpoint,
+		P256DH:    req.P256DH,
+		Auth:      req.Auth,
+		SessionID: &accountSession.ID,
+	}); err != nil {
+		utils.LogError(r.Context(), "PushSubscribe", "SavePushSubscription", err)
 		utils.SendInternalError(w)
 		return
 	}
@@ -122,15 +281,15 @@ func PushSubscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 // PushTest sends a test notification to the user.
-func PushTest(w http.ResponseWriter, r *http.Request) {
+func (h *API) PushTest(w http.ResponseWriter, r *http.Request) {
 	user := session.GetLoggedInUser(r)
 	utils.Assert(user != nil) // ensured by AuthMiddleware
 
 	switch r.URL.Query().Get("type") {
 	case "notification":
-		push.SendToUser(r.Context(), user.UUID, push.NotificationEvent("Test Notification", "You are user: "+user.UUID))
+		h.push.SendToUser(r.Context(), user.UUID, push.NotificationEvent("Test Notification", "You are user: "+user.UUID))
 	case "sync":
-		push.SendToUser(r.Context(), user.UUID, push.SyncEvent(r.URL.Query().Get("origin")))
+		h.push.SendToUser(r.Context(), user.UUID, push.SyncEvent(r.URL.Query().Get("origin")))
 	default:
 		utils.SendBadRequest(w)
 		return
@@ -140,3 +299,53 @@ func PushTest(w http.ResponseWriter, r *http.Request) {
 		Success: true,
 	})
 }
+
+/* -------------------- Helpers -------------------- */
+
+// decodeReencryptedEvents decodes the events re-encrypted under a new password,
+// marking them as updated so other devices download them again. It reports false for invalid or repeated events.
+func decodeReencryptedEvents(encrypted []types.EncryptedEvent, now time.Time) ([]types.CalendarEvent, bool) {
+	seen := make(map[string]struct{}, len(encrypted))
+	events := make([]types.CalendarEvent, 0, len(encrypted))
+	for _, ev := range encrypted {
+		decoded, err := base64.StdEncoding.DecodeString(ev.Data)
+		if err != nil || len(decoded) > constants.MaxEventLen {
+			return nil, false
+		}
+
+		if _, ok := seen[ev.ID]; ok || !utils.ValidateUUID(ev.ID) {
+			return nil, false
+		}
+		seen[ev.ID] = struct{}{}
+
+		events = append(events, types.CalendarEvent{
+			ID:        ev.ID,
+			Data:      decoded,
+			UpdatedAt: now,
+		})
+	}
+	return events, true
+}
+
+// deleteUser cancels the user's billing, then deletes their account along with everything they own.
+func (h *API) deleteUser(ctx context.Context, user *types.User) error {
+	if err := h.cancelBilling(ctx, user); err != nil {
+		return fmt.Errorf("cancel billing: %w", err)
+	}
+
+	if err := database.DB.DeleteUser(ctx, user.UUID); err != nil {
+		return err
+	}
+
+	// Forget cached state of the account
+	if user.StripeSubscriptionID != nil {
+		if err := h.state.Subscriptions.Delete(ctx, *user.StripeSubscriptionID); err != nil {
+			return fmt.Errorf("forget subscription status: %w", err)
+		}
+	}
+	if err := h.state.SRPSessions.DeleteByEmail(ctx, user.Email); err != nil {
+		return fmt.Errorf("forget login handshakes: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"acLife/database"
+	"acLife/types"
+)
+
+func TestPurgeDeletedAccounts(t *testing.T) {
+	h := newTestAPI(t, database.NewMemoryStore(), nil)
+	ctx := context.Background()
+
+	due, pending := &types.User{Email: "due@example.com"}, &types.User{Email: "pending@example.com"}
+	for _, user := range []*types.User{due, pending} {
+		if err := database.DB.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	if err := database.DB.ScheduleUserDeletion(ctx, due.UUID, &past); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB.ScheduleUserDeletion(ctx, pending.UUID, &future); err != nil {
+		t.Fatal(err)
+	}
+
+	h.purgeDeletedAccounts(ctx)
+
+	if _, err := database.DB.GetUserByUUID(ctx, due.UUID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("user due for deletion: got error %v, want ErrNotFound", err)
+	}
+	if _, err := database.DB.GetUserByUUID(ctx, pending.UUID); err != nil {
+		t.Errorf("user in cooling-off period: %v", err)
+	}
+}
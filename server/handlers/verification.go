@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/mail"
+	"acLife/types"
+	"acLife/utils"
+)
+
+// verifyEmailPurpose is signed into verification links, so other signed tokens aren't accepted in their place.
+const verifyEmailPurpose = "verify-email"
+
+// emailClaims are carried by a verification link. The address is included,
+// so that the link stops working if the account's address changes.
+type emailClaims struct {
+	UUID  string `json:"u"`
+	Email string `json:"m"`
+}
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupVerificationMails(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := h.state.VerificationMails.DeleteBefore(ctx, time.Now().Add(-constants.VerificationMailInterval)); err != nil {
+		utils.LogError(ctx, "cleanupVerificationMails", "DeleteBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// VerifyEmail confirms the email address of an account, given the token of the emailed link.
+func (h *API) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var claims emailClaims
+	if err := utils.ParseSignedToken(h.linkKey, verifyEmailPurpose, r.URL.Query().Get("token"), &claims, time.Now()); err != nil {
+		sendInvalidVerificationLink(w)
+		return
+	}
+
+	user, err := database.DB.GetUserByUUID(r.Context(), claims.UUID)
+	if errors.Is(err, database.ErrNotFound) {
+		sendInvalidVerificationLink(w)
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "VerifyEmail", "GetUserByUUID", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if user.Email != claims.Email {
+		sendInvalidVerificationLink(w)
+		return
+	}
+
+	// Opening the link again is fine
+	if !user.EmailVerified {
+		err := database.DB.VerifyEmail(r.Context(), user.UUID, user.Email)
+		if errors.Is(err, database.ErrNotFound) { // address changed in the meantime
+			sendInvalidVerificationLink(w)
+			return
+		}
+		if err != nil {
+			utils.LogError(r.Context(), "VerifyEmail", "VerifyEmail", err)
+			utils.SendInternalError(w)
+			return
+		}
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+		Message: "Email address verified.",
+	})
+}
+
+// ResendVerificationEmail sends a new verification link to an account that hasn't confirmed its address.
+// It replies the same whether or not such an account exists, so it can't be used to look up addresses.
+func (h *API) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var req types.ResendVerificationRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if len(req.Email) == 0 || len(req.Email) > constants.MaxEmailLen {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	if h.cfg.Registration.EmailVerificationRequired() {
+		user, err := database.DB.GetUserByEmail(r.Context(), req.Email)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			utils.LogError(r.Context(), "ResendVerificationEmail", "GetUserByEmail", err)
+			utils.SendInternalError(w)
+			return
+		}
+
+		if err == nil && !user.EmailVerified {
+			// At most one email every constants.VerificationMailInterval
+			allowed, err := h.state.VerificationMails.Allow(r.Context(), user.UUID, constants.VerificationMailInterval, time.Now())
+			if err != nil {
+				utils.LogError(r.Context(), "ResendVerificationEmail", "VerificationMails.Allow", err)
+				utils.SendInternalError(w)
+				return
+			}
+			if allowed {
+				if err := h.sendVerificationEmail(r.Context(), user); err != nil {
+					utils.LogError(r.Context(), "ResendVerificationEmail", "sendVerificationEmail", err)
+					utils.SendInternalError(w)
+					return
+				}
+			}
+		}
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+		Message: "If the account exists and isn't verified yet, a new link is on its way.",
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// sendVerificationEmail emails the user a signed link that verifies their current address.
+func (h *API) sendVerificationEmail(ctx context.Context, user *types.User) error {
+	token, err := utils.SignToken(h.linkKey, verifyEmailPurpose, emailClaims{
+		UUID:  user.UUID,
+		Email: user.Email,
+	}, time.Now().Add(constants.EmailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	link := h.cfg.ServerURL.JoinPath("auth/email/verify")
+	link.RawQuery = url.Values{"token": {token}}.Encode()
+
+	h.mail.Enqueue(ctx, mail.VerificationEmail(user.Email, link.String(), constants.EmailVerificationTTL))
+	return nil
+}
+
+func sendInvalidVerificationLink(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+		Success: false,
+		Message: "Invalid or expired verification link.",
+	})
+}
+
+func sendEmailNotVerified(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusForbidden, types.Reply[any]{
+		Success: false,
+		Message: "Please verify your email address first.",
+	})
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/session"
+	"acLife/state"
+	"acLife/twofactor"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+/* -------------------- Cleanup -------------------- */
+
+func (h *API) cleanupWebAuthnSetups(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, constants.DBTimeout)
+	defer cancel()
+
+	if err := h.state.WebAuthnSetups.DeleteCreatedBefore(ctx, time.Now().Add(-constants.WebAuthnSetupTTL)); err != nil {
+		utils.LogError(ctx, "cleanupWebAuthnSetups", "DeleteCreatedBefore", err)
+	}
+}
+
+/* -------------------- Handlers -------------------- */
+
+// StartWebAuthnRegistration returns the options for navigator.credentials.create to register a security key.
+// The password is proven first, so the registration started here is the only proof FinishWebAuthnRegistration needs.
+func (h *API) StartWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.WebAuthnRegisterStartRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Prove knowledge of the password
+	if _, ok := h.checkSRPProof(w, r, "StartWebAuthnRegistration", req.SessionID, user.Email, req.M1, false); !ok {
+		return
+	}
+
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "StartWebAuthnRegistration", "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	// Don't register the same key twice
+	waUser := twofactor.WebAuthnUser{User: user, Credentials: creds}
+	exclude := webauthn.Credentials(waUser.WebAuthnCredentials()).CredentialDescriptors()
+
+	creation, setup, err := h.webAuthn.BeginRegistration(waUser, webauthn.WithExclusions(exclude))
+	if err != nil {
+		utils.LogError(r.Context(), "StartWebAuthnRegistration", "BeginRegistration", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	if err := h.state.WebAuthnSetups.Save(r.Context(), user.UUID, &types.WebAuthnSetup{
+		Session:   setup,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		utils.LogError(r.Context(), "StartWebAuthnRegistration", "WebAuthnSetups.Save", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+		Data:    creation,
+	})
+}
+
+// FinishWebAuthnRegistration verifies and stores the credential created by the security key.
+func (h *API) FinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	var req types.WebAuthnRegisterRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) == 0 || len(name) > constants.MaxKeyNameLen || len(req.Credential) == 0 {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	setup, err := h.state.WebAuthnSetups.Take(r.Context(), user.UUID)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		utils.LogError(r.Context(), "FinishWebAuthnRegistration", "WebAuthnSetups.Take", err)
+		utils.SendInternalError(w)
+		return
+	}
+	if err != nil || time.Since(setup.CreatedAt) > constants.WebAuthnSetupTTL {
+		utils.SendJSON(w, http.StatusBadRequest, types.Reply[any]{
+			Success: false,
+			Message: "Security key registration was not started or has expired.",
+		})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		sendInvalidSecurityKey(w, http.StatusBadRequest)
+		return
+	}
+
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "FinishWebAuthnRegistration", "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	waUser := twofactor.WebAuthnUser{User: user, Credentials: creds}
+	credential, err := h.webAuthn.CreateCredential(waUser, *setup.Session, parsed)
+	if err != nil {
+		sendInvalidSecurityKey(w, http.StatusBadRequest)
+		return
+	}
+
+	cred := twofactor.NewWebAuthnCredential(user.UUID, name, credential, time.Now())
+	if err := database.DB.AddWebAuthnCredential(r.Context(), cred); err != nil {
+		if database.IsDuplicateEntry(err) {
+			utils.SendJSON(w, http.StatusConflict, types.Reply[any]{
+				Success: false,
+				Message: "Security key already registered.",
+			})
+			return
+		}
+
+		utils.LogError(r.Context(), "FinishWebAuthnRegistration", "AddWebAuthnCredential", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[types.WebAuthnCredentialInfo]{
+		Success: true,
+		Data: types.WebAuthnCredentialInfo{
+			ID:        cred.ID,
+			Name:      cred.Name,
+			CreatedAt: cred.CreatedAt.UnixMilli(),
+		},
+	})
+}
+
+// ListWebAuthnCredentials returns the user's security keys.
+func (h *API) ListWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), "ListWebAuthnCredentials", "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	infos := make([]types.WebAuthnCredentialInfo, 0, len(creds))
+	for _, c := range creds {
+		info := types.WebAuthnCredentialInfo{
+			ID:        c.ID,
+			Name:      c.Name,
+			CreatedAt: c.CreatedAt.UnixMilli(),
+		}
+		if c.LastUsedAt != nil {
+			info.LastUsedAt = c.LastUsedAt.UnixMilli()
+		}
+		infos = append(infos, info)
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[[]types.WebAuthnCredentialInfo]{
+		Success: true,
+		Data:    infos,
+	})
+}
+
+// RemoveWebAuthnCredential deletes one of the user's security keys.
+func (h *API) RemoveWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	user := session.GetLoggedInUser(r)
+	utils.Assert(user != nil) // ensured by AuthMiddleware
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	var req types.WebAuthnRemoveRequest
+	if err := utils.ParseJSON(r.Body, &req); err != nil {
+		utils.SendBadRequest(w)
+		return
+	}
+
+	// Prove knowledge of the password
+	if _, ok := h.checkSRPProof(w, r, "RemoveWebAuthnCredential", req.SessionID, user.Email, req.M1, false); !ok {
+		return
+	}
+
+	err = database.DB.DeleteWebAuthnCredential(r.Context(), user.UUID, id)
+	if errors.Is(err, database.ErrNotFound) {
+		utils.SendJSON(w, http.StatusNotFound, types.Reply[any]{
+			Success: false,
+			Message: "Security key not found.",
+		})
+		return
+	}
+	if err != nil {
+		utils.LogError(r.Context(), "RemoveWebAuthnCredential", "DeleteWebAuthnCredential", err)
+		utils.SendInternalError(w)
+		return
+	}
+
+	utils.SendJSON(w, http.StatusOK, types.Reply[any]{
+		Success: true,
+	})
+}
+
+/* -------------------- Helpers -------------------- */
+
+// verifyWebAuthnAssertion checks a security key's response to the assertion options of a pending login,
+// and records its new signature counter. It reports whether the response is valid, and returns false for ok
+// if the error response has been sent. An invalid response is left for the caller to reply to.
+func (h *API) verifyWebAuthnAssertion(w http.ResponseWriter, r *http.Request, function string, user *types.User, setup *webauthn.SessionData, credential json.RawMessage) (valid, ok bool) {
+	if setup == nil || len(credential) == 0 {
+		return false, true
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(credential)
+	if err != nil {
+		return false, true
+	}
+
+	creds, err := database.DB.GetWebAuthnCredentials(r.Context(), user.UUID)
+	if err != nil {
+		utils.LogError(r.Context(), function, "GetWebAuthnCredentials", err)
+		utils.SendInternalError(w)
+		return false, false
+	}
+
+	cred, err := h.webAuthn.ValidateLogin(twofactor.WebAuthnUser{User: user, Credentials: creds}, *setup, parsed)
+	if err != nil {
+		return false, true
+	}
+
+	// A counter that went backwards means the key may have been cloned
+	if cred.Authenticator.CloneWarning {
+		slog.WarnContext(r.Context(), "security key counter went backwards", "function", function)
+		return false, true
+	}
+
+	if err := database.DB.UseWebAuthnCredential(r.Context(), user.UUID, cred.ID, cred.Authenticator.SignCount, cred.Flags.BackupState, time.Now()); err != nil {
+		utils.LogError(r.Context(), function, "UseWebAuthnCredential", err)
+		utils.SendInternalError(w)
+		return false, false
+	}
+
+	return true, true
+}
+
+func sendInvalidSecurityKey(w http.ResponseWriter, status int) {
+	utils.SendJSON(w, status, types.Reply[any]{
+		Success: false,
+		Message: "Invalid security key response.",
+	})
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"acLife/config"
+	"acLife/constants"
+	"acLife/database"
+	"acLife/handlers"
+	"acLife/lifecycle"
+	"acLife/session"
+	"acLife/types"
+	"acLife/utils"
+
+	"mz.attahri.com/code/srp/v3"
+)
+
+// testServer runs the full API router over TLS, backed by an in-memory store.
+type testServer struct {
+	t      *testing.T
+	server *httptest.Server
+	api    *handlers.API
+	tasks  *lifecycle.Manager
+}
+
+// testClient is a single browser-like client with its own cookie jar.
+type testClient struct {
+	ts     *testServer
+	client *http.Client
+	header http.Header // sent with every request
+
+	deviceName string // sent on login
+	bearer     bool   // log in with a Bearer token instead of the cookie
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerWithConfig(t, nil)
+}
+
+// newTestServerWithConfig starts a test server with the given settings overriding the test defaults.
+func newTestServerWithConfig(t *testing.T, overrides map[string]string) *testServer {
+	t.Helper()
+
+	cfg := testConfig(t, overrides)
+
+	database.DB = database.NewMemoryStore()
+	session.Store = newSessionStore([]byte(cfg.SessionKey), "", cfg.Sessions.MaxLifetime)
+
+	return startTestServer(t, cfg)
+}
+
+// newReplica starts another instance sharing the configuration, database and session store,
+// like a second replica behind a load balancer.
+func (ts *testServer) newReplica() *testServer {
+	ts.t.Helper()
+	return startTestServer(ts.t, ts.api.Config())
+}
+
+// startTestServer serves the API on the current database and session store.
+func startTestServer(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+
+	tasks := lifecycle.New()
+	api := handlers.New(cfg, tasks)
+
+	srv := httptest.NewTLSServer(newRouter(api))
+	t.Cleanup(func() {
+		srv.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := api.DrainPush(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := api.DrainMail(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := tasks.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &testServer{t: t, server: srv, api: api, tasks: tasks}
+}
+
+// testConfig returns a valid configuration, with overrides applied on top of the defaults.
+func testConfig(t *testing.T, overrides map[string]string) *config.Config {
+	t.Helper()
+
+	values := map[string]string{
+		"ENV":             "development",
+		"IS_BEHIND_PROXY": "true", // clients are told apart by X-Real-IP
+		"PORT":            "8000",
+		"SERVER_URL":      "https://localhost:8000/",
+		"SESSION_KEY":     utils.RandomToken(32),
+		"DB_DRIVER":       "sqlite",
+		"DB_PATH":         filepath.Join(t.TempDir(), "unused.db"),
+		"MAIL_DIR":        t.TempDir(),
+
+		// Accounts can log in right after registering, TestEmailVerification turns this back on
+		"DISABLE_EMAIL_VALIDATION": "true",
+	}
+	maps.Copy(values, overrides)
+
+	cfg, err := config.Parse(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// mails waits for queued emails and returns the decoded bodies of all emails sent so far, oldest first.
+func (ts *testServer) mails() []string {
+	ts.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.api.DrainMail(ctx); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	dir := ts.api.Config().Mail.Dir
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ts.t.Fatal(err)
+	}
+
+	var bodies []string // file names start with the time written
+	for _, entry := range entries {
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		_ = f.Close()
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+// withoutLoginAlerts drops the alerts of logins from new devices, for tests about other emails.
+func withoutLoginAlerts(mails []string) []string {
+	var other []string
+	for _, body := range mails {
+		if !strings.Contains(body, "logged in from a new device") {
+			other = append(other, body)
+		}
+	}
+	return other
+}
+
+func (ts *testServer) newClient() *testClient {
+	ts.t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	// The server's client is shared, so copy it before giving it its own cookie jar
+	client := *ts.server.Client()
+	client.Jar = jar
+
+	// Each client gets its own address, so rate limits don't carry over between tests
+	ip := randomBytes(ts.t, 3)
+	header := make(http.Header)
+	header.Set("X-Real-IP", fmt.Sprintf("10.%d.%d.%d", ip[0], ip[1], ip[2]))
+
+	return &testClient{ts: ts, client: &client, header: header}
+}
+
+// newBearerClient returns a native-like client without cookies, authenticating with a Bearer token.
+func (ts *testServer) newBearerClient() *testClient {
+	ts.t.Helper()
+
+	c := ts.newClient()
+	c.client.Jar = nil
+	c.bearer = true
+	return c
+}
+
+// setSessionCookie replaces the client's session cookie with one holding values, as the server would encode it.
+func (c *testClient) setSessionCookie(values map[string]any) {
+	c.ts.t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, c.ts.server.URL, nil)
+	rec := httptest.NewRecorder()
+
+	sess, err := session.Store.New(req, constants.SessionName)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	for key, value := range values {
+		sess.Values[key] = value
+	}
+	if err := sess.Save(req, rec); err != nil {
+		c.ts.t.Fatal(err)
+	}
+
+	u, err := url.Parse(c.ts.server.URL)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	c.client.Jar.SetCookies(u, rec.Result().Cookies())
+}
+
+// do sends a request with an optional JSON body and decodes the JSON reply into data.
+func (c *testClient) do(method, path string, body any, data any) (int, types.Reply[json.RawMessage]) {
+	c.ts.t.Helper()
+
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.ts.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.ts.server.URL+path, reader)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var reply types.Reply[json.RawMessage]
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		c.ts.t.Fatalf("%s %s: decoding reply: %v", method, path, err)
+	}
+
+	if data != nil && len(reply.Data) > 0 {
+		if err := json.Unmarshal(reply.Data, data); err != nil {
+			c.ts.t.Fatalf("%s %s: decoding data: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode, reply
+}
+
+func (c *testClient) post(path string, body any, data any) (int, types.Reply[json.RawMessage]) {
+	c.ts.t.Helper()
+	return c.do(http.MethodPost, path, body, data)
+}
+
+func (c *testClient) get(path string, data any) (int, types.Reply[json.RawMessage]) {
+	c.ts.t.Helper()
+	return c.do(http.MethodGet, path, nil, data)
+}
+
+// page sends a request with an optional form to a route serving HTML, and returns the status and the page.
+func (c *testClient) page(method, path string, form url.Values) (int, string) {
+	c.ts.t.Helper()
+
+	req, err := http.NewRequest(method, c.ts.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// register creates an account the same way the web client does.
+func (c *testClient) register(email, password string) (int, types.Reply[json.RawMessage]) {
+	c.ts.t.Helper()
+	return c.registerWithInvite(email, password, "")
+}
+
+// registerWithInvite is register with an invite code, for invite-only servers.
+func (c *testClient) registerWithInvite(email, password, code string) (int, types.Reply[json.RawMessage]) {
+	c.ts.t.Helper()
+
+	srpSalt := randomBytes(c.ts.t, 16)
+	triplet, err := srp.ComputeVerifier(utils.SRPParams, email, password, srpSalt)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+
+	return c.post("/auth/register", map[string]any{
+		"challenge":   "test-challenge",
+		"triplet":     []byte(triplet),
+		"salt":        randomBytes(c.ts.t, 16),
+		"invite_code": code,
+	}, nil)
+}
+
+// login runs both SRP steps and verifies the server proof.
+// It returns the status of the final request.
+func (c *testClient) login(email, password string) int {
+	c.ts.t.Helper()
+
+	_, status := c.loginVerify(email, password)
+	return status
+}
+
+// loginVerify is login, also returning the reply of the final request.
+func (c *testClient) loginVerify(email, password string) (types.LoginVerifyResponse, int) {
+	c.ts.t.Helper()
+
+	var verify types.LoginVerifyResponse
+
+	client, sessionID, status := c.startSRP(email, password)
+	if status != http.StatusOK {
+		return verify, status
+	}
+
+	M1, err := client.ComputeM1()
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+
+	status, _ = c.post("/auth/login/verify", map[string]any{
+		"email":        email,
+		"M1":           M1,
+		"session_id":   sessionID,
+		"device_name":  c.deviceName,
+		"return_token": c.bearer,
+	}, &verify)
+	if status != http.StatusOK {
+		return verify, status
+	}
+
+	if ok, err := client.CheckM2(verify.M2); err != nil || !ok {
+		c.ts.t.Fatalf("server proof M2 did not verify: %v", err)
+	}
+
+	if verify.Session != nil {
+		c.header.Set("Authorization", "Bearer "+verify.Session.AccessToken)
+	}
+
+	return verify, status
+}
+
+// startSRP runs the first SRP step and returns the client, ready to compute M1, with the handshake ID.
+func (c *testClient) startSRP(email, password string) (*srp.Client, string, int) {
+	c.ts.t.Helper()
+	return c.startSRPAt("/auth/login/start", email, password)
+}
+
+// startSRPAt is startSRP against another endpoint taking the same requests, such as /auth/recovery/start.
+func (c *testClient) startSRPAt(path, email, password string) (*srp.Client, string, int) {
+	c.ts.t.Helper()
+
+	var salt []byte
+	if status, _ := c.post(path, map[string]any{"email": email}, &salt); status != http.StatusOK {
+		return nil, "", status
+	}
+
+	client, err := srp.NewClient(utils.SRPParams, email, password, salt)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+
+	var start types.LoginStartResponse
+	status, _ := c.post(path, map[string]any{
+		"email": email,
+		"A":     client.A(),
+	}, &start)
+	if status != http.StatusOK {
+		return nil, "", status
+	}
+
+	if err := client.SetB(start.B); err != nil {
+		c.ts.t.Fatal(err)
+	}
+
+	return client, start.SessionID, status
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
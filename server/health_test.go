@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"acLife/types"
+)
+
+func TestHealthProbes(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.get("/health/live", nil); status != http.StatusOK {
+		t.Fatalf("live: got %d", status)
+	}
+
+	var report types.Readiness
+	if status, _ := c.get("/health/ready", &report); status != http.StatusOK {
+		t.Fatalf("ready: got %d %+v", status, report)
+	}
+	if !report.Ready || report.Checks["database"].Status != "ok" || report.Checks["schema"].Status != "ok" {
+		t.Fatalf("ready: got %+v", report)
+	}
+	if report.Checks["stripe"].Status != "disabled" || report.Checks["push"].Status != "disabled" {
+		t.Fatalf("ready: optional services should be disabled, got %+v", report)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	token := strings.Repeat("d", 32)
+	ts := newTestServerWithConfig(t, map[string]string{"DIAGNOSTICS_TOKEN": token})
+	c := ts.newClient()
+
+	if status, _ := c.get("/diagnostics", nil); status != http.StatusUnauthorized {
+		t.Fatalf("without token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	c.header.Set("Authorization", "Bearer "+strings.Repeat("x", 32))
+	if status, _ := c.get("/diagnostics", nil); status != http.StatusUnauthorized {
+		t.Fatalf("wrong token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	c.header.Set("Authorization", "Bearer "+token)
+	var diag types.Diagnostics
+	if status, _ := c.get("/diagnostics", &diag); status != http.StatusOK {
+		t.Fatalf("diagnostics: got %d", status)
+	}
+	if diag.Version == "" || diag.PushPending != 0 {
+		t.Fatalf("diagnostics: got %+v", diag)
+	}
+}
+
+func TestDiagnosticsDisabledWithoutToken(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	c.header.Set("Authorization", "Bearer ")
+	if status, _ := c.get("/diagnostics", nil); status != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"METRICS_TOKEN": strings.Repeat("m", 32)})
+	c := ts.newClient()
+
+	// Generate some traffic
+	c.get("/health/live", nil)
+
+	req, err := http.NewRequest(http.MethodGet, ts.server.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without token: got %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.Repeat("m", 32))
+	resp, err = c.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `aclife_http_requests_total{code="200",method="GET",route="/health/live"}`
+	if !strings.Contains(string(body), want) {
+		t.Fatalf("metrics output is missing %s", want)
+	}
+}
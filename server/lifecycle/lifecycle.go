@@ -0,0 +1,146 @@
+// Package lifecycle runs background workers and stops them on shutdown.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Manager starts background workers and delayed tasks and waits for them on shutdown.
+type Manager struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	running  map[string]int           // worker name -> number running
+	delayed  map[*time.Timer]struct{} // pending delayed tasks
+	stopping bool
+}
+
+// New creates a Manager with no workers.
+func New() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]int),
+		delayed: make(map[*time.Timer]struct{}),
+	}
+}
+
+// Go runs fn in a new goroutine. The context passed to fn is cancelled on shutdown.
+// It does nothing once shutdown has begun.
+func (m *Manager) Go(name string, fn func(ctx context.Context)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping {
+		return
+	}
+
+	m.running[name]++
+	m.wg.Add(1)
+
+	go func() {
+		defer m.done(name)
+		fn(m.ctx)
+	}()
+}
+
+// Every runs fn every interval until shutdown.
+func (m *Manager) Every(name string, interval time.Duration, fn func(ctx context.Context)) {
+	m.Go(name, func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	})
+}
+
+// After runs fn once after the delay.
+// Tasks still pending on shutdown are run immediately instead of being dropped.
+func (m *Manager) After(name string, delay time.Duration, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping {
+		return
+	}
+
+	m.running[name]++
+	m.wg.Add(1)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		delete(m.delayed, timer)
+		m.mu.Unlock()
+
+		defer m.done(name)
+		fn()
+	})
+	m.delayed[timer] = struct{}{}
+}
+
+// Shutdown cancels all workers, runs pending delayed tasks and waits for everything to finish.
+// If ctx expires first, the error names the workers that are still running.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopping = true
+	m.cancel()
+
+	// Fire pending delayed tasks now
+	for timer := range m.delayed {
+		if timer.Stop() {
+			timer.Reset(0)
+		}
+	}
+	m.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("workers still running: %v", m.Running())
+	}
+}
+
+// Running returns the names of the workers that haven't finished yet.
+func (m *Manager) Running() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.running))
+	for name := range m.running {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (m *Manager) done(name string) {
+	m.mu.Lock()
+	if m.running[name]--; m.running[name] == 0 {
+		delete(m.running, name)
+	}
+	m.mu.Unlock()
+
+	m.wg.Done()
+}
@@ -0,0 +1,91 @@
+package lifecycle
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownStopsWorkers(t *testing.T) {
+	m := New()
+
+	var ticks atomic.Int32
+	m.Every("tick", time.Millisecond, func(ctx context.Context) {
+		ticks.Add(1)
+	})
+
+	stopped := make(chan struct{})
+	m.Go("blocking", func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Error("worker context was not cancelled")
+	}
+
+	if ticks.Load() == 0 {
+		t.Error("periodic worker never ran")
+	}
+	if running := m.Running(); len(running) != 0 {
+		t.Errorf("workers still running: %v", running)
+	}
+}
+
+func TestShutdownRunsPendingDelayedTasks(t *testing.T) {
+	m := New()
+
+	var ran atomic.Bool
+	m.After("delayed", time.Hour, func() {
+		ran.Store(true)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !ran.Load() {
+		t.Error("pending delayed task was dropped")
+	}
+
+	// Nothing new starts after shutdown
+	m.After("late", 0, func() {
+		t.Error("task scheduled after shutdown ran")
+	})
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	m := New()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	m.Go("stuck", func(ctx context.Context) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := m.Shutdown(ctx); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if running := m.Running(); len(running) != 1 || running[0] != "stuck" {
+		t.Errorf("Running() = %v", running)
+	}
+}
@@ -0,0 +1,118 @@
+// Package logging sets up structured JSON logging with request context and redaction.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces the value of sensitive attributes.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values never reach the log output, compared case-insensitively.
+var sensitiveKeys = map[string]bool{
+	"access_token":  true,
+	"accesstoken":   true,
+	"refresh_token": true,
+	"refreshtoken":  true,
+	"token":         true,
+	"authorization": true,
+	"cookie":        true,
+	"password":      true,
+	"session_key":   true,
+
+	// SRP values
+	"a":         true,
+	"b":         true,
+	"m1":        true,
+	"m2":        true,
+	"triplet":   true,
+	"verifier":  true,
+	"salt":      true,
+	"srp_salt":  true,
+	"challenge": true,
+
+	// Push subscription keys
+	"p256dh": true,
+	"auth":   true,
+}
+
+// Setup installs a JSON logger writing to w as the default slog logger.
+// The standard log package is redirected to it as well.
+func Setup(w io.Writer, level slog.Level) {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	})
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+/* -------------------- Request Context -------------------- */
+
+type contextKey struct{}
+
+// requestFields are attached to every log line written with a request context.
+// The user is set later by the auth middleware, so the fields are shared and guarded.
+type requestFields struct {
+	mu        sync.Mutex
+	requestID string
+	route     string
+	user      string
+}
+
+// WithRequest returns a context whose log lines carry the request ID and route.
+func WithRequest(ctx context.Context, requestID, route string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestFields{requestID: requestID, route: route})
+}
+
+// SetUser adds the authenticated user's UUID to the log lines of the request.
+func SetUser(ctx context.Context, uuid string) {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		f.mu.Lock()
+		f.user = uuid
+		f.mu.Unlock()
+	}
+}
+
+// RequestID returns the ID of the request the context belongs to, if any.
+func RequestID(ctx context.Context) string {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		return f.requestID
+	}
+	return ""
+}
+
+// contextHandler adds the request fields of the context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		f.mu.Lock()
+		r.AddAttrs(slog.String("request_id", f.requestID), slog.String("route", f.route))
+		if f.user != "" {
+			r.AddAttrs(slog.String("user", f.user))
+		}
+		f.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestRequestFieldsAndRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, slog.LevelInfo)
+	t.Cleanup(func() { slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))) })
+
+	ctx := WithRequest(context.Background(), "req-1", "/calendar/save")
+	SetUser(ctx, "6f1c7d7e-0000-4000-8000-000000000000")
+
+	slog.InfoContext(ctx, "login", "access_token", "secret", "M1", []byte{1, 2}, "p256dh", "key", "email", "a@example.com")
+	slog.Debug("hidden")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", buf.String(), err)
+	}
+
+	want := map[string]any{
+		"request_id":   "req-1",
+		"route":        "/calendar/save",
+		"user":         "6f1c7d7e-0000-4000-8000-000000000000",
+		"access_token": Redacted,
+		"M1":           Redacted,
+		"p256dh":       Redacted,
+		"email":        "a@example.com",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+}
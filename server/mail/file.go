@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"time"
+
+	"acLife/utils"
+)
+
+// fileSender writes each email to a .eml file instead of sending it, for development.
+type fileSender struct {
+	dir  string
+	from *netmail.Address
+}
+
+func newFileSender(dir string, from *netmail.Address) *fileSender {
+	return &fileSender{dir: dir, from: from}
+}
+
+func (s *fileSender) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := now.UTC().Format("20060102-150405.000000000") + "-" + utils.RandomToken(4) + ".eml"
+	path := filepath.Join(s.dir, name)
+
+	if err := os.WriteFile(path, msg.encode(s.from, now), 0o600); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Email written to file", "subject", msg.Subject, "path", path)
+	return nil
+}
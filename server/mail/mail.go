@@ -0,0 +1,219 @@
+// Package mail sends emails to users.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"acLife/config"
+	"acLife/constants"
+	"acLife/metrics"
+	"acLife/utils"
+)
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers emails.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Mailer sends emails in the background through the configured Sender.
+type Mailer struct {
+	sender Sender
+
+	wg      sync.WaitGroup
+	pending atomic.Int64 // background sends not yet finished
+}
+
+// New creates a Mailer using the configured driver.
+func New(cfg config.Mail) *Mailer {
+	from, err := netmail.ParseAddress(cfg.From)
+	utils.Assert(err == nil) // validated by the config
+
+	var sender Sender
+	switch cfg.Driver {
+	case "smtp":
+		sender = newSMTPSender(cfg, from)
+	default:
+		sender = newFileSender(cfg.Dir, from)
+	}
+
+	return &Mailer{sender: sender}
+}
+
+// Enqueue sends an email in the background. Failures are logged.
+// The send isn't cancelled with ctx, which only carries values such as the request's log fields.
+func (m *Mailer) Enqueue(ctx context.Context, msg Message) {
+	ctx = context.WithoutCancel(ctx)
+
+	m.wg.Add(1)
+	m.pending.Add(1)
+
+	go func() {
+		defer m.wg.Done()
+		defer m.pending.Add(-1)
+
+		ctx, cancel := context.WithTimeout(ctx, constants.MailTimeout)
+		defer cancel()
+
+		if err := m.sender.Send(ctx, msg); err != nil {
+			metrics.MailSends.WithLabelValues("error").Inc()
+			utils.LogError(ctx, "mail.Enqueue", "Send", err)
+			return
+		}
+		metrics.MailSends.WithLabelValues("sent").Inc()
+	}()
+}
+
+// Pending returns the number of queued emails that haven't been sent yet.
+func (m *Mailer) Pending() int {
+	return int(m.pending.Load())
+}
+
+// Drain waits until all queued emails have been sent or ctx expires.
+func (m *Mailer) Drain(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d emails still pending: %w", m.Pending(), ctx.Err())
+	}
+}
+
+// encode formats the message as an RFC 5322 email with a quoted-printable UTF-8 body.
+func (msg Message) encode(from *netmail.Address, now time.Time) []byte {
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", utils.RandomToken(16), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))) // writes to a buffer can't fail
+	_ = qp.Close()
+
+	return b.Bytes()
+}
+
+/* -------------------- Messages -------------------- */
+
+// VerificationEmail asks a new user to confirm their email address by opening link.
+func VerificationEmail(to, link string, expiry time.Duration) Message {
+	return Message{
+		To:      to,
+		Subject: "Verify your acLife email address",
+		Body: "Welcome to acLife!\n\n" +
+			"Open the link below to verify your email address:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + formatDuration(expiry) + ". " +
+			"If you didn't create an account, you can ignore this email.\n",
+	}
+}
+
+// EmailChangeEmail asks the user to confirm the new address of their account by opening link.
+func EmailChangeEmail(to, link string, expiry time.Duration) Message {
+	return Message{
+		To:      to,
+		Subject: "Confirm your new acLife email address",
+		Body: "Open the link below to make this the email address of your acLife account:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + formatDuration(expiry) + ". " +
+			"If you didn't ask for this, you can ignore this email.\n",
+	}
+}
+
+// EmailChangedEmail tells the user at their old address that the account's address was changed to newEmail.
+func EmailChangedEmail(to, newEmail string, at time.Time) Message {
+	return Message{
+		To:      to,
+		Subject: "Your acLife email address was changed",
+		Body: "The email address of your acLife account was changed to " + newEmail + " on " +
+			at.UTC().Format("January 2, 2006 at 15:04 UTC") + ". Log in with the new address from now on.\n\n" +
+			"The recovery key was removed, since it only works with the old address. " +
+			"Set up a new one in your account settings.\n\n" +
+			"If this wasn't you, someone else knows your password and now has access to your account.\n",
+	}
+}
+
+// PasswordRecoveredEmail tells the user that their password was reset with the recovery key.
+func PasswordRecoveredEmail(to string, at time.Time) Message {
+	return Message{
+		To:      to,
+		Subject: "Your acLife password was reset",
+		Body: "The password of your acLife account was reset with your recovery key on " +
+			at.UTC().Format("January 2, 2006 at 15:04 UTC") + ".\n\n" +
+			"All devices were logged out and the recovery key can't be used again. " +
+			"Set up a new one in your account settings.\n\n" +
+			"If this wasn't you, someone else had your recovery key and now has access to your account.\n",
+	}
+}
+
+// AccountLockedEmail tells the user that logins to their account are blocked until the given time after repeated failures.
+func AccountLockedEmail(to string, until time.Time) Message {
+	return Message{
+		To:      to,
+		Subject: "Too many failed logins to your acLife account",
+		Body: "Someone entered a wrong password or recovery code for your acLife account too many times, " +
+			"so logins are blocked until " + until.UTC().Format("January 2, 2006 at 15:04 UTC") + ".\n\n" +
+			"If this was you, wait until then and try again. " +
+			"If it wasn't, your calendar stays encrypted, but consider choosing a stronger password.\n",
+	}
+}
+
+// NewDeviceLoginEmail tells the user about a login from a device they haven't used before.
+// link leads to a page that logs that device out once confirmed.
+func NewDeviceLoginEmail(to string, at time.Time, ip, device, link string) Message {
+	return Message{
+		To:      to,
+		Subject: "New login to your acLife account",
+		Body: "Your acLife account was logged in from a new device around " +
+			at.UTC().Format("January 2, 2006 at 15:04 UTC") + ".\n\n" +
+			"Device: " + device + "\n" +
+			"IP address: " + ip + "\n\n" +
+			"If this was you, you can ignore this email. If it wasn't, open the link below and confirm to log that device out, " +
+			"then change your password:\n\n" +
+			link + "\n",
+	}
+}
+
+// formatDuration writes whole hours or minutes, such as "24 hours".
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		return plural(int(d/time.Hour), "hour")
+	}
+	return plural(int(d/time.Minute), "minute")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
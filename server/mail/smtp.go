@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"acLife/config"
+)
+
+// smtpSender sends emails through an SMTP server.
+// Port 465 connects with TLS, other ports upgrade with STARTTLS when the server offers it.
+type smtpSender struct {
+	addr string
+	host string
+	from *netmail.Address
+	auth smtp.Auth // nil without credentials
+	tls  bool      // TLS from the start instead of STARTTLS
+}
+
+func newSMTPSender(cfg config.Mail, from *netmail.Address) *smtpSender {
+	s := &smtpSender{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		host: cfg.Host,
+		from: from,
+		tls:  cfg.Port == 465,
+	}
+	if cfg.User != "" {
+		// Refuses to send the password over an unencrypted connection, except to localhost
+		s.auth = smtp.PlainAuth("", cfg.User, cfg.Password, cfg.Host)
+	}
+	return s
+}
+
+func (s *smtpSender) Send(ctx context.Context, msg Message) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp has no contexts, so the deadline is set on the connection
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if !s.tls {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.encode(s.from, time.Now())); err != nil {
+		return errors.Join(err, w.Close())
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (s *smtpSender) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if s.tls {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.host}}
+		return tlsDialer.DialContext(ctx, "tcp", s.addr)
+	}
+	return dialer.DialContext(ctx, "tcp", s.addr)
+}
@@ -1,71 +1,167 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"acLife/config"
 	"acLife/constants"
 	"acLife/database"
 	"acLife/handlers"
+	"acLife/lifecycle"
+	"acLife/logging"
+	"acLife/metrics"
+	"acLife/openapi"
 	"acLife/routes"
 	"acLife/session"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/rs/cors"
+	"github.com/stripe/stripe-go/v84"
 )
 
 func main() {
+	rollback := flag.Int("rollback", -1, "roll the database schema back to the given version and exit")
+	flag.Parse()
+
+	// Load and validate the configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Log JSON lines from here on
+	logging.Setup(os.Stdout, cfg.LogLevel)
+
 	// Connect to the database
-	if err := database.Connect(); err != nil {
-		log.Fatalf("Database connection failed: %v", err)
+	if err := database.Connect(cfg.Database); err != nil {
+		fatal("Database connection failed", err)
+	}
+
+	// Roll back the schema if requested
+	if *rollback >= 0 {
+		if err := database.Rollback(*rollback); err != nil {
+			fatal("Database rollback failed", err)
+		}
+		slog.Info("Database schema rolled back", "version", *rollback)
+		return
 	}
 
-	// Setup database
-	if err := database.Setup(); err != nil {
-		log.Fatalf("Database setup failed: %v", err)
+	// Apply pending migrations
+	if err := database.Migrate(); err != nil {
+		fatal("Database migration failed", err)
 	}
 
+	// Stripe client is configured globally
+	stripe.Key = cfg.Stripe.APIKey
+
 	// Create cookie store
-	sessionKey := os.Getenv("SESSION_KEY")
-	if sessionKey == "" {
-		log.Fatal("SESSION_KEY is not set")
+	session.Store = newSessionStore([]byte(cfg.SessionKey), cfg.CookieDomain(), cfg.Sessions.MaxLifetime)
+
+	// Start background workers
+	tasks := lifecycle.New()
+	api := handlers.New(cfg, tasks)
+	api.StartWorkers()
+
+	// Setup API router
+	r := newRouter(api)
+
+	// Setup CORS
+	c := cors.New(cors.Options{
+		AllowedOrigins:   cfg.CORSAllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-Request-ID"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+	})
+
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.Port),
+		Handler: c.Handler(r),
 	}
 
-	if len(sessionKey) < 32 {
-		log.Fatal("SESSION_KEY is too short, must be at least 32 characters")
+	// Stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Bind to port
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Running", "port", cfg.Port)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("HTTP server failed", err)
+	case <-ctx.Done():
+		stop() // a second signal kills the process
 	}
 
-	serverURL, err := url.Parse(os.Getenv("SERVER_URL"))
-	if err != nil {
-		log.Fatal("SERVER_URL is invalid")
+	slog.Info("Shutting down")
+	if err := shutdown(srv, api, tasks); err != nil {
+		fatal("Shutdown failed", err)
 	}
+}
 
-	// Figure out the cookie domain from the SERVER_URL
-	cookieDomain := serverURL.Hostname()
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// shutdown stops the server in order: in-flight requests are drained first,
+// then queued push notifications, emails and background workers, and finally the database pool is closed.
+func shutdown(srv *http.Server, api *handlers.API, tasks *lifecycle.Manager) error {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.ShutdownTimeout)
+	defer cancel()
 
-	if cookieDomain == "localhost" || net.ParseIP(cookieDomain) != nil {
-		cookieDomain = "" // omit localhost or IPs
+	var errs []error
+
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
 	}
 
-	session.Store = sessions.NewCookieStore([]byte(sessionKey))
-	session.Store.Options = &sessions.Options{
-		Domain:   cookieDomain,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-		MaxAge:   int(constants.AccessTokenExpiry.Seconds()),
+	if err := api.DrainPush(ctx); err != nil {
+		errs = append(errs, err)
 	}
 
-	// Setup API router
+	if err := api.DrainMail(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := tasks.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := database.DB.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("database: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// newRouter creates the API router with all middleware and routes registered.
+func newRouter(h *handlers.API) *mux.Router {
 	r := mux.NewRouter()
 
+	// Count requests and measure latency per route
+	r.Use(metrics.Middleware())
+
+	// Tag requests and their log lines with an ID
+	r.Use(handlers.RequestIDMiddleware())
+
 	// We always want to close the request body
 	r.Use(handlers.BodyCloseMiddleware())
 
@@ -73,36 +169,36 @@ func main() {
 	r.Use(handlers.TimeoutMiddleware(constants.HTTPTimeout))
 
 	// Routes consist of a path and a handler function
-	r.HandleFunc("/", handlers.Root).Methods("GET")
-	r.HandleFunc("/metadata", handlers.Metadata).Methods("GET")
+	r.HandleFunc("/", h.Root).Methods("GET")
+	r.HandleFunc("/metadata", h.Metadata).Methods("GET")
+	r.Handle("/openapi.yaml", openapi.Handler()).Methods("GET")
 
 	// Register error handlers
 	r.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
 	r.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
 
 	// Register all routes
-	routes.Auth(r)
-	routes.User(r)
-	routes.Stripe(r)
-	routes.Calendar(r)
-
-	// Setup CORS
-	origins := strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",")
+	routes.Auth(r, h)
+	routes.User(r, h)
+	routes.Stripe(r, h)
+	routes.Calendar(r, h)
+	routes.Health(r, h)
+	routes.Admin(r, h)
+
+	return r
+}
 
-	for i := range origins {
-		origins[i] = strings.TrimSpace(origins[i])
+// newSessionStore creates the cookie store used for sessions.
+// The cookie holds the refresh token, so it lives as long as a session can.
+func newSessionStore(key []byte, cookieDomain string, maxAge time.Duration) *sessions.CookieStore {
+	store := sessions.NewCookieStore(key)
+	store.Options = &sessions.Options{
+		Domain:   cookieDomain,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+		MaxAge:   int(maxAge.Seconds()),
 	}
-
-	c := cors.New(cors.Options{
-		AllowedOrigins:   origins,
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
-		AllowCredentials: true,
-	})
-
-	handler := c.Handler(r)
-
-	// Bind to port
-	fmt.Println("Running on port " + os.Getenv("PORT"))
-	log.Fatal(http.ListenAndServe(":"+os.Getenv("PORT"), handler))
+	return store
 }
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"acLife/constants"
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, reply := c.register("alice@example.com", "correct horse"); status != http.StatusOK {
+		t.Fatalf("register: got %d %q", status, reply.Message)
+	}
+
+	// Not logged in yet
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info before login: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	if status := c.login("alice@example.com", "correct horse"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	var user types.PublicUser
+	if status, _ := c.get("/user", &user); status != http.StatusOK {
+		t.Fatalf("user info: got %d", status)
+	}
+	if user.Email != "alice@example.com" || user.UUID == "" {
+		t.Fatalf("user info: got %+v", user)
+	}
+
+	// Logging out ends the session
+	if status, _ := c.post("/auth/logout", nil, nil); status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info after logout: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newBearerClient()
+
+	if status, _ := c.register("oscar@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	verify, status := c.loginVerify("oscar@example.com", "password")
+	if status != http.StatusOK || verify.Session == nil || verify.Session.AccessToken == "" {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+	if verify.Session.ExpiresAt <= time.Now().UnixMilli() {
+		t.Fatalf("token expiry: got %d", verify.Session.ExpiresAt)
+	}
+
+	if status, _ := c.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info with the token: got %d", status)
+	}
+
+	// The token is the only credential, a wrong one is rejected
+	other := ts.newBearerClient()
+	other.header.Set("Authorization", "Bearer wrong")
+	if status, _ := other.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info with a wrong token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Revoking the session from a browser invalidates the token
+	browser := ts.newClient()
+	if status := browser.login("oscar@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("browser login: got %d", status)
+	}
+	if status, _ := browser.post("/user/sessions/revoke-others", nil, nil); status != http.StatusOK {
+		t.Fatalf("revoke others: got %d", status)
+	}
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info after revocation: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Logging out deletes the token's session
+	if status := c.login("oscar@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("second login: got %d", status)
+	}
+	if status, _ := c.post("/auth/logout", nil, nil); status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info after logout: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newBearerClient()
+
+	if status, _ := c.register("peggy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	verify, status := c.loginVerify("peggy@example.com", "password")
+	if status != http.StatusOK || verify.Session == nil || verify.Session.RefreshToken == "" {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+	first := *verify.Session
+
+	// Refreshing rotates both tokens
+	var next types.SessionToken
+	if status, _ := c.post("/auth/refresh", types.RefreshRequest{RefreshToken: first.RefreshToken}, &next); status != http.StatusOK {
+		t.Fatalf("refresh: got %d", status)
+	}
+	if next.AccessToken == first.AccessToken || next.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh did not rotate the tokens: %+v", next)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info with the old access token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	c.header.Set("Authorization", "Bearer "+next.AccessToken)
+	if status, _ := c.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info with the new access token: got %d", status)
+	}
+
+	// Replaying a used refresh token revokes the whole session
+	if status, _ := c.post("/auth/refresh", types.RefreshRequest{RefreshToken: first.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("replayed refresh token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := c.post("/auth/refresh", types.RefreshRequest{RefreshToken: next.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after the replay: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info after the replay: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newBearerClient()
+
+	if status, _ := c.register("quentin@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	verify, status := c.loginVerify("quentin@example.com", "password")
+	if status != http.StatusOK || verify.Session == nil {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+	body, err := json.Marshal(types.RefreshRequest{RefreshToken: verify.Session.RefreshToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client firing the same refresh several times at once gets new tokens once
+	const requests = 8
+	statuses := make(chan int, requests)
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest(http.MethodPost, ts.server.URL+"/auth/refresh", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Real-IP", c.header.Get("X-Real-IP"))
+
+			resp, err := c.client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	ok := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			ok++
+		case http.StatusUnauthorized:
+		default:
+			t.Errorf("concurrent refresh: got %d", status)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("concurrent refreshes succeeded %d times, want 1", ok)
+	}
+
+	// The server is still up
+	if status, _ := ts.newClient().get("/health/live", nil); status != http.StatusOK {
+		t.Errorf("liveness after concurrent refreshes: got %d", status)
+	}
+}
+
+func TestRefreshTokenInCookie(t *testing.T) {
+	ts := newTestServer(t)
+	native := ts.newBearerClient()
+
+	if status, _ := native.register("rupert@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	verify, status := native.loginVerify("rupert@example.com", "password")
+	if status != http.StatusOK || verify.Session == nil {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+
+	// Browsers renew an expired access token from the cookie without calling /auth/refresh,
+	// and concurrent requests that still carry the old cookie are let through
+	cookie := map[string]any{"access_token": "expired", "refresh_token": verify.Session.RefreshToken}
+	browser, tab := ts.newClient(), ts.newClient()
+	browser.setSessionCookie(cookie)
+	tab.setSessionCookie(cookie)
+
+	if status, _ := browser.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info with an expired access token: got %d", status)
+	}
+	if status, _ := tab.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("concurrent request with the old cookie: got %d", status)
+	}
+	if status, _ := browser.get("/user", nil); status != http.StatusOK {
+		t.Fatalf("user info with the renewed cookie: got %d", status)
+	}
+
+	// The refresh token was rotated, the native client's copy is spent
+	if status, _ := native.post("/auth/refresh", types.RefreshRequest{RefreshToken: verify.Session.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("refresh with the rotated token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"SESSION_IDLE_TIMEOUT": "1s"})
+	c := ts.newBearerClient()
+
+	if status, _ := c.register("sybil@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	verify, status := c.loginVerify("sybil@example.com", "password")
+	if status != http.StatusOK || verify.Session == nil {
+		t.Fatalf("login: got %d %+v", status, verify)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if status, _ := c.post("/auth/refresh", types.RefreshRequest{RefreshToken: verify.Session.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after the idle timeout: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRegisterDuplicateEmail(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("bob@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("first register: got %d", status)
+	}
+
+	status, reply := c.register("BOB@example.com", "password")
+	if status != http.StatusConflict {
+		t.Fatalf("duplicate register: got %d %q, want %d", status, reply.Message, http.StatusConflict)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("carol@example.com", "right"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	if status := c.login("carol@example.com", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("login with wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	if status, _ := c.get("/user", nil); status != http.StatusUnauthorized {
+		t.Fatalf("user info after failed login: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("dave@example.com", "right"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	// verify sends a proof for the handshake
+	verify := func(sessionID string, M1 []byte) (int, types.Reply[json.RawMessage]) {
+		t.Helper()
+		return c.post("/auth/login/verify", map[string]any{
+			"email":      "dave@example.com",
+			"M1":         M1,
+			"session_id": sessionID,
+		}, nil)
+	}
+
+	// A handshake accepts a few wrong proofs, which also start the account's backoff
+	_, usedID, status := c.startSRP("dave@example.com", "wrong")
+	if status != http.StatusOK {
+		t.Fatalf("login start: got %d", status)
+	}
+	for i := range constants.MaxSRPProofAttempts {
+		if status, _ := verify(usedID, randomBytes(t, 32)); status != http.StatusUnauthorized {
+			t.Fatalf("wrong proof %d: got %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+
+	// Even the right password has to wait now
+	sessionID, M1 := proveSRP(t, c, "dave@example.com", "right")
+	if status, reply := verify(sessionID, M1); status != http.StatusTooManyRequests {
+		t.Fatalf("login during the backoff: got %d %q, want %d", status, reply.Message, http.StatusTooManyRequests)
+	}
+
+	time.Sleep(constants.LoginBackoffBase)
+
+	// The used up handshake is gone, a new one works
+	if status, _ := verify(usedID, randomBytes(t, 32)); status != http.StatusUnauthorized {
+		t.Fatalf("proof with the used up handshake: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := verify(sessionID, M1); status != http.StatusOK {
+		t.Fatalf("login after the backoff: got %d", status)
+	}
+
+	// The success reset the count
+	if status := c.login("dave@example.com", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("login with wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := c.login("dave@example.com", "right"); status != http.StatusOK {
+		t.Fatalf("login after a single failure: got %d", status)
+	}
+}
+
+func TestSharedStateAcrossReplicas(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"STATE_STORE": "database"})
+	replica := ts.newReplica()
+
+	c := ts.newClient()
+	if status, _ := c.register("olga@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+
+	// The handshake started on one instance is finished on the other
+	client, sessionID, status := c.startSRP("olga@example.com", "password")
+	if status != http.StatusOK {
+		t.Fatalf("login start: got %d", status)
+	}
+	M1, err := client.ComputeM1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := replica.newClient()
+	var verify types.LoginVerifyResponse
+	if status, _ := other.post("/auth/login/verify", map[string]any{
+		"email":      "olga@example.com",
+		"M1":         M1,
+		"session_id": sessionID,
+	}, &verify); status != http.StatusOK {
+		t.Fatalf("login verify on the replica: got %d", status)
+	}
+	if ok, err := client.CheckM2(verify.M2); err != nil || !ok {
+		t.Fatalf("server proof M2 did not verify: %v", err)
+	}
+
+	// Requests from one address to both instances count against the same limit
+	a, b := ts.newClient(), replica.newClient()
+	b.header = a.header
+	for i := range 30 {
+		client := a
+		if i%2 == 1 {
+			client = b
+		}
+		if status, _ := client.post("/auth/login/start", map[string]any{"email": "nobody@example.com"}, nil); status != http.StatusUnauthorized {
+			t.Fatalf("request %d: got %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := b.post("/auth/login/start", map[string]any{"email": "nobody@example.com"}, nil); status != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"DISABLE_EMAIL_VALIDATION": "false"})
+	c := ts.newClient()
+
+	var meta types.ServerMetadata
+	if status, _ := c.get("/metadata", &meta); status != http.StatusOK || !meta.Registration.Email.VerificationRequired {
+		t.Fatalf("metadata: got %d %+v", status, meta.Registration.Email)
+	}
+
+	if status, _ := c.register("trent@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	mails := ts.mails()
+	if len(mails) != 1 {
+		t.Fatalf("got %d emails after registering, want 1", len(mails))
+	}
+	link := verificationLink(t, mails[0])
+
+	// Unverified accounts can't log in
+	if status := c.login("trent@example.com", "password"); status != http.StatusForbidden {
+		t.Fatalf("login before verifying: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	// nor sync with a session they already had
+	user, err := database.DB.GetUserByEmail(context.Background(), "trent@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	accessToken := utils.RandomToken(32)
+	if err := database.DB.CreateAccountSession(context.Background(), &types.AccountSession{
+		Owner:       user.UUID,
+		AccessToken: accessToken,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+		LastSeenAt:  now,
+	}, utils.HashToken(utils.RandomToken(32))); err != nil {
+		t.Fatal(err)
+	}
+	device := ts.newBearerClient()
+	device.header.Set("Authorization", "Bearer "+accessToken)
+	if status, _ := device.post("/calendar/events/sync", []types.CachedEvent{}, nil); status != http.StatusForbidden {
+		t.Fatalf("sync before verifying: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	// A new link can be requested, but not right away again
+	for range 2 {
+		if status, _ := c.post("/auth/email/resend", types.ResendVerificationRequest{Email: "trent@example.com"}, nil); status != http.StatusOK {
+			t.Fatalf("resend: got %d", status)
+		}
+	}
+	if status, _ := c.post("/auth/email/resend", types.ResendVerificationRequest{Email: "nobody@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("resend to an unknown address: got %d", status)
+	}
+	if mails = ts.mails(); len(mails) != 2 {
+		t.Fatalf("got %d emails after resending, want 2", len(mails))
+	}
+
+	if status, _ := c.get(link+"x", nil); status != http.StatusBadRequest {
+		t.Fatalf("altered link: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Any of the links verifies the address, more than once
+	for _, path := range []string{link, verificationLink(t, mails[1])} {
+		if status, reply := c.get(path, nil); status != http.StatusOK {
+			t.Fatalf("verify: got %d %q", status, reply.Message)
+		}
+	}
+
+	if status := c.login("trent@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login after verifying: got %d", status)
+	}
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	var info types.PublicUser
+	if status, _ := c.get("/user", &info); status != http.StatusOK || !info.EmailVerified {
+		t.Fatalf("user info: got %d %+v", status, info)
+	}
+	if status, _ := device.post("/calendar/events/sync", []types.CachedEvent{}, nil); status != http.StatusOK {
+		t.Fatalf("sync after verifying: got %d", status)
+	}
+}
+
+// verificationLink returns the path and query of the verification link in an email body.
+func TestEmailDomainBlocklist(t *testing.T) {
+	ts := newTestServerWithConfig(t, map[string]string{"EMAIL_DOMAIN_BLOCKLIST": "mailinator.com"})
+	c := ts.newClient()
+
+	var meta types.ServerMetadata
+	if status, _ := c.get("/metadata", &meta); status != http.StatusOK || !slices.Equal(meta.Registration.Email.DomainBlacklist, []string{"mailinator.com"}) {
+		t.Fatalf("metadata: got %d %+v", status, meta.Registration.Email)
+	}
+
+	if status, reply := c.register("vic@eu.mailinator.com", "password"); status != http.StatusBadRequest || !strings.Contains(reply.Message, "domain") {
+		t.Errorf("register with a blocked domain: got %d %q", status, reply.Message)
+	}
+	if status, _ := c.register("vic@example.com", "password"); status != http.StatusOK {
+		t.Errorf("register: got %d", status)
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	adminToken := utils.RandomToken(32)
+	ts := newTestServerWithConfig(t, map[string]string{
+		"INVITE_ONLY":  "true",
+		"INVITE_QUOTA": "2",
+		"ADMIN_TOKEN":  adminToken,
+	})
+	c, admin := ts.newClient(), ts.newClient()
+	admin.header.Set("Authorization", "Bearer "+adminToken)
+
+	var meta types.ServerMetadata
+	if status, _ := c.get("/metadata", &meta); status != http.StatusOK || !meta.Registration.InviteOnly {
+		t.Fatalf("metadata: got %d %+v", status, meta.Registration)
+	}
+
+	for _, code := range []string{"", "bogus"} {
+		if status, _ := c.registerWithInvite("wendy@example.com", "password", code); status != http.StatusForbidden {
+			t.Errorf("register with invite code %q: got %d, want %d", code, status, http.StatusForbidden)
+		}
+	}
+
+	// Only the admin token creates invites without a quota
+	if status, _ := c.post("/admin/invites", types.CreateInviteRequest{}, nil); status != http.StatusUnauthorized {
+		t.Errorf("create admin invite without the token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	var invite types.InviteInfo
+	if status, _ := admin.post("/admin/invites", types.CreateInviteRequest{MaxUses: 5}, &invite); status != http.StatusOK || invite.Code == "" {
+		t.Fatalf("create admin invite: got %d %+v", status, invite)
+	}
+
+	if status, _ := c.registerWithInvite("wendy@example.com", "password", invite.Code); status != http.StatusOK {
+		t.Fatalf("register with invite: got %d", status)
+	}
+	if status := c.login("wendy@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	// Users invite within their quota, optionally a single address
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	var own types.InviteInfo
+	if status, _ := c.post("/user/invites", types.CreateInviteRequest{Email: "xavier@example.com"}, &own); status != http.StatusOK {
+		t.Fatalf("create invite: got %d", status)
+	}
+	if status, _ := c.post("/user/invites", types.CreateInviteRequest{MaxUses: 2}, nil); status != http.StatusForbidden {
+		t.Errorf("create invite over the quota: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	other := ts.newClient()
+	if status, _ := other.registerWithInvite("yara@example.com", "password", own.Code); status != http.StatusForbidden {
+		t.Errorf("register with another address's invite: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := other.registerWithInvite("Xavier@example.com", "password", own.Code); status != http.StatusOK {
+		t.Fatalf("register with own invite: got %d", status)
+	}
+	if status, _ := other.registerWithInvite("zoe@example.com", "password", own.Code); status != http.StatusForbidden {
+		t.Errorf("register with a used up invite: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	// Revoking ends an invite, but the accounts it admitted still count
+	var invites []types.InviteInfo
+	if status, _ := c.get("/user/invites", &invites); status != http.StatusOK || len(invites) != 1 || invites[0].Uses != 1 || invites[0].Code != "" {
+		t.Fatalf("list invites: got %d %+v", status, invites)
+	}
+	if status, _ := c.post("/user/invites/"+strconv.Itoa(invite.ID)+"/revoke", nil, nil); status != http.StatusNotFound {
+		t.Errorf("revoke the admin's invite: got %d, want %d", status, http.StatusNotFound)
+	}
+	time.Sleep(time.Second) // rate limits are shared per client, let the 5 reqs/sec of /user recover
+	if status, _ := c.post("/user/invites/"+strconv.Itoa(own.ID)+"/revoke", nil, nil); status != http.StatusOK {
+		t.Errorf("revoke own invite: got %d", status)
+	}
+	if status, _ := c.post("/user/invites", types.CreateInviteRequest{MaxUses: 2}, nil); status != http.StatusForbidden {
+		t.Errorf("create invite over the quota after revoking: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := c.post("/user/invites", types.CreateInviteRequest{}, nil); status != http.StatusOK {
+		t.Errorf("create invite within the quota after revoking: got %d", status)
+	}
+
+	if status, _ := admin.post("/admin/invites/"+strconv.Itoa(invite.ID)+"/revoke", nil, nil); status != http.StatusOK {
+		t.Errorf("revoke admin invite: got %d", status)
+	}
+	if status, _ := ts.newClient().registerWithInvite("zoe@example.com", "password", invite.Code); status != http.StatusForbidden {
+		t.Errorf("register with a revoked invite: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	if status, _ := admin.get("/admin/invites", &invites); status != http.StatusOK || len(invites) != 3 {
+		t.Errorf("list all invites: got %d %+v", status, invites)
+	}
+}
+
+func verificationLink(t *testing.T, body string) string {
+	t.Helper()
+
+	match := regexp.MustCompile(`https://\S+/auth/email/verify\?token=\S+`).FindString(body)
+	u, err := url.Parse(match)
+	if err != nil || match == "" {
+		t.Fatalf("no verification link in email:\n%s", body)
+	}
+	return u.RequestURI()
+}
+
+func TestCalendarSaveAndSync(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.register("dave@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("register: got %d", status)
+	}
+	if status := c.login("dave@example.com", "password"); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+
+	first, second := utils.NewUUID(), utils.NewUUID()
+	created := time.Now().Add(-time.Hour).UnixMilli()
+
+	event := func(id, data string, ts int64) types.EncryptedEvent {
+		return types.EncryptedEvent{
+			ID:        id,
+			Data:      base64.StdEncoding.EncodeToString([]byte(data)),
+			UpdatedAt: ts,
+		}
+	}
+
+	// Add two events
+	if status, reply := c.post("/calendar/events/save", []map[string]any{
+		{"type": "added", "event": event(first, "one", created)},
+		{"type": "added", "event": event(second, "two", created)},
+	}, nil); status != http.StatusOK {
+		t.Fatalf("save: got %d %q", status, reply.Message)
+	}
+
+	// A client with an empty cache receives both
+	var sync types.EventSyncResponse
+	if status, _ := c.post("/calendar/events/sync", []types.CachedEvent{}, &sync); status != http.StatusOK {
+		t.Fatalf("sync: got %d", status)
+	}
+	if len(sync.Added) != 2 || len(sync.Updated) != 0 || len(sync.Deleted) != 0 {
+		t.Fatalf("initial sync: got %+v", sync)
+	}
+
+	// Update one twice and delete the other, the last update wins
+	updated := time.Now().UnixMilli()
+	if status, _ := c.post("/calendar/events/save", []map[string]any{
+		{"type": "updated", "event": event(first, "one v1", updated-1)},
+		{"type": "updated", "event": event(first, "one v2", updated)},
+		{"type": "deleted", "id": second},
+	}, nil); status != http.StatusOK {
+		t.Fatalf("second save: got %d", status)
+	}
+
+	// Event IDs must be UUIDs
+	for _, change := range []map[string]any{
+		{"type": "added", "event": event("not-a-uuid", "three", updated)},
+		{"type": "deleted", "id": strings.ToUpper(first)},
+	} {
+		if status, _ := c.post("/calendar/events/save", []map[string]any{change}, nil); status != http.StatusBadRequest {
+			t.Fatalf("save %v: got %d, want %d", change, status, http.StatusBadRequest)
+		}
+	}
+
+	// A client that cached both at the original timestamp sees the changes
+	sync = types.EventSyncResponse{}
+	if status, _ := c.post("/calendar/events/sync", []types.CachedEvent{
+		{ID: uuidToBase64(t, first), Timestamp: created},
+		{ID: uuidToBase64(t, second), Timestamp: created},
+	}, &sync); status != http.StatusOK {
+		t.Fatalf("sync: got %d", status)
+	}
+
+	if len(sync.Added) != 0 {
+		t.Errorf("added: got %+v, want none", sync.Added)
+	}
+	if len(sync.Updated) != 1 || sync.Updated[0].ID != first || sync.Updated[0].UpdatedAt != updated {
+		t.Errorf("updated: got %+v", sync.Updated)
+	} else if data, _ := base64.StdEncoding.DecodeString(sync.Updated[0].Data); string(data) != "one v2" {
+		t.Errorf("updated data: got %q", data)
+	}
+	if len(sync.Deleted) != 1 || sync.Deleted[0] != second {
+		t.Errorf("deleted: got %v, want [%s]", sync.Deleted, second)
+	}
+}
+
+func TestCalendarRequiresLogin(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.newClient()
+
+	if status, _ := c.post("/calendar/events/sync", []types.CachedEvent{}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("sync without login: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// uuidToBase64 encodes a UUID string the way the client caches event IDs.
+func TestRequestID(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, tc := range []struct {
+		sent     string
+		keepSent bool
+	}{
+		{"", false},
+		{"trace-123.abc", true},
+		{"bad id with spaces", false},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.server.URL+"/health/live", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.sent != "" {
+			req.Header.Set("X-Request-ID", tc.sent)
+		}
+
+		resp, err := ts.server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		got := resp.Header.Get("X-Request-ID")
+		if got == "" || (got == tc.sent) != tc.keepSent {
+			t.Errorf("sent %q, got %q", tc.sent, got)
+		}
+	}
+}
+
+func uuidToBase64(t *testing.T, uuid string) string {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,130 @@
+// Package metrics defines the Prometheus metrics exported by the server.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "aclife"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// RateLimitRejections counts requests rejected by the rate limiter, by route template.
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiter.",
+	}, []string{"route"})
+
+	// Logins counts SRP login attempts by result ("success", "failure", or "throttled" after too many failures).
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "srp_logins_total",
+		Help:      "SRP login attempts by result.",
+	}, []string{"result"})
+
+	// CalendarEvents counts saved calendar event changes by type ("added", "updated" or "deleted").
+	CalendarEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "calendar_events_total",
+		Help:      "Calendar event changes saved by type.",
+	}, []string{"type"})
+
+	// PushSends counts push notifications by the push service's status code, or "error" if the request failed.
+	PushSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_sends_total",
+		Help:      "Push notification sends by push service status code.",
+	}, []string{"status"})
+
+	// PushPrunes counts subscriptions deleted after the push service reported them gone.
+	PushPrunes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_subscription_prunes_total",
+		Help:      "Push subscriptions removed because they expired or became invalid.",
+	})
+
+	// MailSends counts emails by outcome, "sent" or "error".
+	MailSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mail_sends_total",
+		Help:      "Emails sent, by outcome.",
+	}, []string{"result"})
+
+	// StripeWebhooks counts verified Stripe webhook events by event type.
+	StripeWebhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stripe_webhooks_total",
+		Help:      "Verified Stripe webhook events by type.",
+	}, []string{"type"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count and latency of requests by route template.
+// It must be registered on the router so that the matched route is known.
+func Middleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(rec, r)
+
+			route := Route(r)
+			httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+			httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// Route returns the path template of the route matching r, so that labels don't contain IDs.
+func Route(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unmatched"
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,20 @@
+// Package openapi contains the OpenAPI description of the API.
+package openapi
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Spec is the OpenAPI 3 document describing every route of the API.
+//
+//go:embed openapi.yaml
+var Spec []byte
+
+// Handler serves the OpenAPI document.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(Spec)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"acLife/handlers"
+	"acLife/lifecycle"
+	"acLife/openapi"
+	"acLife/types"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+)
+
+// apiBodies lists the JSON request and success response bodies of every route.
+// Nil means the route doesn't exchange JSON in that direction.
+var apiBodies = map[string]struct{ request, response any }{
+	"GET /":             {nil, types.Reply[any]{}},
+	"GET /metadata":     {nil, types.Reply[types.ServerMetadata]{}},
+	"GET /openapi.yaml": {nil, nil},
+
+	"POST /auth/register":        {types.RegisterRequest{}, types.Reply[any]{}},
+	"POST /auth/login/start":     {types.LoginStartRequest{}, types.Reply[types.LoginStartResponse]{}},
+	"POST /auth/login/verify":    {types.LoginVerifyRequest{}, types.Reply[types.LoginVerifyResponse]{}},
+	"POST /auth/login/2fa":       {types.LoginSecondFactorRequest{}, types.Reply[*types.SessionToken]{}},
+	"POST /auth/refresh":         {types.RefreshRequest{}, types.Reply[types.SessionToken]{}},
+	"GET /auth/email/verify":     {nil, types.Reply[any]{}},
+	"POST /auth/email/resend":    {types.ResendVerificationRequest{}, types.Reply[any]{}},
+	"GET /auth/email/change":     {nil, types.Reply[any]{}},
+	"GET /auth/sessions/revoke":  {nil, nil},
+	"POST /auth/sessions/revoke": {nil, nil},
+	"POST /auth/recovery/start":  {types.LoginStartRequest{}, types.Reply[types.LoginStartResponse]{}},
+	"POST /auth/recovery/verify": {types.RecoveryVerifyRequest{}, types.Reply[types.RecoveryVerifyResponse]{}},
+	"POST /auth/recovery/finish": {types.RecoveryFinishRequest{}, types.Reply[any]{}},
+	"POST /auth/logout":          {nil, types.Reply[any]{}},
+
+	"GET /user":                               {nil, types.Reply[types.PublicUser]{}},
+	"POST /user/password":                     {types.ChangePasswordRequest{}, types.Reply[types.LoginVerifyResponse]{}},
+	"POST /user/recovery":                     {types.RecoveryKeySetupRequest{}, types.Reply[types.LoginVerifyResponse]{}},
+	"POST /user/recovery/remove":              {nil, types.Reply[any]{}},
+	"POST /user/email":                        {types.ChangeEmailRequest{}, types.Reply[types.LoginVerifyResponse]{}},
+	"POST /user/delete":                       {types.DeleteAccountRequest{}, types.Reply[types.DeleteAccountResponse]{}},
+	"POST /user/delete/cancel":                {nil, types.Reply[any]{}},
+	"GET /user/sessions":                      {nil, types.Reply[[]types.SessionInfo]{}},
+	"POST /user/sessions/{id}/revoke":         {nil, types.Reply[any]{}},
+	"POST /user/sessions/revoke-others":       {nil, types.Reply[any]{}},
+	"POST /user/2fa/totp/enroll":              {nil, types.Reply[types.TOTPEnrollResponse]{}},
+	"POST /user/2fa/totp/confirm":             {types.TOTPConfirmRequest{}, types.Reply[types.TOTPConfirmResponse]{}},
+	"POST /user/2fa/totp/disable":             {types.TOTPDisableRequest{}, types.Reply[any]{}},
+	"GET /user/2fa/webauthn":                  {nil, types.Reply[[]types.WebAuthnCredentialInfo]{}},
+	"POST /user/2fa/webauthn/register/start":  {types.WebAuthnRegisterStartRequest{}, types.Reply[any]{}},
+	"POST /user/2fa/webauthn/register/finish": {types.WebAuthnRegisterRequest{}, types.Reply[types.WebAuthnCredentialInfo]{}},
+	"POST /user/2fa/webauthn/{id}/remove":     {types.WebAuthnRemoveRequest{}, types.Reply[any]{}},
+	"POST /user/push/subscribe":               {types.PushSubscribeRequest{}, types.Reply[any]{}},
+	"GET /user/invites":                       {nil, types.Reply[[]types.InviteInfo]{}},
+	"POST /user/invites":                      {types.CreateInviteRequest{}, types.Reply[types.InviteInfo]{}},
+	"POST /user/invites/{id}/revoke":          {nil, types.Reply[any]{}},
+	"GET /user/push/test":                     {nil, types.Reply[any]{}},
+
+	"POST /calendar/events/save": {[]types.CalendarChange{}, types.Reply[any]{}},
+	"POST /calendar/events/sync": {[]types.CachedEvent{}, types.Reply[types.EventSyncResponse]{}},
+
+	"GET /stripe/pricing":   {nil, types.Reply[[]types.Price]{}},
+	"POST /stripe/checkout": {types.CheckoutRequest{}, types.Reply[string]{}},
+	"GET /stripe/manage":    {nil, types.Reply[string]{}},
+	"POST /stripe/webhook":  {nil, nil}, // Stripe event payload
+
+	"GET /health/live":  {nil, types.Reply[any]{}},
+	"GET /health/ready": {nil, types.Reply[types.Readiness]{}},
+	"GET /diagnostics":  {nil, types.Reply[types.Diagnostics]{}},
+	"GET /metrics":      {nil, nil},
+
+	"GET /admin/invites":              {nil, types.Reply[[]types.InviteInfo]{}},
+	"POST /admin/invites":             {types.CreateInviteRequest{}, types.Reply[types.InviteInfo]{}},
+	"POST /admin/invites/{id}/revoke": {nil, types.Reply[any]{}},
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	doc, err := openapi3.NewLoader().LoadFromData(openapi.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+
+	// Routes registered on the router, including development-only ones
+	router := newRouter(handlers.New(testConfig(t, nil), lifecycle.New()))
+
+	var registered []string
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // subrouter prefix
+		}
+		for _, method := range methods {
+			registered = append(registered, method+" "+path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var documented []string
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	var listed []string
+	for route := range apiBodies {
+		listed = append(listed, route)
+	}
+
+	sort.Strings(registered)
+	sort.Strings(documented)
+	sort.Strings(listed)
+
+	if !slices.Equal(registered, documented) {
+		t.Errorf("registered routes and openapi.yaml differ\nregistered: %v\ndocumented: %v", registered, documented)
+	}
+	if !slices.Equal(registered, listed) {
+		t.Errorf("registered routes and apiBodies differ\nregistered: %v\nlisted:     %v", registered, listed)
+	}
+
+	for route, bodies := range apiBodies {
+		method, path, _ := strings.Cut(route, " ")
+
+		op := doc.Paths.Find(path).GetOperation(method)
+		if op == nil {
+			continue // reported above
+		}
+
+		if bodies.request != nil {
+			if op.RequestBody == nil || op.RequestBody.Value.Content.Get("application/json") == nil {
+				t.Errorf("%s: JSON request body is not documented", route)
+			} else {
+				schema := op.RequestBody.Value.Content.Get("application/json").Schema.Value
+				for _, problem := range matchSchema("request", schema, reflect.TypeOf(bodies.request)) {
+					t.Errorf("%s: %s", route, problem)
+				}
+			}
+		}
+
+		if bodies.response != nil {
+			resp := op.Responses.Status(http.StatusOK)
+			if resp == nil || resp.Value.Content.Get("application/json") == nil {
+				t.Errorf("%s: JSON response is not documented", route)
+			} else {
+				schema := resp.Value.Content.Get("application/json").Schema.Value
+				for _, problem := range matchSchema("response", schema, reflect.TypeOf(bodies.response)) {
+					t.Errorf("%s: %s", route, problem)
+				}
+			}
+		}
+	}
+}
+
+// matchSchema compares a schema with the JSON encoding of a Go type and returns the differences.
+func matchSchema(path string, schema *openapi3.Schema, typ reflect.Type) []string {
+	if len(schema.OneOf) > 0 {
+		for _, option := range schema.OneOf {
+			if len(matchSchema(path, option.Value, typ)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: none of the oneOf schemas matches %s", path, typ)}
+	}
+
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if typ == reflect.TypeFor[json.RawMessage]() {
+		return nil // any value
+	}
+
+	expect := func(want string) []string {
+		if !schema.Type.Is(want) {
+			return []string{fmt.Sprintf("%s: documented as %v, but %s encodes as %s", path, schema.Type, typ, want)}
+		}
+		return nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Interface:
+		return nil // any value
+
+	case reflect.String:
+		if schema.Format == "byte" {
+			return []string{fmt.Sprintf("%s: documented as bytes, but is a string", path)}
+		}
+		return expect(openapi3.TypeString)
+
+	case reflect.Bool:
+		return expect(openapi3.TypeBoolean)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return expect(openapi3.TypeInteger)
+
+	case reflect.Float32, reflect.Float64:
+		return expect(openapi3.TypeNumber)
+
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			if problems := expect(openapi3.TypeString); problems != nil {
+				return problems
+			}
+			if schema.Format != "byte" {
+				return []string{fmt.Sprintf("%s: bytes must be documented with format byte", path)}
+			}
+			return nil
+		}
+
+		if problems := expect(openapi3.TypeArray); problems != nil {
+			return problems
+		}
+		return matchSchema(path+"[]", schema.Items.Value, typ.Elem())
+
+	case reflect.Map:
+		if problems := expect(openapi3.TypeObject); problems != nil {
+			return problems
+		}
+		if schema.AdditionalProperties.Schema == nil {
+			return []string{fmt.Sprintf("%s: map must be documented with additionalProperties", path)}
+		}
+		return matchSchema(path+"{}", schema.AdditionalProperties.Schema.Value, typ.Elem())
+
+	case reflect.Struct:
+		if problems := expect(openapi3.TypeObject); problems != nil {
+			return problems
+		}
+
+		var problems []string
+		fields := make(map[string]bool)
+
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = true
+
+			prop, ok := schema.Properties[name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s: field of %s is not documented", path, name, typ))
+				continue
+			}
+			problems = append(problems, matchSchema(path+"."+name, prop.Value, field.Type)...)
+		}
+
+		for name := range schema.Properties {
+			if !fields[name] {
+				problems = append(problems, fmt.Sprintf("%s.%s: documented, but %s has no such field", path, name, typ))
+			}
+		}
+		return problems
+	}
+
+	return []string{fmt.Sprintf("%s: unsupported type %s", path, typ)}
+}
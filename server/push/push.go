@@ -4,24 +4,42 @@ package push
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
+	"acLife/config"
 	"acLife/database"
+	"acLife/metrics"
 	"acLife/types"
 	"acLife/utils"
 
 	"github.com/SherClockHolmes/webpush-go"
 )
 
-func send(
+// Sender sends push notifications to the subscriptions of users.
+type Sender struct {
+	cfg config.Push
+
+	wg      sync.WaitGroup
+	pending atomic.Int64 // background sends not yet finished
+}
+
+// NewSender creates a Sender using the given VAPID keys.
+func NewSender(cfg config.Push) *Sender {
+	return &Sender{cfg: cfg}
+}
+
+func (s *Sender) send(
 	ctx context.Context,
 	sub types.PushSubscription,
 	payload any,
 ) {
 	data, err := json.Marshal(payload)
 	if err != nil {
-		utils.LogError("push.Send", "Marshal", err)
+		utils.LogError(ctx, "push.Send", "Marshal", err)
 		return
 	}
 
@@ -36,57 +54,104 @@ func send(
 		},
 		&webpush.Options{
 			TTL:             60,
-			VAPIDPublicKey:  os.Getenv("VAPID_PUBLIC_KEY"),
-			VAPIDPrivateKey: os.Getenv("VAPID_PRIVATE_KEY"),
+			VAPIDPublicKey:  s.cfg.VAPIDPublicKey,
+			VAPIDPrivateKey: s.cfg.VAPIDPrivateKey,
 		},
 	)
 	if err != nil {
-		utils.LogError("push.Send", "SendNotification", err)
+		metrics.PushSends.WithLabelValues("error").Inc()
+		utils.LogError(ctx, "push.Send", "SendNotification", err)
 		return
 	}
 
 	defer func() { _ = resp.Body.Close() }()
 
+	metrics.PushSends.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
 	// Delete invalid or expired subscriptions
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
-		if _, err = database.Exec(ctx,
-			`DELETE FROM push_subscriptions WHERE endpoint = ?`,
-			sub.Endpoint,
-		); err != nil {
-			utils.LogError("push.Send", "Exec", err)
+		if err := database.DB.DeletePushSubscription(ctx, sub.Endpoint); err != nil {
+			utils.LogError(ctx, "push.Send", "DeletePushSubscription", err)
 			return
 		}
+		metrics.PushPrunes.Inc()
 	}
 }
 
 // SendToUser sends a JSON-serializable payload to the user's push subscriptions.
-func SendToUser(
+func (s *Sender) SendToUser(
 	ctx context.Context,
 	uuid string,
 	payload any,
 ) {
-	rows, err := database.Query(ctx, `
-		SELECT endpoint, p256dh, auth
-		FROM push_subscriptions
-		WHERE owner = ?`,
-		uuid,
-	)
+	subs, err := database.DB.GetPushSubscriptions(ctx, uuid)
 	if err != nil {
-		utils.LogError("push.SendToUser", "Query", err)
+		utils.LogError(ctx, "push.SendToUser", "GetPushSubscriptions", err)
 		return
 	}
 
-	defer func() { _ = rows.Close() }()
-
 	// Send to all subscriptions
-	for rows.Next() {
-		var sub types.PushSubscription
-		if err := rows.Scan(&sub.Endpoint, &sub.P256DH, &sub.Auth); err != nil {
-			utils.LogError("push.SendToUser", "Scan", err)
-			continue
+	for _, sub := range subs {
+		s.send(ctx, sub, payload)
+	}
+}
+
+// Enqueue sends a payload to the user's push subscriptions in the background.
+// The send isn't cancelled with ctx, which only carries values such as the request's log fields.
+// Use Drain to wait for queued sends on shutdown.
+func (s *Sender) Enqueue(ctx context.Context, uuid string, payload any) {
+	s.background(ctx, func(ctx context.Context) {
+		s.SendToUser(ctx, uuid, payload)
+	})
+}
+
+// EnqueueTo sends a payload to the given subscriptions in the background, like Enqueue.
+// It is used when the subscriptions are about to be deleted, such as those of a revoked session.
+func (s *Sender) EnqueueTo(ctx context.Context, subs []types.PushSubscription, payload any) {
+	if len(subs) == 0 {
+		return
+	}
+
+	s.background(ctx, func(ctx context.Context) {
+		for _, sub := range subs {
+			s.send(ctx, sub, payload)
 		}
+	})
+}
 
-		send(ctx, sub, payload)
+func (s *Sender) background(ctx context.Context, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+
+	s.wg.Add(1)
+	s.pending.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer s.pending.Add(-1)
+
+		fn(ctx)
+	}()
+}
+
+// Pending returns the number of queued sends that haven't finished yet.
+func (s *Sender) Pending() int {
+	return int(s.pending.Load())
+}
+
+// Drain waits until all queued sends have finished or ctx expires.
+// Nothing may be enqueued once draining has started.
+func (s *Sender) Drain(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d push sends still pending: %w", s.Pending(), ctx.Err())
 	}
 }
 
@@ -98,6 +163,21 @@ func NotificationEvent(title string, body string) types.PushEvent {
 	}
 }
 
+// ReauthEvent tells the user's other devices that their session was revoked and they must log in again.
+func ReauthEvent(originClientID string) types.PushEvent {
+	return types.PushEvent{
+		Type:           "reauth",
+		OriginClientID: originClientID,
+	}
+}
+
+// RevokedEvent tells a device that its session was revoked and it must drop its local keys.
+func RevokedEvent() types.PushEvent {
+	return types.PushEvent{
+		Type: "revoked",
+	}
+}
+
 func SyncEvent(originClientID string) types.PushEvent {
 	return types.PushEvent{
 		Type:           "sync",
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"time"
+
+	"acLife/handlers"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin contains routes for operators, authorized with the admin token.
+func Admin(r *mux.Router, h *handlers.API) {
+	sr := r.PathPrefix("/admin").Subrouter()
+
+	sr.Use(h.RateLimitMiddleware(30, time.Minute))  // 30 reqs/min, before the token check to slow down guessing
+	sr.Use(h.AdminAuthMiddleware())                 // must have the admin token
+	sr.Use(handlers.MaxBodySizeMiddleware(1 << 10)) // 1 KB
+
+	sr.HandleFunc("/invites", h.ListAllInvites).Methods("GET")
+	sr.HandleFunc("/invites", h.CreateAdminInvite).Methods("POST")
+	sr.HandleFunc("/invites/{id}/revoke", h.RevokeAdminInvite).Methods("POST")
+}
@@ -9,14 +9,31 @@ import (
 )
 
 // Auth contains routes related to authentication.
-func Auth(r *mux.Router) {
+func Auth(r *mux.Router, h *handlers.API) {
+	// Finishing a recovery carries every calendar event, like a password change
+	rec := r.PathPrefix("/auth/recovery").Subrouter()
+
+	rec.Use(handlers.MaxBodySizeMiddleware(64 << 20)) // 64 MB
+	rec.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
+
+	rec.HandleFunc("/start", h.StartRecovery).Methods("POST")
+	rec.HandleFunc("/verify", h.VerifyRecovery).Methods("POST")
+	rec.HandleFunc("/finish", h.FinishRecovery).Methods("POST")
+
 	sr := r.PathPrefix("/auth").Subrouter()
 
-	sr.Use(handlers.MaxBodySizeMiddleware(16 << 10))      // 16 KB
-	sr.Use(handlers.RateLimitMiddleware(30, time.Minute)) // 30 reqs/min
+	sr.Use(handlers.MaxBodySizeMiddleware(16 << 10)) // 16 KB
+	sr.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
 
-	sr.HandleFunc("/register", handlers.Register).Methods("POST")
-	sr.HandleFunc("/login/start", handlers.LoginStart).Methods("POST")
-	sr.HandleFunc("/login/verify", handlers.LoginVerify).Methods("POST")
-	sr.HandleFunc("/logout", handlers.Logout).Methods("POST")
+	sr.HandleFunc("/register", h.Register).Methods("POST")
+	sr.HandleFunc("/login/start", h.LoginStart).Methods("POST")
+	sr.HandleFunc("/login/verify", h.LoginVerify).Methods("POST")
+	sr.HandleFunc("/login/2fa", h.LoginSecondFactor).Methods("POST")
+	sr.HandleFunc("/refresh", h.Refresh).Methods("POST")
+	sr.HandleFunc("/email/verify", h.VerifyEmail).Methods("GET")
+	sr.HandleFunc("/email/resend", h.ResendVerificationEmail).Methods("POST")
+	sr.HandleFunc("/email/change", h.ConfirmEmailChange).Methods("GET")
+	sr.HandleFunc("/sessions/revoke", h.ConfirmRevokeSession).Methods("GET")
+	sr.HandleFunc("/sessions/revoke", h.RevokeSessionByLink).Methods("POST")
+	sr.HandleFunc("/logout", h.Logout).Methods("POST")
 }
@@ -9,14 +9,15 @@ import (
 )
 
 // Calendar contains routes related to the calendar.
-func Calendar(r *mux.Router) {
+func Calendar(r *mux.Router, h *handlers.API) {
 	sr := r.PathPrefix("/calendar").Subrouter()
 
-	sr.Use(handlers.RateLimitMiddleware(20, time.Second)) // 20 reqs/sec
-	sr.Use(handlers.AuthMiddleware())                     // must be logged in
-	sr.Use(handlers.SubscriptionMiddleware())             // must have a valid subscription
-	sr.Use(handlers.MaxBodySizeMiddleware(64 << 20))      // 64 MB
+	sr.Use(h.RateLimitMiddleware(20, time.Second))   // 20 reqs/sec
+	sr.Use(h.AuthMiddleware())                       // must be logged in
+	sr.Use(h.VerifiedEmailMiddleware())              // must have confirmed the email address
+	sr.Use(h.SubscriptionMiddleware())               // must have a valid subscription
+	sr.Use(handlers.MaxBodySizeMiddleware(64 << 20)) // 64 MB
 
-	sr.HandleFunc("/events/save", handlers.SaveCalendarEvents).Methods("POST")
-	sr.HandleFunc("/events/sync", handlers.SyncCalendarEvents).Methods("POST")
+	sr.HandleFunc("/events/save", h.SaveCalendarEvents).Methods("POST")
+	sr.HandleFunc("/events/sync", h.SyncCalendarEvents).Methods("POST")
 }
@@ -0,0 +1,29 @@
+package routes
+
+import (
+	"time"
+
+	"acLife/handlers"
+	"acLife/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// Health contains the liveness, readiness and diagnostics probes and the metrics endpoint.
+func Health(r *mux.Router, h *handlers.API) {
+	r.HandleFunc("/health/live", h.Live).Methods("GET")
+	r.HandleFunc("/health/ready", h.Ready).Methods("GET")
+
+	sr := r.PathPrefix("/diagnostics").Subrouter()
+
+	sr.Use(h.RateLimitMiddleware(30, time.Minute)) // 30 reqs/min
+	sr.Use(h.DiagnosticsAuthMiddleware())          // must have the diagnostics token
+
+	sr.HandleFunc("", h.Diagnostics).Methods("GET")
+
+	mr := r.PathPrefix("/metrics").Subrouter()
+
+	mr.Use(h.MetricsAuthMiddleware()) // must have the metrics token, if one is set
+
+	mr.Handle("", metrics.Handler()).Methods("GET")
+}
@@ -9,18 +9,18 @@ import (
 )
 
 // Stripe contains routes related to stripe.
-func Stripe(r *mux.Router) {
+func Stripe(r *mux.Router, h *handlers.API) {
 	sr := r.PathPrefix("/stripe").Subrouter()
 
-	sr.Use(handlers.AuthMiddleware())                      // require login
-	sr.Use(handlers.MaxBodySizeMiddleware(64 << 10))       // 64 KB
-	sr.Use(handlers.RateLimitMiddleware(100, time.Second)) // 100 reqs/sec
+	sr.Use(h.AuthMiddleware())                       // require login
+	sr.Use(handlers.MaxBodySizeMiddleware(64 << 10)) // 64 KB
+	sr.Use(h.RateLimitMiddleware(100, time.Second))  // 100 reqs/sec
 
 	// The webhook doesn't have to be logged in
-	r.HandleFunc("/stripe/webhook", handlers.StripeWebhook).Methods("POST")
+	r.HandleFunc("/stripe/webhook", h.StripeWebhook).Methods("POST")
 
 	// Other routes are authenticated
-	sr.HandleFunc("/pricing", handlers.Pricing).Methods("GET")
-	sr.HandleFunc("/checkout", handlers.CreateCheckoutSession).Methods("POST")
-	sr.HandleFunc("/manage", handlers.CreatePortalSession).Methods("GET")
+	sr.HandleFunc("/pricing", h.Pricing).Methods("GET")
+	sr.HandleFunc("/checkout", h.CreateCheckoutSession).Methods("POST")
+	sr.HandleFunc("/manage", h.CreatePortalSession).Methods("GET")
 }
@@ -1,7 +1,6 @@
 package routes
 
 import (
-	"os"
 	"time"
 
 	"acLife/handlers"
@@ -10,17 +9,76 @@ import (
 )
 
 // User contains routes related to user accounts.
-func User(r *mux.Router) {
+func User(r *mux.Router, h *handlers.API) {
+	// Password change carries every calendar event, so it needs a larger body limit than the rest
+	pw := r.PathPrefix("/user/password").Subrouter()
+
+	pw.Use(h.AuthMiddleware())                       // must be logged in
+	pw.Use(handlers.MaxBodySizeMiddleware(64 << 20)) // 64 MB
+	pw.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
+
+	pw.HandleFunc("", h.ChangePassword).Methods("POST")
+
+	// Deletion needs a password proof like logging in, so it's limited the same way
+	del := r.PathPrefix("/user/delete").Subrouter()
+
+	del.Use(h.AuthMiddleware())                      // must be logged in
+	del.Use(handlers.MaxBodySizeMiddleware(1 << 10)) // 1 KB
+	del.Use(h.RateLimitMiddleware(30, time.Minute))  // 30 reqs/min
+
+	del.HandleFunc("", h.DeleteAccount).Methods("POST")
+	del.HandleFunc("/cancel", h.CancelAccountDeletion).Methods("POST")
+
+	// Setting a recovery key needs a password proof too
+	rec := r.PathPrefix("/user/recovery").Subrouter()
+
+	rec.Use(h.AuthMiddleware())                       // must be logged in
+	rec.Use(handlers.MaxBodySizeMiddleware(16 << 10)) // 16 KB
+	rec.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
+
+	rec.HandleFunc("", h.SetRecoveryKey).Methods("POST")
+	rec.HandleFunc("/remove", h.RemoveRecoveryKey).Methods("POST")
+
+	// Changing the email address needs a password proof too
+	em := r.PathPrefix("/user/email").Subrouter()
+
+	em.Use(h.AuthMiddleware())                       // must be logged in
+	em.Use(handlers.MaxBodySizeMiddleware(16 << 10)) // 16 KB
+	em.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
+
+	em.HandleFunc("", h.ChangeEmail).Methods("POST")
+
+	// Codes are short, so guesses are limited like password proofs
+	tfa := r.PathPrefix("/user/2fa").Subrouter()
+
+	tfa.Use(h.AuthMiddleware())                       // must be logged in
+	tfa.Use(handlers.MaxBodySizeMiddleware(16 << 10)) // 16 KB, for security key attestations
+	tfa.Use(h.RateLimitMiddleware(30, time.Minute))   // 30 reqs/min
+
+	tfa.HandleFunc("/totp/enroll", h.EnrollTOTP).Methods("POST")
+	tfa.HandleFunc("/totp/confirm", h.ConfirmTOTP).Methods("POST")
+	tfa.HandleFunc("/totp/disable", h.DisableTOTP).Methods("POST")
+	tfa.HandleFunc("/webauthn", h.ListWebAuthnCredentials).Methods("GET")
+	tfa.HandleFunc("/webauthn/register/start", h.StartWebAuthnRegistration).Methods("POST")
+	tfa.HandleFunc("/webauthn/register/finish", h.FinishWebAuthnRegistration).Methods("POST")
+	tfa.HandleFunc("/webauthn/{id}/remove", h.RemoveWebAuthnCredential).Methods("POST")
+
 	sr := r.PathPrefix("/user").Subrouter()
 
-	sr.Use(handlers.AuthMiddleware())                    // must be logged in
-	sr.Use(handlers.MaxBodySizeMiddleware(1 << 10))      // 1 KB
-	sr.Use(handlers.RateLimitMiddleware(5, time.Second)) // 5 reqs/sec
+	sr.Use(h.AuthMiddleware())                      // must be logged in
+	sr.Use(handlers.MaxBodySizeMiddleware(1 << 10)) // 1 KB
+	sr.Use(h.RateLimitMiddleware(5, time.Second))   // 5 reqs/sec
 
-	sr.HandleFunc("", handlers.UserInfo).Methods("GET")
-	sr.HandleFunc("/push/subscribe", handlers.PushSubscribe).Methods("POST")
+	sr.HandleFunc("", h.UserInfo).Methods("GET")
+	sr.HandleFunc("/sessions", h.ListSessions).Methods("GET")
+	sr.HandleFunc("/sessions/revoke-others", h.RevokeOtherSessions).Methods("POST")
+	sr.HandleFunc("/sessions/{id}/revoke", h.RevokeSession).Methods("POST")
+	sr.HandleFunc("/push/subscribe", h.PushSubscribe).Methods("POST")
+	sr.HandleFunc("/invites", h.ListInvites).Methods("GET")
+	sr.HandleFunc("/invites", h.CreateInvite).Methods("POST")
+	sr.HandleFunc("/invites/{id}/revoke", h.RevokeInvite).Methods("POST")
 
-	if os.Getenv("ENV") != "production" {
-		sr.HandleFunc("/push/test", handlers.PushTest).Methods("GET")
+	if !h.Config().IsProduction() {
+		sr.HandleFunc("/push/test", h.PushTest).Methods("GET")
 	}
 }
@@ -1,8 +1,9 @@
 package session
 
 import (
-	"database/sql"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"acLife/database"
@@ -12,9 +13,21 @@ import (
 
 type ContextKey struct{ name string }
 
-var UserContextKey = ContextKey{"user"}
+var (
+	UserContextKey           = ContextKey{"user"}
+	AccountSessionContextKey = ContextKey{"account_session"}
+)
+
+// GetAccessToken returns the access token of the request, sent as an Authorization: Bearer header
+// by native and CLI clients, or stored in the session cookie by browsers.
+func GetAccessToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return Get[string](r, "access_token")
+}
 
-// GetLoggedInUser retrieves the currently logged in user using the access_token stored in the session.
+// GetLoggedInUser retrieves the currently logged in user using the access token of the request.
 func GetLoggedInUser(r *http.Request, refetch ...bool) *types.User {
 	doRefetch := false
 	if len(refetch) > 0 {
@@ -28,60 +41,46 @@ func GetLoggedInUser(r *http.Request, refetch ...bool) *types.User {
 		}
 	}
 
-	// Get access token from session
-	token := Get[string](r, "access_token")
+	user, _ := GetLoggedInSession(r)
+	return user
+}
+
+// GetLoggedInSession retrieves the currently logged in user along with their account session.
+// It always reads from the database, unlike GetLoggedInUser.
+func GetLoggedInSession(r *http.Request) (*types.User, *types.AccountSession) {
+	token := GetAccessToken(r)
 	if token == "" {
-		return nil
+		return nil, nil
 	}
 
 	// Find matching session in account_sessions
-	var ownerUUID string
-	var expiresAt time.Time
-	if err := database.QueryRow(
-		r.Context(),
-		`SELECT owner, expires_at FROM account_sessions WHERE access_token = ?`,
-		token,
-	).Scan(&ownerUUID, &expiresAt); err != nil {
-		if err != sql.ErrNoRows {
-			utils.LogError("GetLoggedInUser", "QueryRow account_sessions", err)
+	accountSession, err := database.DB.GetAccountSession(r.Context(), token)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			utils.LogError(r.Context(), "GetLoggedInSession", "GetAccountSession", err)
 		}
-		return nil
+		return nil, nil
 	}
 
 	// Check if token expired
-	if time.Now().After(expiresAt) {
-		return nil
+	if time.Now().After(accountSession.ExpiresAt) {
+		return nil, nil
 	}
 
 	// Fetch user from database
-	user := &types.User{}
-	if err := database.QueryRow(
-		r.Context(),
-		`
-			SELECT 
-				id, uuid, email, salt, srp_salt, verifier, challenge,
-				stripe_customer_id, stripe_subscription_id, subscription_status
-			FROM users
-			WHERE uuid = ?`,
-		ownerUUID,
-	).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Email,
-		&user.Salt,
-		&user.SrpSalt,
-		&user.Verifier,
-		&user.Challenge,
-		&user.StripeCustomerID,
-		&user.StripeSubscriptionID,
-		&user.SubscriptionStatus,
-	); err != nil {
-		if err != sql.ErrNoRows {
-			utils.LogError("GetLoggedInUser", "QueryRow", err)
+	user, err := database.DB.GetUserByUUID(r.Context(), accountSession.Owner)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			utils.LogError(r.Context(), "GetLoggedInSession", "GetUserByUUID", err)
 		}
-
-		return nil
+		return nil, nil
 	}
 
-	return user
+	return user, accountSession
+}
+
+// GetAccountSession returns the account session of the request, stored by the auth middleware.
+func GetAccountSession(r *http.Request) *types.AccountSession {
+	accountSession, _ := r.Context().Value(AccountSessionContextKey).(*types.AccountSession)
+	return accountSession
 }
@@ -26,6 +26,18 @@ func Set(w http.ResponseWriter, r *http.Request, key string, value any) error {
 	return sess.Save(r, w)
 }
 
+// SetValues sets several values and saves the session once
+func SetValues(w http.ResponseWriter, r *http.Request, values map[string]any) error {
+	sess, err := GetSession(r)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		sess.Values[key] = value
+	}
+	return sess.Save(r, w)
+}
+
 // Get returns a value of type T from the session
 func Get[T any](r *http.Request, key string) T {
 	var zero T
@@ -0,0 +1,276 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"mz.attahri.com/code/srp/v3"
+)
+
+/* -------------------- SRP Sessions -------------------- */
+
+// dbSRPSessions stores the SRP servers serialized, so that any instance can check the proof.
+type dbSRPSessions struct{}
+
+func (dbSRPSessions) Save(ctx context.Context, id string, sess *types.SRPSession) error {
+	state, err := sess.Server.Save()
+	if err != nil {
+		return err
+	}
+
+	return database.DB.CreateSRPSession(ctx, &types.SavedSRPSession{
+		ID:        id,
+		Email:     sess.Email,
+		Recovery:  sess.Recovery,
+		State:     state,
+		Attempts:  sess.Attempts,
+		CreatedAt: sess.CreatedAt,
+	})
+}
+
+func (dbSRPSessions) Get(ctx context.Context, id string) (*types.SRPSession, error) {
+	saved, err := database.DB.GetSRPSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := srp.RestoreServer(utils.SRPParams, saved.State)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.SRPSession{
+		Server:    server,
+		CreatedAt: saved.CreatedAt,
+		Email:     saved.Email,
+		Recovery:  saved.Recovery,
+		Attempts:  saved.Attempts,
+	}, nil
+}
+
+func (dbSRPSessions) CountAttempt(ctx context.Context, id string, maxAttempts int) (bool, error) {
+	return database.DB.CountSRPAttempt(ctx, id, maxAttempts)
+}
+
+func (dbSRPSessions) Delete(ctx context.Context, id string) error {
+	return database.DB.DeleteSRPSession(ctx, id)
+}
+
+func (dbSRPSessions) DeleteByEmail(ctx context.Context, email string) error {
+	return database.DB.DeleteSRPSessionsByEmail(ctx, email)
+}
+
+func (dbSRPSessions) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeleteSRPSessionsCreatedBefore(ctx, before)
+}
+
+func (dbSRPSessions) Len(ctx context.Context) (int, error) {
+	return database.DB.CountSRPSessions(ctx)
+}
+
+/* -------------------- Pending Logins -------------------- */
+
+// dbPendingLogins stores the WebAuthn assertions as JSON.
+type dbPendingLogins struct{}
+
+func (dbPendingLogins) Save(ctx context.Context, token string, login *types.PendingLogin) error {
+	var assertion []byte
+	if login.WebAuthn != nil {
+		var err error
+		if assertion, err = json.Marshal(login.WebAuthn); err != nil {
+			return err
+		}
+	}
+
+	return database.DB.CreatePendingLogin(ctx, &types.SavedPendingLogin{
+		Token:       token,
+		Owner:       login.UUID,
+		DeviceName:  login.DeviceName,
+		ReturnToken: login.ReturnToken,
+		WebAuthn:    assertion,
+		Attempts:    login.Attempts,
+		CreatedAt:   login.CreatedAt,
+	})
+}
+
+func (dbPendingLogins) Get(ctx context.Context, token string) (*types.PendingLogin, error) {
+	saved, err := database.DB.GetPendingLogin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &types.PendingLogin{
+		UUID:        saved.Owner,
+		DeviceName:  saved.DeviceName,
+		ReturnToken: saved.ReturnToken,
+		Attempts:    saved.Attempts,
+		CreatedAt:   saved.CreatedAt,
+	}
+	if saved.WebAuthn != nil {
+		login.WebAuthn = &webauthn.SessionData{}
+		if err := json.Unmarshal(saved.WebAuthn, login.WebAuthn); err != nil {
+			return nil, err
+		}
+	}
+	return login, nil
+}
+
+func (dbPendingLogins) CountAttempt(ctx context.Context, token string, maxAttempts int) (bool, error) {
+	return database.DB.CountPendingLoginAttempt(ctx, token, maxAttempts)
+}
+
+func (dbPendingLogins) Delete(ctx context.Context, token string) error {
+	return database.DB.DeletePendingLogin(ctx, token)
+}
+
+func (dbPendingLogins) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeletePendingLoginsCreatedBefore(ctx, before)
+}
+
+func (dbPendingLogins) Len(ctx context.Context) (int, error) {
+	return database.DB.CountPendingLogins(ctx)
+}
+
+/* -------------------- Pending Recoveries -------------------- */
+
+type dbPendingRecoveries struct{}
+
+func (dbPendingRecoveries) Save(ctx context.Context, recovery *types.PendingRecovery) error {
+	return database.DB.CreatePendingRecovery(ctx, recovery)
+}
+
+func (dbPendingRecoveries) Get(ctx context.Context, token string) (*types.PendingRecovery, error) {
+	return database.DB.GetPendingRecovery(ctx, token)
+}
+
+func (dbPendingRecoveries) Delete(ctx context.Context, token string) error {
+	return database.DB.DeletePendingRecovery(ctx, token)
+}
+
+func (dbPendingRecoveries) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeletePendingRecoveriesCreatedBefore(ctx, before)
+}
+
+/* -------------------- Security Key Registrations -------------------- */
+
+// dbWebAuthnSetups stores the registration sessions as JSON.
+type dbWebAuthnSetups struct{}
+
+func (dbWebAuthnSetups) Save(ctx context.Context, uuid string, setup *types.WebAuthnSetup) error {
+	session, err := json.Marshal(setup.Session)
+	if err != nil {
+		return err
+	}
+
+	return database.DB.SaveWebAuthnSetup(ctx, &types.SavedWebAuthnSetup{
+		Owner:     uuid,
+		Session:   session,
+		CreatedAt: setup.CreatedAt,
+	})
+}
+
+func (dbWebAuthnSetups) Take(ctx context.Context, uuid string) (*types.WebAuthnSetup, error) {
+	saved, err := database.DB.TakeWebAuthnSetup(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &types.WebAuthnSetup{
+		Session:   &webauthn.SessionData{},
+		CreatedAt: saved.CreatedAt,
+	}
+	if err := json.Unmarshal(saved.Session, setup.Session); err != nil {
+		return nil, err
+	}
+	return setup, nil
+}
+
+func (dbWebAuthnSetups) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeleteWebAuthnSetupsCreatedBefore(ctx, before)
+}
+
+/* -------------------- Login Failures -------------------- */
+
+type dbLoginFailures struct{}
+
+func (dbLoginFailures) Get(ctx context.Context, email string) (*types.LoginFailures, error) {
+	return database.DB.GetLoginFailures(ctx, email)
+}
+
+func (dbLoginFailures) Add(ctx context.Context, email string, now time.Time) (int, error) {
+	return database.DB.AddLoginFailure(ctx, email, now)
+}
+
+func (dbLoginFailures) Delay(ctx context.Context, email string, at time.Time, reset bool) error {
+	return database.DB.DelayLogins(ctx, email, at, reset)
+}
+
+func (dbLoginFailures) Delete(ctx context.Context, email string) error {
+	return database.DB.DeleteLoginFailures(ctx, email)
+}
+
+func (dbLoginFailures) DeleteExpired(ctx context.Context, lastFailureBefore, now time.Time) error {
+	return database.DB.DeleteExpiredLoginFailures(ctx, lastFailureBefore, now)
+}
+
+func (dbLoginFailures) Len(ctx context.Context) (int, error) {
+	return database.DB.CountLoginFailures(ctx)
+}
+
+/* -------------------- Verification Mails -------------------- */
+
+type dbVerificationMails struct{}
+
+func (dbVerificationMails) Allow(ctx context.Context, uuid string, interval time.Duration, now time.Time) (bool, error) {
+	return database.DB.ClaimVerificationMail(ctx, uuid, now.Add(-interval), now)
+}
+
+func (dbVerificationMails) DeleteBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeleteVerificationMailsSentBefore(ctx, before)
+}
+
+/* -------------------- Rate Limits -------------------- */
+
+type dbRateLimits struct{}
+
+func (dbRateLimits) Allow(ctx context.Context, client string, limit int, window time.Duration, now time.Time) (bool, error) {
+	return database.DB.AddRateLimitHit(ctx, client, limit, now.Add(-window), now)
+}
+
+func (dbRateLimits) DeleteBefore(ctx context.Context, before time.Time) error {
+	return database.DB.DeleteRateLimitHits(ctx, before)
+}
+
+func (dbRateLimits) Len(ctx context.Context) (int, error) {
+	return database.DB.CountRateLimitClients(ctx)
+}
+
+/* -------------------- Subscriptions -------------------- */
+
+type dbSubscriptions struct{}
+
+func (dbSubscriptions) Get(ctx context.Context, subscriptionID string, now time.Time) (string, error) {
+	return database.DB.GetCachedSubscriptionStatus(ctx, subscriptionID, now)
+}
+
+func (dbSubscriptions) Set(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error {
+	return database.DB.CacheSubscriptionStatus(ctx, subscriptionID, status, expiresAt)
+}
+
+func (dbSubscriptions) Delete(ctx context.Context, subscriptionID string) error {
+	return database.DB.DeleteCachedSubscriptionStatus(ctx, subscriptionID)
+}
+
+func (dbSubscriptions) DeleteExpired(ctx context.Context, now time.Time) error {
+	return database.DB.DeleteExpiredSubscriptionStatuses(ctx, now)
+}
+
+func (dbSubscriptions) Len(ctx context.Context) (int, error) {
+	return database.DB.CountCachedSubscriptionStatuses(ctx)
+}
@@ -0,0 +1,494 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"acLife/types"
+)
+
+/* -------------------- SRP Sessions -------------------- */
+
+// memorySRPSessions keeps the SRP servers themselves, for a single instance.
+type memorySRPSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*types.SRPSession // by id
+}
+
+func newMemorySRPSessions() *memorySRPSessions {
+	return &memorySRPSessions{sessions: make(map[string]*types.SRPSession)}
+}
+
+func (m *memorySRPSessions) Save(ctx context.Context, id string, sess *types.SRPSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *sess
+	m.sessions[id] = &c
+	return nil
+}
+
+func (m *memorySRPSessions) Get(ctx context.Context, id string) (*types.SRPSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *sess
+	return &c, nil
+}
+
+func (m *memorySRPSessions) CountAttempt(ctx context.Context, id string, maxAttempts int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.sessions[id]
+	if !ok || sess.Attempts >= maxAttempts {
+		return false, nil
+	}
+	sess.Attempts++
+	return true, nil
+}
+
+func (m *memorySRPSessions) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySRPSessions) DeleteByEmail(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, sess := range m.sessions {
+		if strings.EqualFold(sess.Email, email) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySRPSessions) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, sess := range m.sessions {
+		if sess.CreatedAt.Before(before) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySRPSessions) Len(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.sessions), nil
+}
+
+/* -------------------- Pending Logins -------------------- */
+
+type memoryPendingLogins struct {
+	mu     sync.Mutex
+	logins map[string]*types.PendingLogin // by token
+}
+
+func newMemoryPendingLogins() *memoryPendingLogins {
+	return &memoryPendingLogins{logins: make(map[string]*types.PendingLogin)}
+}
+
+func (m *memoryPendingLogins) Save(ctx context.Context, token string, login *types.PendingLogin) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *login
+	m.logins[token] = &c
+	return nil
+}
+
+func (m *memoryPendingLogins) Get(ctx context.Context, token string) (*types.PendingLogin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.logins[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *login
+	return &c, nil
+}
+
+func (m *memoryPendingLogins) CountAttempt(ctx context.Context, token string, maxAttempts int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.logins[token]
+	if !ok || login.Attempts >= maxAttempts {
+		return false, nil
+	}
+	login.Attempts++
+	return true, nil
+}
+
+func (m *memoryPendingLogins) Delete(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.logins, token)
+	return nil
+}
+
+func (m *memoryPendingLogins) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, login := range m.logins {
+		if login.CreatedAt.Before(before) {
+			delete(m.logins, token)
+		}
+	}
+	return nil
+}
+
+func (m *memoryPendingLogins) Len(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.logins), nil
+}
+
+/* -------------------- Pending Recoveries -------------------- */
+
+type memoryPendingRecoveries struct {
+	mu         sync.Mutex
+	recoveries map[string]types.PendingRecovery // by token
+}
+
+func newMemoryPendingRecoveries() *memoryPendingRecoveries {
+	return &memoryPendingRecoveries{recoveries: make(map[string]types.PendingRecovery)}
+}
+
+func (m *memoryPendingRecoveries) Save(ctx context.Context, recovery *types.PendingRecovery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recoveries[recovery.Token] = *recovery
+	return nil
+}
+
+func (m *memoryPendingRecoveries) Get(ctx context.Context, token string) (*types.PendingRecovery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recovery, ok := m.recoveries[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &recovery, nil
+}
+
+func (m *memoryPendingRecoveries) Delete(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.recoveries, token)
+	return nil
+}
+
+func (m *memoryPendingRecoveries) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, recovery := range m.recoveries {
+		if recovery.CreatedAt.Before(before) {
+			delete(m.recoveries, token)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Security Key Registrations -------------------- */
+
+type memoryWebAuthnSetups struct {
+	mu     sync.Mutex
+	setups map[string]types.WebAuthnSetup // by user uuid
+}
+
+func newMemoryWebAuthnSetups() *memoryWebAuthnSetups {
+	return &memoryWebAuthnSetups{setups: make(map[string]types.WebAuthnSetup)}
+}
+
+func (m *memoryWebAuthnSetups) Save(ctx context.Context, uuid string, setup *types.WebAuthnSetup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setups[uuid] = *setup
+	return nil
+}
+
+func (m *memoryWebAuthnSetups) Take(ctx context.Context, uuid string) (*types.WebAuthnSetup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	setup, ok := m.setups[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.setups, uuid)
+	return &setup, nil
+}
+
+func (m *memoryWebAuthnSetups) DeleteCreatedBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for uuid, setup := range m.setups {
+		if setup.CreatedAt.Before(before) {
+			delete(m.setups, uuid)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Login Failures -------------------- */
+
+type memoryLoginFailures struct {
+	mu       sync.Mutex
+	failures map[string]*types.LoginFailures // by email
+}
+
+func newMemoryLoginFailures() *memoryLoginFailures {
+	return &memoryLoginFailures{failures: make(map[string]*types.LoginFailures)}
+}
+
+func (m *memoryLoginFailures) Get(ctx context.Context, email string) (*types.LoginFailures, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.failures[email]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *failures
+	return &c, nil
+}
+
+func (m *memoryLoginFailures) Add(ctx context.Context, email string, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.failures[email]
+	if !ok {
+		failures = &types.LoginFailures{Email: email, NextAttemptAt: now}
+		m.failures[email] = failures
+	}
+	failures.Failures++
+	failures.LastFailureAt = now
+	return failures.Failures, nil
+}
+
+func (m *memoryLoginFailures) Delay(ctx context.Context, email string, at time.Time, reset bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.failures[email]
+	if !ok || !failures.NextAttemptAt.Before(at) {
+		return nil
+	}
+	failures.NextAttemptAt = at
+	if reset {
+		failures.Failures = 0
+	}
+	return nil
+}
+
+func (m *memoryLoginFailures) Delete(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, email)
+	return nil
+}
+
+func (m *memoryLoginFailures) DeleteExpired(ctx context.Context, lastFailureBefore, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for email, failures := range m.failures {
+		if failures.LastFailureAt.Before(lastFailureBefore) && !failures.NextAttemptAt.After(now) {
+			delete(m.failures, email)
+		}
+	}
+	return nil
+}
+
+func (m *memoryLoginFailures) Len(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.failures), nil
+}
+
+/* -------------------- Verification Mails -------------------- */
+
+type memoryVerificationMails struct {
+	mu     sync.Mutex
+	sentAt map[string]time.Time // by user uuid
+}
+
+func newMemoryVerificationMails() *memoryVerificationMails {
+	return &memoryVerificationMails{sentAt: make(map[string]time.Time)}
+}
+
+func (m *memoryVerificationMails) Allow(ctx context.Context, uuid string, interval time.Duration, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last, ok := m.sentAt[uuid]; ok && now.Sub(last) < interval {
+		return false, nil
+	}
+	m.sentAt[uuid] = now
+	return true, nil
+}
+
+func (m *memoryVerificationMails) DeleteBefore(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for uuid, last := range m.sentAt {
+		if last.Before(before) {
+			delete(m.sentAt, uuid)
+		}
+	}
+	return nil
+}
+
+/* -------------------- Rate Limits -------------------- */
+
+type memoryRateLimits struct {
+	clients sync.Map // map[string]*rateLimitEntry
+}
+
+type rateLimitEntry struct {
+	timestamps []time.Time
+	mu         sync.Mutex
+}
+
+func (m *memoryRateLimits) Allow(ctx context.Context, client string, limit int, window time.Duration, now time.Time) (bool, error) {
+	val, _ := m.clients.LoadOrStore(client, &rateLimitEntry{})
+	entry := val.(*rateLimitEntry)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	count := 0
+	for _, ts := range entry.timestamps {
+		if now.Sub(ts) <= window {
+			count++
+		}
+	}
+	if count >= limit {
+		return false, nil
+	}
+
+	entry.timestamps = append(entry.timestamps, now)
+	return true, nil
+}
+
+func (m *memoryRateLimits) DeleteBefore(ctx context.Context, before time.Time) error {
+	m.clients.Range(func(key, value any) bool {
+		entry := value.(*rateLimitEntry)
+
+		entry.mu.Lock()
+		filtered := make([]time.Time, 0, len(entry.timestamps))
+		for _, ts := range entry.timestamps {
+			if !ts.Before(before) {
+				filtered = append(filtered, ts)
+			}
+		}
+		entry.timestamps = filtered
+		empty := len(filtered) == 0
+		entry.mu.Unlock()
+
+		if empty {
+			m.clients.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+func (m *memoryRateLimits) Len(ctx context.Context) (int, error) {
+	return countEntries(&m.clients), nil
+}
+
+/* -------------------- Subscriptions -------------------- */
+
+type memorySubscriptions struct {
+	statuses sync.Map // map[string]subCacheEntry
+}
+
+type subCacheEntry struct {
+	status    string
+	expiresAt time.Time
+}
+
+func (m *memorySubscriptions) Get(ctx context.Context, subscriptionID string, now time.Time) (string, error) {
+	val, ok := m.statuses.Load(subscriptionID)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	entry := val.(subCacheEntry)
+	if now.After(entry.expiresAt) {
+		m.statuses.Delete(subscriptionID)
+		return "", ErrNotFound
+	}
+
+	return entry.status, nil
+}
+
+func (m *memorySubscriptions) Set(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error {
+	m.statuses.Store(subscriptionID, subCacheEntry{
+		status:    status,
+		expiresAt: expiresAt,
+	})
+	return nil
+}
+
+func (m *memorySubscriptions) Delete(ctx context.Context, subscriptionID string) error {
+	m.statuses.Delete(subscriptionID)
+	return nil
+}
+
+func (m *memorySubscriptions) DeleteExpired(ctx context.Context, now time.Time) error {
+	m.statuses.Range(func(key, value any) bool {
+		if now.After(value.(subCacheEntry).expiresAt) {
+			m.statuses.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+func (m *memorySubscriptions) Len(ctx context.Context) (int, error) {
+	return countEntries(&m.statuses), nil
+}
+
+/* -------------------- Helpers -------------------- */
+
+func countEntries(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,143 @@
+// Package state keeps the short-lived state of the API: SRP handshakes, logins waiting for a second factor,
+// recoveries and security key registrations in progress, failed logins, rate limits and cached subscription statuses.
+// It lives in process memory by default. With STATE_STORE=database it is kept in the database instead,
+// so that several instances behind a load balancer can serve the same clients.
+package state
+
+import (
+	"context"
+	"time"
+
+	"acLife/database"
+	"acLife/types"
+)
+
+// ErrNotFound is returned for missing or expired entries, by both stores.
+var ErrNotFound = database.ErrNotFound
+
+// Store holds the short-lived state.
+type Store struct {
+	SRPSessions       SRPSessions
+	PendingLogins     PendingLogins
+	PendingRecoveries PendingRecoveries
+	WebAuthnSetups    WebAuthnSetups
+	LoginFailures     LoginFailures
+	VerificationMails VerificationMails
+	RateLimits        RateLimits
+	Subscriptions     Subscriptions
+}
+
+// New returns the store for driver, "memory" or "database". The database store uses database.DB.
+func New(driver string) *Store {
+	if driver == "database" {
+		return &Store{
+			SRPSessions:       dbSRPSessions{},
+			PendingLogins:     dbPendingLogins{},
+			PendingRecoveries: dbPendingRecoveries{},
+			WebAuthnSetups:    dbWebAuthnSetups{},
+			LoginFailures:     dbLoginFailures{},
+			VerificationMails: dbVerificationMails{},
+			RateLimits:        dbRateLimits{},
+			Subscriptions:     dbSubscriptions{},
+		}
+	}
+
+	return &Store{
+		SRPSessions:       newMemorySRPSessions(),
+		PendingLogins:     newMemoryPendingLogins(),
+		PendingRecoveries: newMemoryPendingRecoveries(),
+		WebAuthnSetups:    newMemoryWebAuthnSetups(),
+		LoginFailures:     newMemoryLoginFailures(),
+		VerificationMails: newMemoryVerificationMails(),
+		RateLimits:        &memoryRateLimits{},
+		Subscriptions:     &memorySubscriptions{},
+	}
+}
+
+// SRPSessions keeps SRP handshakes between their start and the client's proof.
+type SRPSessions interface {
+	Save(ctx context.Context, id string, sess *types.SRPSession) error
+	// Get returns ErrNotFound if there is no session with that ID. Checking its age is up to the caller.
+	Get(ctx context.Context, id string) (*types.SRPSession, error)
+	// CountAttempt records a proof attempt, reporting false if the session is gone or already had maxAttempts.
+	CountAttempt(ctx context.Context, id string, maxAttempts int) (bool, error)
+	Delete(ctx context.Context, id string) error
+	DeleteByEmail(ctx context.Context, email string) error
+	DeleteCreatedBefore(ctx context.Context, before time.Time) error
+	Len(ctx context.Context) (int, error)
+}
+
+// PendingLogins keeps the logins that passed the SRP proof until the second factor is checked.
+type PendingLogins interface {
+	Save(ctx context.Context, token string, login *types.PendingLogin) error
+	// Get returns ErrNotFound if there is no login with that token. Checking its age is up to the caller.
+	Get(ctx context.Context, token string) (*types.PendingLogin, error)
+	// CountAttempt records a second factor attempt, reporting false if the login is gone or already had maxAttempts.
+	CountAttempt(ctx context.Context, token string, maxAttempts int) (bool, error)
+	Delete(ctx context.Context, token string) error
+	DeleteCreatedBefore(ctx context.Context, before time.Time) error
+	Len(ctx context.Context) (int, error)
+}
+
+// PendingRecoveries keeps the recoveries that proved the recovery code until the new password is set.
+type PendingRecoveries interface {
+	Save(ctx context.Context, recovery *types.PendingRecovery) error
+	// Get returns ErrNotFound if there is no recovery with that token. Checking its age is up to the caller.
+	Get(ctx context.Context, token string) (*types.PendingRecovery, error)
+	Delete(ctx context.Context, token string) error
+	DeleteCreatedBefore(ctx context.Context, before time.Time) error
+}
+
+// WebAuthnSetups keeps the security key registrations waiting for the authenticator, one per user.
+type WebAuthnSetups interface {
+	// Save replaces the user's registration in progress, if any.
+	Save(ctx context.Context, uuid string, setup *types.WebAuthnSetup) error
+	// Take returns and forgets the user's registration, or ErrNotFound. Of concurrent calls, only one gets it.
+	Take(ctx context.Context, uuid string) (*types.WebAuthnSetup, error)
+	DeleteCreatedBefore(ctx context.Context, before time.Time) error
+}
+
+// LoginFailures counts the failed proofs of each account, by lowercased email.
+type LoginFailures interface {
+	// Get returns ErrNotFound if the account has no recorded failures.
+	Get(ctx context.Context, email string) (*types.LoginFailures, error)
+	// Add records a failure at now and returns the number of consecutive failures, including it.
+	Add(ctx context.Context, email string, now time.Time) (int, error)
+	// Delay makes the account wait until at before its next attempt, unless it has to wait longer already.
+	// With reset the failures are counted from zero again.
+	Delay(ctx context.Context, email string, at time.Time, reset bool) error
+	Delete(ctx context.Context, email string) error
+	// DeleteExpired forgets the accounts whose last failure was before lastFailureBefore and that may try again at now.
+	DeleteExpired(ctx context.Context, lastFailureBefore, now time.Time) error
+	Len(ctx context.Context) (int, error)
+}
+
+// VerificationMails throttles the verification emails resent to each user.
+type VerificationMails interface {
+	// Allow records a verification email to the user at now, unless one was sent within interval.
+	// It reports whether the email was recorded.
+	Allow(ctx context.Context, uuid string, interval time.Duration, now time.Time) (bool, error)
+	// DeleteBefore forgets the emails sent before the given time.
+	DeleteBefore(ctx context.Context, before time.Time) error
+}
+
+// RateLimits counts the requests of each client. All limits of a client count the same requests.
+type RateLimits interface {
+	// Allow records a request of client at now, unless it made limit requests within window already.
+	// It reports whether the request was recorded.
+	Allow(ctx context.Context, client string, limit int, window time.Duration, now time.Time) (bool, error)
+	// DeleteBefore forgets the requests made before the given time.
+	DeleteBefore(ctx context.Context, before time.Time) error
+	// Len returns the number of clients with recorded requests.
+	Len(ctx context.Context) (int, error)
+}
+
+// Subscriptions caches the subscription statuses fetched from Stripe.
+type Subscriptions interface {
+	// Get returns ErrNotFound if the status isn't cached or expired before now.
+	Get(ctx context.Context, subscriptionID string, now time.Time) (string, error)
+	Set(ctx context.Context, subscriptionID, status string, expiresAt time.Time) error
+	Delete(ctx context.Context, subscriptionID string) error
+	DeleteExpired(ctx context.Context, now time.Time) error
+	Len(ctx context.Context) (int, error)
+}
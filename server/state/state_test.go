@@ -0,0 +1,371 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"acLife/config"
+	"acLife/database"
+	"acLife/types"
+	"acLife/utils"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"mz.attahri.com/code/srp/v3"
+)
+
+// forEachStore runs test against the memory store and the database store, the latter on a new SQLite database.
+func forEachStore(t *testing.T, test func(t *testing.T, s *Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, New("memory"))
+	})
+
+	t.Run("database", func(t *testing.T) {
+		if err := database.Connect(config.Database{
+			Driver: "sqlite",
+			Path:   filepath.Join(t.TempDir(), "state.db"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = database.DB.Close() })
+
+		if err := database.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, New("database"))
+	})
+}
+
+// newSRPSession starts the server side of a handshake for email.
+func newSRPSession(t *testing.T, email string, createdAt time.Time) *types.SRPSession {
+	t.Helper()
+
+	triplet, err := srp.ComputeVerifier(utils.SRPParams, email, "password", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := srp.NewServer(utils.SRPParams, email, triplet.Salt(), triplet.Verifier())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := srp.NewClient(utils.SRPParams, email, "password", triplet.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetA(client.A()); err != nil {
+		t.Fatal(err)
+	}
+
+	return &types.SRPSession{Server: server, CreatedAt: createdAt, Email: email}
+}
+
+func TestSRPSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		if err := s.SRPSessions.Save(ctx, "a", newSRPSession(t, "alice@example.com", now)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SRPSessions.Save(ctx, "b", newSRPSession(t, "Alice@Example.com", now)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SRPSessions.Save(ctx, "c", newSRPSession(t, "bob@example.com", now.Add(-time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+
+		sess, err := s.SRPSessions.Get(ctx, "a")
+		if err != nil || sess.Email != "alice@example.com" || sess.Server == nil {
+			t.Fatalf("get: got %+v, %v", sess, err)
+		}
+
+		// Each handshake has its own attempts
+		for i := range 3 {
+			if ok, err := s.SRPSessions.CountAttempt(ctx, "a", 2); err != nil || ok != (i < 2) {
+				t.Fatalf("attempt %d: got %v, %v", i+1, ok, err)
+			}
+		}
+		if ok, err := s.SRPSessions.CountAttempt(ctx, "b", 2); err != nil || !ok {
+			t.Fatalf("attempt on another handshake: got %v, %v", ok, err)
+		}
+
+		// Old handshakes expire, and a user's handshakes can be dropped together, whatever the case of the address
+		if err := s.SRPSessions.DeleteCreatedBefore(ctx, now.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SRPSessions.Get(ctx, "c"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after expiry: got %v", err)
+		}
+		if err := s.SRPSessions.DeleteByEmail(ctx, "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.SRPSessions.Len(ctx); err != nil || n != 0 {
+			t.Fatalf("len after DeleteByEmail: got %d, %v", n, err)
+		}
+	})
+}
+
+func TestPendingLogins(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		login := &types.PendingLogin{
+			UUID:        "owner",
+			DeviceName:  "Phone",
+			ReturnToken: true,
+			WebAuthn:    &webauthn.SessionData{Challenge: "challenge", UserID: []byte("owner")},
+			CreatedAt:   now,
+		}
+		if err := s.PendingLogins.Save(ctx, "a", login); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PendingLogins.Save(ctx, "b", &types.PendingLogin{UUID: "owner", CreatedAt: now.Add(-time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.PendingLogins.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.UUID != "owner" || got.DeviceName != "Phone" || !got.ReturnToken || !got.CreatedAt.Equal(now) ||
+			got.WebAuthn == nil || got.WebAuthn.Challenge != "challenge" || string(got.WebAuthn.UserID) != "owner" {
+			t.Fatalf("get: got %+v", got)
+		}
+		if got, err := s.PendingLogins.Get(ctx, "b"); err != nil || got.WebAuthn != nil {
+			t.Fatalf("get without keys: got %+v, %v", got, err)
+		}
+
+		for i := range 3 {
+			if ok, err := s.PendingLogins.CountAttempt(ctx, "a", 2); err != nil || ok != (i < 2) {
+				t.Fatalf("attempt %d: got %v, %v", i+1, ok, err)
+			}
+		}
+		if ok, err := s.PendingLogins.CountAttempt(ctx, "missing", 2); err != nil || ok {
+			t.Fatalf("attempt on a missing login: got %v, %v", ok, err)
+		}
+
+		if err := s.PendingLogins.DeleteCreatedBefore(ctx, now.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PendingLogins.Get(ctx, "b"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after expiry: got %v", err)
+		}
+		if n, err := s.PendingLogins.Len(ctx); err != nil || n != 1 {
+			t.Fatalf("len: got %d, %v", n, err)
+		}
+
+		if err := s.PendingLogins.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PendingLogins.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after delete: got %v", err)
+		}
+	})
+}
+
+func TestPendingRecoveries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		for _, recovery := range []*types.PendingRecovery{
+			{Token: "a", Owner: "owner", CreatedAt: now},
+			{Token: "b", Owner: "owner", CreatedAt: now.Add(-time.Hour)},
+		} {
+			if err := s.PendingRecoveries.Save(ctx, recovery); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got, err := s.PendingRecoveries.Get(ctx, "a"); err != nil || got.Owner != "owner" || !got.CreatedAt.Equal(now) {
+			t.Fatalf("get: got %+v, %v", got, err)
+		}
+
+		if err := s.PendingRecoveries.DeleteCreatedBefore(ctx, now.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PendingRecoveries.Get(ctx, "b"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after expiry: got %v", err)
+		}
+
+		if err := s.PendingRecoveries.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PendingRecoveries.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after delete: got %v", err)
+		}
+	})
+}
+
+func TestWebAuthnSetups(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		// A new registration replaces the previous one
+		for _, challenge := range []string{"first", "second"} {
+			if err := s.WebAuthnSetups.Save(ctx, "owner", &types.WebAuthnSetup{
+				Session:   &webauthn.SessionData{Challenge: challenge},
+				CreatedAt: now,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// It can only be taken once
+		setup, err := s.WebAuthnSetups.Take(ctx, "owner")
+		if err != nil || setup.Session.Challenge != "second" || !setup.CreatedAt.Equal(now) {
+			t.Fatalf("take: got %+v, %v", setup, err)
+		}
+		if _, err := s.WebAuthnSetups.Take(ctx, "owner"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("take again: got %v", err)
+		}
+
+		if err := s.WebAuthnSetups.Save(ctx, "other", &types.WebAuthnSetup{
+			Session:   &webauthn.SessionData{Challenge: "old"},
+			CreatedAt: now.Add(-time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WebAuthnSetups.DeleteCreatedBefore(ctx, now.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.WebAuthnSetups.Take(ctx, "other"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("take after expiry: got %v", err)
+		}
+	})
+}
+
+func TestLoginFailures(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		if _, err := s.LoginFailures.Get(ctx, "alice@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get before failures: got %v", err)
+		}
+
+		for i := range 3 {
+			if n, err := s.LoginFailures.Add(ctx, "alice@example.com", now); err != nil || n != i+1 {
+				t.Fatalf("failure %d: got %d, %v", i+1, n, err)
+			}
+		}
+		f, err := s.LoginFailures.Get(ctx, "alice@example.com")
+		if err != nil || f.Failures != 3 || !f.LastFailureAt.Equal(now) || f.NextAttemptAt.After(now) {
+			t.Fatalf("get: got %+v, %v", f, err)
+		}
+
+		// Delays only move later, a lockout starts the count over
+		if err := s.LoginFailures.Delay(ctx, "alice@example.com", now.Add(time.Hour), true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.LoginFailures.Delay(ctx, "alice@example.com", now.Add(time.Minute), false); err != nil {
+			t.Fatal(err)
+		}
+		f, err = s.LoginFailures.Get(ctx, "alice@example.com")
+		if err != nil || f.Failures != 0 || !f.NextAttemptAt.Equal(now.Add(time.Hour)) {
+			t.Fatalf("get after delays: got %+v, %v", f, err)
+		}
+
+		// Old failures are forgotten, unless the account still has to wait
+		if _, err := s.LoginFailures.Add(ctx, "bob@example.com", now.Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.LoginFailures.DeleteExpired(ctx, now.Add(time.Minute), now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.LoginFailures.Get(ctx, "bob@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get after expiry: got %v", err)
+		}
+		if n, err := s.LoginFailures.Len(ctx); err != nil || n != 1 {
+			t.Fatalf("len: got %d, %v", n, err)
+		}
+
+		if err := s.LoginFailures.Delete(ctx, "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.LoginFailures.Len(ctx); err != nil || n != 0 {
+			t.Fatalf("len after delete: got %d, %v", n, err)
+		}
+	})
+}
+
+func TestVerificationMails(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		for _, tc := range []struct {
+			at   time.Time
+			want bool
+		}{
+			{now, true},
+			{now.Add(time.Minute), false},
+			{now.Add(time.Hour), true},
+		} {
+			if ok, err := s.VerificationMails.Allow(ctx, "owner", 10*time.Minute, tc.at); err != nil || ok != tc.want {
+				t.Fatalf("allow at %v: got %v, %v, want %v", tc.at.Sub(now), ok, err, tc.want)
+			}
+		}
+
+		// Forgetting old emails allows the next one
+		if err := s.VerificationMails.DeleteBefore(ctx, now.Add(2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.VerificationMails.Allow(ctx, "owner", 10*time.Minute, now.Add(time.Hour)); err != nil || !ok {
+			t.Fatalf("allow after DeleteBefore: got %v, %v", ok, err)
+		}
+	})
+}
+
+func TestRateLimits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+
+		for i := range 4 {
+			if ok, err := s.RateLimits.Allow(ctx, "client", 3, time.Second, now); err != nil || ok != (i < 3) {
+				t.Fatalf("request %d: got %v, %v", i+1, ok, err)
+			}
+		}
+		if ok, err := s.RateLimits.Allow(ctx, "client", 3, time.Second, now.Add(2*time.Second)); err != nil || !ok {
+			t.Fatalf("request after the window: got %v, %v", ok, err)
+		}
+
+		if err := s.RateLimits.DeleteBefore(ctx, now.Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.RateLimits.Len(ctx); err != nil || n != 1 {
+			t.Fatalf("len: got %d, %v", n, err)
+		}
+
+		// Concurrent requests don't get past the limit together
+		var (
+			wg      sync.WaitGroup
+			allowed atomic.Int32
+		)
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ok, err := s.RateLimits.Allow(ctx, "burst", 5, time.Minute, now)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					allowed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := allowed.Load(); n > 5 {
+			t.Fatalf("concurrent requests allowed: got %d, want at most 5", n)
+		}
+	})
+}
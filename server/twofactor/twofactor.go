@@ -0,0 +1,92 @@
+// Package twofactor implements the second login factors: TOTP codes and single-use backup codes.
+package twofactor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// Issuer is the name shown by authenticator apps.
+	Issuer = "acLife"
+
+	period = 30 // seconds per TOTP step
+	skew   = 1  // steps accepted before and after the current one, for clock drift
+
+	backupCodeLen = 10
+)
+
+var validateOpts = totp.ValidateOpts{
+	Period:    period,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// NewTOTPKey generates a TOTP secret for the account.
+// It returns the base32 secret and the otpauth:// URL to show as a QR code.
+func NewTOTPKey(accountName string) (secret, url string, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      Issuer,
+		AccountName: accountName,
+		Period:      period,
+		Digits:      validateOpts.Digits,
+		Algorithm:   validateOpts.Algorithm,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return key.Secret(), key.URL(), nil
+}
+
+// ValidateTOTP checks a code against the secret at time t.
+// It returns the time step the code belongs to, so callers can reject a code that was already used.
+func ValidateTOTP(secret, code string, t time.Time) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != validateOpts.Digits.Length() {
+		return 0, false
+	}
+
+	current := t.Unix() / period
+	for offset := int64(-skew); offset <= skew; offset++ {
+		step := current + offset
+
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), validateOpts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewBackupCodes generates n single-use backup codes along with the hashes to store.
+func NewBackupCodes(n int) (codes []string, hashes [][]byte) {
+	for range n {
+		b := make([]byte, backupCodeLen)
+		_, _ = rand.Read(b) // never returns an error
+
+		code := base32.StdEncoding.EncodeToString(b)[:backupCodeLen]
+		codes = append(codes, code)
+		hashes = append(hashes, HashBackupCode(code))
+	}
+	return codes, hashes
+}
+
+// HashBackupCode returns the stored form of a backup code.
+// Codes are random, so a fast hash is enough. Case, spaces and dashes are ignored.
+func HashBackupCode(code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
@@ -0,0 +1,64 @@
+package twofactor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	secret, url, err := NewTOTPKey("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(url, "otpauth://totp/acLife:alice@example.com") {
+		t.Errorf("url = %q", url)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	code, err := totp.GenerateCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != now.Unix()/period {
+		t.Fatalf("current code: step %d, ok %v", step, ok)
+	}
+
+	// One step of clock drift is tolerated, more is not
+	if _, ok := ValidateTOTP(secret, code, now.Add(period*time.Second)); !ok {
+		t.Error("code from the previous step was rejected")
+	}
+	if _, ok := ValidateTOTP(secret, code, now.Add(3*period*time.Second)); ok {
+		t.Error("code from three steps ago was accepted")
+	}
+
+	if _, ok := ValidateTOTP(secret, "12345", now); ok {
+		t.Error("short code was accepted")
+	}
+}
+
+func TestBackupCodes(t *testing.T) {
+	codes, hashes := NewBackupCodes(10)
+	if len(codes) != 10 || len(hashes) != 10 {
+		t.Fatalf("got %d codes and %d hashes", len(codes), len(hashes))
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if len(code) != backupCodeLen || seen[code] {
+			t.Errorf("code %q is malformed or repeated", code)
+		}
+		seen[code] = true
+
+		// Users may type codes in lower case and with separators
+		typed := strings.ToLower(code[:5]) + "-" + code[5:]
+		if !bytes.Equal(HashBackupCode(typed), hashes[i]) {
+			t.Errorf("hash of %q does not match %q", typed, code)
+		}
+	}
+}
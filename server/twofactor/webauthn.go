@@ -0,0 +1,94 @@
+package twofactor
+
+import (
+	"strings"
+	"time"
+
+	"acLife/config"
+	"acLife/types"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// NewWebAuthn creates the WebAuthn relying party for the configured domain and origins.
+func NewWebAuthn(cfg config.WebAuthn) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: Issuer,
+		RPOrigins:     cfg.Origins,
+		// Keys are a second factor, the password was already checked
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationDiscouraged,
+		},
+	})
+}
+
+// WebAuthnUser adapts a user and their stored credentials to the WebAuthn library.
+type WebAuthnUser struct {
+	User        *types.User
+	Credentials []types.WebAuthnCredential
+}
+
+// WebAuthnID is the user handle stored on the authenticator.
+func (u WebAuthnUser) WebAuthnID() []byte {
+	return []byte(u.User.UUID)
+}
+
+func (u WebAuthnUser) WebAuthnName() string {
+	return u.User.Email
+}
+
+func (u WebAuthnUser) WebAuthnDisplayName() string {
+	return u.User.Email
+}
+
+func (u WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.Credentials))
+	for _, c := range u.Credentials {
+		var transports []protocol.AuthenticatorTransport
+		for t := range strings.SplitSeq(c.Transports, ",") {
+			if t != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+
+		creds = append(creds, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return creds
+}
+
+// NewWebAuthnCredential converts a newly registered credential for storage.
+func NewWebAuthnCredential(owner, name string, c *webauthn.Credential, now time.Time) *types.WebAuthnCredential {
+	transports := make([]string, 0, len(c.Transport))
+	for _, t := range c.Transport {
+		transports = append(transports, string(t))
+	}
+
+	return &types.WebAuthnCredential{
+		Owner:           owner,
+		Name:            name,
+		CredentialID:    c.ID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          c.Authenticator.AAGUID,
+		SignCount:       c.Authenticator.SignCount,
+		BackupEligible:  c.Flags.BackupEligible,
+		BackupState:     c.Flags.BackupState,
+		CreatedAt:       now,
+	}
+}
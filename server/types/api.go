@@ -0,0 +1,238 @@
+package types
+
+import "encoding/json"
+
+// Request and response bodies of the API endpoints.
+// They are described in openapi/openapi.yaml, keep both in sync.
+
+/* -------------------- Auth -------------------- */
+
+type RegisterRequest struct {
+	Challenge  string `json:"challenge"`
+	Triplet    []byte `json:"triplet"`
+	Salt       []byte `json:"salt"`
+	InviteCode string `json:"invite_code,omitempty"` // required in invite-only mode
+}
+
+type LoginStartRequest struct {
+	Email string `json:"email"`
+	A     []byte `json:"A"`
+}
+
+type LoginStartResponse struct {
+	Salt      []byte `json:"salt"`
+	B         []byte `json:"B"`
+	SessionID string `json:"session_id"`
+}
+
+type LoginVerifyRequest struct {
+	Email      string `json:"email"`
+	M1         []byte `json:"M1"`
+	SessionID  string `json:"session_id"`
+	DeviceName string `json:"device_name,omitempty"` // shown in the session list
+	// ReturnToken asks for the access token in the reply instead of the session cookie, for clients without cookies
+	ReturnToken bool `json:"return_token,omitempty"`
+}
+
+type LoginVerifyResponse struct {
+	M2           []byte                 `json:"M2"`
+	SecondFactor *SecondFactorChallenge `json:"secondFactor,omitempty"` // set when the login still needs a second factor
+	Session      *SessionToken          `json:"session,omitempty"`      // set when the token was asked for
+}
+
+// SessionToken is the access token of a session, sent back as an Authorization: Bearer header,
+// and the refresh token that renews it at /auth/refresh.
+type SessionToken struct {
+	AccessToken  string `json:"accessToken"`
+	ExpiresAt    int64  `json:"expiresAt"` // of the access token, unix milliseconds
+	RefreshToken string `json:"refreshToken"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SecondFactorChallenge is returned instead of a session when the account has two-factor authentication enabled.
+// The login is completed by sending the token and a code to /auth/login/2fa.
+type SecondFactorChallenge struct {
+	Token   string   `json:"token"`
+	Methods []string `json:"methods"` // "totp", "backup_code" or "webauthn"
+	// WebAuthn holds the options for navigator.credentials.get when the user has security keys
+	WebAuthn any `json:"webauthn,omitempty"`
+}
+
+type LoginSecondFactorRequest struct {
+	Token      string          `json:"token"`
+	Method     string          `json:"method"`
+	Code       string          `json:"code,omitempty"`       // for "totp" and "backup_code"
+	Credential json.RawMessage `json:"credential,omitempty"` // the security key's assertion, for "webauthn"
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// RecoveryVerifyRequest proves the recovery code with an SRP handshake started by /auth/recovery/start.
+type RecoveryVerifyRequest struct {
+	Email     string `json:"email"`
+	M1        []byte `json:"M1"`
+	SessionID string `json:"session_id"`
+}
+
+// RecoveryVerifyResponse carries the master key wrapped under the recovery code and every calendar event,
+// so the client can re-encrypt them under a new password and send them to /auth/recovery/finish with the token.
+type RecoveryVerifyResponse struct {
+	M2         []byte           `json:"M2"`
+	WrappedKey []byte           `json:"wrapped_key"`
+	Token      string           `json:"token"`
+	Events     []EncryptedEvent `json:"events"`
+}
+
+// RecoveryFinishRequest sets a new password, like ChangePasswordRequest without the proof of the old one.
+type RecoveryFinishRequest struct {
+	Token     string           `json:"token"`
+	Challenge string           `json:"challenge"`
+	Triplet   []byte           `json:"triplet"`
+	Salt      []byte           `json:"salt"`
+	Events    []EncryptedEvent `json:"events"`
+}
+
+/* -------------------- User -------------------- */
+
+type PushSubscribeRequest struct {
+	Endpoint string `json:"endpoint"`
+	Auth     string `json:"auth"`
+	P256DH   string `json:"p256dh"`
+}
+
+// ChangePasswordRequest proves the current password with an SRP handshake started by /auth/login/start,
+// and carries the new credentials along with every calendar event re-encrypted under the new key.
+type ChangePasswordRequest struct {
+	SessionID string           `json:"session_id"`
+	M1        []byte           `json:"M1"`
+	Challenge string           `json:"challenge"`
+	Triplet   []byte           `json:"triplet"`
+	Salt      []byte           `json:"salt"`
+	Events    []EncryptedEvent `json:"events"`
+}
+
+// RecoveryKeySetupRequest proves the password with an SRP handshake started by /auth/login/start,
+// and carries the SRP triplet of the recovery code along with the master key wrapped under it.
+type RecoveryKeySetupRequest struct {
+	SessionID  string `json:"session_id"`
+	M1         []byte `json:"M1"`
+	Triplet    []byte `json:"triplet"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// ChangeEmailRequest proves the password with an SRP handshake started by /auth/login/start,
+// and carries the SRP triplet of the same password for the new address, which is its username.
+type ChangeEmailRequest struct {
+	SessionID string `json:"session_id"`
+	M1        []byte `json:"M1"`
+	Triplet   []byte `json:"triplet"`
+}
+
+// DeleteAccountRequest proves the password with an SRP handshake started by /auth/login/start.
+type DeleteAccountRequest struct {
+	SessionID string `json:"session_id"`
+	M1        []byte `json:"M1"`
+}
+
+// DeleteAccountResponse carries the time of a scheduled deletion, in Unix milliseconds.
+// It is zero when the account was deleted right away.
+type DeleteAccountResponse struct {
+	ScheduledAt int64 `json:"scheduledAt,omitempty"`
+}
+
+// SessionInfo describes one of the user's logged in devices.
+type SessionInfo struct {
+	ID         int    `json:"id"`
+	DeviceName string `json:"deviceName"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"createdAt"`  // Unix time in milliseconds
+	LastSeenAt int64  `json:"lastSeenAt"` // Unix time in milliseconds
+	Current    bool   `json:"current"`    // the session making the request
+}
+
+// TOTPEnrollResponse carries a new TOTP secret, which is enabled once a code generated from it is confirmed.
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"` // base32
+	URL    string `json:"url"`    // otpauth:// URL, usually shown as a QR code
+}
+
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPConfirmResponse carries the backup codes. They are only stored hashed, so this is the only time they are shown.
+type TOTPConfirmResponse struct {
+	BackupCodes []string `json:"backupCodes"`
+}
+
+// TOTPDisableRequest proves the second factor with a TOTP or backup code.
+type TOTPDisableRequest struct {
+	Method string `json:"method"` // "totp" or "backup_code"
+	Code   string `json:"code"`
+}
+
+// CreateInviteRequest describes a new invite code. Zero values default to a single use and constants.InviteTTL.
+type CreateInviteRequest struct {
+	Email     string `json:"email,omitempty"` // the only address that may use the code
+	MaxUses   int    `json:"max_uses,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix time in milliseconds
+}
+
+// InviteInfo describes an invite code. The code itself is only returned when it is created.
+type InviteInfo struct {
+	ID        int    `json:"id"`
+	Code      string `json:"code,omitempty"`
+	Email     string `json:"email,omitempty"`
+	MaxUses   int    `json:"maxUses"`
+	Uses      int    `json:"uses"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix time in milliseconds
+	CreatedAt int64  `json:"createdAt"` // Unix time in milliseconds
+}
+
+// WebAuthnRegisterStartRequest proves the password with an SRP handshake started by /auth/login/start.
+type WebAuthnRegisterStartRequest struct {
+	SessionID string `json:"session_id"`
+	M1        []byte `json:"M1"`
+}
+
+// WebAuthnRegisterRequest carries the credential created for the options returned by /user/2fa/webauthn/register/start.
+type WebAuthnRegisterRequest struct {
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// WebAuthnRemoveRequest proves the password with an SRP handshake started by /auth/login/start.
+type WebAuthnRemoveRequest struct {
+	SessionID string `json:"session_id"`
+	M1        []byte `json:"M1"`
+}
+
+// WebAuthnCredentialInfo describes one of the user's security keys.
+type WebAuthnCredentialInfo struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"createdAt"`            // Unix time in milliseconds
+	LastUsedAt int64  `json:"lastUsedAt,omitempty"` // Unix time in milliseconds, absent if never used
+}
+
+/* -------------------- Calendar -------------------- */
+
+// CalendarChange is a single change in a save request.
+// Type is "added", "updated" or "deleted". Deletions only set ID.
+type CalendarChange struct {
+	Type  string         `json:"type"`
+	ID    string         `json:"id,omitempty"`
+	Event EncryptedEvent `json:"event"`
+}
+
+/* -------------------- Stripe -------------------- */
+
+type CheckoutRequest struct {
+	PriceID string `json:"priceId"`
+}
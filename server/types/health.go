@@ -0,0 +1,38 @@
+package types
+
+// HealthCheck is the result of a single readiness check.
+type HealthCheck struct {
+	Status string `json:"status"` // "ok", "disabled" or "fail"
+	Detail string `json:"detail,omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+type PoolStats struct {
+	MaxOpen      int   `json:"maxOpen"`
+	Open         int   `json:"open"`
+	InUse        int   `json:"inUse"`
+	Idle         int   `json:"idle"`
+	WaitCount    int64 `json:"waitCount"`
+	WaitDuration int64 `json:"waitDurationMs"`
+}
+
+type CacheSizes struct {
+	SRPSessions   int `json:"srpSessions"`
+	PendingLogins int `json:"pendingLogins"`
+	RateLimits    int `json:"rateLimits"`
+	LoginFailures int `json:"loginFailures"`
+	Subscriptions int `json:"subscriptions"`
+}
+
+type Diagnostics struct {
+	Version       string     `json:"version"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Pool          PoolStats  `json:"pool"`
+	Caches        CacheSizes `json:"caches"`
+	PushPending   int        `json:"pushPending"`
+	Workers       []string   `json:"workers"`
+}
@@ -9,11 +9,13 @@ type Price struct {
 
 type EmailSettings struct {
 	VerificationRequired bool     `json:"verificationRequired"`
-	DomainBlacklist      []string `json:"domainBlacklist"`
+	DomainBlacklist      []string `json:"domainBlacklist"` // subdomains are blocked too
+	DomainWhitelist      []string `json:"domainWhitelist"` // empty allows every domain that isn't blacklisted
 }
 
 type Registration struct {
 	Enabled              bool           `json:"enabled"`
+	InviteOnly           bool           `json:"inviteOnly"` // registering needs an invite code
 	SubscriptionRequired bool           `json:"subscriptionRequired"`
 	Email                *EmailSettings `json:"email,omitempty"`
 	RetentionPeriod      int            `json:"retentionPeriod,omitempty"` // in days
@@ -2,11 +2,12 @@ package types
 
 // PushSubscription represents a push subscription returned from the database.
 type PushSubscription struct {
-	ID       int    `db:"id"`
-	Owner    string `db:"owner"`
-	Endpoint string `db:"endpoint"`
-	P256DH   string `db:"p256dh"`
-	Auth     string `db:"auth"`
+	ID        int    `db:"id"`
+	Owner     string `db:"owner"`
+	Endpoint  string `db:"endpoint"`
+	P256DH    string `db:"p256dh"`
+	Auth      string `db:"auth"`
+	SessionID *int   `db:"session_id"` // account session that registered it, nil for older subscriptions
 }
 
 type PushEvent struct {
@@ -16,6 +17,7 @@ type PushEvent struct {
 	Title string `json:"title,omitempty"`
 	Body  string `json:"body,omitempty"`
 
-	// For type == "sync"
+	// For type == "sync" and "reauth"
+	// Type "revoked" has no fields, the device must drop its local keys
 	OriginClientID string `json:"originClientId,omitempty"`
 }
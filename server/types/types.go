@@ -4,6 +4,7 @@ package types
 import (
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"mz.attahri.com/code/srp/v3"
 )
 
@@ -16,16 +17,101 @@ type Reply[T any] struct {
 
 // User represents the user data returned from the database.
 type User struct {
-	ID                   int     `db:"id"`
-	UUID                 string  `db:"uuid"`
-	Email                string  `db:"email"`
-	Salt                 []byte  `db:"salt"`     // main salt used for master kdf
-	SrpSalt              []byte  `db:"srp_salt"` // secondary salt used exclusively for srp flow
-	Verifier             []byte  `db:"verifier"`
-	Challenge            []byte  `db:"challenge"`
-	StripeCustomerID     *string `db:"stripe_customer_id"`
-	StripeSubscriptionID *string `db:"stripe_subscription_id"`
-	SubscriptionStatus   *string `db:"subscription_status"`
+	ID                   int        `db:"id"`
+	UUID                 string     `db:"uuid"`
+	Email                string     `db:"email"`
+	Salt                 []byte     `db:"salt"`     // main salt used for master kdf
+	SrpSalt              []byte     `db:"srp_salt"` // secondary salt used exclusively for srp flow
+	Verifier             []byte     `db:"verifier"`
+	Challenge            []byte     `db:"challenge"`
+	EmailVerified        bool       `db:"email_verified"`
+	StripeCustomerID     *string    `db:"stripe_customer_id"`
+	StripeSubscriptionID *string    `db:"stripe_subscription_id"`
+	SubscriptionStatus   *string    `db:"subscription_status"`
+	DeletionScheduledAt  *time.Time `db:"deletion_scheduled_at"` // set during the cooling-off period of a deletion
+	TOTPSecret           *string    `db:"totp_secret"`           // set on enrollment, before it is confirmed
+	TOTPEnabled          bool       `db:"totp_enabled"`
+	TOTPLastStep         *int64     `db:"totp_last_step"`    // time step of the last accepted code, so codes can't be replayed
+	RecoverySrpSalt      []byte     `db:"recovery_srp_salt"` // SRP salt and verifier of the recovery code, nil without one
+	RecoveryVerifier     []byte     `db:"recovery_verifier"`
+	RecoveryKey          []byte     `db:"recovery_key"` // master key wrapped under the recovery code by the client
+}
+
+// RecoveryKey is the escrow that lets a user who forgot their password recover their data.
+type RecoveryKey struct {
+	SrpSalt    []byte
+	Verifier   []byte
+	WrappedKey []byte
+}
+
+// Credentials contains the user fields derived from the password.
+type Credentials struct {
+	Salt      []byte
+	SrpSalt   []byte
+	Verifier  []byte
+	Challenge []byte
+}
+
+// EmailChange is an address change waiting for the user to open the link sent to the new address.
+// The SRP verifier is bound to the address, so the client sends a new one along.
+type EmailChange struct {
+	Owner     string    `db:"owner"`
+	Email     string    `db:"email"`
+	SrpSalt   []byte    `db:"srp_salt"`
+	Verifier  []byte    `db:"verifier"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Invite is an invite code for invite-only registration. Only the hash of the code is stored.
+type Invite struct {
+	ID        int       `db:"id"`
+	CodeHash  []byte    `db:"code_hash"`
+	Creator   *string   `db:"creator"` // nil for invites created by admins
+	Email     *string   `db:"email"`   // the only address that may use the code, if set
+	MaxUses   int       `db:"max_uses"`
+	Uses      int       `db:"uses"`
+	ExpiresAt time.Time `db:"expires_at"` // moved to the revocation time when revoked
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// AccountSession represents a logged in session returned from the database.
+type AccountSession struct {
+	ID          int       `db:"id"`
+	Owner       string    `db:"owner"`
+	AccessToken string    `db:"access_token"`
+	CreatedAt   time.Time `db:"created_at"`
+	ExpiresAt   time.Time `db:"expires_at"`  // of the access token, pushed back by each refresh
+	DeviceName  string    `db:"device_name"` // chosen by the client on login
+	UserAgent   string    `db:"user_agent"`
+	IP          string    `db:"ip"`           // last seen client address
+	LastSeenAt  time.Time `db:"last_seen_at"` // updated at most every constants.SessionTouchInterval
+}
+
+// RefreshToken is a hashed refresh token of an account session.
+// Used tokens are kept, so that replaying one can be detected.
+type RefreshToken struct {
+	ID        int        `db:"id"`
+	SessionID int        `db:"session_id"`
+	TokenHash []byte     `db:"token_hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	UsedAt    *time.Time `db:"used_at"` // set once exchanged for its successor
+}
+
+// WebAuthnCredential is a security key registered as a second factor.
+type WebAuthnCredential struct {
+	ID              int        `db:"id"`
+	Owner           string     `db:"owner"`
+	Name            string     `db:"name"` // chosen by the user
+	CredentialID    []byte     `db:"credential_id"`
+	PublicKey       []byte     `db:"public_key"` // COSE encoded
+	AttestationType string     `db:"attestation_type"`
+	Transports      string     `db:"transports"` // comma separated
+	AAGUID          []byte     `db:"aaguid"`
+	SignCount       uint32     `db:"sign_count"`
+	BackupEligible  bool       `db:"backup_eligible"`
+	BackupState     bool       `db:"backup_state"`
+	CreatedAt       time.Time  `db:"created_at"`
+	LastUsedAt      *time.Time `db:"last_used_at"`
 }
 
 // PublicUser contains only the exposed fields of a user.
@@ -36,6 +122,11 @@ type PublicUser struct {
 	// SrpSalt is exposed during SRP flow only, so it is not here
 	Salt      []byte `json:"salt"`
 	Challenge []byte `json:"challenge"`
+	// Unix time in milliseconds at which the account will be deleted, if a deletion is pending
+	DeletionScheduledAt *int64 `json:"deletion_scheduled_at,omitempty"`
+	TwoFactorEnabled    bool   `json:"two_factor_enabled"`
+	EmailVerified       bool   `json:"email_verified"`
+	RecoveryKeyEnabled  bool   `json:"recovery_key_enabled"`
 }
 
 // SRPSession holds the SRP server and a timestamp.
@@ -43,4 +134,65 @@ type SRPSession struct {
 	Server    *srp.Server
 	CreatedAt time.Time
 	Email     string
+	Recovery  bool // proves the recovery code instead of the password
+	Attempts  int  // proofs checked, up to constants.MaxSRPProofAttempts
+}
+
+// SavedSRPSession is an SRPSession as stored in the database, with the server state serialized.
+type SavedSRPSession struct {
+	ID        string    `db:"id"`
+	Email     string    `db:"email"`
+	Recovery  bool      `db:"recovery"`
+	State     []byte    `db:"state"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// PendingLogin is a login that passed the SRP proof and still needs a second factor.
+type PendingLogin struct {
+	UUID        string
+	DeviceName  string
+	ReturnToken bool                  // reply with the access token instead of setting the cookie
+	WebAuthn    *webauthn.SessionData // assertion the security keys have to answer, nil without keys
+	Attempts    int                   // second factors checked, up to constants.MaxSecondFactorAttempts
+	CreatedAt   time.Time
+}
+
+// SavedPendingLogin is a PendingLogin as stored in the database, with the assertion serialized.
+type SavedPendingLogin struct {
+	Token       string    `db:"token"`
+	Owner       string    `db:"owner"`
+	DeviceName  string    `db:"device_name"`
+	ReturnToken bool      `db:"return_token"`
+	WebAuthn    []byte    `db:"webauthn"` // JSON, nil without keys
+	Attempts    int       `db:"attempts"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// PendingRecovery is a recovery that proved the recovery code and waits for the new password.
+type PendingRecovery struct {
+	Token     string    `db:"token"`
+	Owner     string    `db:"owner"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// WebAuthnSetup is a security key registration waiting for the authenticator's response.
+type WebAuthnSetup struct {
+	Session   *webauthn.SessionData
+	CreatedAt time.Time
+}
+
+// SavedWebAuthnSetup is a WebAuthnSetup as stored in the database, with the session serialized.
+type SavedWebAuthnSetup struct {
+	Owner     string    `db:"owner"`
+	Session   []byte    `db:"session"` // JSON
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// LoginFailures counts the failed password and recovery code proofs of an account, from any address.
+type LoginFailures struct {
+	Email         string    `db:"email"`           // lowercased
+	Failures      int       `db:"failures"`        // consecutive, since the last success or lockout
+	LastFailureAt time.Time `db:"last_failure_at"` // forgotten after constants.LoginFailureTTL
+	NextAttemptAt time.Time `db:"next_attempt_at"` // nothing is checked before then
 }
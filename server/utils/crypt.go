@@ -1,9 +1,20 @@
 package utils
 
 import (
+	"crypto"
+
 	"golang.org/x/crypto/argon2"
+	"mz.attahri.com/code/srp/v3"
 )
 
+// SRPParams are the SRP parameters shared with the client. They must match exactly.
+var SRPParams = &srp.Params{
+	Name:  "DH16–SHA256–Argon2",
+	Group: srp.RFC5054Group4096,
+	Hash:  crypto.SHA256,
+	KDF:   KDFArgon2,
+}
+
 // KDFArgon2 derives an Argon2id key from a username, password, and salt.
 func KDFArgon2(username, password string, salt []byte) ([]byte, error) {
 	p := []byte(username + ":" + password)
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignedToken is returned for signed tokens that were altered, have expired or were made for another purpose.
+var ErrInvalidSignedToken = errors.New("invalid or expired signed token")
+
+// signedPayload is the signed part of a token.
+type signedPayload struct {
+	Purpose string          `json:"p"`
+	Expires int64           `json:"e"` // unix time
+	Claims  json.RawMessage `json:"c"`
+}
+
+// DeriveKey derives a key for the given purpose from a secret, so one secret can sign several kinds of data.
+func DeriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// SignToken returns a URL-safe token carrying claims until expires, authenticated with key.
+// The purpose is signed along, so that a token is only accepted for what it was made for.
+func SignToken(key []byte, purpose string, claims any, expires time.Time) (string, error) {
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(signedPayload{Purpose: purpose, Expires: expires.Unix(), Claims: c})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(key, encoded)), nil
+}
+
+// ParseSignedToken checks a token made by SignToken for purpose and decodes its claims into dest.
+func ParseSignedToken(key []byte, purpose, token string, dest any, now time.Time) error {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidSignedToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, sign(key, encoded)) {
+		return ErrInvalidSignedToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidSignedToken
+	}
+
+	var payload signedPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return ErrInvalidSignedToken
+	}
+	if payload.Purpose != purpose || now.Unix() >= payload.Expires {
+		return ErrInvalidSignedToken
+	}
+
+	if err := json.Unmarshal(payload.Claims, dest); err != nil {
+		return ErrInvalidSignedToken
+	}
+	return nil
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -2,13 +2,15 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/mail"
 	"regexp"
@@ -26,7 +28,7 @@ func SendJSON(w http.ResponseWriter, status int, v any) {
 
 	err := json.NewEncoder(w).Encode(v)
 	if err != nil {
-		log.Printf("JSON encode error: %v", err)
+		slog.Error("JSON encode error", "error", err)
 		http.Error(w, `{"success":false,"message":"Internal server error"}`, http.StatusInternalServerError)
 	}
 }
@@ -69,6 +71,32 @@ func RandomToken(n int) string {
 	return fmt.Sprintf("%x", b)
 }
 
+// HashToken returns the SHA-256 hash a token is stored under.
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// NewUUID generates a random (version 4) UUID string.
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // should never fail
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// ValidateUUID returns true if id is a UUID in the lowercase form generated by NewUUID and browsers.
+func ValidateUUID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
+
 // ValidateEmail returns true if the email is valid.
 func ValidateEmail(email string) bool {
 	if len(email) > 254 {
@@ -84,9 +112,10 @@ func ValidateEmail(email string) bool {
 	return re.MatchString(email)
 }
 
-// LogError logs an error in a particular format.
-func LogError(function, action string, err error) {
-	log.Printf("[ERROR] in %s @ %s: %v", function, action, err)
+// LogError logs an error along with the function and action that failed.
+// Log lines written with a request context also carry the request's ID, route and user.
+func LogError(ctx context.Context, function, action string, err error) {
+	slog.ErrorContext(ctx, "error", "function", function, "action", action, "error", err)
 }
 
 // Assert panics if a condition is false.